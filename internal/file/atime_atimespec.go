@@ -0,0 +1,17 @@
+//go:build darwin || freebsd || netbsd
+
+package file
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// fileAtime returns the last access time of a file, falling back to its modification time
+func fileAtime(info os.FileInfo) time.Time {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(int64(stat.Atimespec.Sec), int64(stat.Atimespec.Nsec))
+	}
+	return info.ModTime()
+}
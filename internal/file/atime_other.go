@@ -0,0 +1,13 @@
+//go:build !linux && !openbsd && !dragonfly && !solaris && !illumos && !aix && !darwin && !freebsd && !netbsd
+
+package file
+
+import (
+	"os"
+	"time"
+)
+
+// fileAtime returns the modification time, as the access time is not available on this platform
+func fileAtime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
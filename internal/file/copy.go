@@ -0,0 +1,156 @@
+package file
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/sftp"
+
+	"ssh-mcp/internal/security"
+	"ssh-mcp/internal/session"
+)
+
+// CopyBetweenSessions copies a file from one remote host to another over SFTP.
+// The data is streamed through memory and never touches the local disk. As with
+// Upload, the destination is written to a partial file and renamed into place.
+// The SHA-256 of the streamed data is always returned; with Verify it is also
+// compared against sha256sum on both hosts.
+func (o *Operations) CopyBetweenSessions(ctx context.Context, srcSessionID, srcPath, dstSessionID, dstPath string, opts TransferOptions) (*TransferResult, error) {
+	srcSess, releaseSrc, err := o.sessionManager.AcquireSession(srcSessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseSrc()
+	dstSess, releaseDst, err := o.sessionManager.AcquireSession(dstSessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseDst()
+
+	// Removing either session cancels the copy as well
+	ctx, cancelSrc := srcSess.WithContext(ctx)
+	defer cancelSrc()
+	ctx, cancelDst := dstSess.WithContext(ctx)
+	defer cancelDst()
+
+	srcPath = filepath.ToSlash(srcPath)
+	dstPath = filepath.ToSlash(dstPath)
+	if srcPath, err = o.remotePath(srcSess, srcPath, security.AccessRead); err != nil {
+		return nil, err
+	}
+	if dstPath, err = o.remotePath(dstSess, dstPath, security.AccessWrite); err != nil {
+		return nil, err
+	}
+
+	change, err := o.snapshot(dstSess, dstSessionID, "copy_between_sessions", dstPath, opts.Backup)
+	if err != nil {
+		return nil, err
+	}
+
+	var result *TransferResult
+	err = o.sftpSession(srcSess, func(srcClient *sftp.Client) error {
+		return o.sftpSession(dstSess, func(dstClient *sftp.Client) error {
+			result, err = sftpCopy(ctx, srcClient, dstClient, srcSess, dstSess, srcPath, dstPath, opts)
+			return err
+		})
+	})
+	o.finishChange(dstSessionID, change, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// sftpCopy streams a file between two SFTP connections through a partial destination file
+func sftpCopy(ctx context.Context, srcClient, dstClient *sftp.Client, srcSess, dstSess *session.Session, srcPath, dstPath string, opts TransferOptions) (*TransferResult, error) {
+	srcFile, err := srcClient.Open(srcPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open source file: %v", err)
+	}
+	defer srcFile.Close()
+
+	srcInfo, err := srcFile.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get source file info: %v", err)
+	}
+	if !srcInfo.Mode().IsRegular() {
+		return nil, fmt.Errorf("source path %s is not a regular file", srcPath)
+	}
+	size := srcInfo.Size()
+
+	partialPath := remotePartialPath(dstPath)
+	dstFile, err := dstClient.OpenFile(partialPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open destination file: %v", err)
+	}
+
+	h := sha256.New()
+	p := newProgress(ctx, opts.Progress, 0, size)
+	written, err := dstFile.ReadFrom(io.TeeReader(p.Reader(io.LimitReader(srcFile, size)), h))
+	if err == nil && written != size {
+		err = fmt.Errorf("source file ended after %d of %d bytes", written, size)
+	}
+	if closeErr := dstFile.Close(); err == nil {
+		err = closeErr
+	}
+	if ctxErr := p.ctx.Err(); ctxErr != nil {
+		dstClient.Remove(partialPath)
+		return nil, fmt.Errorf("copy cancelled after %d bytes: %w", written, ctxErr)
+	}
+	if err != nil {
+		dstClient.Remove(partialPath)
+		return nil, fmt.Errorf("failed to copy file content after %d bytes: %v", written, err)
+	}
+
+	result := &TransferResult{
+		Size:        size,
+		Transferred: written,
+		SHA256:      hex.EncodeToString(h.Sum(nil)),
+	}
+
+	if opts.Verify {
+		if err := verifyRemoteChecksum(srcSess, srcPath, result.SHA256); err != nil {
+			dstClient.Remove(partialPath)
+			return nil, fmt.Errorf("source %v", err)
+		}
+		if err := verifyRemoteChecksum(dstSess, partialPath, result.SHA256); err != nil {
+			dstClient.Remove(partialPath)
+			return nil, fmt.Errorf("destination %v", err)
+		}
+	}
+
+	// Keep the permissions of a file that is being replaced, otherwise take the source's
+	mode := srcInfo.Mode().Perm()
+	if fi, err := dstClient.Stat(dstPath); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	if err := dstClient.Chmod(partialPath, mode); err != nil {
+		dstClient.Remove(partialPath)
+		return nil, fmt.Errorf("failed to set permissions: %v", err)
+	}
+
+	if err := renameRemote(dstClient, partialPath, dstPath); err != nil {
+		dstClient.Remove(partialPath)
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// verifyRemoteChecksum compares the sha256sum of a remote file with an expected checksum
+func verifyRemoteChecksum(sess *session.Session, remotePath, expected string) error {
+	sum, err := remoteSHA256(sess, remotePath)
+	if err != nil {
+		return err
+	}
+	if sum != expected {
+		return fmt.Errorf("checksum mismatch: expected %s, got %s", expected, sum)
+	}
+	return nil
+}
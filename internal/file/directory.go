@@ -0,0 +1,303 @@
+package file
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// Symlink policies for directory transfers
+const (
+	SymlinkFollow = "follow" // Transfer what the link points to
+	SymlinkCopy   = "copy"   // Recreate the link itself on the destination
+	SymlinkSkip   = "skip"   // Leave links out of the transfer
+)
+
+// normalizeSymlinkPolicy validates a symlink policy, defaulting to follow
+func normalizeSymlinkPolicy(policy string) (string, error) {
+	switch policy {
+	case "":
+		return SymlinkFollow, nil
+	case SymlinkFollow, SymlinkCopy, SymlinkSkip:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid symlink policy %q, expected follow, copy or skip", policy)
+	}
+}
+
+// remoteSymlink is a link to create on the remote side after an upload
+type remoteSymlink struct {
+	path   string
+	target string
+}
+
+// dirUpload carries the state of a recursive SCP directory upload
+type dirUpload struct {
+	w         io.Writer
+	r         *bufio.Reader
+	p         *progress
+	opts      DirTransferOptions
+	links     []remoteSymlink    // Symlinks to recreate once the SCP transfer is done
+	ancestors map[string]bool    // Resolved directories currently being uploaded
+	checkLink func(string) error // Vets symlinks before they are followed, may be nil
+}
+
+// checkFollow verifies that a symlink may be followed
+func (u *dirUpload) checkFollow(linkPath string) error {
+	if u.checkLink == nil {
+		return nil
+	}
+	return u.checkLink(linkPath)
+}
+
+// enter records a directory as being uploaded and fails if it is already on the stack,
+// which happens when a followed symlink points to one of its ancestors
+func (u *dirUpload) enter(localPath string) error {
+	resolved, err := filepath.EvalSymlinks(localPath)
+	if err != nil {
+		return err
+	}
+	if u.ancestors[resolved] {
+		return fmt.Errorf("symlink loop at %s", localPath)
+	}
+	u.ancestors[resolved] = true
+	return nil
+}
+
+// leave removes a directory from the upload stack
+func (u *dirUpload) leave(localPath string) {
+	if resolved, err := filepath.EvalSymlinks(localPath); err == nil {
+		delete(u.ancestors, resolved)
+	}
+}
+
+// fileMode returns the mode sent for a file
+func (u *dirUpload) fileMode(info os.FileInfo) uint32 {
+	if u.opts.Preserve {
+		return posixPermBits(info.Mode())
+	}
+	return 0644
+}
+
+// dirMode returns the mode sent for a directory
+func (u *dirUpload) dirMode(info os.FileInfo) uint32 {
+	if u.opts.Preserve {
+		return posixPermBits(info.Mode())
+	}
+	return 0755
+}
+
+// sendTimes sends a T record with the times of the entry that follows, when preserving
+func (u *dirUpload) sendTimes(info os.FileInfo) error {
+	if !u.opts.Preserve {
+		return nil
+	}
+
+	fmt.Fprintf(u.w, "T%d 0 %d 0\n", info.ModTime().Unix(), fileAtime(info).Unix())
+	if err := checkSCPStatus(u.r); err != nil {
+		return fmt.Errorf("failed to send times: %v", err)
+	}
+	return nil
+}
+
+// scpTimes holds the times of an SCP T record
+type scpTimes struct {
+	mtime time.Time
+	atime time.Time
+}
+
+// parseSCPTimes parses a T record of the form "T<mtime> 0 <atime> 0"
+func parseSCPTimes(header string) (*scpTimes, error) {
+	fields := strings.Fields(strings.TrimPrefix(header, "T"))
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("invalid times header: %q", header)
+	}
+
+	mtime, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modification time in header: %v", err)
+	}
+	atime, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid access time in header: %v", err)
+	}
+
+	return &scpTimes{
+		mtime: time.Unix(mtime, 0),
+		atime: time.Unix(atime, 0),
+	}, nil
+}
+
+// parseSCPMode parses the octal mode of a C or D record, e.g. "C0755"
+func parseSCPMode(field string) (os.FileMode, error) {
+	if len(field) < 2 {
+		return 0, fmt.Errorf("invalid mode in header: %q", field)
+	}
+
+	bits, err := strconv.ParseUint(field[1:], 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid mode in header: %v", err)
+	}
+
+	return modeFromPosix(uint32(bits)), nil
+}
+
+// modeFromPosix converts POSIX permission bits to an os.FileMode
+func modeFromPosix(bits uint32) os.FileMode {
+	mode := os.FileMode(bits & 0777)
+	if bits&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if bits&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if bits&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// applySCPAttributes sets the mode and, if known, the times of a downloaded entry
+func applySCPAttributes(localPath string, mode os.FileMode, times *scpTimes) error {
+	if err := os.Chmod(localPath, mode); err != nil {
+		return fmt.Errorf("failed to set mode of %s: %v", localPath, err)
+	}
+	if times != nil {
+		if err := os.Chtimes(localPath, times.atime, times.mtime); err != nil {
+			return fmt.Errorf("failed to set times of %s: %v", localPath, err)
+		}
+	}
+	return nil
+}
+
+// createRemoteSymlinks recreates symlinks on the remote side, replacing whatever is in the way
+func createRemoteSymlinks(client *sftp.Client, links []remoteSymlink) error {
+	for _, link := range links {
+		if err := client.Remove(link.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to replace %s with a symlink: %v", link.path, err)
+		}
+		if err := client.Symlink(link.target, link.path); err != nil {
+			return fmt.Errorf("failed to create symlink %s: %v", link.path, err)
+		}
+	}
+	return nil
+}
+
+// sftpDownloadDir downloads the contents of a remote directory into a local directory
+// over SFTP, which unlike scp can see symlinks instead of following them
+func sftpDownloadDir(client *sftp.Client, remoteDir, localDir string, opts DirTransferOptions, p *progress) error {
+	infos, err := client.ReadDir(remoteDir)
+	if err != nil {
+		return fmt.Errorf("failed to read remote directory %s: %v", remoteDir, err)
+	}
+
+	for _, info := range infos {
+		if err := p.ctx.Err(); err != nil {
+			return err
+		}
+
+		remotePath := path.Join(remoteDir, info.Name())
+		if err := validEntryName(info.Name()); err != nil {
+			return err
+		}
+		localPath := filepath.Join(localDir, info.Name())
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			if opts.Symlinks == SymlinkSkip {
+				continue
+			}
+			target, err := client.ReadLink(remotePath)
+			if err != nil {
+				return fmt.Errorf("failed to read symlink %s: %v", remotePath, err)
+			}
+			if err := os.Remove(localPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("failed to replace %s with a symlink: %v", localPath, err)
+			}
+			if err := os.Symlink(target, localPath); err != nil {
+				return fmt.Errorf("failed to create symlink %s: %v", localPath, err)
+			}
+
+		case info.IsDir():
+			if localPath, err = localChildPath(localDir, info.Name()); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(localPath, 0755); err != nil {
+				return err
+			}
+			if err := sftpDownloadDir(client, remotePath, localPath, opts, p); err != nil {
+				return err
+			}
+			// Directory times are applied last, as writing entries changes them
+			if opts.Preserve {
+				if err := applySFTPAttributes(localPath, info); err != nil {
+					return err
+				}
+			}
+
+		case info.Mode().IsRegular():
+			if localPath, err = localChildPath(localDir, info.Name()); err != nil {
+				return err
+			}
+			if err := sftpDownloadDirFile(client, remotePath, localPath, p); err != nil {
+				return err
+			}
+			if opts.Preserve {
+				if err := applySFTPAttributes(localPath, info); err != nil {
+					return err
+				}
+			}
+
+		default:
+			log.Printf("[DEBUG] SFTP: skipping special file %s", remotePath)
+		}
+	}
+
+	return nil
+}
+
+// sftpDownloadDirFile copies a single remote file as part of a directory download
+func sftpDownloadDirFile(client *sftp.Client, remotePath, localPath string, p *progress) error {
+	remoteFile, err := client.Open(remotePath)
+	if err != nil {
+		return fmt.Errorf("failed to open remote file %s: %v", remotePath, err)
+	}
+	defer remoteFile.Close()
+
+	localFile, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+
+	p.current = localPath
+	_, err = io.Copy(p.Writer(localFile), remoteFile)
+	if closeErr := localFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to copy %s: %v", remotePath, err)
+	}
+	p.current = ""
+
+	return nil
+}
+
+// applySFTPAttributes copies the mode and times reported by SFTP onto a local path
+func applySFTPAttributes(localPath string, info os.FileInfo) error {
+	times := &scpTimes{mtime: info.ModTime(), atime: info.ModTime()}
+	if stat, ok := info.Sys().(*sftp.FileStat); ok {
+		times.atime = time.Unix(int64(stat.Atime), 0)
+	}
+
+	return applySCPAttributes(localPath, modeFromPosix(posixPermBits(info.Mode())), times)
+}
@@ -0,0 +1,134 @@
+package file
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// excludeRule is a single compiled .gitignore-style pattern
+type excludeRule struct {
+	re      *regexp.Regexp
+	negate  bool // Pattern started with ! and re-includes matching paths
+	dirOnly bool // Pattern ended with / and only matches directories
+}
+
+// excludeMatcher decides whether relative paths are excluded by a list of
+// .gitignore-style patterns. The last matching pattern wins.
+type excludeMatcher struct {
+	rules []excludeRule
+}
+
+// newExcludeMatcher compiles .gitignore-style patterns.
+// Supported syntax: # comments, ! negation, trailing / for directories, a leading
+// or inner / anchors the pattern to the root, and *, ?, [...] and ** wildcards.
+func newExcludeMatcher(patterns []string) (*excludeMatcher, error) {
+	m := &excludeMatcher{}
+
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+
+		rule := excludeRule{}
+		if strings.HasPrefix(pattern, "!") {
+			rule.negate = true
+			pattern = pattern[1:]
+		}
+		if strings.HasSuffix(pattern, "/") {
+			rule.dirOnly = true
+			pattern = strings.TrimRight(pattern, "/")
+		}
+		if pattern == "" {
+			continue
+		}
+
+		// A slash anywhere but the end anchors the pattern to the root
+		anchored := strings.Contains(pattern, "/")
+		pattern = strings.TrimPrefix(pattern, "/")
+
+		expr := globToRegexp(pattern)
+		if anchored {
+			expr = "^" + expr + "$"
+		} else {
+			expr = "^(?:.*/)?" + expr + "$"
+		}
+
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern %q: %v", pattern, err)
+		}
+		rule.re = re
+
+		m.rules = append(m.rules, rule)
+	}
+
+	return m, nil
+}
+
+// Match reports whether the slash-separated relative path is excluded
+func (m *excludeMatcher) Match(relPath string, isDir bool) bool {
+	if m == nil {
+		return false
+	}
+
+	excluded := false
+	for _, rule := range m.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.re.MatchString(relPath) {
+			excluded = !rule.negate
+		}
+	}
+
+	return excluded
+}
+
+// globToRegexp converts a gitignore glob to a regular expression without anchors
+func globToRegexp(glob string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				// ** matches across directories; **/ also matches zero directories
+				i++
+				if i+1 < len(glob) && glob[i+1] == '/' {
+					i++
+					b.WriteString("(?:.*/)?")
+				} else {
+					b.WriteString(".*")
+				}
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(regexp.QuoteMeta(string(c)))
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				b.WriteString(regexp.QuoteMeta(string(glob[i])))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return b.String()
+}
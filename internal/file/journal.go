@@ -0,0 +1,248 @@
+package file
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"ssh-mcp/internal/security"
+	"ssh-mcp/internal/session"
+)
+
+// backupRoot is the remote directory, relative to the home directory, that holds the
+// previous versions of paths changed with backups enabled
+const backupRoot = ".ssh-mcp/backups"
+
+// Change is an entry of a session's change journal. It records a remote path that
+// was about to be overwritten and where its previous version was saved.
+type Change struct {
+	ID         int       `json:"id"`
+	Time       time.Time `json:"time"`
+	Operation  string    `json:"operation"`        // Tool that made the change
+	Path       string    `json:"path"`             // Remote file or directory that was changed
+	Existed    bool      `json:"existed"`          // Whether the path existed; if not, rolling back removes it
+	Backup     string    `json:"backup,omitempty"` // Remote copy of the previous version
+	Error      string    `json:"error,omitempty"`  // The change failed, possibly leaving the path half written
+	RolledBack bool      `json:"rolledBack"`       // The previous version has been restored
+}
+
+// ChangeList holds the journal of a session
+type ChangeList struct {
+	SessionID  string   `json:"sessionId"`
+	Changes    []Change `json:"changes"`
+	Checkpoint int      `json:"checkpoint"` // ID of the latest change, to roll back everything after it later
+}
+
+// RollbackResult lists the changes that were rolled back
+type RollbackResult struct {
+	RolledBack []Change `json:"rolledBack"`
+}
+
+// changeJournal holds the changes made in one session
+type changeJournal struct {
+	mu      sync.Mutex
+	lastID  int
+	changes []*Change
+}
+
+// unsafeBackupChars matches characters not used in backup directory names
+var unsafeBackupChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// journal returns the change journal of a session, creating it if needed
+func (o *Operations) journal(sessionID string) *changeJournal {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	j, ok := o.journals[sessionID]
+	if !ok {
+		j = &changeJournal{}
+		o.journals[sessionID] = j
+	}
+	return j
+}
+
+// discardJournal forgets the change journal of a removed session and deletes the backups
+// it made from the remote host
+func (o *Operations) discardJournal(sess *session.Session) {
+	o.mu.Lock()
+	j, ok := o.journals[sess.ID]
+	delete(o.journals, sess.ID)
+	o.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	j.mu.Lock()
+	backups := len(j.changes) > 0
+	j.mu.Unlock()
+	if !backups {
+		return
+	}
+
+	if _, err := remoteOutput(sess, "rm -rf -- "+shellQuote(backupDir(sess.ID))); err != nil {
+		log.Printf("[DEBUG] journal: failed to remove the backups of %s: %v", sess.ID, err)
+	}
+}
+
+// snapshot saves the current version of a remote path before it is changed and records
+// the change in the session's journal. It returns nil if backup is false. The path is
+// copied with cp -a, so directories are saved with everything below them.
+func (o *Operations) snapshot(sess *session.Session, sessionID, operation, remotePath string, backup bool) (*Change, error) {
+	if !backup {
+		return nil, nil
+	}
+
+	j := o.journal(sessionID)
+	j.mu.Lock()
+	j.lastID++
+	change := &Change{
+		ID:        j.lastID,
+		Time:      time.Now(),
+		Operation: operation,
+		Path:      remotePath,
+		Backup:    path.Join(backupDir(sessionID), fmt.Sprint(j.lastID)),
+	}
+	j.mu.Unlock()
+
+	q := shellQuote(remotePath)
+	cmd := fmt.Sprintf("if [ -e %s ] || [ -L %s ]; then (umask 077 && mkdir -p -- %s) && cp -a -- %s %s && echo existed; fi",
+		q, q, shellQuote(path.Dir(change.Backup)), q, shellQuote(change.Backup))
+	output, err := remoteOutput(sess, cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to back up %s: %v", remotePath, err)
+	}
+	change.Existed = strings.TrimSpace(output) == "existed"
+	if !change.Existed {
+		change.Backup = ""
+	}
+
+	j.mu.Lock()
+	j.changes = append(j.changes, change)
+	j.mu.Unlock()
+
+	return change, nil
+}
+
+// finishChange records the outcome of a change started with snapshot
+func (o *Operations) finishChange(sessionID string, change *Change, err error) {
+	if change == nil || err == nil {
+		return
+	}
+
+	j := o.journal(sessionID)
+	j.mu.Lock()
+	change.Error = err.Error()
+	j.mu.Unlock()
+}
+
+// ListChanges returns the change journal of a session, oldest change first
+func (o *Operations) ListChanges(sessionID string) (*ChangeList, error) {
+	if _, err := o.sessionManager.GetSession(sessionID); err != nil {
+		return nil, err
+	}
+
+	j := o.journal(sessionID)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	list := &ChangeList{SessionID: sessionID, Changes: []Change{}, Checkpoint: j.lastID}
+	for _, change := range j.changes {
+		list.Changes = append(list.Changes, *change)
+	}
+	return list, nil
+}
+
+// Rollback restores the previous version of the paths of one change, or of every change
+// after the checkpoint since when changeID is 0. Changes are rolled back newest first and
+// their backups are removed once restored. Rolling back stops at the first failure.
+func (o *Operations) Rollback(sessionID string, changeID, since int) (*RollbackResult, error) {
+	sess, release, err := o.sessionManager.AcquireSession(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	j := o.journal(sessionID)
+	j.mu.Lock()
+	changes, err := selectChanges(j.changes, changeID, since)
+	j.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &RollbackResult{RolledBack: []Change{}}
+	for _, change := range changes {
+		if err := o.restore(sess, change); err != nil {
+			return result, fmt.Errorf("failed to roll back change %d of %s: %v", change.ID, change.Path, err)
+		}
+
+		j.mu.Lock()
+		change.RolledBack = true
+		result.RolledBack = append(result.RolledBack, *change)
+		j.mu.Unlock()
+	}
+
+	return result, nil
+}
+
+// restore puts the previous version of a changed path back, or removes the path if it
+// did not exist before the change
+func (o *Operations) restore(sess *session.Session, change *Change) error {
+	// The path is replaced as a whole, which both writes and deletes below it
+	for _, access := range []security.PathAccess{security.AccessWrite, security.AccessDelete} {
+		if _, err := o.remoteTree(sess, change.Path, access); err != nil {
+			return err
+		}
+	}
+
+	q := shellQuote(change.Path)
+	cmd := "rm -rf -- " + q
+	if change.Existed {
+		b := shellQuote(change.Backup)
+		cmd = fmt.Sprintf("[ -e %s ] || [ -L %s ] || { echo 'backup is missing' >&2; exit 1; }; %s && mkdir -p -- %s && cp -a -- %s %s && rm -rf -- %s",
+			b, b, cmd, shellQuote(path.Dir(change.Path)), b, q, b)
+	}
+
+	if _, err := remoteOutput(sess, cmd); err != nil {
+		return err
+	}
+	return nil
+}
+
+// selectChanges picks the changes to roll back, newest first: the change with changeID,
+// or if changeID is 0, every change after since that has not been rolled back yet
+func selectChanges(changes []*Change, changeID, since int) ([]*Change, error) {
+	if changeID > 0 {
+		for _, change := range changes {
+			if change.ID != changeID {
+				continue
+			}
+			if change.RolledBack {
+				return nil, fmt.Errorf("change %d has already been rolled back", changeID)
+			}
+			return []*Change{change}, nil
+		}
+		return nil, fmt.Errorf("change not found: %d", changeID)
+	}
+	if since < 0 {
+		return nil, errors.New("either a change ID or a checkpoint is required")
+	}
+
+	var selected []*Change
+	for i := len(changes) - 1; i >= 0; i-- {
+		if changes[i].ID > since && !changes[i].RolledBack {
+			selected = append(selected, changes[i])
+		}
+	}
+	return selected, nil
+}
+
+// backupDir returns the remote directory holding the backups of a session
+func backupDir(sessionID string) string {
+	return path.Join(backupRoot, unsafeBackupChars.ReplaceAllString(sessionID, "_"))
+}
@@ -0,0 +1,332 @@
+package file
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// FileEntry describes a single entry of a remote directory listing
+type FileEntry struct {
+	Name          string `json:"name"`                    // Path relative to the listed directory
+	Path          string `json:"path"`                    // Absolute remote path
+	Type          string `json:"type"`                    // file, directory, symlink, char, block, fifo, socket
+	Size          int64  `json:"size"`                    // Size in bytes
+	Mode          string `json:"mode"`                    // Octal permission bits, e.g. 0644
+	Permissions   string `json:"permissions"`             // ls-style permission string, e.g. -rw-r--r--
+	UID           uint32 `json:"uid"`                     // Numeric owner ID
+	GID           uint32 `json:"gid"`                     // Numeric group ID
+	Owner         string `json:"owner,omitempty"`         // Owner name, if it could be resolved
+	Group         string `json:"group,omitempty"`         // Group name, if it could be resolved
+	ModTime       string `json:"mtime"`                   // Modification time in RFC3339
+	SymlinkTarget string `json:"symlinkTarget,omitempty"` // Target of a symbolic link
+}
+
+// ListOptions controls how a remote directory is listed
+type ListOptions struct {
+	Depth   int    // How many levels to descend, up to MaxListDepth (values below 1 list only the directory itself)
+	Pattern string // Glob matched against entry base names (empty matches everything)
+	SortBy  string // Sort key: name (default), size or mtime
+	Reverse bool   // Reverse the sort order
+	Offset  int    // Number of entries to skip after sorting
+	Limit   int    // Maximum number of entries to return (0 means no limit)
+}
+
+// MaxListDepth is the deepest a directory listing descends, so that a listing of / cannot
+// walk the whole file system
+const MaxListDepth = 10
+
+// DirectoryListing is the result of a remote directory listing
+type DirectoryListing struct {
+	Path    string      `json:"path"`
+	Total   int         `json:"total"` // Number of matching entries before pagination
+	Entries []FileEntry `json:"entries"`
+	Skipped []string    `json:"skipped,omitempty"` // Subdirectories that could not be read, with the reason
+}
+
+// listDirectory walks a remote directory over SFTP and returns the matching entries.
+// Subdirectories that cannot be read are skipped and reported in the listing. Owner and
+// group names are only looked up in /etc/passwd and /etc/group if allowRead permits
+// reading them; a nil allowRead permits everything.
+func listDirectory(client *sftp.Client, remotePath string, opts ListOptions, allowRead func(remotePath string) error) (*DirectoryListing, error) {
+	if opts.Pattern != "" {
+		// Validate the pattern up front so that a bad glob is reported instead of matching nothing
+		if _, err := path.Match(opts.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", opts.Pattern, err)
+		}
+	}
+
+	depth := opts.Depth
+	if depth < 1 {
+		depth = 1
+	}
+	if depth > MaxListDepth {
+		depth = MaxListDepth
+	}
+
+	owners := readIDNames(client, "/etc/passwd", allowRead)
+	groups := readIDNames(client, "/etc/group", allowRead)
+
+	entries := make([]FileEntry, 0)
+	var skipped []string
+	var walk func(dir, rel string, level int) error
+	walk = func(dir, rel string, level int) error {
+		infos, err := client.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+
+		for _, fi := range infos {
+			fullPath := path.Join(dir, fi.Name())
+			relPath := path.Join(rel, fi.Name())
+
+			if opts.Pattern == "" || matchName(opts.Pattern, fi.Name()) {
+				entry := newFileEntry(relPath, fullPath, fi, owners, groups)
+				if fi.Mode()&os.ModeSymlink != 0 {
+					if target, err := client.ReadLink(fullPath); err == nil {
+						entry.SymlinkTarget = target
+					}
+				}
+				entries = append(entries, entry)
+			}
+
+			// Symlinks are never followed so that loops cannot trap the walk
+			if fi.IsDir() && level < depth {
+				if err := walk(fullPath, relPath, level+1); err != nil {
+					skipped = append(skipped, fmt.Sprintf("%s: %v", relPath, err))
+				}
+			}
+		}
+
+		return nil
+	}
+
+	if err := walk(remotePath, "", 1); err != nil {
+		return nil, fmt.Errorf("failed to list directory: %v", err)
+	}
+
+	sortEntries(entries, opts.SortBy, opts.Reverse)
+
+	return &DirectoryListing{
+		Path:    remotePath,
+		Total:   len(entries),
+		Entries: paginate(entries, opts.Offset, opts.Limit),
+		Skipped: skipped,
+	}, nil
+}
+
+// newFileEntry builds a FileEntry from SFTP file info
+func newFileEntry(name, fullPath string, fi os.FileInfo, owners, groups map[uint32]string) FileEntry {
+	entry := FileEntry{
+		Name:        name,
+		Path:        fullPath,
+		Type:        fileType(fi.Mode()),
+		Size:        fi.Size(),
+		Mode:        fmt.Sprintf("%04o", posixPermBits(fi.Mode())),
+		Permissions: lsPermissions(fi.Mode()),
+		ModTime:     fi.ModTime().UTC().Format(time.RFC3339),
+	}
+
+	if stat, ok := fi.Sys().(*sftp.FileStat); ok {
+		entry.UID = stat.UID
+		entry.GID = stat.GID
+		entry.Owner = owners[stat.UID]
+		entry.Group = groups[stat.GID]
+	}
+
+	return entry
+}
+
+// matchName reports whether a base name matches a glob pattern
+func matchName(pattern, name string) bool {
+	matched, err := path.Match(pattern, name)
+	return err == nil && matched
+}
+
+// fileType returns a short type name for a file mode
+func fileType(mode os.FileMode) string {
+	switch {
+	case mode.IsDir():
+		return "directory"
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	case mode&os.ModeCharDevice != 0:
+		return "char"
+	case mode&os.ModeDevice != 0:
+		return "block"
+	case mode&os.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	default:
+		return "file"
+	}
+}
+
+// posixPermBits returns the permission bits of a file mode including setuid, setgid and sticky
+func posixPermBits(mode os.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return bits
+}
+
+// lsPermissions formats a file mode the way ls -l does
+func lsPermissions(mode os.FileMode) string {
+	var b [10]byte
+
+	switch fileType(mode) {
+	case "directory":
+		b[0] = 'd'
+	case "symlink":
+		b[0] = 'l'
+	case "char":
+		b[0] = 'c'
+	case "block":
+		b[0] = 'b'
+	case "fifo":
+		b[0] = 'p'
+	case "socket":
+		b[0] = 's'
+	default:
+		b[0] = '-'
+	}
+
+	const rwx = "rwxrwxrwx"
+	perm := mode.Perm()
+	for i := 0; i < 9; i++ {
+		if perm&(1<<uint(8-i)) != 0 {
+			b[i+1] = rwx[i]
+		} else {
+			b[i+1] = '-'
+		}
+	}
+
+	// Special bits replace the execute slot, upper case when execute is not set
+	special := func(idx int, set bool, lower, upper byte) {
+		if !set {
+			return
+		}
+		if b[idx] == '-' {
+			b[idx] = upper
+		} else {
+			b[idx] = lower
+		}
+	}
+	special(3, mode&os.ModeSetuid != 0, 's', 'S')
+	special(6, mode&os.ModeSetgid != 0, 's', 'S')
+	special(9, mode&os.ModeSticky != 0, 't', 'T')
+
+	return string(b[:])
+}
+
+// sortEntries sorts directory entries in place by the given key
+func sortEntries(entries []FileEntry, sortBy string, reverse bool) {
+	less := func(a, b FileEntry) bool { return a.Name < b.Name }
+
+	switch sortBy {
+	case "size":
+		less = func(a, b FileEntry) bool {
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+			return a.Name < b.Name
+		}
+	case "mtime":
+		// RFC3339 timestamps in UTC sort lexically
+		less = func(a, b FileEntry) bool {
+			if a.ModTime != b.ModTime {
+				return a.ModTime < b.ModTime
+			}
+			return a.Name < b.Name
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if reverse {
+			return less(entries[j], entries[i])
+		}
+		return less(entries[i], entries[j])
+	})
+}
+
+// paginate returns the window of entries selected by offset and limit
+func paginate(entries []FileEntry, offset, limit int) []FileEntry {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset >= len(entries) {
+		return []FileEntry{}
+	}
+
+	entries = entries[offset:]
+	if limit > 0 && limit < len(entries) {
+		entries = entries[:limit]
+	}
+
+	return entries
+}
+
+// readIDNames reads a passwd-style file from the remote host and maps numeric IDs to names.
+// Missing, unreadable or disallowed files yield an empty map so that listings still work
+// without names.
+func readIDNames(client *sftp.Client, remotePath string, allowRead func(remotePath string) error) map[uint32]string {
+	if allowRead != nil {
+		if err := allowRead(remotePath); err != nil {
+			return map[uint32]string{}
+		}
+	}
+
+	f, err := client.Open(remotePath)
+	if err != nil {
+		return map[uint32]string{}
+	}
+	defer f.Close()
+
+	return parseIDNames(f)
+}
+
+// parseIDNames parses name:x:id lines as found in /etc/passwd and /etc/group
+func parseIDNames(r io.Reader) map[uint32]string {
+	names := make(map[uint32]string)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, ":")
+		if len(fields) < 3 {
+			continue
+		}
+
+		id, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			continue
+		}
+
+		// Keep the first name for an ID, as getpwuid would
+		if _, exists := names[uint32(id)]; !exists {
+			names[uint32(id)] = fields[0]
+		}
+	}
+
+	return names
+}
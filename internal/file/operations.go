@@ -3,160 +3,224 @@ package file
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 
+	"github.com/pkg/sftp"
+
+	"ssh-mcp/internal/security"
 	"ssh-mcp/internal/session"
 )
 
 // Operations handles file transfer and directory operations over SSH
 type Operations struct {
-	sessionManager *session.Manager
+	sessionManager  *session.Manager
+	securityManager *security.Manager
+
+	mu       sync.Mutex
+	tails    map[string]*tailSubscription  // Follow subscriptions by ID
+	watches  map[string]*watchSubscription // Watches by ID
+	journals map[string]*changeJournal     // Change journals by session ID
 }
 
-// NewOperations creates a new file operations handler
-func NewOperations(sessionManager *session.Manager) *Operations {
-	return &Operations{
-		sessionManager: sessionManager,
-	}
+// NewOperations creates a new file operations handler.
+// The security manager confines local paths to its allowed local roots and may be nil.
+func NewOperations(sessionManager *session.Manager, securityManager *security.Manager) *Operations {
+	o := &Operations{
+		sessionManager:  sessionManager,
+		securityManager: securityManager,
+		tails:           make(map[string]*tailSubscription),
+		watches:         make(map[string]*watchSubscription),
+		journals:        make(map[string]*changeJournal),
+	}
+	sessionManager.OnRemove(o.discardJournal)
+	return o
 }
 
-// Upload transfers a local file to the remote server
-func (o *Operations) Upload(sessionID, localPath, remotePath string) error {
+// Upload transfers a local file to the remote server over SFTP.
+// The data is written to a partial file next to remotePath which is renamed into place
+// once complete, so readers never observe a half-written file.
+func (o *Operations) Upload(ctx context.Context, sessionID, localPath, remotePath string, opts TransferOptions) (*TransferResult, error) {
 	// Get the session from the manager
-	sess, err := o.sessionManager.GetSession(sessionID)
+	sess, release, err := o.sessionManager.AcquireSession(sessionID)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer release()
 
-	// The target directory and file for talking the SCP protocol
-	targetDir := filepath.Dir(remotePath)
-	targetFile := filepath.Base(remotePath)
+	// Removing the session cancels the operation as well
+	ctx, cancel := sess.WithContext(ctx)
+	defer cancel()
 
-	// Convert to forward slashes for compatibility with Unix systems
-	targetDir = filepath.ToSlash(targetDir)
+	if localPath, err = o.localPath(sessionID, localPath); err != nil {
+		return nil, err
+	}
 
-	// Open the local file to determine size
-	localFile, err := os.Open(localPath)
-	if err != nil {
-		return fmt.Errorf("failed to open local file: %v", err)
+	// Convert to forward slashes for compatibility with Unix systems
+	remotePath = filepath.ToSlash(remotePath)
+	if remotePath, err = o.remotePath(sess, remotePath, security.AccessWrite); err != nil {
+		return nil, err
 	}
-	defer localFile.Close()
 
-	// Get file info for size
-	fileInfo, err := localFile.Stat()
+	change, err := o.snapshot(sess, sessionID, "upload", remotePath, opts.Backup)
 	if err != nil {
-		return fmt.Errorf("failed to get file info: %v", err)
+		return nil, err
 	}
-	size := fileInfo.Size()
 
-	// Define the SCP upload function
-	scpFunc := func(w io.Writer, stdoutR *bufio.Reader) error {
-		return scpUploadFile(targetFile, localFile, w, stdoutR, size)
+	var result *TransferResult
+	err = o.sftpSession(sess, func(client *sftp.Client) error {
+		result, err = sftpUpload(ctx, client, sess, localPath, remotePath, opts)
+		return err
+	})
+	o.finishChange(sessionID, change, err)
+	if err != nil {
+		return nil, err
 	}
 
-	// Execute the SCP command
-	cmd := fmt.Sprintf("scp -vt %s", targetDir)
-	return o.scpSession(sess, cmd, scpFunc)
+	return result, nil
 }
 
-// Download transfers a remote file to the local machine
-func (o *Operations) Download(sessionID, remotePath, localPath string) error {
+// Download transfers a remote file to the local machine over SFTP.
+// The data is written to a partial file next to localPath which is renamed into place
+// once complete, so a failed transfer never leaves a truncated file at localPath.
+func (o *Operations) Download(ctx context.Context, sessionID, remotePath, localPath string, opts TransferOptions) (*TransferResult, error) {
 	// Get the session from the manager
-	sess, err := o.sessionManager.GetSession(sessionID)
+	sess, release, err := o.sessionManager.AcquireSession(sessionID)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer release()
 
-	// Create the local file
-	localFile, err := os.Create(localPath)
-	if err != nil {
-		return fmt.Errorf("failed to create local file: %v", err)
-	}
-	defer localFile.Close()
+	// Removing the session cancels the operation as well
+	ctx, cancel := sess.WithContext(ctx)
+	defer cancel()
 
-	// Define the SCP download function
-	scpFunc := func(w io.Writer, stdoutR *bufio.Reader) error {
-		// Send null byte to initiate transfer
-		if _, err := w.Write([]byte{0}); err != nil {
-			return fmt.Errorf("failed to initiate transfer: %v", err)
-		}
+	if localPath, err = o.localPath(sessionID, localPath); err != nil {
+		return nil, err
+	}
+	if remotePath, err = o.remotePath(sess, remotePath, security.AccessRead); err != nil {
+		return nil, err
+	}
 
-		// Read file header
-		header, err := stdoutR.ReadString('\n')
-		if err != nil {
-			return fmt.Errorf("failed to read file header: %v", err)
-		}
+	var result *TransferResult
+	err = o.sftpSession(sess, func(client *sftp.Client) error {
+		result, err = sftpDownload(ctx, client, sess, remotePath, localPath, opts)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		if !strings.HasPrefix(header, "C") {
-			return fmt.Errorf("invalid file header: %s", header)
-		}
+	return result, nil
+}
 
-		// Parse file size
-		parts := strings.Split(header, " ")
-		if len(parts) < 3 {
-			return fmt.Errorf("invalid file header format: %s", header)
-		}
+// MaxReadSize caps the bytes ReadFile returns
+const MaxReadSize = 1 << 20
 
-		// Parse file size
-		fileSize, err := strconv.ParseInt(parts[1], 10, 64)
-		if err != nil {
-			return fmt.Errorf("invalid file size in header: %v", err)
-		}
+// FileContent is the start of a remote file
+type FileContent struct {
+	Path      string
+	Data      []byte
+	Truncated bool // The file is longer than MaxReadSize
+}
 
-		// Send acknowledgment
-		if _, err := w.Write([]byte{0}); err != nil {
-			return fmt.Errorf("failed to send acknowledgment: %v", err)
-		}
+// ReadFile reads up to MaxReadSize bytes of a remote file
+func (o *Operations) ReadFile(sessionID, remotePath string) (*FileContent, error) {
+	sess, release, err := o.sessionManager.AcquireSession(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 
-		// Copy file content with size limit
-		if _, err := io.CopyN(localFile, stdoutR, fileSize); err != nil {
-			return fmt.Errorf("failed to copy file content: %v", err)
-		}
+	if remotePath, err = o.remotePath(sess, filepath.ToSlash(remotePath), security.AccessRead); err != nil {
+		return nil, err
+	}
 
-		// Read the final status byte
-		statusBuf := make([]byte, 1)
-		if _, err := stdoutR.Read(statusBuf); err != nil {
-			return fmt.Errorf("failed to read status byte: %v", err)
+	content := &FileContent{Path: remotePath}
+	err = o.sftpSession(sess, func(client *sftp.Client) error {
+		f, err := client.Open(remotePath)
+		if err != nil {
+			return fmt.Errorf("failed to open remote file: %v", err)
 		}
+		defer f.Close()
 
-		if statusBuf[0] != 0 {
-			message, _, err := stdoutR.ReadLine()
-			if err != nil {
-				return fmt.Errorf("error reading error message: %v", err)
-			}
-			return fmt.Errorf("SCP protocol error: %s", message)
+		content.Data, err = io.ReadAll(io.LimitReader(f, MaxReadSize+1))
+		if err != nil {
+			return fmt.Errorf("failed to read remote file: %v", err)
 		}
-
-		// Send final acknowledgment
-		if _, err := w.Write([]byte{0}); err != nil {
-			return fmt.Errorf("failed to send final acknowledgment: %v", err)
+		if len(content.Data) > MaxReadSize {
+			content.Data = content.Data[:MaxReadSize]
+			content.Truncated = true
 		}
-
 		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	// Execute the SCP command
-	cmd := fmt.Sprintf("scp -vf %s", remotePath)
-	return o.scpSession(sess, cmd, scpFunc)
+	return content, nil
 }
 
 // UploadDir uploads a local directory to the remote server
-func (o *Operations) UploadDir(sessionID, localDir, remoteDir string) error {
+func (o *Operations) UploadDir(ctx context.Context, sessionID, localDir, remoteDir string, opts DirTransferOptions) error {
 	// Get the session from the manager
-	sess, err := o.sessionManager.GetSession(sessionID)
+	sess, release, err := o.sessionManager.AcquireSession(sessionID)
 	if err != nil {
 		return err
 	}
+	defer release()
+
+	// Removing the session cancels the operation as well
+	ctx, cancel := sess.WithContext(ctx)
+	defer cancel()
+
+	if opts.Symlinks, err = normalizeSymlinkPolicy(opts.Symlinks); err != nil {
+		return err
+	}
+	if opts.Mode, opts.Compression, err = normalizeTransferMode(opts.Mode, opts.Compression); err != nil {
+		return err
+	}
+
+	name, err := uploadDirName(localDir)
+	if err != nil {
+		return err
+	}
+	if localDir, err = o.localPath(sessionID, localDir); err != nil {
+		return err
+	}
 
 	// Convert remote path to forward slashes for compatibility with Unix systems
 	remoteDir = filepath.ToSlash(remoteDir)
+	if remoteDir, err = o.remotePath(sess, remoteDir, security.AccessWrite); err != nil {
+		return err
+	}
+
+	// The remote directory the entries of localDir end up in
+	remoteRoot := path.Join(remoteDir, name)
+	if _, err := o.remoteTree(sess, remoteRoot, security.AccessWrite); err != nil {
+		return err
+	}
+
+	// Size the transfer up front so that progress can be reported against a total
+	total, err := localTreeSize(localDir)
+	if err != nil {
+		return err
+	}
+	u := &dirUpload{
+		p:         newProgress(ctx, opts.Progress, 0, total),
+		opts:      opts,
+		ancestors: make(map[string]bool),
+		checkLink: o.linkChecker(sessionID),
+	}
 
 	// Define the SCP upload directory function
 	scpFunc := func(w io.Writer, r *bufio.Reader) error {
@@ -173,6 +237,8 @@ func (o *Operations) UploadDir(sessionID, localDir, remoteDir string) error {
 			return errors.New(string(message))
 		}
 
+		u.w, u.r = w, r
+
 		// Open the source directory
 		f, err := os.Open(localDir)
 		if err != nil {
@@ -180,6 +246,11 @@ func (o *Operations) UploadDir(sessionID, localDir, remoteDir string) error {
 		}
 		defer f.Close()
 
+		rootInfo, err := f.Stat()
+		if err != nil {
+			return err
+		}
+
 		// Read all entries in the directory
 		entries, err := f.Readdir(-1)
 		if err != nil {
@@ -188,15 +259,23 @@ func (o *Operations) UploadDir(sessionID, localDir, remoteDir string) error {
 
 		// Upload the directory
 		uploadEntries := func() error {
-			return scpUploadDirEntries(localDir, entries, w, r)
+			if err := u.enter(localDir); err != nil {
+				return err
+			}
+			defer u.leave(localDir)
+			return scpUploadDirEntries(localDir, remoteRoot, entries, u)
 		}
 
-		if localDir[len(localDir)-1] != '/' {
+		if name != "" {
 			// No trailing slash, so include the directory name
-			log.Printf("[DEBUG] SCP: starting directory upload: %s", filepath.Base(localDir))
+			log.Printf("[DEBUG] SCP: starting directory upload: %s", name)
+
+			if err := u.sendTimes(rootInfo); err != nil {
+				return err
+			}
 
-			// Use Fprintln with proper spacing exactly as in the example
-			fmt.Fprintln(w, "D0755 0", filepath.Base(localDir))
+			// Use Fprintf with proper spacing exactly as in the example
+			fmt.Fprintf(w, "D%04o 0 %s\n", u.dirMode(rootInfo), name)
 			if err := checkSCPStatus(r); err != nil {
 				return err
 			}
@@ -216,17 +295,80 @@ func (o *Operations) UploadDir(sessionID, localDir, remoteDir string) error {
 		return nil
 	}
 
-	// Execute the SCP command
-	cmd := fmt.Sprintf("scp -vrt %s", remoteDir)
-	return o.scpSession(sess, cmd, scpFunc)
+	change, err := o.snapshot(sess, sessionID, "upload_directory", remoteRoot, opts.Backup)
+	if err != nil {
+		return err
+	}
+
+	if o.useTar(sess, &u.opts) {
+		err = o.tarUploadDir(ctx, sess, localDir, remoteRoot, u)
+	} else {
+		// Execute the SCP command, with -p the remote side applies exact modes and times
+		flags := "-vrt"
+		if opts.Preserve {
+			flags = "-vrpt"
+		}
+		cmd := fmt.Sprintf("scp %s %s", flags, shellQuote(remoteDir))
+		err = o.scpSession(ctx, sess, cmd, scpFunc)
+	}
+
+	// A cancelled upload leaves the file that was being written truncated, so remove it
+	if err != nil && ctx.Err() != nil && u.p.current != "" {
+		if _, rmErr := remoteOutput(sess, "rm -f -- "+shellQuote(u.p.current)); rmErr != nil {
+			log.Printf("[DEBUG] SCP: failed to remove partial file %s: %v", u.p.current, rmErr)
+		}
+	}
+
+	// SCP cannot carry symlinks, so links being copied are recreated over SFTP
+	if err == nil && len(u.links) > 0 {
+		err = o.sftpSession(sess, func(client *sftp.Client) error {
+			return createRemoteSymlinks(client, u.links)
+		})
+	}
+
+	o.finishChange(sessionID, change, err)
+	return err
+}
+
+// uploadDirName returns the name of the remote directory an upload of localDir creates,
+// or "" if a trailing slash asks for only its contents. The name comes from the path the
+// caller gave, not from where symlinks in it lead.
+func uploadDirName(localDir string) (string, error) {
+	if strings.HasSuffix(localDir, "/") {
+		return "", nil
+	}
+	abs, err := filepath.Abs(localDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve local directory: %v", err)
+	}
+	return filepath.Base(abs), nil
 }
 
 // DownloadDir downloads a remote directory to the local machine.
-func (o *Operations) DownloadDir(sessionID, remotePath, localPath string) error {
-	sess, err := o.sessionManager.GetSession(sessionID)
+func (o *Operations) DownloadDir(ctx context.Context, sessionID, remotePath, localPath string, opts DirTransferOptions) error {
+	sess, release, err := o.sessionManager.AcquireSession(sessionID)
 	if err != nil {
 		return err
 	}
+	defer release()
+
+	// Removing the session cancels the operation as well
+	ctx, cancel := sess.WithContext(ctx)
+	defer cancel()
+
+	if opts.Symlinks, err = normalizeSymlinkPolicy(opts.Symlinks); err != nil {
+		return err
+	}
+	if opts.Mode, opts.Compression, err = normalizeTransferMode(opts.Mode, opts.Compression); err != nil {
+		return err
+	}
+
+	if localPath, err = o.localPath(sessionID, localPath); err != nil {
+		return err
+	}
+	if remotePath, err = o.remoteTree(sess, remotePath, security.AccessRead); err != nil {
+		return err
+	}
 
 	// Ensure local path exists and is a directory.
 	fi, err := os.Stat(localPath)
@@ -242,28 +384,94 @@ func (o *Operations) DownloadDir(sessionID, remotePath, localPath string) error
 		return fmt.Errorf("local path %s is not a directory", localPath)
 	}
 
+	// The size of a remote tree is not known in advance, so progress has no total
+	p := newProgress(ctx, opts.Progress, 0, 0)
+
+	// The remote tar handles every symlink policy itself
+	if o.useTar(sess, &opts) {
+		err = o.tarDownloadDir(ctx, sess, remotePath, localPath, opts, p)
+		if err != nil && ctx.Err() != nil && p.current != "" {
+			os.Remove(p.current)
+		}
+		return err
+	}
+
+	// The remote scp always follows symlinks, so other policies walk the tree over SFTP
+	if opts.Symlinks != SymlinkFollow {
+		err = o.sftpSession(sess, func(client *sftp.Client) error {
+			return sftpDownloadDir(client, remotePath, localPath, opts, p)
+		})
+		if err != nil && ctx.Err() != nil {
+			if p.current != "" {
+				os.Remove(p.current)
+			}
+			return fmt.Errorf("transfer cancelled: %w", ctx.Err())
+		}
+		return err
+	}
+
 	scpFunc := func(w io.Writer, r *bufio.Reader) error {
 		// Signal that we're ready for the protocol to start
 		if _, err := w.Write([]byte{0}); err != nil {
 			return err
 		}
 
-		return scpDownloadDir(localPath, w, r, true)
+		return scpDownloadDir(localPath, w, r, true, p, opts.Preserve)
+	}
+
+	// With -p the remote side sends modes and T records with times
+	flags := "-rf"
+	if opts.Preserve {
+		flags = "-rpf"
+	}
+	cmd := fmt.Sprintf("scp %s %s", flags, shellQuote(remotePath))
+	err = o.scpSession(ctx, sess, cmd, scpFunc)
+
+	// A cancelled download leaves the file that was being written truncated, so remove it
+	if err != nil && ctx.Err() != nil && p.current != "" {
+		os.Remove(p.current)
+	}
+
+	return err
+}
+
+// useTar decides whether a directory transfer goes through the remote tar, settling the
+// compression on what the remote host supports. Without a remote tar the transfer falls
+// back to SCP.
+func (o *Operations) useTar(sess *session.Session, opts *DirTransferOptions) bool {
+	if opts.Mode != ModeTar {
+		return false
 	}
 
-	cmd := fmt.Sprintf("scp -rf %s", remotePath)
-	return o.scpSession(sess, cmd, scpFunc)
+	compression, ok := remoteTarCompression(sess, opts.Compression)
+	if !ok {
+		log.Printf("[DEBUG] tar: not available on the remote host, falling back to SCP")
+		opts.Mode = ModeSCP
+		return false
+	}
+	if compression != opts.Compression {
+		log.Printf("[DEBUG] tar: %s not available on the remote host, using %s", opts.Compression, compression)
+		opts.Compression = compression
+	}
+
+	return true
 }
 
-// scpSession executes an SCP command and handles the SCP protocol
-func (o *Operations) scpSession(sess *session.Session, scpCommand string, f func(io.Writer, *bufio.Reader) error) error {
+// scpSession executes an SCP command and handles the SCP protocol.
+// Cancelling ctx closes the SSH session, which unblocks any pending protocol I/O.
+func (o *Operations) scpSession(ctx context.Context, sess *session.Session, scpCommand string, f func(io.Writer, *bufio.Reader) error) error {
 	// Create a new SSH session
-	sshSession, err := sess.Client.NewSession()
+	sshSession, err := sess.NewSession()
 	if err != nil {
 		return fmt.Errorf("failed to create SSH session: %v", err)
 	}
 	defer sshSession.Close()
 
+	stop := context.AfterFunc(ctx, func() {
+		sshSession.Close()
+	})
+	defer stop()
+
 	// Get a pipe to stdin so that we can send data
 	stdinW, err := sshSession.StdinPipe()
 	if err != nil {
@@ -303,6 +511,11 @@ func (o *Operations) scpSession(sess *session.Session, scpCommand string, f func
 	stdinW.Close()
 	stdinW = nil
 
+	// A cancelled context is the real cause of whatever error the protocol hit
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return fmt.Errorf("transfer cancelled: %w", ctxErr)
+	}
+
 	// If we got an error (not EOF which is normal), return it
 	if err != nil && err != io.EOF {
 		return fmt.Errorf("SCP protocol error: %v", err)
@@ -322,8 +535,52 @@ func (o *Operations) scpSession(sess *session.Session, scpCommand string, f func
 	return nil
 }
 
+// sftpSession opens an SFTP subsystem on the session's connection for the duration of f
+func (o *Operations) sftpSession(sess *session.Session, f func(*sftp.Client) error) error {
+	releaseChannel, err := sess.AcquireChannel()
+	if err != nil {
+		return fmt.Errorf("failed to start SFTP subsystem: %v", err)
+	}
+	defer releaseChannel()
+
+	client, err := sftp.NewClient(sess.Client)
+	if err != nil {
+		return fmt.Errorf("failed to start SFTP subsystem: %v", err)
+	}
+	defer client.Close()
+
+	return f(client)
+}
+
+// remoteOutput runs a command on the remote host and returns its standard output
+func remoteOutput(sess *session.Session, command string) (string, error) {
+	sshSession, err := sess.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("failed to create SSH session: %v", err)
+	}
+	defer sshSession.Close()
+
+	stderr := new(bytes.Buffer)
+	sshSession.Stderr = stderr
+
+	output, err := sshSession.Output(command)
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%v: %s", err, msg)
+		}
+		return "", err
+	}
+
+	return string(output), nil
+}
+
+// shellQuote quotes a string for safe use as a single POSIX shell word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
 // scpUploadFile uploads a file using the SCP protocol
-func scpUploadFile(filename string, src io.Reader, w io.Writer, r *bufio.Reader, size int64) error {
+func scpUploadFile(filename string, src io.Reader, w io.Writer, r *bufio.Reader, size int64, mode uint32) error {
 	// If size is 0, we need to create a temporary file to determine the actual size
 	if size == 0 {
 		// Create a temporary file where we can copy the contents of the src
@@ -362,7 +619,7 @@ func scpUploadFile(filename string, src io.Reader, w io.Writer, r *bufio.Reader,
 	}
 
 	// Start the protocol
-	fmt.Fprintf(w, "C0644 %d %s\n", size, filename)
+	fmt.Fprintf(w, "C%04o %d %s\n", mode, size, filename)
 	if err := checkSCPStatus(r); err != nil {
 		return fmt.Errorf("failed to send file header: %v", err)
 	}
@@ -412,7 +669,10 @@ func checkSCPStatus(r *bufio.Reader) error {
 }
 
 // scpDownloadDir recursively downloads a directory.
-func scpDownloadDir(destPath string, w io.Writer, r *bufio.Reader, stripName bool) error {
+func scpDownloadDir(destPath string, w io.Writer, r *bufio.Reader, stripName bool, p *progress, preserve bool) error {
+	// Times from a T record apply to the file or directory that follows it
+	var times *scpTimes
+
 	for {
 		header, err := r.ReadString('\n')
 		if err != nil {
@@ -432,8 +692,11 @@ func scpDownloadDir(destPath string, w io.Writer, r *bufio.Reader, stripName boo
 			// End of directory marker
 			return ackSCP(w)
 		case 'T':
-			// Timestamp, which we ignore.
-			// Acknowledge it and continue.
+			// Timestamp for the next entry, only sent when preserving
+			times, err = parseSCPTimes(header)
+			if err != nil {
+				return err
+			}
 			if err := ackSCP(w); err != nil {
 				return err
 			}
@@ -452,33 +715,51 @@ func scpDownloadDir(destPath string, w io.Writer, r *bufio.Reader, stripName boo
 
 			name := strings.TrimRight(parts[2], "\n")
 
+			mode, err := parseSCPMode(parts[0])
+			if err != nil {
+				return err
+			}
+
 			// Acknowledge header
 			if err := ackSCP(w); err != nil {
 				return err
 			}
 
-			// Create file
-			filePath := filepath.Join(destPath, name)
+			// Create file, refusing names that would land outside of destPath
+			filePath, err := localChildPath(destPath, name)
+			if err != nil {
+				return err
+			}
 			file, err := os.Create(filePath)
 			if err != nil {
 				return err
 			}
 
 			// Copy contents
-			_, err = io.CopyN(file, r, size)
+			p.current = filePath
+			_, err = io.CopyN(p.Writer(file), r, size)
 			if err != nil {
+				file.Close()
 				return err
 			}
 			err = file.Close()
 			if err != nil {
 				return fmt.Errorf("failed to close file %s: %v", filePath, err)
 			}
+			p.current = ""
 
 			// Check status byte
 			if err := checkSCPStatus(r); err != nil {
 				return err
 			}
 
+			if preserve {
+				if err := applySCPAttributes(filePath, mode, times); err != nil {
+					return err
+				}
+			}
+			times = nil
+
 			// Acknowledge file transfer
 			if err := ackSCP(w); err != nil {
 				return err
@@ -492,6 +773,13 @@ func scpDownloadDir(destPath string, w io.Writer, r *bufio.Reader, stripName boo
 
 			name := strings.TrimRight(parts[2], "\n")
 
+			mode, err := parseSCPMode(parts[0])
+			if err != nil {
+				return err
+			}
+			dirTimes := times
+			times = nil
+
 			// Acknowledge header
 			if err := ackSCP(w); err != nil {
 				return err
@@ -500,16 +788,25 @@ func scpDownloadDir(destPath string, w io.Writer, r *bufio.Reader, stripName boo
 			// Create directory
 			dirPath := destPath
 			if !stripName {
-				dirPath = filepath.Join(destPath, name)
+				if dirPath, err = localChildPath(destPath, name); err != nil {
+					return err
+				}
 			}
 			if err := os.MkdirAll(dirPath, 0755); err != nil {
 				return err
 			}
 
 			// Recursively download directory contents
-			if err := scpDownloadDir(dirPath, w, r, false); err != nil {
+			if err := scpDownloadDir(dirPath, w, r, false, p, preserve); err != nil {
 				return err
 			}
+
+			// Directory times are applied last, as writing entries changes them
+			if preserve {
+				if err := applySCPAttributes(dirPath, mode, dirTimes); err != nil {
+					return err
+				}
+			}
 		case 1, 2: // Warning or error message
 			// The message is the line itself. We can just ignore it.
 			continue
@@ -528,9 +825,9 @@ func ackSCP(w io.Writer) error {
 }
 
 // scpUploadDirProtocol initiates a directory upload in the SCP protocol
-func scpUploadDirProtocol(dirName string, w io.Writer, r *bufio.Reader, f func() error) error {
+func scpUploadDirProtocol(dirName string, mode uint32, w io.Writer, r *bufio.Reader, f func() error) error {
 	log.Printf("[DEBUG] SCP: starting directory upload: %s", dirName)
-	fmt.Fprintln(w, "D0755 0", dirName)
+	fmt.Fprintf(w, "D%04o 0 %s\n", mode, dirName)
 	err := checkSCPStatus(r)
 	if err != nil {
 		return err
@@ -548,50 +845,80 @@ func scpUploadDirProtocol(dirName string, w io.Writer, r *bufio.Reader, f func()
 	return nil
 }
 
-// scpUploadDirEntries uploads the entries of a directory using SCP protocol
-func scpUploadDirEntries(root string, entries []os.FileInfo, w io.Writer, r *bufio.Reader) error {
+// scpUploadDirEntries uploads the entries of a directory using SCP protocol.
+// remoteRoot is the remote directory the entries end up in.
+func scpUploadDirEntries(root, remoteRoot string, entries []os.FileInfo, u *dirUpload) error {
 	for _, entry := range entries {
 		localPath := filepath.Join(root, entry.Name())
+		remotePath := path.Join(remoteRoot, entry.Name())
 
-		// Check if this is a symlink to a directory
-		isSymlinkToDir := false
 		if entry.Mode()&os.ModeSymlink == os.ModeSymlink {
-			// Resolve the symlink
-			symPath, err := filepath.EvalSymlinks(localPath)
-			if err != nil {
-				return err
+			switch u.opts.Symlinks {
+			case SymlinkSkip:
+				continue
+			case SymlinkCopy:
+				target, err := os.Readlink(localPath)
+				if err != nil {
+					return err
+				}
+				u.links = append(u.links, remoteSymlink{path: remotePath, target: target})
+				continue
 			}
 
-			// Check if it points to a directory
-			symInfo, err := os.Lstat(symPath)
+			// Follow the symlink and upload whatever it points to
+			resolved, err := os.Stat(localPath)
 			if err != nil {
+				log.Printf("[DEBUG] SCP: skipping dangling symlink %s: %v", localPath, err)
+				continue
+			}
+			if err := u.checkFollow(localPath); err != nil {
 				return err
 			}
-
-			isSymlinkToDir = symInfo.IsDir()
+			entry = resolved
 		}
 
-		if !entry.IsDir() && !isSymlinkToDir {
+		if !entry.IsDir() {
+			// Devices, sockets and pipes cannot be sent as files
+			if !entry.Mode().IsRegular() {
+				log.Printf("[DEBUG] SCP: skipping special file %s", localPath)
+				continue
+			}
+
 			// It's a regular file or symlink to a file
 			file, err := os.Open(localPath)
 			if err != nil {
 				return err
 			}
 
+			u.p.current = remotePath
 			err = func() error {
 				defer file.Close()
-				return scpUploadFile(entry.Name(), file, w, r, entry.Size())
+				if err := u.sendTimes(entry); err != nil {
+					return err
+				}
+				return scpUploadFile(entry.Name(), u.p.Reader(file), u.w, u.r, entry.Size(), u.fileMode(entry))
 			}()
 
 			if err != nil {
 				return err
 			}
+			u.p.current = ""
 
 			continue
 		}
 
+		// A followed symlink pointing back up the tree would recurse forever
+		if err := u.enter(localPath); err != nil {
+			log.Printf("[DEBUG] SCP: skipping %s: %v", localPath, err)
+			continue
+		}
+
+		if err := u.sendTimes(entry); err != nil {
+			return err
+		}
+
 		// It's a directory or symlink to directory, upload recursively
-		err := scpUploadDirProtocol(entry.Name(), w, r, func() error {
+		err := scpUploadDirProtocol(entry.Name(), u.dirMode(entry), u.w, u.r, func() error {
 			// Open the directory
 			f, err := os.Open(localPath)
 			if err != nil {
@@ -606,8 +933,9 @@ func scpUploadDirEntries(root string, entries []os.FileInfo, w io.Writer, r *buf
 			}
 
 			// Upload the entries
-			return scpUploadDirEntries(localPath, subEntries, w, r)
+			return scpUploadDirEntries(localPath, remotePath, subEntries, u)
 		})
+		u.leave(localPath)
 
 		if err != nil {
 			return err
@@ -617,58 +945,40 @@ func scpUploadDirEntries(root string, entries []os.FileInfo, w io.Writer, r *buf
 	return nil
 }
 
-// ListDirectory lists the contents of a remote directory
-func (o *Operations) ListDirectory(sessionID, remotePath string) ([]map[string]string, error) {
+// ListDirectory lists the contents of a remote directory over SFTP
+func (o *Operations) ListDirectory(sessionID, remotePath string, opts ListOptions) (*DirectoryListing, error) {
 	// Get the session from the manager
-	sess, err := o.sessionManager.GetSession(sessionID)
+	sess, release, err := o.sessionManager.AcquireSession(sessionID)
 	if err != nil {
 		return nil, err
 	}
+	defer release()
 
-	// Create a new SSH session
-	sshSession, err := sess.Client.NewSession()
-	if err != nil {
-		return nil, fmt.Errorf("failed to create SSH session: %v", err)
+	// Deny rules must not cover any of the subdirectories a deeper listing walks
+	check := o.remotePath
+	if opts.Depth > 1 {
+		check = o.remoteTree
 	}
-	defer sshSession.Close()
-
-	// Execute ls command
-	cmd := fmt.Sprintf("ls -la %s", remotePath)
-	output, err := sshSession.CombinedOutput(cmd)
-	if err != nil {
-		return nil, fmt.Errorf("failed to list directory: %v", err)
+	if remotePath, err = check(sess, remotePath, security.AccessRead); err != nil {
+		return nil, err
 	}
 
-	// Parse the output
-	lines := strings.Split(string(output), "\n")
-	result := make([]map[string]string, 0, len(lines))
-
-	// Skip the first line (total count) and empty lines
-	for _, line := range lines {
-		if line == "" || strings.HasPrefix(line, "total ") {
-			continue
-		}
-
-		// Parse the ls output
-		fields := strings.Fields(line)
-		if len(fields) < 9 {
-			continue
-		}
-
-		// Extract file information
-		permissions := fields[0]
-		size := fields[4]
-		date := strings.Join(fields[5:8], " ")
-		name := strings.Join(fields[8:], " ")
+	// The user and group databases are read for names only if the path rules allow it
+	idFiles := make(map[string]error)
+	for _, idFile := range []string{"/etc/passwd", "/etc/group"} {
+		_, idFiles[idFile] = o.remotePath(sess, idFile, security.AccessRead)
+	}
 
-		result = append(result, map[string]string{
-			"name":        name,
-			"permissions": permissions,
-			"size":        size,
-			"date":        date,
-			"isDirectory": strconv.FormatBool(permissions[0] == 'd'),
+	var listing *DirectoryListing
+	err = o.sftpSession(sess, func(client *sftp.Client) error {
+		listing, err = listDirectory(client, remotePath, opts, func(idFile string) error {
+			return idFiles[idFile]
 		})
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return result, nil
+	return listing, nil
 }
@@ -1,8 +1,21 @@
 package file
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
 
 	"ssh-mcp/internal/session"
 )
@@ -10,7 +23,7 @@ import (
 // TestNewOperations tests the NewOperations function
 func TestNewOperations(t *testing.T) {
 	sessionManager := session.NewManager(0) // Use default expiry
-	ops := NewOperations(sessionManager)
+	ops := NewOperations(sessionManager, nil)
 
 	if ops == nil {
 		t.Fatal("NewOperations returned nil")
@@ -22,98 +35,1504 @@ func TestNewOperations(t *testing.T) {
 	}
 }
 
-// TestParseDirectoryListing tests the parsing of directory listing output
-func TestParseDirectoryListing(t *testing.T) {
-	// Sample output from ls -la command
+// TestFileTypeAndPermissions tests the conversion of file modes to listing fields
+func TestFileTypeAndPermissions(t *testing.T) {
+	tests := []struct {
+		mode        os.FileMode
+		fileType    string
+		permissions string
+		octal       uint32
+	}{
+		{0644, "file", "-rw-r--r--", 0644},
+		{os.ModeDir | 0755, "directory", "drwxr-xr-x", 0755},
+		{os.ModeSymlink | 0777, "symlink", "lrwxrwxrwx", 0777},
+		{os.ModeDevice | os.ModeCharDevice | 0620, "char", "crw--w----", 0620},
+		{os.ModeDevice | 0660, "block", "brw-rw----", 0660},
+		{os.ModeNamedPipe | 0644, "fifo", "prw-r--r--", 0644},
+		{os.ModeSocket | 0755, "socket", "srwxr-xr-x", 0755},
+		{os.ModeSetuid | 0755, "file", "-rwsr-xr-x", 04755},
+		{os.ModeDir | os.ModeSticky | 0777, "directory", "drwxrwxrwt", 01777},
+		{os.ModeSetgid | 0644, "file", "-rw-r-Sr--", 02644},
+	}
+
+	for _, tt := range tests {
+		if got := fileType(tt.mode); got != tt.fileType {
+			t.Errorf("fileType(%v) = %s, expected %s", tt.mode, got, tt.fileType)
+		}
+		if got := lsPermissions(tt.mode); got != tt.permissions {
+			t.Errorf("lsPermissions(%v) = %s, expected %s", tt.mode, got, tt.permissions)
+		}
+		if got := posixPermBits(tt.mode); got != tt.octal {
+			t.Errorf("posixPermBits(%v) = %04o, expected %04o", tt.mode, got, tt.octal)
+		}
+	}
+}
+
+// TestSortAndPaginate tests sorting and pagination of listing entries
+func TestSortAndPaginate(t *testing.T) {
+	newEntries := func() []FileEntry {
+		return []FileEntry{
+			{Name: "b.txt", Size: 10, ModTime: "2024-01-02T00:00:00Z"},
+			{Name: "a.txt", Size: 30, ModTime: "2024-01-03T00:00:00Z"},
+			{Name: "c.txt", Size: 20, ModTime: "2024-01-01T00:00:00Z"},
+		}
+	}
+
+	names := func(entries []FileEntry) string {
+		result := make([]string, 0, len(entries))
+		for _, e := range entries {
+			result = append(result, e.Name)
+		}
+		return strings.Join(result, ",")
+	}
+
+	tests := []struct {
+		sortBy   string
+		reverse  bool
+		expected string
+	}{
+		{"", false, "a.txt,b.txt,c.txt"},
+		{"name", true, "c.txt,b.txt,a.txt"},
+		{"size", false, "b.txt,c.txt,a.txt"},
+		{"mtime", false, "c.txt,b.txt,a.txt"},
+		{"mtime", true, "a.txt,b.txt,c.txt"},
+	}
+
+	for _, tt := range tests {
+		entries := newEntries()
+		sortEntries(entries, tt.sortBy, tt.reverse)
+		if got := names(entries); got != tt.expected {
+			t.Errorf("sortEntries(%q, %v) = %s, expected %s", tt.sortBy, tt.reverse, got, tt.expected)
+		}
+	}
+
+	entries := newEntries()
+	sortEntries(entries, "name", false)
+
+	if got := names(paginate(entries, 1, 1)); got != "b.txt" {
+		t.Errorf("Expected page b.txt, got %s", got)
+	}
+	if got := names(paginate(entries, 1, 0)); got != "b.txt,c.txt" {
+		t.Errorf("Expected page b.txt,c.txt, got %s", got)
+	}
+	if got := paginate(entries, 5, 1); len(got) != 0 {
+		t.Errorf("Expected empty page, got %d entries", len(got))
+	}
+}
 
-	// Create a sample directory listing output
-	output := `total 16
-drwxr-xr-x  2 user group 4096 Jan  1 12:34 .
-drwxr-xr-x 10 user group 4096 Jan  1 12:34 ..
--rw-r--r--  1 user group  123 Jan  1 12:34 file1.txt
-drwxr-xr-x  3 user group 4096 Jan  1 12:34 dir1
+// TestParseIDNames tests the parsing of passwd and group files
+func TestParseIDNames(t *testing.T) {
+	passwd := `# comment
+root:x:0:0:root:/root:/bin/bash
+testuser:x:1000:1000::/home/testuser:/bin/sh
+alias:x:1000:1000::/home/alias:/bin/sh
+broken line
+nobody:x:notanumber:0::/:/bin/false
 `
 
-	// Parse the output using similar logic to ListDirectory
-	lines := strings.Split(output, "\n")
-	result := make([]map[string]string, 0, len(lines))
+	names := parseIDNames(strings.NewReader(passwd))
 
-	// Skip the first line (total count) and empty lines
-	for _, line := range lines {
-		if line == "" || strings.HasPrefix(line, "total ") {
-			continue
+	if len(names) != 2 {
+		t.Errorf("Expected 2 names, got %d", len(names))
+	}
+	if names[0] != "root" {
+		t.Errorf("Expected root for uid 0, got %s", names[0])
+	}
+	if names[1000] != "testuser" {
+		t.Errorf("Expected testuser for uid 1000, got %s", names[1000])
+	}
+}
+
+// TestMatchName tests glob matching of entry names
+func TestMatchName(t *testing.T) {
+	if !matchName("*.log", "app.log") {
+		t.Error("Expected app.log to match *.log")
+	}
+	if matchName("*.log", "app.txt") {
+		t.Error("Expected app.txt not to match *.log")
+	}
+	if matchName("[", "anything") {
+		t.Error("Expected invalid pattern not to match")
+	}
+}
+
+// newTestSFTPClient starts an in-process SFTP server on the local filesystem and returns a client for it
+func newTestSFTPClient(t *testing.T) *sftp.Client {
+	t.Helper()
+
+	clientReader, serverWriter := io.Pipe()
+	serverReader, clientWriter := io.Pipe()
+
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{serverReader, serverWriter})
+	if err != nil {
+		t.Fatalf("Failed to create SFTP server: %v", err)
+	}
+	go server.Serve()
+
+	client, err := sftp.NewClientPipe(clientReader, clientWriter)
+	if err != nil {
+		t.Fatalf("Failed to create SFTP client: %v", err)
+	}
+
+	// Closing the server first ends the client's receive loop
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+
+	return client
+}
+
+// TestResumeOffset tests the choice of resume offset
+func TestResumeOffset(t *testing.T) {
+	tests := []struct {
+		resume      bool
+		partialSize int64
+		sourceSize  int64
+		expected    int64
+	}{
+		{false, 50, 100, 0},
+		{true, -1, 100, 0},
+		{true, 50, 100, 50},
+		{true, 100, 100, 100},
+		{true, 150, 100, 0},
+	}
+
+	for _, tt := range tests {
+		if got := resumeOffset(tt.resume, tt.partialSize, tt.sourceSize); got != tt.expected {
+			t.Errorf("resumeOffset(%v, %d, %d) = %d, expected %d", tt.resume, tt.partialSize, tt.sourceSize, got, tt.expected)
 		}
+	}
+}
+
+// TestParseChecksumOutput tests the parsing of sha256sum output
+func TestParseChecksumOutput(t *testing.T) {
+	sum := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	got, err := parseChecksumOutput(sum + "  /tmp/empty\n")
+	if err != nil || got != sum {
+		t.Errorf("Expected %s, got %s (err %v)", sum, got, err)
+	}
+
+	got, err = parseChecksumOutput("\\" + sum + "  /tmp/new\\nline\n")
+	if err != nil || got != sum {
+		t.Errorf("Expected %s for escaped name, got %s (err %v)", sum, got, err)
+	}
+
+	if _, err := parseChecksumOutput(""); err == nil {
+		t.Error("Expected error for empty output")
+	}
+
+	if _, err := parseChecksumOutput("sha256sum: missing: No such file or directory"); err == nil {
+		t.Error("Expected error for malformed output")
+	}
+}
+
+// TestPartialPaths tests the naming of partial transfer files
+func TestPartialPaths(t *testing.T) {
+	if got := remotePartialPath("/srv/app/config.yml"); got != "/srv/app/.config.yml.ssh-mcp-part" {
+		t.Errorf("Unexpected remote partial path %s", got)
+	}
+	if got := remotePartialPath("config.yml"); got != ".config.yml.ssh-mcp-part" {
+		t.Errorf("Unexpected remote partial path %s", got)
+	}
+	if got := localPartialPath("/tmp/dump.sql"); got != "/tmp/dump.sql.ssh-mcp-part" {
+		t.Errorf("Unexpected local partial path %s", got)
+	}
+}
+
+// TestShellQuote tests quoting of shell arguments
+func TestShellQuote(t *testing.T) {
+	if got := shellQuote("/tmp/a b"); got != "'/tmp/a b'" {
+		t.Errorf("Unexpected quoting %s", got)
+	}
+	if got := shellQuote("it's"); got != `'it'\''s'` {
+		t.Errorf("Unexpected quoting %s", got)
+	}
+}
+
+// TestSFTPUploadResume tests that an upload continues from an existing partial file
+func TestSFTPUploadResume(t *testing.T) {
+	client := newTestSFTPClient(t)
+	dir := t.TempDir()
+
+	content := strings.Repeat("0123456789", 1000)
+	localPath := filepath.Join(dir, "local.txt")
+	if err := os.WriteFile(localPath, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write local file: %v", err)
+	}
+
+	remotePath := filepath.ToSlash(filepath.Join(dir, "remote.txt"))
+	if err := os.WriteFile(remotePartialPath(remotePath), []byte(content[:4000]), 0644); err != nil {
+		t.Fatalf("Failed to write partial file: %v", err)
+	}
+
+	result, err := sftpUpload(context.Background(), client, nil, localPath, remotePath, TransferOptions{Resume: true})
+	if err != nil {
+		t.Fatalf("sftpUpload returned error: %v", err)
+	}
+
+	if result.ResumedFrom != 4000 || result.Transferred != 6000 || result.Size != 10000 {
+		t.Errorf("Unexpected transfer result %+v", result)
+	}
+
+	data, err := os.ReadFile(remotePath)
+	if err != nil {
+		t.Fatalf("Failed to read uploaded file: %v", err)
+	}
+	if string(data) != content {
+		t.Error("Uploaded file content does not match")
+	}
+
+	if _, err := os.Stat(remotePartialPath(remotePath)); !os.IsNotExist(err) {
+		t.Error("Partial file was not renamed into place")
+	}
+}
+
+// TestSFTPDownloadRestart tests that a download without resume replaces a stale partial file
+func TestSFTPDownloadRestart(t *testing.T) {
+	client := newTestSFTPClient(t)
+	dir := t.TempDir()
+
+	content := strings.Repeat("abcdef", 500)
+	remotePath := filepath.ToSlash(filepath.Join(dir, "remote.txt"))
+	if err := os.WriteFile(remotePath, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write remote file: %v", err)
+	}
+
+	localPath := filepath.Join(dir, "local.txt")
+	if err := os.WriteFile(localPartialPath(localPath), []byte("stale data that is not a prefix"), 0644); err != nil {
+		t.Fatalf("Failed to write partial file: %v", err)
+	}
+
+	result, err := sftpDownload(context.Background(), client, nil, remotePath, localPath, TransferOptions{})
+	if err != nil {
+		t.Fatalf("sftpDownload returned error: %v", err)
+	}
+
+	if result.ResumedFrom != 0 || result.Transferred != int64(len(content)) {
+		t.Errorf("Unexpected transfer result %+v", result)
+	}
+
+	data, err := os.ReadFile(localPath)
+	if err != nil {
+		t.Fatalf("Failed to read downloaded file: %v", err)
+	}
+	if string(data) != content {
+		t.Error("Downloaded file content does not match")
+	}
+}
+
+// TestProgressReader tests that reads are counted and stop once the context is cancelled
+func TestProgressReader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var lastDone, lastTotal int64
+	p := newProgress(ctx, func(done, total int64) {
+		lastDone, lastTotal = done, total
+	}, 10, 110)
+
+	r := p.Reader(strings.NewReader(strings.Repeat("x", 100)))
+	buf := make([]byte, 60)
+
+	if n, err := r.Read(buf); err != nil || n != 60 {
+		t.Fatalf("Expected to read 60 bytes, got %d (err %v)", n, err)
+	}
+	if lastDone != 70 || lastTotal != 110 {
+		t.Errorf("Expected progress 70/110, got %d/%d", lastDone, lastTotal)
+	}
+
+	cancel()
+	if _, err := r.Read(buf); err != context.Canceled {
+		t.Errorf("Expected context.Canceled after cancel, got %v", err)
+	}
+	if lastDone != 70 {
+		t.Errorf("Expected no progress after cancel, got %d", lastDone)
+	}
+}
+
+// TestSFTPUploadCancelled tests that a cancelled upload removes its partial file
+func TestSFTPUploadCancelled(t *testing.T) {
+	client := newTestSFTPClient(t)
+	dir := t.TempDir()
+
+	localPath := filepath.Join(dir, "local.txt")
+	if err := os.WriteFile(localPath, []byte(strings.Repeat("data", 1000)), 0644); err != nil {
+		t.Fatalf("Failed to write local file: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
 
-		// Parse the ls output
-		fields := strings.Fields(line)
-		if len(fields) < 9 {
-			continue
+	remotePath := filepath.ToSlash(filepath.Join(dir, "remote.txt"))
+	if _, err := sftpUpload(ctx, client, nil, localPath, remotePath, TransferOptions{}); err == nil {
+		t.Fatal("Expected error for cancelled upload")
+	}
+
+	if _, err := os.Stat(remotePartialPath(remotePath)); !os.IsNotExist(err) {
+		t.Error("Partial file was not removed after cancellation")
+	}
+	if _, err := os.Stat(remotePath); !os.IsNotExist(err) {
+		t.Error("Destination file was created by a cancelled upload")
+	}
+}
+
+// TestLocalTreeSize tests summing the sizes of files in a local directory tree
+func TestLocalTreeSize(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	os.WriteFile(filepath.Join(dir, "a.txt"), make([]byte, 100), 0644)
+	os.WriteFile(filepath.Join(dir, "sub", "b.txt"), make([]byte, 23), 0644)
+
+	total, err := localTreeSize(dir)
+	if err != nil {
+		t.Fatalf("localTreeSize returned error: %v", err)
+	}
+	if total != 123 {
+		t.Errorf("Expected 123 bytes, got %d", total)
+	}
+}
+
+// TestExcludeMatcher tests .gitignore-style exclude patterns
+func TestExcludeMatcher(t *testing.T) {
+	m, err := newExcludeMatcher([]string{
+		"# build output",
+		"*.log",
+		"!keep.log",
+		"node_modules/",
+		"/dist",
+		"docs/**/*.tmp",
+	})
+	if err != nil {
+		t.Fatalf("newExcludeMatcher returned error: %v", err)
+	}
+
+	tests := []struct {
+		path     string
+		isDir    bool
+		expected bool
+	}{
+		{"app.log", false, true},
+		{"logs/app.log", false, true},
+		{"keep.log", false, false},
+		{"node_modules", true, true},
+		{"web/node_modules", true, true},
+		{"node_modules", false, false},
+		{"dist", true, true},
+		{"web/dist", true, false},
+		{"docs/a/b/c.tmp", false, true},
+		{"docs/c.tmp", false, true},
+		{"src/c.tmp", false, false},
+		{"main.go", false, false},
+	}
+
+	for _, tt := range tests {
+		if got := m.Match(tt.path, tt.isDir); got != tt.expected {
+			t.Errorf("Match(%q, %v) = %v, expected %v", tt.path, tt.isDir, got, tt.expected)
 		}
+	}
+
+	var nilMatcher *excludeMatcher
+	if nilMatcher.Match("anything", false) {
+		t.Error("Expected nil matcher to exclude nothing")
+	}
+}
+
+// TestPlanSync tests the comparison of source and destination trees
+func TestPlanSync(t *testing.T) {
+	now := time.Now()
+	src := map[string]syncEntry{
+		"dir":          {isDir: true},
+		"dir/same.txt": {size: 10, modTime: now},
+		"dir/new.txt":  {size: 5, modTime: now},
+		"changed.txt":  {size: 7, modTime: now},
+		"touched.txt":  {size: 7, modTime: now},
+	}
+	dst := map[string]syncEntry{
+		"dir":          {isDir: true},
+		"dir/same.txt": {size: 10, modTime: now},
+		"changed.txt":  {size: 8, modTime: now},
+		"touched.txt":  {size: 7, modTime: now.Add(-time.Hour)},
+		"old":          {isDir: true},
+		"old/gone.txt": {size: 1, modTime: now},
+	}
 
-		// Extract file information
-		permissions := fields[0]
-		size := fields[4]
-		date := strings.Join(fields[5:8], " ")
-		name := strings.Join(fields[8:], " ")
+	plan := planSync(src, dst, false, sameByModTime)
+	if strings.Join(plan.add, ",") != "dir/new.txt" {
+		t.Errorf("Unexpected additions %v", plan.add)
+	}
+	if strings.Join(plan.update, ",") != "changed.txt,touched.txt" {
+		t.Errorf("Unexpected updates %v", plan.update)
+	}
+	if len(plan.remove) != 0 {
+		t.Errorf("Expected no deletions without delete, got %v", plan.remove)
+	}
+	if plan.unchanged != 2 {
+		t.Errorf("Expected 2 unchanged entries, got %d", plan.unchanged)
+	}
 
-		isDir := "false"
-		if permissions[0] == 'd' {
-			isDir = "true"
+	plan = planSync(src, dst, true, sameByModTime)
+	if strings.Join(plan.remove, ",") != "old/gone.txt,old" {
+		t.Errorf("Expected deepest-first deletions, got %v", plan.remove)
+	}
+
+	// A file replacing a directory, or a directory replacing a file, needs delete
+	src = map[string]syncEntry{
+		"conf":       {size: 3, modTime: now},
+		"logs":       {isDir: true},
+		"logs/a.log": {size: 1, modTime: now},
+		"plain.txt":  {size: 1, modTime: now},
+	}
+	dst = map[string]syncEntry{
+		"conf":        {isDir: true},
+		"conf/x.conf": {size: 1, modTime: now},
+		"logs":        {size: 2, modTime: now},
+	}
+	plan = planSync(src, dst, false, sameByModTime)
+	if strings.Join(plan.conflicts, ",") != "conf,logs" {
+		t.Errorf("Expected conflicts for conf and logs, got %v", plan.conflicts)
+	}
+	if strings.Join(plan.add, ",") != "plain.txt" || len(plan.update) != 0 || len(plan.dirs) != 0 || len(plan.remove) != 0 {
+		t.Errorf("Expected only plain.txt to be added, got %+v", plan)
+	}
+
+	plan = planSync(src, dst, true, sameByModTime)
+	if len(plan.conflicts) != 0 || strings.Join(plan.update, ",") != "conf" || strings.Join(plan.dirs, ",") != "logs" {
+		t.Errorf("Expected conflicting paths to be replaced with delete, got %+v", plan)
+	}
+}
+
+// TestParseChecksumList tests the parsing of multi-line sha256sum output
+func TestParseChecksumList(t *testing.T) {
+	a := strings.Repeat("a", 64)
+	b := strings.Repeat("b", 64)
+	output := a + "  ./one.txt\n\\" + b + "  ./two\\nlines.txt\nsha256sum: ./gone: No such file\n"
+
+	sums := parseChecksumList(output)
+	if len(sums) != 2 {
+		t.Fatalf("Expected 2 checksums, got %d", len(sums))
+	}
+	if sums["./one.txt"] != a {
+		t.Errorf("Unexpected checksum for one.txt: %s", sums["./one.txt"])
+	}
+	if sums["./two\nlines.txt"] != b {
+		t.Errorf("Unexpected checksum for escaped name: %v", sums)
+	}
+}
+
+// TestSyncTreesUpload tests a delta upload followed by a no-op resync
+func TestSyncTreesUpload(t *testing.T) {
+	client := newTestSFTPClient(t)
+	localDir := filepath.Join(t.TempDir(), "local")
+	remoteDir := filepath.ToSlash(filepath.Join(t.TempDir(), "remote"))
+
+	os.MkdirAll(filepath.Join(localDir, "sub"), 0755)
+	os.MkdirAll(filepath.Join(localDir, "cache"), 0755)
+	os.WriteFile(filepath.Join(localDir, "a.txt"), []byte("alpha"), 0644)
+	os.WriteFile(filepath.Join(localDir, "sub", "b.sh"), []byte("#!/bin/sh\n"), 0755)
+	os.WriteFile(filepath.Join(localDir, "cache", "skip.bin"), []byte("skip"), 0644)
+
+	os.MkdirAll(remoteDir, 0755)
+	os.WriteFile(filepath.Join(remoteDir, "stale.txt"), []byte("stale"), 0644)
+
+	excludes, err := newExcludeMatcher([]string{"cache/"})
+	if err != nil {
+		t.Fatalf("newExcludeMatcher returned error: %v", err)
+	}
+
+	opts := SyncOptions{LocalDir: localDir, RemoteDir: remoteDir, Direction: "upload", Delete: true}
+
+	// A dry run reports changes without touching the remote side
+	opts.DryRun = true
+	result, err := syncTrees(context.Background(), client, nil, opts, excludes)
+	if err != nil {
+		t.Fatalf("syncTrees dry run returned error: %v", err)
+	}
+	if len(result.Added) != 2 || len(result.Deleted) != 1 {
+		t.Errorf("Unexpected dry run result %+v", result)
+	}
+	if _, err := os.Stat(filepath.Join(remoteDir, "a.txt")); !os.IsNotExist(err) {
+		t.Error("Dry run created a file")
+	}
+
+	opts.DryRun = false
+	result, err = syncTrees(context.Background(), client, nil, opts, excludes)
+	if err != nil {
+		t.Fatalf("syncTrees returned error: %v", err)
+	}
+	if strings.Join(result.Added, ",") != "a.txt,sub/b.sh" || strings.Join(result.Deleted, ",") != "stale.txt" {
+		t.Errorf("Unexpected sync result %+v", result)
+	}
+
+	info, err := os.Stat(filepath.Join(remoteDir, "sub", "b.sh"))
+	if err != nil {
+		t.Fatalf("Uploaded file missing: %v", err)
+	}
+	if info.Mode().Perm() != 0755 {
+		t.Errorf("Expected mode 0755, got %v", info.Mode().Perm())
+	}
+	if _, err := os.Stat(filepath.Join(remoteDir, "cache")); !os.IsNotExist(err) {
+		t.Error("Excluded directory was uploaded")
+	}
+
+	// Nothing changed, so nothing should be sent again
+	result, err = syncTrees(context.Background(), client, nil, opts, excludes)
+	if err != nil {
+		t.Fatalf("syncTrees resync returned error: %v", err)
+	}
+	if len(result.Added)+len(result.Updated)+len(result.Deleted) != 0 || result.Transferred != 0 {
+		t.Errorf("Expected no changes on resync, got %+v", result)
+	}
+}
+
+// TestSCPUploadDirEntriesPreserve tests the SCP records sent for a tree with preserve and symlink policies
+func TestSCPUploadDirEntriesPreserve(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "run.sh")
+	os.WriteFile(script, []byte("#!/bin/sh\n"), 0755)
+	mtime := time.Unix(1700000000, 0)
+	os.Chtimes(script, mtime, mtime)
+	os.Symlink("run.sh", filepath.Join(dir, "link.sh"))
+
+	entries := func() []os.FileInfo {
+		f, err := os.Open(dir)
+		if err != nil {
+			t.Fatalf("Failed to open directory: %v", err)
+		}
+		defer f.Close()
+		infos, err := f.Readdir(-1)
+		if err != nil {
+			t.Fatalf("Failed to read directory: %v", err)
+		}
+		return infos
+	}
+
+	run := func(opts DirTransferOptions) (string, *dirUpload) {
+		var out bytes.Buffer
+		u := &dirUpload{
+			w:         &out,
+			r:         bufio.NewReader(bytes.NewReader(make([]byte, 64))), // Every status byte is OK
+			p:         newProgress(context.Background(), nil, 0, 0),
+			opts:      opts,
+			ancestors: make(map[string]bool),
 		}
+		if err := scpUploadDirEntries(dir, "/remote", entries(), u); err != nil {
+			t.Fatalf("scpUploadDirEntries returned error: %v", err)
+		}
+		return out.String(), u
+	}
+
+	out, u := run(DirTransferOptions{Preserve: true, Symlinks: SymlinkCopy})
+	if !strings.Contains(out, "T1700000000 0 ") || !strings.Contains(out, "C0755 10 run.sh\n") {
+		t.Errorf("Expected times and exact mode for run.sh, got %q", out)
+	}
+	if strings.Contains(out, "link.sh") {
+		t.Errorf("Copied symlink should not be sent as a file, got %q", out)
+	}
+	if len(u.links) != 1 || u.links[0].path != "/remote/link.sh" || u.links[0].target != "run.sh" {
+		t.Errorf("Unexpected symlinks to create: %+v", u.links)
+	}
+
+	out, u = run(DirTransferOptions{Symlinks: SymlinkFollow})
+	if strings.Contains(out, "T") || !strings.Contains(out, "C0644 10 link.sh\n") {
+		t.Errorf("Expected followed link with default mode and no times, got %q", out)
+	}
+	if len(u.links) != 0 {
+		t.Errorf("Expected no symlinks to create, got %+v", u.links)
+	}
+
+	out, _ = run(DirTransferOptions{Symlinks: SymlinkSkip})
+	if strings.Contains(out, "link.sh") {
+		t.Errorf("Expected skipped symlink, got %q", out)
+	}
+}
+
+// TestSCPDownloadDirPreserve tests that modes and times from SCP records are applied locally
+func TestSCPDownloadDirPreserve(t *testing.T) {
+	dir := t.TempDir()
 
-		result = append(result, map[string]string{
-			"name":        name,
-			"permissions": permissions,
-			"size":        size,
-			"date":        date,
-			"isDirectory": isDir,
+	stream := "D0750 0 tree\n" +
+		"T1700000000 0 1700000100 0\n" +
+		"C0755 3 run.sh\n" + "abc" + "\x00" +
+		"E\n"
+
+	var acks bytes.Buffer
+	p := newProgress(context.Background(), nil, 0, 0)
+	if err := scpDownloadDir(dir, &acks, bufio.NewReader(strings.NewReader(stream)), true, p, true); err != nil {
+		t.Fatalf("scpDownloadDir returned error: %v", err)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "run.sh"))
+	if err != nil {
+		t.Fatalf("Downloaded file missing: %v", err)
+	}
+	if info.Mode().Perm() != 0755 {
+		t.Errorf("Expected mode 0755, got %v", info.Mode().Perm())
+	}
+	if info.ModTime().Unix() != 1700000000 {
+		t.Errorf("Expected mtime 1700000000, got %d", info.ModTime().Unix())
+	}
+
+	dirInfo, err := os.Stat(dir)
+	if err != nil {
+		t.Fatalf("Failed to stat directory: %v", err)
+	}
+	if dirInfo.Mode().Perm() != 0750 {
+		t.Errorf("Expected directory mode 0750, got %v", dirInfo.Mode().Perm())
+	}
+}
+
+// TestParseSCPRecords tests parsing of SCP mode fields and T records
+func TestParseSCPRecords(t *testing.T) {
+	mode, err := parseSCPMode("C4755")
+	if err != nil {
+		t.Fatalf("parseSCPMode returned error: %v", err)
+	}
+	if mode != os.ModeSetuid|0755 {
+		t.Errorf("Unexpected mode %v", mode)
+	}
+	if _, err := parseSCPMode("C09"); err == nil {
+		t.Error("Expected error for invalid octal mode")
+	}
+
+	times, err := parseSCPTimes("T1700000000 0 1700000100 0\n")
+	if err != nil {
+		t.Fatalf("parseSCPTimes returned error: %v", err)
+	}
+	if times.mtime.Unix() != 1700000000 || times.atime.Unix() != 1700000100 {
+		t.Errorf("Unexpected times %+v", times)
+	}
+	if _, err := parseSCPTimes("T1700000000\n"); err == nil {
+		t.Error("Expected error for truncated T record")
+	}
+
+	if _, err := normalizeSymlinkPolicy("dereference"); err == nil {
+		t.Error("Expected error for unknown symlink policy")
+	}
+	if policy, _ := normalizeSymlinkPolicy(""); policy != SymlinkFollow {
+		t.Errorf("Expected default policy follow, got %s", policy)
+	}
+}
+
+// TestPickTarCompression tests compression fallback based on the remote tools
+func TestPickTarCompression(t *testing.T) {
+	tests := []struct {
+		tools       []string
+		compression string
+		expected    string
+		ok          bool
+	}{
+		{[]string{"tar", "gzip", "zstd"}, CompressionZstd, CompressionZstd, true},
+		{[]string{"tar", "gzip"}, CompressionZstd, CompressionGzip, true},
+		{[]string{"tar"}, CompressionZstd, CompressionNone, true},
+		{[]string{"tar"}, CompressionGzip, CompressionNone, true},
+		{[]string{"gzip", "zstd"}, CompressionGzip, "", false},
+	}
+
+	for _, tt := range tests {
+		compression, ok := pickTarCompression(tt.tools, tt.compression)
+		if compression != tt.expected || ok != tt.ok {
+			t.Errorf("pickTarCompression(%v, %s) = %s, %v; expected %s, %v", tt.tools, tt.compression, compression, ok, tt.expected, tt.ok)
+		}
+	}
+
+	if _, _, err := normalizeTransferMode("rsync", ""); err == nil {
+		t.Error("Expected error for unknown transfer mode")
+	}
+	if mode, compression, _ := normalizeTransferMode("", ""); mode != ModeSCP || compression != CompressionGzip {
+		t.Errorf("Expected defaults scp and gzip, got %s and %s", mode, compression)
+	}
+}
+
+// TestUploadDirName tests that the remote directory is named after the given path
+func TestUploadDirName(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "real"), 0755)
+	os.Symlink("real", filepath.Join(dir, "current"))
+
+	tests := []struct {
+		localDir string
+		want     string
+	}{
+		{filepath.Join(dir, "current"), "current"},
+		{filepath.Join(dir, "real"), "real"},
+		{filepath.Join(dir, "current") + "/", ""},
+		{filepath.Join(dir, "real", ".."), filepath.Base(dir)},
+	}
+	for _, tt := range tests {
+		name, err := uploadDirName(tt.localDir)
+		if err != nil || name != tt.want {
+			t.Errorf("uploadDirName(%q) = %q, %v, want %q", tt.localDir, name, err, tt.want)
+		}
+	}
+}
+
+// TestTarEntryPath tests that archive entries cannot escape the destination
+func TestTarEntryPath(t *testing.T) {
+	dest := t.TempDir()
+	os.Mkdir(filepath.Join(dest, "sub"), 0755)
+	os.Symlink("/etc", filepath.Join(dest, "link"))
+
+	if p, err := localEntryPath(dest, "./sub/file"); err != nil || p != filepath.Join(dest, "sub", "file") {
+		t.Errorf("Unexpected result for safe entry: %s, %v", p, err)
+	}
+	if p, err := localEntryPath(dest, "./"); err != nil || p != dest {
+		t.Errorf("Unexpected result for root entry: %s, %v", p, err)
+	}
+
+	for _, name := range []string{"/etc/passwd", "../outside", "sub/../../outside", "link/passwd"} {
+		if _, err := localEntryPath(dest, name); err == nil {
+			t.Errorf("Expected entry %q to be rejected", name)
+		}
+	}
+}
+
+// TestTarRoundTrip tests that a tree written as a tar stream extracts to the same tree
+func TestTarRoundTrip(t *testing.T) {
+	for _, compression := range []string{CompressionGzip, CompressionZstd, CompressionNone} {
+		t.Run(compression, func(t *testing.T) {
+			src := t.TempDir()
+			os.MkdirAll(filepath.Join(src, "sub"), 0750)
+			os.WriteFile(filepath.Join(src, "run.sh"), []byte("#!/bin/sh\n"), 0755)
+			os.WriteFile(filepath.Join(src, "sub", "data.txt"), []byte("data"), 0600)
+			os.Symlink("run.sh", filepath.Join(src, "link.sh"))
+			mtime := time.Unix(1700000000, 0)
+			os.Chtimes(filepath.Join(src, "run.sh"), mtime, mtime)
+
+			opts := DirTransferOptions{Preserve: true, Symlinks: SymlinkCopy, Compression: compression}
+			u := &dirUpload{
+				p:         newProgress(context.Background(), nil, 0, 0),
+				opts:      opts,
+				ancestors: make(map[string]bool),
+			}
+
+			var stream bytes.Buffer
+			cw, err := compressWriter(&stream, compression)
+			if err != nil {
+				t.Fatalf("compressWriter returned error: %v", err)
+			}
+			tw := tar.NewWriter(cw)
+			if err := writeTarTree(tw, src, "/remote", u); err != nil {
+				t.Fatalf("writeTarTree returned error: %v", err)
+			}
+			tw.Close()
+			cw.Close()
+
+			if u.p.done.Load() != 14 {
+				t.Errorf("Expected 14 bytes of progress, got %d", u.p.done.Load())
+			}
+
+			dest := t.TempDir()
+			dr, err := decompressReader(&stream, compression)
+			if err != nil {
+				t.Fatalf("decompressReader returned error: %v", err)
+			}
+			p := newProgress(context.Background(), nil, 0, 0)
+			if err := extractTar(tar.NewReader(dr), dest, opts, p); err != nil {
+				t.Fatalf("extractTar returned error: %v", err)
+			}
+
+			info, err := os.Stat(filepath.Join(dest, "run.sh"))
+			if err != nil {
+				t.Fatalf("Extracted file missing: %v", err)
+			}
+			if info.Mode().Perm() != 0755 || info.ModTime().Unix() != 1700000000 {
+				t.Errorf("Expected mode 0755 and mtime 1700000000, got %v and %d", info.Mode().Perm(), info.ModTime().Unix())
+			}
+			if content, _ := os.ReadFile(filepath.Join(dest, "sub", "data.txt")); string(content) != "data" {
+				t.Errorf("Unexpected content %q", content)
+			}
+			if info, err := os.Stat(filepath.Join(dest, "sub")); err != nil || info.Mode().Perm() != 0750 {
+				t.Errorf("Expected directory mode 0750, got %v, %v", info, err)
+			}
+			if target, err := os.Readlink(filepath.Join(dest, "link.sh")); err != nil || target != "run.sh" {
+				t.Errorf("Expected symlink to run.sh, got %q, %v", target, err)
+			}
 		})
 	}
+}
 
-	// Verify the parsed results
-	if len(result) != 4 {
-		t.Errorf("Expected 4 entries, got %d", len(result))
+// TestExtractTarSymlinkDir tests that a directory entry cannot follow a link from an earlier entry
+func TestExtractTarSymlinkDir(t *testing.T) {
+	outside := t.TempDir()
+	os.Chmod(outside, 0700)
+
+	var stream bytes.Buffer
+	tw := tar.NewWriter(&stream)
+	tw.WriteHeader(&tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: outside})
+	tw.WriteHeader(&tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0777, ModTime: time.Unix(1700000000, 0)})
+	tw.Close()
+
+	dest := t.TempDir()
+	opts := DirTransferOptions{Preserve: true, Symlinks: SymlinkCopy}
+	p := newProgress(context.Background(), nil, 0, 0)
+	if err := extractTar(tar.NewReader(&stream), dest, opts, p); err == nil {
+		t.Error("Expected the directory entry to be refused")
+	}
+	if info, err := os.Stat(outside); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("Expected the link target to keep mode 0700, got %v, %v", info, err)
+	}
+}
+
+// countingReader counts the status bytes read from the remote side, one per round trip
+type countingReader struct {
+	reads int
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	c.reads++
+	b[0] = 0
+	return 1, nil
+}
+
+// BenchmarkDirectoryUpload compares the SCP protocol with tar streams for a tree of
+// many small files. Besides time, it reports the bytes put on the wire and the number
+// of round trips to the remote side, which dominate SCP transfers over real links.
+func BenchmarkDirectoryUpload(b *testing.B) {
+	dir := b.TempDir()
+	for i := 0; i < 500; i++ {
+		sub := filepath.Join(dir, "dir"+strconv.Itoa(i%10))
+		os.MkdirAll(sub, 0755)
+		content := strings.Repeat("line "+strconv.Itoa(i)+"\n", 40)
+		os.WriteFile(filepath.Join(sub, "file"+strconv.Itoa(i)+".txt"), []byte(content), 0644)
 	}
 
-	// Check file1.txt details
-	var file1 map[string]string
-	for _, f := range result {
-		if f["name"] == "file1.txt" {
-			file1 = f
-			break
+	b.Run("scp", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			f, _ := os.Open(dir)
+			entries, _ := f.Readdir(-1)
+			f.Close()
+
+			var out bytes.Buffer
+			acks := &countingReader{}
+			u := &dirUpload{
+				w:         &out,
+				r:         bufio.NewReaderSize(acks, 16),
+				p:         newProgress(context.Background(), nil, 0, 0),
+				ancestors: make(map[string]bool),
+			}
+			if err := scpUploadDirEntries(dir, "/remote", entries, u); err != nil {
+				b.Fatalf("scpUploadDirEntries returned error: %v", err)
+			}
+			b.ReportMetric(float64(out.Len()), "wire-bytes/op")
+			b.ReportMetric(float64(acks.reads), "round-trips/op")
 		}
+	})
+
+	for _, compression := range []string{CompressionNone, CompressionGzip, CompressionZstd} {
+		b.Run("tar-"+compression, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var out bytes.Buffer
+				u := &dirUpload{
+					p:         newProgress(context.Background(), nil, 0, 0),
+					opts:      DirTransferOptions{Compression: compression},
+					ancestors: make(map[string]bool),
+				}
+				cw, _ := compressWriter(&out, compression)
+				tw := tar.NewWriter(cw)
+				if err := writeTarTree(tw, dir, "/remote", u); err != nil {
+					b.Fatalf("writeTarTree returned error: %v", err)
+				}
+				tw.Close()
+				cw.Close()
+				b.ReportMetric(float64(out.Len()), "wire-bytes/op")
+				b.ReportMetric(0, "round-trips/op")
+			}
+		})
 	}
+}
 
-	if file1 == nil {
-		t.Fatal("file1.txt not found in results")
+// TestSFTPCopy tests copying a file between two SFTP connections
+func TestSFTPCopy(t *testing.T) {
+	srcClient := newTestSFTPClient(t)
+	dstClient := newTestSFTPClient(t)
+	dir := t.TempDir()
+
+	content := strings.Repeat("dump", 5000)
+	srcPath := filepath.ToSlash(filepath.Join(dir, "db.dump"))
+	if err := os.WriteFile(srcPath, []byte(content), 0640); err != nil {
+		t.Fatalf("Failed to write source file: %v", err)
 	}
+	dstPath := filepath.ToSlash(filepath.Join(dir, "backup.dump"))
 
-	if file1["permissions"] != "-rw-r--r--" {
-		t.Errorf("Expected permissions -rw-r--r--, got %s", file1["permissions"])
+	var reported int64
+	opts := TransferOptions{Progress: func(transferred, total int64) { reported = transferred }}
+	result, err := sftpCopy(context.Background(), srcClient, dstClient, nil, nil, srcPath, dstPath, opts)
+	if err != nil {
+		t.Fatalf("sftpCopy returned error: %v", err)
 	}
 
-	if file1["size"] != "123" {
-		t.Errorf("Expected size 123, got %s", file1["size"])
+	sum, _ := localSHA256(srcPath)
+	if result.Size != 20000 || result.Transferred != 20000 || result.SHA256 != sum {
+		t.Errorf("Unexpected copy result %+v", result)
+	}
+	if reported != 20000 {
+		t.Errorf("Expected progress to reach 20000, got %d", reported)
 	}
 
-	if file1["isDirectory"] != "false" {
-		t.Errorf("Expected isDirectory false, got %s", file1["isDirectory"])
+	info, err := os.Stat(dstPath)
+	if err != nil {
+		t.Fatalf("Copied file missing: %v", err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("Expected source mode 0640, got %v", info.Mode().Perm())
+	}
+	if _, err := os.Stat(remotePartialPath(dstPath)); !os.IsNotExist(err) {
+		t.Error("Partial file was not renamed into place")
+	}
+
+	if _, err := sftpCopy(context.Background(), srcClient, dstClient, nil, nil, dir, dstPath, TransferOptions{}); err == nil {
+		t.Error("Expected error when copying a directory")
+	}
+}
+
+// TestSCPDownloadDirUnsafeNames tests that names sent by a malicious server cannot leave the destination
+func TestSCPDownloadDirUnsafeNames(t *testing.T) {
+	outside := t.TempDir()
+	dest := t.TempDir()
+	os.Symlink(outside, filepath.Join(dest, "link"))
+
+	streams := map[string]string{
+		"file escaping with ..":       "C0644 3 ../evil\nabc\x00",
+		"directory escaping with ..":  "D0755 0 ..\nC0644 3 evil\nabc\x00E\n",
+		"file with a path":            "C0644 3 sub/../../evil\nabc\x00",
+		"directory through a symlink": "D0755 0 link\nC0644 3 evil\nabc\x00E\n",
+		"file through a symlink":      "C0644 3 link\nabc\x00",
 	}
 
-	// Check dir1 details
-	var dir1 map[string]string
-	for _, f := range result {
-		if f["name"] == "dir1" {
-			dir1 = f
-			break
+	for name, stream := range streams {
+		var acks bytes.Buffer
+		p := newProgress(context.Background(), nil, 0, 0)
+		if err := scpDownloadDir(dest, &acks, bufio.NewReader(strings.NewReader(stream)), false, p, false); err == nil {
+			t.Errorf("%s: expected error", name)
 		}
 	}
 
-	if dir1 == nil {
-		t.Fatal("dir1 not found in results")
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Errorf("Expected nothing written outside of the destination, found %d entries", len(entries))
 	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dest), "evil")); !os.IsNotExist(err) {
+		t.Error("File was written next to the destination")
+	}
+
+	if _, err := localChildPath(dest, "ok.txt"); err != nil {
+		t.Errorf("Expected safe name to be accepted, got %v", err)
+	}
+}
 
-	if dir1["isDirectory"] != "true" {
-		t.Errorf("Expected isDirectory true, got %s", dir1["isDirectory"])
+// TestParseRipgrepJSON tests turning rg --json output into matches with context
+func TestParseRipgrepJSON(t *testing.T) {
+	output := `{"type":"begin","data":{"path":{"text":"app/main.go"}}}
+{"type":"context","data":{"path":{"text":"app/main.go"},"lines":{"text":"func main() {\n"},"line_number":9,"absolute_offset":0,"submatches":[]}}
+{"type":"match","data":{"path":{"text":"app/main.go"},"lines":{"text":"\tpanic(err)\n"},"line_number":10,"absolute_offset":14,"submatches":[{"match":{"text":"panic"},"start":1,"end":6}]}}
+{"type":"context","data":{"path":{"text":"app/main.go"},"lines":{"text":"}\n"},"line_number":11,"absolute_offset":26,"submatches":[]}}
+{"type":"end","data":{"path":{"text":"app/main.go"}}}
+{"type":"match","data":{"path":{"bytes":"bGF0aW4xLWZpbGU="},"lines":{"text":"panic\n"},"line_number":1,"absolute_offset":0,"submatches":[{"match":{"text":"panic"},"start":0,"end":5}]}}
+{"type":"summary","data":{}}
+`
+	c := &searchCollector{limit: 10, context: 1}
+	if err := parseRipgrepJSON(strings.NewReader(output), c); err != nil {
+		t.Fatalf("parseRipgrepJSON returned error: %v", err)
+	}
+
+	if len(c.matches) != 2 {
+		t.Fatalf("Expected 2 matches, got %+v", c.matches)
+	}
+	m := c.matches[0]
+	if m.File != "app/main.go" || m.Line != 10 || m.Column != 2 || m.Text != "\tpanic(err)" {
+		t.Errorf("Unexpected match %+v", m)
+	}
+	if len(m.Before) != 1 || m.Before[0] != "func main() {" || len(m.After) != 1 || m.After[0] != "}" {
+		t.Errorf("Unexpected context %+v", m)
+	}
+	if c.matches[1].File != "latin1-file" {
+		t.Errorf("Expected base64 path to be decoded, got %q", c.matches[1].File)
+	}
+	if c.truncated {
+		t.Error("Search should not be truncated")
+	}
+}
+
+// TestParseGrepOutput tests parsing grep -nZ output, including file names with separators and truncation
+func TestParseGrepOutput(t *testing.T) {
+	output := "logs/app-1:2.log\x004-starting\n" +
+		"logs/app-1:2.log\x005:ERROR failed to bind\n" +
+		"logs/app-1:2.log\x006-retrying\n" +
+		"--\n" +
+		"logs/other.log\x0012:ERROR disk full\n" +
+		"logs/other.log\x0013-cleanup\n" +
+		"logs/third.log\x001:ERROR never reached\n"
+
+	c := &searchCollector{limit: 2, context: 1}
+	if err := parseGrepOutput(strings.NewReader(output), regexp.MustCompile("ERROR"), c); err != nil {
+		t.Fatalf("parseGrepOutput returned error: %v", err)
+	}
+
+	if len(c.matches) != 2 || !c.truncated {
+		t.Fatalf("Expected 2 matches and truncation, got %+v, truncated %v", c.matches, c.truncated)
+	}
+	m := c.matches[0]
+	if m.File != "logs/app-1:2.log" || m.Line != 5 || m.Column != 1 || m.Text != "ERROR failed to bind" {
+		t.Errorf("Unexpected match %+v", m)
+	}
+	if len(m.Before) != 1 || m.Before[0] != "starting" || len(m.After) != 1 || m.After[0] != "retrying" {
+		t.Errorf("Unexpected context %+v", m)
+	}
+	if after := c.matches[1].After; len(after) != 1 || after[0] != "cleanup" {
+		t.Errorf("Expected trailing context of the last match, got %+v", after)
+	}
+
+	if _, ok := parseGrepLine("--"); ok {
+		t.Error("Expected group separator to be skipped")
+	}
+}
+
+// TestSearchCommands tests that search patterns and globs are quoted for the remote shell
+func TestSearchCommands(t *testing.T) {
+	opts := SearchOptions{Root: "/srv/app", Pattern: "it's", Include: []string{"*.go"}, Exclude: []string{"vendor"}, Context: 2}
+
+	rg := ripgrepCommand(opts)
+	if !strings.Contains(rg, `-e 'it'\''s' -- '/srv/app'`) || !strings.Contains(rg, "-g '*.go' -g '!vendor'") {
+		t.Errorf("Unexpected rg command %q", rg)
+	}
+
+	grep := grepCommand(opts)
+	if !strings.Contains(grep, "'--include=*.go' '--exclude=vendor' '--exclude-dir=vendor'") || !strings.Contains(grep, "-C 2") {
+		t.Errorf("Unexpected grep command %q", grep)
+	}
+}
+
+// TestTailSubscription tests buffering, filtering and cursor reads of a follow subscription
+func TestTailSubscription(t *testing.T) {
+	var notified []TailLine
+	sub := &tailSubscription{
+		id:     "tail-test",
+		filter: regexp.MustCompile("ERROR"),
+		notify: func(_ string, lines []TailLine) { notified = append(notified, lines...) },
+	}
+
+	sub.run(strings.NewReader("INFO starting\nERROR one\nINFO ok\nERROR two\r\nERROR three"))
+
+	if len(notified) != 3 || notified[0].Text != "ERROR one" || notified[1].Text != "ERROR two" || notified[2].Cursor != 3 {
+		t.Errorf("Unexpected notifications %+v", notified)
+	}
+
+	read := sub.read(0, 2)
+	if len(read.Lines) != 2 || read.Cursor != 2 || !read.Closed || read.Dropped != 0 {
+		t.Errorf("Unexpected first read %+v", read)
+	}
+	read = sub.read(read.Cursor, 0)
+	if len(read.Lines) != 1 || read.Lines[0].Text != "ERROR three" || read.Cursor != 3 {
+		t.Errorf("Unexpected second read %+v", read)
+	}
+	read = sub.read(read.Cursor, 0)
+	if len(read.Lines) != 0 || read.Cursor != 3 {
+		t.Errorf("Expected nothing new, got %+v", read)
+	}
+
+	// Lines that left the buffer are reported as dropped
+	var input strings.Builder
+	for i := 0; i < tailBufferLines+5; i++ {
+		input.WriteString("line\n")
+	}
+	sub = &tailSubscription{id: "tail-overflow"}
+	sub.run(strings.NewReader(input.String()))
+	read = sub.read(0, 1)
+	if read.Dropped != 5 || read.Lines[0].Cursor != 6 {
+		t.Errorf("Expected 5 dropped lines, got %+v", read.Dropped)
+	}
+
+	// Ended subscriptions that are never read are forgotten, but not ones replacing them
+	ops := NewOperations(session.NewManager(0), nil)
+	ops.tails[sub.id] = sub
+	ops.forgetTail(&tailSubscription{id: sub.id})
+	if _, err := ops.ReadTail(sub.id, 0, 1); err != nil {
+		t.Errorf("Expected the subscription to be kept, got %v", err)
+	}
+	ops.forgetTail(sub)
+	if _, err := ops.ReadTail(sub.id, 0, 1); err == nil {
+		t.Error("Expected the subscription to be forgotten")
+	}
+}
+
+// TestParseInotifyLine tests the parsing of inotifywait output and the merging of repeated events
+func TestParseInotifyLine(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected WatchEvent
+		ok       bool
+	}{
+		{"CREATE /etc/app/new.conf", WatchEvent{Type: WatchCreate, Path: "/etc/app/new.conf"}, true},
+		{"CREATE,ISDIR /etc/app/conf.d", WatchEvent{Type: WatchCreate, Path: "/etc/app/conf.d", Dir: true}, true},
+		{"MODIFY /etc/app/app file.conf", WatchEvent{Type: WatchModify, Path: "/etc/app/app file.conf"}, true},
+		{"MOVED_FROM /etc/app/old.conf", WatchEvent{Type: WatchDelete, Path: "/etc/app/old.conf"}, true},
+		{"DELETE_SELF /etc/app/", WatchEvent{Type: WatchDelete, Path: "/etc/app"}, true},
+		{"OPEN /etc/app/app.conf", WatchEvent{}, false},
+		{"garbage", WatchEvent{}, false},
+	}
+
+	for _, tt := range tests {
+		event, ok := parseInotifyLine(tt.line)
+		if ok != tt.ok || event != tt.expected {
+			t.Errorf("parseInotifyLine(%q) = %+v, %v; expected %+v, %v", tt.line, event, ok, tt.expected, tt.ok)
+		}
+	}
+
+	merged := mergeWatchEvents([]WatchEvent{
+		{Type: WatchCreate, Path: "/a"},
+		{Type: WatchModify, Path: "/a"},
+		{Type: WatchModify, Path: "/a"},
+		{Type: WatchModify, Path: "/b"},
+	})
+	if len(merged) != 3 {
+		t.Errorf("Expected repeated modify events to be merged, got %+v", merged)
+	}
+}
+
+// TestWatchSnapshot tests that stat snapshots of a tree are diffed into watch events
+func TestWatchSnapshot(t *testing.T) {
+	client := newTestSFTPClient(t)
+	root := filepath.ToSlash(filepath.Join(t.TempDir(), "watched"))
+
+	// A missing root is watched as empty, so that its creation is reported
+	prev, err := watchSnapshot(client, root)
+	if err != nil || len(prev) != 0 {
+		t.Fatalf("Expected an empty snapshot, got %v, %v", prev, err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "sub", "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "b.txt"), []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	next, err := watchSnapshot(client, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := diffSnapshots(prev, next)
+	expected := []WatchEvent{
+		{Type: WatchCreate, Path: root, Dir: true},
+		{Type: WatchCreate, Path: root + "/b.txt"},
+		{Type: WatchCreate, Path: root + "/sub", Dir: true},
+		{Type: WatchCreate, Path: root + "/sub/a.txt"},
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("Unexpected create events %+v", events)
+	}
+
+	prev = next
+	if err := os.WriteFile(filepath.Join(root, "b.txt"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(root, "sub")); err != nil {
+		t.Fatal(err)
+	}
+
+	next, err = watchSnapshot(client, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events = diffSnapshots(prev, next)
+	expected = []WatchEvent{
+		{Type: WatchDelete, Path: root + "/sub/a.txt"},
+		{Type: WatchDelete, Path: root + "/sub", Dir: true},
+		{Type: WatchModify, Path: root + "/b.txt"},
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("Unexpected events %+v", events)
+	}
+
+	if events := diffSnapshots(next, next); len(events) != 0 {
+		t.Errorf("Expected no events for an unchanged tree, got %+v", events)
+	}
+}
+
+// TestSelectChanges tests the choice of changes to roll back and the backup directory names
+func TestSelectChanges(t *testing.T) {
+	changes := []*Change{
+		{ID: 1, Path: "/etc/a.conf"},
+		{ID: 2, Path: "/etc/b.conf", RolledBack: true},
+		{ID: 3, Path: "/etc/c.conf"},
+		{ID: 4, Path: "/etc/d.conf"},
+	}
+
+	ids := func(selected []*Change) []int {
+		var result []int
+		for _, change := range selected {
+			result = append(result, change.ID)
+		}
+		return result
+	}
+
+	selected, err := selectChanges(changes, 3, -1)
+	if err != nil || !reflect.DeepEqual(ids(selected), []int{3}) {
+		t.Errorf("Expected change 3, got %v, %v", ids(selected), err)
+	}
+
+	// Everything after a checkpoint is rolled back newest first, skipping rolled back changes
+	selected, err = selectChanges(changes, 0, 1)
+	if err != nil || !reflect.DeepEqual(ids(selected), []int{4, 3}) {
+		t.Errorf("Expected changes 4 and 3, got %v, %v", ids(selected), err)
+	}
+	selected, err = selectChanges(changes, 0, 0)
+	if err != nil || !reflect.DeepEqual(ids(selected), []int{4, 3, 1}) {
+		t.Errorf("Expected changes 4, 3 and 1, got %v, %v", ids(selected), err)
+	}
+
+	if _, err := selectChanges(changes, 2, -1); err == nil {
+		t.Error("Expected an error for a change that was already rolled back")
+	}
+	if _, err := selectChanges(changes, 9, -1); err == nil {
+		t.Error("Expected an error for an unknown change")
+	}
+	if _, err := selectChanges(changes, 0, -1); err == nil {
+		t.Error("Expected an error without a change ID or checkpoint")
+	}
+
+	if dir := backupDir("example.com-root-1"); dir != ".ssh-mcp/backups/example.com-root-1" {
+		t.Errorf("Unexpected backup directory %s", dir)
+	}
+	if dir := backupDir("::1-root/../x"); dir != ".ssh-mcp/backups/__1-root_.._x" {
+		t.Errorf("Expected the session ID to be sanitised, got %s", dir)
+	}
+}
+
+// TestRenderTemplate tests the rendering of templates with variables and helper functions
+func TestRenderTemplate(t *testing.T) {
+	vars := map[string]interface{}{
+		"name":  "api",
+		"port":  float64(8080),
+		"hosts": []interface{}{"a", "b"},
+		"debug": false,
+	}
+	text := `server {{ .name | upper }}:{{ .port }}
+hosts={{ join "," .hosts }}
+debug={{ default "off" .debug }}
+log={{ default "/var/log/app.log" (index . "log") }}
+{{- range .hosts }}
+  - {{ . | quote }}
+{{- end }}
+`
+	expected := "server API:8080\nhosts=a,b\ndebug=off\nlog=/var/log/app.log\n  - \"a\"\n  - \"b\"\n"
+
+	content, err := renderTemplate("test", text, vars)
+	if err != nil {
+		t.Fatalf("Failed to render template: %v", err)
+	}
+	if string(content) != expected {
+		t.Errorf("Unexpected rendering:\n%s", content)
+	}
+
+	// Missing variables are an error instead of rendering as <no value>
+	if _, err := renderTemplate("test", "{{ .missing }}", vars); err == nil {
+		t.Error("Expected an error for a missing variable")
+	}
+	if _, err := renderTemplate("test", `{{ required "name is required" (index . "nothing") }}`, vars); err == nil || !strings.Contains(err.Error(), "name is required") {
+		t.Errorf("Expected the required message, got %v", err)
+	}
+	if _, err := renderTemplate("test", "{{ .name ", vars); err == nil {
+		t.Error("Expected a parse error")
+	}
+}
+
+// TestWriteTemplate tests the diff preview and writing a rendered template with its mode
+func TestWriteTemplate(t *testing.T) {
+	client := newTestSFTPClient(t)
+	remotePath := filepath.ToSlash(filepath.Join(t.TempDir(), "app.conf"))
+
+	if err := os.WriteFile(remotePath, []byte("port=80\nhost=a\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	current, exists, err := readRemoteForDiff(client, remotePath)
+	if err != nil || !exists {
+		t.Fatalf("Failed to read remote file: %v", err)
+	}
+	content := []byte("port=8080\nhost=a\n")
+
+	diff, err := unifiedDiff(remotePath, current, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(diff, "-port=80\n") || !strings.Contains(diff, "+port=8080\n") || !strings.Contains(diff, " host=a\n") {
+		t.Errorf("Unexpected diff:\n%s", diff)
+	}
+
+	// The permissions of the replaced file are kept
+	if err := writeTemplate(client, nil, remotePath, content, true, nil, ""); err != nil {
+		t.Fatalf("Failed to write template: %v", err)
+	}
+	data, err := os.ReadFile(remotePath)
+	if err != nil || string(data) != string(content) {
+		t.Errorf("Unexpected content %q, %v", data, err)
+	}
+	if fi, err := os.Stat(remotePath); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("Expected mode 0600 to be kept, got %v", fi.Mode().Perm())
+	}
+	if _, err := os.Stat(remotePartialPath(remotePath)); !os.IsNotExist(err) {
+		t.Error("Expected the partial file to be gone")
+	}
+
+	// An unchanged file only gets its mode applied
+	mode := os.FileMode(0640)
+	if err := writeTemplate(client, nil, remotePath, content, false, &mode, ""); err != nil {
+		t.Fatalf("Failed to apply mode: %v", err)
+	}
+	if fi, err := os.Stat(remotePath); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("Expected mode 0640, got %v", fi.Mode().Perm())
+	}
+
+	if _, exists, err := readRemoteForDiff(client, remotePath+".missing"); err != nil || exists {
+		t.Errorf("Expected a missing file to be reported as such, got %v, %v", exists, err)
+	}
+}
+
+// TestListDirectoryLimits tests the depth cap, skipped subdirectories and the check on the
+// user and group databases
+func TestListDirectoryLimits(t *testing.T) {
+	client := newTestSFTPClient(t)
+	dir := t.TempDir()
+
+	nested := dir
+	for i := 0; i < MaxListDepth+2; i++ {
+		nested = filepath.Join(nested, "d")
+	}
+	if err := os.MkdirAll(nested, 0755); err != nil {
+		t.Fatalf("Failed to create directories: %v", err)
+	}
+
+	var checked []string
+	deny := func(remotePath string) error {
+		checked = append(checked, remotePath)
+		return os.ErrPermission
+	}
+
+	listing, err := listDirectory(client, filepath.ToSlash(dir), ListOptions{Depth: 100}, deny)
+	if err != nil {
+		t.Fatalf("listDirectory returned error: %v", err)
+	}
+	if listing.Total != MaxListDepth {
+		t.Errorf("Expected the listing to stop at %d levels, got %d entries", MaxListDepth, listing.Total)
+	}
+	if !reflect.DeepEqual(checked, []string{"/etc/passwd", "/etc/group"}) {
+		t.Errorf("Expected the user and group databases to be checked, got %v", checked)
+	}
+	for _, entry := range listing.Entries {
+		if entry.Owner != "" || entry.Group != "" {
+			t.Errorf("Expected no names when the databases are denied, got %+v", entry)
+		}
+	}
+
+	// Permissions do not stop root from reading a directory
+	if os.Geteuid() == 0 {
+		return
+	}
+	locked := filepath.Join(dir, "locked")
+	if err := os.Mkdir(locked, 0); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.Chmod(locked, 0755)
+
+	listing, err = listDirectory(client, filepath.ToSlash(dir), ListOptions{Depth: 2}, nil)
+	if err != nil {
+		t.Fatalf("Expected the unreadable directory to be skipped, got %v", err)
+	}
+	if len(listing.Skipped) != 1 || !strings.HasPrefix(listing.Skipped[0], "locked: ") {
+		t.Errorf("Expected locked to be reported as skipped, got %v", listing.Skipped)
+	}
+}
+
+// TestResolveRemoteLinks tests that symlinks are resolved in every existing part of a path
+func TestResolveRemoteLinks(t *testing.T) {
+	client := newTestSFTPClient(t)
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir = filepath.ToSlash(dir)
+
+	if err := os.MkdirAll(dir+"/secret/keys", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(dir+"/allowed", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(dir+"/secret", dir+"/allowed/abs"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../secret/keys", dir+"/allowed/rel"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("loop", dir+"/allowed/loop"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{dir + "/allowed", dir + "/allowed"},
+		{dir + "/allowed/abs/keys", dir + "/secret/keys"},
+		{dir + "/allowed/rel", dir + "/secret/keys"},
+		{dir + "/allowed/abs/new/file", dir + "/secret/new/file"},
+		{dir + "/missing/../allowed", dir + "/allowed"},
+	}
+	for _, tt := range tests {
+		got, err := resolveRemoteLinks(client, tt.path)
+		if err != nil || got != tt.expected {
+			t.Errorf("resolveRemoteLinks(%s) = %s, %v; expected %s", tt.path, got, err, tt.expected)
+		}
+	}
+
+	if _, err := resolveRemoteLinks(client, dir+"/allowed/loop"); err == nil {
+		t.Error("Expected an error for a symlink loop")
+	}
+}
+
+// TestDiscardJournal tests that the journal of a removed session is forgotten
+func TestDiscardJournal(t *testing.T) {
+	sessionManager := session.NewManager(0)
+	sessionManager.AddSession("session1", nil, "example.com", "testuser")
+	ops := NewOperations(sessionManager, nil)
+
+	ops.journal("session1")
+	if err := sessionManager.RemoveSession("session1"); err != nil {
+		t.Fatal(err)
+	}
+
+	ops.mu.Lock()
+	defer ops.mu.Unlock()
+	if _, ok := ops.journals["session1"]; ok {
+		t.Error("Expected the journal to be discarded with the session")
+	}
+}
+
+// TestCheckSubscriptionOwner tests that subscriptions are only visible to their owner
+func TestCheckSubscriptionOwner(t *testing.T) {
+	ops := NewOperations(session.NewManager(0), nil)
+	ops.tails["tail-1"] = &tailSubscription{id: "tail-1", owner: "client1"}
+	ops.watches["watch-1"] = &watchSubscription{id: "watch-1", owner: "client1"}
+
+	for _, id := range []string{"tail-1", "watch-1"} {
+		if err := ops.CheckSubscriptionOwner(id, "client1"); err != nil {
+			t.Errorf("Expected the owner to have access to %s, got %v", id, err)
+		}
+		if err := ops.CheckSubscriptionOwner(id, "client2"); err == nil {
+			t.Errorf("Expected another client to be refused %s", id)
+		}
+	}
+	if err := ops.CheckSubscriptionOwner("tail-2", "client1"); err == nil {
+		t.Error("Expected an unknown subscription to be refused")
 	}
 }
@@ -0,0 +1,115 @@
+package file
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// ProgressFunc receives the number of bytes transferred so far and the expected total.
+// A total of 0 means the size of the transfer is not known in advance.
+type ProgressFunc func(transferred, total int64)
+
+// progress counts the bytes flowing through a transfer, reports them to a ProgressFunc
+// and aborts the transfer once its context is done
+type progress struct {
+	ctx   context.Context
+	fn    ProgressFunc
+	total int64
+	done  atomic.Int64
+
+	// current is the path of the file being written, so that a cancelled
+	// transfer can remove it instead of leaving a truncated copy behind
+	current string
+}
+
+// newProgress creates a progress tracker for a transfer of total bytes starting at offset
+func newProgress(ctx context.Context, fn ProgressFunc, offset, total int64) *progress {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	p := &progress{
+		ctx:   ctx,
+		fn:    fn,
+		total: total,
+	}
+	p.done.Store(offset)
+
+	return p
+}
+
+// add records n transferred bytes and reports the new position
+func (p *progress) add(n int) {
+	if n <= 0 {
+		return
+	}
+
+	done := p.done.Add(int64(n))
+	if p.fn != nil {
+		p.fn(done, p.total)
+	}
+}
+
+// Reader wraps r so that reads are counted and stop once the context is done
+func (p *progress) Reader(r io.Reader) io.Reader {
+	return &progressReader{r: r, p: p}
+}
+
+// Writer wraps w so that writes are counted and stop once the context is done
+func (p *progress) Writer(w io.Writer) io.Writer {
+	return &progressWriter{w: w, p: p}
+}
+
+// progressReader is an io.Reader that reports progress
+type progressReader struct {
+	r io.Reader
+	p *progress
+}
+
+func (pr *progressReader) Read(b []byte) (int, error) {
+	if err := pr.p.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	n, err := pr.r.Read(b)
+	pr.p.add(n)
+	return n, err
+}
+
+// progressWriter is an io.Writer that reports progress
+type progressWriter struct {
+	w io.Writer
+	p *progress
+}
+
+func (pw *progressWriter) Write(b []byte) (int, error) {
+	if err := pw.p.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	n, err := pw.w.Write(b)
+	pw.p.add(n)
+	return n, err
+}
+
+// localTreeSize returns the total size of the regular files below root
+func localTreeSize(root string) (int64, error) {
+	var total int64
+	err := filepath.Walk(root, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to size local directory: %v", err)
+	}
+	return total, nil
+}
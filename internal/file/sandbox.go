@@ -0,0 +1,208 @@
+package file
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+
+	"ssh-mcp/internal/security"
+	"ssh-mcp/internal/session"
+)
+
+// localPath checks a local path against the allowed local roots and returns it with
+// symlinks resolved. Without a security manager local paths are not restricted.
+func (o *Operations) localPath(sessionID, localPath string) (string, error) {
+	if o.securityManager == nil {
+		return localPath, nil
+	}
+	return o.securityManager.CheckLocalPath(sessionID, localPath)
+}
+
+// linkChecker returns a check for symlinks followed while walking a local tree, so that a
+// link inside an allowed root cannot pull in files from outside of it
+func (o *Operations) linkChecker(sessionID string) func(string) error {
+	return func(linkPath string) error {
+		_, err := o.localPath(sessionID, linkPath)
+		return err
+	}
+}
+
+// validEntryName verifies that a single file name received from the remote side names an
+// entry directly inside its directory
+func validEntryName(name string) error {
+	if name == "" || name == "." || name == ".." ||
+		strings.ContainsRune(name, '/') || strings.ContainsRune(name, filepath.Separator) {
+		return fmt.Errorf("refusing unsafe entry name %q", name)
+	}
+	return nil
+}
+
+// localChildPath joins a file name received from the remote side to a local directory.
+// It rejects names that leave the directory and existing symlinks, which would otherwise
+// redirect the write to wherever they point.
+func localChildPath(dir, name string) (string, error) {
+	if err := validEntryName(name); err != nil {
+		return "", err
+	}
+
+	localPath := filepath.Join(dir, name)
+	if info, err := os.Lstat(localPath); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return "", fmt.Errorf("refusing to write through symlink %s", localPath)
+	}
+
+	return localPath, nil
+}
+
+// localEntryPath resolves a slash-separated entry name, such as a tar entry or a relative
+// path from a remote listing, below dest. It rejects absolute names,
+// names escaping dest with .. and names whose parent directories are symlinks.
+func localEntryPath(dest, name string) (string, error) {
+	if path.IsAbs(name) || hasDotDot(name) {
+		return "", fmt.Errorf("refusing unsafe entry name %q", name)
+	}
+
+	rel := path.Clean(name)
+	if rel == "." {
+		return dest, nil
+	}
+
+	// Every parent must be a real directory, otherwise a link in the tree could
+	// redirect later entries outside of dest
+	parts := strings.Split(rel, "/")
+	current := dest
+	for _, part := range parts[:len(parts)-1] {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				break
+			}
+			return "", err
+		}
+		if !info.IsDir() {
+			return "", fmt.Errorf("refusing entry %q below non-directory %s", name, current)
+		}
+	}
+
+	return filepath.Join(dest, filepath.FromSlash(rel)), nil
+}
+
+// hasDotDot reports whether a slash-separated name contains a .. element
+func hasDotDot(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// remotePath makes a remote path absolute and clean and checks it against the remote path
+// rules for the session's host. Relative paths are resolved against the remote working
+// directory. Without remote path rules the path is returned unchanged.
+func (o *Operations) remotePath(sess *session.Session, remotePath string, access security.PathAccess) (string, error) {
+	return o.checkRemotePath(sess, remotePath, access, false)
+}
+
+// remoteTree is like remotePath for operations on the whole tree below remotePath
+func (o *Operations) remoteTree(sess *session.Session, remotePath string, access security.PathAccess) (string, error) {
+	return o.checkRemotePath(sess, remotePath, access, true)
+}
+
+// checkRemotePath implements remotePath and remoteTree. Both the path and the path with
+// symlinks resolved must pass, so a link inside an allowed directory cannot lead to a
+// denied one. The unresolved path is returned, as operations such as deleting a link
+// must act on the link itself.
+func (o *Operations) checkRemotePath(sess *session.Session, remotePath string, access security.PathAccess, tree bool) (string, error) {
+	if o.securityManager == nil || !o.securityManager.HasRemotePathRules() {
+		return remotePath, nil
+	}
+
+	remotePath = filepath.ToSlash(remotePath)
+	if !path.IsAbs(remotePath) {
+		wd, err := remoteOutput(sess, "pwd")
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve remote working directory: %v", err)
+		}
+		remotePath = path.Join(strings.TrimSpace(wd), remotePath)
+	}
+	remotePath = path.Clean(remotePath)
+
+	check := o.securityManager.CheckRemotePath
+	if tree {
+		check = o.securityManager.CheckRemoteTree
+	}
+	if err := check(sess.ID, sess.Host, remotePath, access); err != nil {
+		return "", err
+	}
+
+	var resolved string
+	err := o.sftpSession(sess, func(client *sftp.Client) error {
+		var err error
+		resolved, err = resolveRemoteLinks(client, remotePath)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve remote path %s: %v", remotePath, err)
+	}
+	if resolved != remotePath {
+		if err := check(sess.ID, sess.Host, resolved, access); err != nil {
+			return "", err
+		}
+	}
+	return remotePath, nil
+}
+
+// maxRemoteLinks is how many symlinks resolving a remote path follows before giving up
+const maxRemoteLinks = 40
+
+// resolveRemoteLinks resolves symlinks in every existing part of a clean absolute remote
+// path, like filepath.EvalSymlinks. The parts that do not exist yet cannot be links and
+// are appended as they are.
+func resolveRemoteLinks(client *sftp.Client, remotePath string) (string, error) {
+	resolved := "/"
+	rest := strings.Split(remotePath, "/")
+	links := 0
+	for len(rest) > 0 {
+		part := rest[0]
+		rest = rest[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		next := path.Join(resolved, part)
+		info, err := client.Lstat(next)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return path.Join(append([]string{next}, rest...)...), nil
+			}
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		if links++; links > maxRemoteLinks {
+			return "", errors.New("too many levels of symbolic links")
+		}
+		target, err := client.ReadLink(next)
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+	return resolved, nil
+}
@@ -0,0 +1,408 @@
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"ssh-mcp/internal/security"
+	"ssh-mcp/internal/session"
+)
+
+// Limits applied to searches, so that a broad pattern cannot flood the caller
+const (
+	defaultSearchResults = 100
+	maxSearchResults     = 1000
+	defaultSearchContext = 2
+	maxSearchContext     = 10
+	maxSearchLineLength  = 1000
+)
+
+// Search engines run on the remote host
+const (
+	SearchEngineRipgrep = "rg"
+	SearchEngineGrep    = "grep"
+)
+
+// SearchOptions describes a remote content search
+type SearchOptions struct {
+	Root       string   // Directory or file to search
+	Pattern    string   // Regular expression, in the dialect of rg or grep -E
+	Include    []string // Only search files matching these globs
+	Exclude    []string // Skip files matching these globs
+	MaxResults int      // Maximum number of matches to return (0 means the default)
+	Context    int      // Lines of context around each match (negative means the default)
+}
+
+// SearchMatch is a single matching line
+type SearchMatch struct {
+	File   string   `json:"file"`
+	Line   int      `json:"line"`
+	Column int      `json:"column,omitempty"` // 1-based byte column of the first match, if known
+	Text   string   `json:"text"`
+	Before []string `json:"before,omitempty"` // Context lines preceding the match
+	After  []string `json:"after,omitempty"`  // Context lines following the match
+}
+
+// SearchResult holds the matches of a search
+type SearchResult struct {
+	Root      string        `json:"root"`
+	Pattern   string        `json:"pattern"`
+	Engine    string        `json:"engine"`
+	Matches   []SearchMatch `json:"matches"`
+	Truncated bool          `json:"truncated"` // More matches exist than were returned
+}
+
+// Search looks for a regular expression in the files below a remote path. It uses rg
+// when the remote host has it and falls back to grep -rn otherwise. Output is read
+// only until MaxResults matches have been collected.
+func (o *Operations) Search(ctx context.Context, sessionID string, opts SearchOptions) (*SearchResult, error) {
+	sess, release, err := o.sessionManager.AcquireSession(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// Removing the session cancels the operation as well
+	ctx, cancel := sess.WithContext(ctx)
+	defer cancel()
+
+	if opts.Pattern == "" {
+		return nil, errors.New("search pattern must not be empty")
+	}
+	if opts.Root == "" {
+		opts.Root = "."
+	}
+	if opts.Root, err = o.remoteTree(sess, opts.Root, security.AccessRead); err != nil {
+		return nil, err
+	}
+
+	if opts.MaxResults <= 0 {
+		opts.MaxResults = defaultSearchResults
+	}
+	if opts.MaxResults > maxSearchResults {
+		opts.MaxResults = maxSearchResults
+	}
+	if opts.Context < 0 {
+		opts.Context = defaultSearchContext
+	}
+	if opts.Context > maxSearchContext {
+		opts.Context = maxSearchContext
+	}
+
+	engine := SearchEngineGrep
+	if _, err := remoteOutput(sess, "command -v rg"); err == nil {
+		engine = SearchEngineRipgrep
+	}
+
+	collector := &searchCollector{limit: opts.MaxResults, context: opts.Context}
+	var parse func(io.Reader) error
+	var cmd string
+	if engine == SearchEngineRipgrep {
+		cmd = ripgrepCommand(opts)
+		parse = func(r io.Reader) error { return parseRipgrepJSON(r, collector) }
+	} else {
+		cmd = grepCommand(opts)
+		// Column numbers are worked out locally, which only works if Go understands the pattern
+		re, _ := regexp.Compile(opts.Pattern)
+		parse = func(r io.Reader) error { return parseGrepOutput(r, re, collector) }
+	}
+
+	if err := runSearch(ctx, sess, cmd, parse, collector); err != nil {
+		return nil, err
+	}
+
+	return &SearchResult{
+		Root:      opts.Root,
+		Pattern:   opts.Pattern,
+		Engine:    engine,
+		Matches:   collector.result(),
+		Truncated: collector.truncated,
+	}, nil
+}
+
+// ripgrepCommand builds an rg invocation with JSON output. Hidden and ignored files are
+// searched as well, to behave like grep -r.
+func ripgrepCommand(opts SearchOptions) string {
+	args := []string{"rg", "--json", "--hidden", "--no-ignore", "--no-messages",
+		"--max-columns", strconv.Itoa(maxSearchLineLength), "--max-columns-preview",
+		"-C", strconv.Itoa(opts.Context)}
+	for _, glob := range opts.Include {
+		args = append(args, "-g", shellQuote(glob))
+	}
+	for _, glob := range opts.Exclude {
+		args = append(args, "-g", shellQuote("!"+glob))
+	}
+	args = append(args, "-e", shellQuote(opts.Pattern), "--", shellQuote(opts.Root))
+	return strings.Join(args, " ")
+}
+
+// grepCommand builds a grep invocation. -Z ends file names with a NUL byte, so that
+// names containing : or - cannot be confused with the line number separators.
+func grepCommand(opts SearchOptions) string {
+	args := []string{"grep", "-rnIEZ", "-s", "-C", strconv.Itoa(opts.Context)}
+	for _, glob := range opts.Include {
+		args = append(args, shellQuote("--include="+glob))
+	}
+	for _, glob := range opts.Exclude {
+		args = append(args, shellQuote("--exclude="+glob), shellQuote("--exclude-dir="+glob))
+	}
+	args = append(args, "-e", shellQuote(opts.Pattern), "--", shellQuote(opts.Root))
+	return strings.Join(args, " ")
+}
+
+// runSearch runs a search command and feeds its output to parse. The session is closed
+// as soon as enough matches have been collected, which stops the remote search.
+func runSearch(ctx context.Context, sess *session.Session, cmd string, parse func(io.Reader) error, collector *searchCollector) error {
+	sshSession, err := sess.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to create SSH session: %v", err)
+	}
+	defer sshSession.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		sshSession.Close()
+	})
+	defer stop()
+
+	stdout, err := sshSession.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to get stdout pipe: %v", err)
+	}
+	stderr := new(bytes.Buffer)
+	sshSession.Stderr = stderr
+
+	if err := sshSession.Start(cmd); err != nil {
+		return fmt.Errorf("failed to start search: %v", err)
+	}
+
+	err = parse(stdout)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return fmt.Errorf("search cancelled: %w", ctxErr)
+	}
+	if err != nil {
+		return err
+	}
+	if collector.truncated {
+		return nil
+	}
+
+	// Both rg and grep exit with status 1 when nothing matched
+	if err := sshSession.Wait(); err != nil {
+		var exitErr *ssh.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitStatus() == 1 {
+			return nil
+		}
+		if len(collector.matches) > 0 {
+			// Unreadable files make the search fail, but the matches found are still valid
+			return nil
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("search failed: %v, stderr: %s", err, msg)
+		}
+		return fmt.Errorf("search failed: %v", err)
+	}
+
+	return nil
+}
+
+// searchLine is a matching or context line reported by a search engine
+type searchLine struct {
+	file   string
+	line   int
+	column int
+	text   string
+	match  bool
+}
+
+// searchCollector turns the stream of matching and context lines into matches with context
+type searchCollector struct {
+	limit     int
+	context   int
+	matches   []SearchMatch
+	pending   []searchLine // Context lines that may precede the next match
+	truncated bool
+}
+
+// add records a line and reports whether the search can stop
+func (c *searchCollector) add(l searchLine) bool {
+	if len(l.text) > maxSearchLineLength {
+		l.text = l.text[:maxSearchLineLength] + "..."
+	}
+
+	var last *SearchMatch
+	if len(c.matches) > 0 {
+		last = &c.matches[len(c.matches)-1]
+	}
+	afterLast := last != nil && last.File == l.file && l.line > last.Line && l.line <= last.Line+c.context
+
+	if !l.match {
+		if afterLast {
+			last.After = append(last.After, l.text)
+		} else if len(c.matches) == c.limit {
+			// The trailing context of the last match is complete
+			return true
+		}
+
+		c.pending = append(c.pending, l)
+		if len(c.pending) > c.context {
+			c.pending = c.pending[len(c.pending)-c.context:]
+		}
+		return false
+	}
+
+	if len(c.matches) == c.limit {
+		c.truncated = true
+		return true
+	}
+
+	m := SearchMatch{File: l.file, Line: l.line, Column: l.column, Text: l.text}
+	for _, p := range c.pending {
+		if p.file == l.file && p.line < l.line && p.line >= l.line-c.context {
+			m.Before = append(m.Before, p.text)
+		}
+	}
+	c.pending = nil
+	c.matches = append(c.matches, m)
+
+	return false
+}
+
+// result returns the collected matches, never nil so that it encodes as an empty list
+func (c *searchCollector) result() []SearchMatch {
+	if c.matches == nil {
+		return []SearchMatch{}
+	}
+	return c.matches
+}
+
+// ripgrepEvent is the part of an rg --json message this package uses
+type ripgrepEvent struct {
+	Type string `json:"type"`
+	Data struct {
+		Path       ripgrepText `json:"path"`
+		Lines      ripgrepText `json:"lines"`
+		LineNumber int         `json:"line_number"`
+		Submatches []struct {
+			Start int `json:"start"`
+		} `json:"submatches"`
+	} `json:"data"`
+}
+
+// ripgrepText is arbitrary data in rg --json output, given as text or, if it is not
+// valid UTF-8, as base64 encoded bytes
+type ripgrepText struct {
+	Text  string `json:"text"`
+	Bytes string `json:"bytes"`
+}
+
+// String returns the data as a string
+func (t ripgrepText) String() string {
+	if t.Bytes != "" {
+		if b, err := base64.StdEncoding.DecodeString(t.Bytes); err == nil {
+			return string(b)
+		}
+	}
+	return t.Text
+}
+
+// parseRipgrepJSON reads rg --json output into a collector
+func parseRipgrepJSON(r io.Reader, c *searchCollector) error {
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var event ripgrepEvent
+			if jsonErr := json.Unmarshal(line, &event); jsonErr != nil {
+				return fmt.Errorf("failed to parse rg output: %v", jsonErr)
+			}
+
+			if event.Type == "match" || event.Type == "context" {
+				l := searchLine{
+					file:  event.Data.Path.String(),
+					line:  event.Data.LineNumber,
+					text:  strings.TrimRight(event.Data.Lines.String(), "\r\n"),
+					match: event.Type == "match",
+				}
+				if l.match && len(event.Data.Submatches) > 0 {
+					l.column = event.Data.Submatches[0].Start + 1
+				}
+				if c.add(l) {
+					return nil
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// parseGrepOutput reads grep -nZ output into a collector. Matching lines look like
+// "file\x00<line>:<text>" and context lines like "file\x00<line>-<text>". If re is
+// not nil it is used to find the column of the match.
+func parseGrepOutput(r io.Reader, re *regexp.Regexp, c *searchCollector) error {
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			if l, ok := parseGrepLine(strings.TrimRight(line, "\r\n")); ok {
+				if l.match && re != nil {
+					if loc := re.FindStringIndex(l.text); loc != nil {
+						l.column = loc[0] + 1
+					}
+				}
+				if c.add(l) {
+					return nil
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// parseGrepLine parses a single line of grep -nZ output; group separators are skipped
+func parseGrepLine(line string) (searchLine, bool) {
+	file, rest, ok := strings.Cut(line, "\x00")
+	if !ok {
+		return searchLine{}, false
+	}
+
+	end := 0
+	for end < len(rest) && rest[end] >= '0' && rest[end] <= '9' {
+		end++
+	}
+	if end == 0 || end == len(rest) || (rest[end] != ':' && rest[end] != '-') {
+		return searchLine{}, false
+	}
+
+	number, err := strconv.Atoi(rest[:end])
+	if err != nil {
+		return searchLine{}, false
+	}
+
+	return searchLine{
+		file:  file,
+		line:  number,
+		text:  rest[end+1:],
+		match: rest[end] == ':',
+	}, true
+}
@@ -0,0 +1,628 @@
+package file
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+
+	"ssh-mcp/internal/security"
+	"ssh-mcp/internal/session"
+)
+
+// SyncOptions controls a delta directory synchronisation
+type SyncOptions struct {
+	LocalDir  string       // Local directory
+	RemoteDir string       // Remote directory
+	Direction string       // upload (local to remote) or download (remote to local)
+	Delete    bool         // Delete destination files that do not exist in the source
+	Exclude   []string     // .gitignore-style patterns of paths to leave alone
+	DryRun    bool         // Only report what would change
+	Compare   string       // How to detect changes: mtime (size and mtime, default) or checksum
+	Backup    bool         // Save the remote directory before an upload in the session's change journal
+	Progress  ProgressFunc // Receives progress updates, may be nil
+}
+
+// SyncResult summarises a directory synchronisation
+type SyncResult struct {
+	Added       []string `json:"added"`
+	Updated     []string `json:"updated"`
+	Deleted     []string `json:"deleted"`
+	Conflicts   []string `json:"conflicts"` // Paths that are a file on one side and a directory on the other, left alone without delete
+	Unchanged   int      `json:"unchanged"`
+	Transferred int64    `json:"transferred"` // Bytes sent (or that would be sent in a dry run)
+	DryRun      bool     `json:"dryRun"`
+}
+
+// syncEntry is the state of one path on either side of a sync
+type syncEntry struct {
+	size    int64
+	modTime time.Time
+	mode    os.FileMode
+	isDir   bool
+}
+
+// syncPlan lists the changes needed to make the destination match the source
+type syncPlan struct {
+	dirs      []string // Directories to create
+	add       []string // Files missing from the destination
+	update    []string // Files that differ on the destination
+	remove    []string // Destination paths not in the source
+	conflicts []string // Paths whose type differs on both sides, only replaced with delete
+	unchanged int
+}
+
+// Sync makes the destination directory match the source, transferring only changed files
+func (o *Operations) Sync(ctx context.Context, sessionID string, opts SyncOptions) (*SyncResult, error) {
+	sess, release, err := o.sessionManager.AcquireSession(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// Removing the session cancels the operation as well
+	ctx, cancel := sess.WithContext(ctx)
+	defer cancel()
+
+	if opts.Direction != "upload" && opts.Direction != "download" {
+		return nil, fmt.Errorf("invalid direction %q, expected upload or download", opts.Direction)
+	}
+	if opts.Compare == "" {
+		opts.Compare = "mtime"
+	}
+	if opts.Compare != "mtime" && opts.Compare != "checksum" {
+		return nil, fmt.Errorf("invalid compare mode %q, expected mtime or checksum", opts.Compare)
+	}
+
+	excludes, err := newExcludeMatcher(opts.Exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.LocalDir, err = o.localPath(sessionID, opts.LocalDir); err != nil {
+		return nil, err
+	}
+	opts.RemoteDir = filepath.ToSlash(opts.RemoteDir)
+
+	// Uploads write the remote tree and may delete from it, downloads only read it
+	access := []security.PathAccess{security.AccessRead}
+	if opts.Direction == "upload" {
+		access = []security.PathAccess{security.AccessWrite}
+		if opts.Delete {
+			access = append(access, security.AccessDelete)
+		}
+	}
+	for _, a := range access {
+		if opts.RemoteDir, err = o.remoteTree(sess, opts.RemoteDir, a); err != nil {
+			return nil, err
+		}
+	}
+
+	change, err := o.snapshot(sess, sessionID, "sync_directory", opts.RemoteDir, opts.Backup && opts.Direction == "upload" && !opts.DryRun)
+	if err != nil {
+		return nil, err
+	}
+
+	var result *SyncResult
+	err = o.sftpSession(sess, func(client *sftp.Client) error {
+		result, err = syncTrees(ctx, client, sess, opts, excludes)
+		return err
+	})
+	o.finishChange(sessionID, change, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// syncTrees lists both sides, plans the changes and applies them unless this is a dry run
+func syncTrees(ctx context.Context, client *sftp.Client, sess *session.Session, opts SyncOptions, excludes *excludeMatcher) (*SyncResult, error) {
+	localTree, err := listLocalTree(opts.LocalDir, excludes)
+	if err != nil {
+		return nil, err
+	}
+	remoteTree, err := listRemoteTree(client, opts.RemoteDir, excludes)
+	if err != nil {
+		return nil, err
+	}
+
+	src, dst := localTree, remoteTree
+	if opts.Direction == "download" {
+		src, dst = remoteTree, localTree
+	}
+
+	same := sameByModTime
+	if opts.Compare == "checksum" {
+		same, err = checksumComparer(sess, opts, src, dst)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	plan := planSync(src, dst, opts.Delete, same)
+
+	result := &SyncResult{
+		Added:     plan.add,
+		Updated:   plan.update,
+		Deleted:   plan.remove,
+		Conflicts: plan.conflicts,
+		Unchanged: plan.unchanged,
+		DryRun:    opts.DryRun,
+	}
+	for _, rel := range append(append([]string{}, plan.add...), plan.update...) {
+		result.Transferred += src[rel].size
+	}
+
+	if opts.DryRun {
+		return result, nil
+	}
+
+	p := newProgress(ctx, opts.Progress, 0, result.Transferred)
+	if opts.Direction == "upload" {
+		err = applyUpload(client, opts.LocalDir, opts.RemoteDir, plan, src, dst, p)
+	} else {
+		err = applyDownload(client, opts.RemoteDir, opts.LocalDir, plan, src, dst, p)
+	}
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, fmt.Errorf("sync cancelled: %w", ctxErr)
+		}
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// sameByModTime treats files with equal size and modification second as unchanged
+func sameByModTime(_ string, s, d syncEntry) bool {
+	return s.size == d.size && s.modTime.Unix() == d.modTime.Unix()
+}
+
+// checksumComparer hashes every file that exists on both sides with the same size
+// and returns a comparer that treats files with equal hashes as unchanged
+func checksumComparer(sess *session.Session, opts SyncOptions, src, dst map[string]syncEntry) (func(string, syncEntry, syncEntry) bool, error) {
+	candidates := make([]string, 0)
+	for rel, s := range src {
+		if d, ok := dst[rel]; ok && !s.isDir && !d.isDir && s.size == d.size {
+			candidates = append(candidates, rel)
+		}
+	}
+	sort.Strings(candidates)
+
+	remoteSums, err := remoteChecksums(sess, opts.RemoteDir, candidates)
+	if err != nil {
+		return nil, err
+	}
+
+	localSums := make(map[string]string, len(candidates))
+	for _, rel := range candidates {
+		sum, err := localSHA256(filepath.Join(opts.LocalDir, filepath.FromSlash(rel)))
+		if err != nil {
+			return nil, err
+		}
+		localSums[rel] = sum
+	}
+
+	return func(rel string, s, d syncEntry) bool {
+		if s.size != d.size {
+			return false
+		}
+		local, ok := localSums[rel]
+		return ok && local == remoteSums[rel]
+	}, nil
+}
+
+// planSync compares source and destination trees. Replacing a file with a directory or
+// the other way round deletes the destination path, so without deleteExtraneous such
+// paths and everything below them are reported as conflicts instead.
+func planSync(src, dst map[string]syncEntry, deleteExtraneous bool, same func(string, syncEntry, syncEntry) bool) syncPlan {
+	plan := syncPlan{
+		dirs:      []string{},
+		add:       []string{},
+		update:    []string{},
+		remove:    []string{},
+		conflicts: []string{},
+	}
+
+	conflicting := make(map[string]bool)
+	if !deleteExtraneous {
+		for rel, s := range src {
+			if d, exists := dst[rel]; exists && d.isDir != s.isDir {
+				conflicting[rel] = true
+				plan.conflicts = append(plan.conflicts, rel)
+			}
+		}
+	}
+
+	for rel, s := range src {
+		if belowConflict(rel, conflicting) {
+			continue
+		}
+
+		d, exists := dst[rel]
+		switch {
+		case s.isDir:
+			if !exists || !d.isDir {
+				plan.dirs = append(plan.dirs, rel)
+			} else {
+				plan.unchanged++
+			}
+			if exists && !d.isDir {
+				// A file is in the way of a directory
+				plan.remove = append(plan.remove, rel)
+			}
+		case !exists:
+			plan.add = append(plan.add, rel)
+		case d.isDir || !same(rel, s, d):
+			plan.update = append(plan.update, rel)
+		default:
+			plan.unchanged++
+		}
+	}
+
+	if deleteExtraneous {
+		for rel := range dst {
+			if _, exists := src[rel]; !exists {
+				plan.remove = append(plan.remove, rel)
+			}
+		}
+	}
+
+	sort.Strings(plan.dirs)
+	sort.Strings(plan.add)
+	sort.Strings(plan.update)
+	sort.Strings(plan.conflicts)
+
+	// Remove the deepest paths first so that directories are empty when their turn comes
+	sort.Slice(plan.remove, func(i, j int) bool {
+		di, dj := strings.Count(plan.remove[i], "/"), strings.Count(plan.remove[j], "/")
+		if di != dj {
+			return di > dj
+		}
+		return plan.remove[i] < plan.remove[j]
+	})
+
+	return plan
+}
+
+// belowConflict reports whether rel or one of its parents is in conflicting
+func belowConflict(rel string, conflicting map[string]bool) bool {
+	for p := rel; p != "." && p != "/"; p = path.Dir(p) {
+		if conflicting[p] {
+			return true
+		}
+	}
+	return false
+}
+
+// listLocalTree collects the directories and regular files below root, keyed by slash-separated relative path
+func listLocalTree(root string, excludes *excludeMatcher) (map[string]syncEntry, error) {
+	tree := make(map[string]syncEntry)
+
+	if _, err := os.Stat(root); errors.Is(err, os.ErrNotExist) {
+		return tree, nil
+	}
+
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == root {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if excludes.Match(rel, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// Only directories and regular files are synchronised
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		tree[rel] = syncEntry{
+			size:    info.Size(),
+			modTime: info.ModTime(),
+			mode:    info.Mode(),
+			isDir:   d.IsDir(),
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan local directory: %v", err)
+	}
+
+	return tree, nil
+}
+
+// listRemoteTree collects the directories and regular files below root over SFTP
+func listRemoteTree(client *sftp.Client, root string, excludes *excludeMatcher) (map[string]syncEntry, error) {
+	tree := make(map[string]syncEntry)
+
+	if _, err := client.Stat(root); errors.Is(err, os.ErrNotExist) {
+		return tree, nil
+	}
+
+	walker := client.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return nil, fmt.Errorf("failed to scan remote directory: %v", err)
+		}
+
+		p := walker.Path()
+		if p == root {
+			continue
+		}
+
+		rel := strings.TrimPrefix(strings.TrimPrefix(p, root), "/")
+		info := walker.Stat()
+
+		if excludes.Match(rel, info.IsDir()) {
+			if info.IsDir() {
+				walker.SkipDir()
+			}
+			continue
+		}
+
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			continue
+		}
+
+		tree[rel] = syncEntry{
+			size:    info.Size(),
+			modTime: info.ModTime(),
+			mode:    info.Mode(),
+			isDir:   info.IsDir(),
+		}
+	}
+
+	return tree, nil
+}
+
+// applyUpload carries out a sync plan from a local to a remote directory
+func applyUpload(client *sftp.Client, localRoot, remoteRoot string, plan syncPlan, src, dst map[string]syncEntry, p *progress) error {
+	for _, rel := range plan.remove {
+		if err := removeRemote(client, path.Join(remoteRoot, rel), dst[rel].isDir); err != nil {
+			return err
+		}
+	}
+
+	if err := client.MkdirAll(remoteRoot); err != nil {
+		return fmt.Errorf("failed to create remote directory: %v", err)
+	}
+	for _, rel := range plan.dirs {
+		if err := client.MkdirAll(path.Join(remoteRoot, rel)); err != nil {
+			return fmt.Errorf("failed to create remote directory %s: %v", rel, err)
+		}
+	}
+
+	for _, rel := range append(append([]string{}, plan.add...), plan.update...) {
+		remotePath := path.Join(remoteRoot, rel)
+		// Only planned with delete, which requires delete access to the whole tree
+		if d, ok := dst[rel]; ok && d.isDir {
+			if err := client.RemoveAll(remotePath); err != nil {
+				return fmt.Errorf("failed to remove remote directory %s: %v", rel, err)
+			}
+		}
+
+		if err := uploadSyncFile(client, filepath.Join(localRoot, filepath.FromSlash(rel)), remotePath, src[rel], p); err != nil {
+			return fmt.Errorf("failed to upload %s: %v", rel, err)
+		}
+	}
+
+	return nil
+}
+
+// applyDownload carries out a sync plan from a remote to a local directory
+func applyDownload(client *sftp.Client, remoteRoot, localRoot string, plan syncPlan, src, dst map[string]syncEntry, p *progress) error {
+	for _, rel := range plan.remove {
+		localPath := filepath.Join(localRoot, filepath.FromSlash(rel))
+		if err := os.Remove(localPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			if dst[rel].isDir {
+				// Directories holding excluded files are left in place
+				log.Printf("[DEBUG] Sync: keeping directory %s: %v", localPath, err)
+				continue
+			}
+			return fmt.Errorf("failed to delete %s: %v", rel, err)
+		}
+	}
+
+	if err := os.MkdirAll(localRoot, 0755); err != nil {
+		return fmt.Errorf("failed to create local directory: %v", err)
+	}
+	for _, rel := range plan.dirs {
+		// Remote names must not lead outside of localRoot, directly or through a local symlink
+		localPath, err := localEntryPath(localRoot, rel)
+		if err != nil {
+			return err
+		}
+		if info, err := os.Lstat(localPath); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("refusing to write through symlink %s", localPath)
+		}
+		if err := os.MkdirAll(localPath, 0755); err != nil {
+			return fmt.Errorf("failed to create local directory %s: %v", rel, err)
+		}
+	}
+
+	for _, rel := range append(append([]string{}, plan.add...), plan.update...) {
+		localPath, err := localEntryPath(localRoot, rel)
+		if err != nil {
+			return err
+		}
+		if d, ok := dst[rel]; ok && d.isDir {
+			if err := os.RemoveAll(localPath); err != nil {
+				return fmt.Errorf("failed to remove local directory %s: %v", rel, err)
+			}
+		}
+
+		if err := downloadSyncFile(client, path.Join(remoteRoot, rel), localPath, src[rel], p); err != nil {
+			return fmt.Errorf("failed to download %s: %v", rel, err)
+		}
+	}
+
+	return nil
+}
+
+// removeRemote deletes a remote file or empty directory
+func removeRemote(client *sftp.Client, remotePath string, isDir bool) error {
+	if !isDir {
+		if err := client.Remove(remotePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to delete %s: %v", remotePath, err)
+		}
+		return nil
+	}
+
+	if err := client.RemoveDirectory(remotePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		// Directories holding excluded files are left in place
+		log.Printf("[DEBUG] Sync: keeping directory %s: %v", remotePath, err)
+	}
+	return nil
+}
+
+// uploadSyncFile writes one file through a partial remote file and carries over its mode and mtime
+func uploadSyncFile(client *sftp.Client, localPath, remotePath string, entry syncEntry, p *progress) error {
+	localFile, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer localFile.Close()
+
+	partialPath := remotePartialPath(remotePath)
+	remoteFile, err := client.OpenFile(partialPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+
+	_, err = remoteFile.ReadFrom(p.Reader(localFile))
+	if closeErr := remoteFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		client.Remove(partialPath)
+		return err
+	}
+
+	if err := client.Chmod(partialPath, entry.mode.Perm()); err != nil {
+		return err
+	}
+	// The mtime is what the next sync compares against
+	if err := client.Chtimes(partialPath, entry.modTime, entry.modTime); err != nil {
+		return err
+	}
+
+	return renameRemote(client, partialPath, remotePath)
+}
+
+// downloadSyncFile writes one file through a partial local file and carries over its mode and mtime
+func downloadSyncFile(client *sftp.Client, remotePath, localPath string, entry syncEntry, p *progress) error {
+	remoteFile, err := client.Open(remotePath)
+	if err != nil {
+		return err
+	}
+	defer remoteFile.Close()
+
+	partialPath := localPartialPath(localPath)
+	localFile, err := os.OpenFile(partialPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, entry.mode.Perm())
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(p.Writer(localFile), remoteFile)
+	if closeErr := localFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(partialPath)
+		return err
+	}
+
+	if err := os.Chmod(partialPath, entry.mode.Perm()); err != nil {
+		return err
+	}
+	// The mtime is what the next sync compares against
+	if err := os.Chtimes(partialPath, entry.modTime, entry.modTime); err != nil {
+		return err
+	}
+
+	return os.Rename(partialPath, localPath)
+}
+
+// remoteChecksums runs sha256sum on the remote host for paths relative to root.
+// Paths are hashed in batches to stay below the remote argument length limit.
+func remoteChecksums(sess *session.Session, root string, relPaths []string) (map[string]string, error) {
+	const batchSize = 64
+
+	sums := make(map[string]string, len(relPaths))
+	for start := 0; start < len(relPaths); start += batchSize {
+		end := start + batchSize
+		if end > len(relPaths) {
+			end = len(relPaths)
+		}
+
+		args := make([]string, 0, end-start)
+		for _, rel := range relPaths[start:end] {
+			args = append(args, shellQuote("./"+rel))
+		}
+
+		output, err := remoteOutput(sess, "cd "+shellQuote(root)+" && sha256sum -- "+strings.Join(args, " "))
+		if err != nil {
+			return nil, fmt.Errorf("failed to compute remote checksums: %v", err)
+		}
+
+		for rel, sum := range parseChecksumList(output) {
+			sums[strings.TrimPrefix(rel, "./")] = sum
+		}
+	}
+
+	return sums, nil
+}
+
+// parseChecksumList parses multi-line sha256sum output into a map of path to checksum.
+// Lines for names containing a backslash or newline start with a backslash and have those
+// characters escaped.
+func parseChecksumList(output string) map[string]string {
+	sums := make(map[string]string)
+
+	for _, line := range strings.Split(output, "\n") {
+		escaped := strings.HasPrefix(line, "\\")
+		line = strings.TrimPrefix(line, "\\")
+
+		// <64 hex digits><space><space or *><name>
+		if len(line) < 67 || line[64] != ' ' {
+			continue
+		}
+		sum := strings.ToLower(line[:64])
+		name := line[66:]
+		if escaped {
+			name = strings.NewReplacer(`\\`, `\`, `\n`, "\n").Replace(name)
+		}
+
+		sums[name] = sum
+	}
+
+	return sums
+}
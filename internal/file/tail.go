@@ -0,0 +1,401 @@
+package file
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"ssh-mcp/internal/security"
+)
+
+// Limits for tailing remote files
+const (
+	defaultTailLines  = 50
+	maxTailLines      = 5000
+	tailBufferLines   = 1000                   // Lines a follow subscription keeps for polling
+	tailFlushInterval = 500 * time.Millisecond // Minimum time between two notifications
+	tailFinishedTTL   = 10 * time.Minute       // How long an ended subscription is kept for reading
+)
+
+// TailOptions describes which lines of a remote file to return
+type TailOptions struct {
+	Path   string // Remote file to read
+	Lines  int    // Number of lines from the end of the file (0 means the default)
+	Filter string // Regular expression lines must match, may be empty
+}
+
+// TailLine is a line of a followed file with the cursor that identifies it
+type TailLine struct {
+	Cursor int64  `json:"cursor"`
+	Text   string `json:"text"`
+}
+
+// TailResult holds the lines returned by a one-shot tail
+type TailResult struct {
+	Path  string   `json:"path"`
+	Lines []string `json:"lines"`
+}
+
+// TailRead holds the lines of a follow subscription after a cursor
+type TailRead struct {
+	SubscriptionID string     `json:"subscriptionId"`
+	Lines          []TailLine `json:"lines"`
+	Cursor         int64      `json:"cursor"`            // Cursor to pass to the next read
+	Dropped        int64      `json:"dropped,omitempty"` // Lines that left the buffer before they were read
+	Closed         bool       `json:"closed"`            // The subscription has ended and no more lines will arrive
+	Error          string     `json:"error,omitempty"`   // Why the subscription ended, if it failed
+}
+
+// tailSubscription follows a remote file with tail -F
+type tailSubscription struct {
+	id     string
+	owner  string // MCP client session that owns the SSH session
+	filter *regexp.Regexp
+	notify func(string, []TailLine)
+	stop   func()
+
+	mu     sync.Mutex
+	lines  []TailLine // The most recent lines, oldest first
+	cursor int64      // Cursor of the most recent line
+	closed bool
+	err    error
+}
+
+// Tail returns the last lines of a remote file, keeping only those matching the filter
+func (o *Operations) Tail(sessionID string, opts TailOptions) (*TailResult, error) {
+	sess, release, err := o.sessionManager.AcquireSession(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	filter, lines, err := normalizeTailOptions(&opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Path, err = o.remotePath(sess, opts.Path, security.AccessRead); err != nil {
+		return nil, err
+	}
+
+	output, err := remoteOutput(sess, fmt.Sprintf("tail -n %d -- %s", lines, shellQuote(opts.Path)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", opts.Path, err)
+	}
+
+	result := &TailResult{Path: opts.Path, Lines: []string{}}
+	if output == "" {
+		return result, nil
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(output, "\n"), "\n") {
+		if filter == nil || filter.MatchString(line) {
+			result.Lines = append(result.Lines, line)
+		}
+	}
+
+	return result, nil
+}
+
+// Follow starts following a remote file like tail -F, so that rotated or recreated files
+// keep being followed. Lines are buffered for ReadTail and, if notify is not nil, passed
+// to it in batches. The subscription ends when it is stopped or the SSH session closes,
+// and is forgotten once its lines have been read or tailFinishedTTL later.
+func (o *Operations) Follow(sessionID string, opts TailOptions, notify func(subscriptionID string, lines []TailLine)) (*TailRead, error) {
+	sess, release, err := o.sessionManager.AcquireSession(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	filter, lines, err := normalizeTailOptions(&opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Path, err = o.remotePath(sess, opts.Path, security.AccessRead); err != nil {
+		return nil, err
+	}
+
+	id, err := newSubscriptionID("tail")
+	if err != nil {
+		return nil, err
+	}
+
+	sshSession, err := sess.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SSH session: %v", err)
+	}
+	stdout, err := sshSession.StdoutPipe()
+	if err != nil {
+		sshSession.Close()
+		return nil, fmt.Errorf("failed to get stdout pipe: %v", err)
+	}
+	if err := sshSession.Start(fmt.Sprintf("tail -F -n %d -- %s", lines, shellQuote(opts.Path))); err != nil {
+		sshSession.Close()
+		return nil, fmt.Errorf("failed to start tail: %v", err)
+	}
+
+	sub := &tailSubscription{
+		id:     id,
+		owner:  sess.Owner,
+		filter: filter,
+		notify: notify,
+		stop:   func() { sshSession.Close() },
+	}
+
+	o.mu.Lock()
+	o.tails[id] = sub
+	o.mu.Unlock()
+
+	// The subscription outlives the hold on the session, so removing the session stops it
+	unwatch := context.AfterFunc(sess.Context(), sub.stop)
+
+	go func() {
+		sub.run(stdout)
+		if err := sshSession.Wait(); err != nil {
+			log.Printf("[DEBUG] tail: %s on %s ended: %v", opts.Path, sessionID, err)
+		}
+		sshSession.Close()
+		unwatch()
+		time.AfterFunc(tailFinishedTTL, func() { o.forgetTail(sub) })
+	}()
+
+	return &TailRead{SubscriptionID: id, Lines: []TailLine{}}, nil
+}
+
+// ReadTail returns the buffered lines of a follow subscription after cursor, at most max
+func (o *Operations) ReadTail(subscriptionID string, cursor int64, max int) (*TailRead, error) {
+	sub, err := o.tailSubscription(subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+
+	read := sub.read(cursor, max)
+
+	// A closed subscription is forgotten once the caller has seen all of its lines
+	if read.Closed && read.Cursor == sub.lastCursor() {
+		o.mu.Lock()
+		delete(o.tails, subscriptionID)
+		o.mu.Unlock()
+	}
+
+	return read, nil
+}
+
+// StopTail ends a follow subscription
+func (o *Operations) StopTail(subscriptionID string) error {
+	o.mu.Lock()
+	sub, ok := o.tails[subscriptionID]
+	delete(o.tails, subscriptionID)
+	o.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("tail subscription not found: %s", subscriptionID)
+	}
+
+	sub.stop()
+	return nil
+}
+
+// CheckSubscriptionOwner verifies that a tail or watch subscription was started on a
+// session of an MCP client session. Subscriptions of other clients are reported as not
+// found, like their sessions.
+func (o *Operations) CheckSubscriptionOwner(subscriptionID, owner string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if sub, ok := o.tails[subscriptionID]; ok && sub.owner == owner {
+		return nil
+	}
+	if sub, ok := o.watches[subscriptionID]; ok && sub.owner == owner {
+		return nil
+	}
+	return fmt.Errorf("subscription not found: %s", subscriptionID)
+}
+
+// forgetTail removes an ended subscription that was not read to the end
+func (o *Operations) forgetTail(sub *tailSubscription) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.tails[sub.id] == sub {
+		delete(o.tails, sub.id)
+	}
+}
+
+// tailSubscription looks up a follow subscription
+func (o *Operations) tailSubscription(subscriptionID string) (*tailSubscription, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	sub, ok := o.tails[subscriptionID]
+	if !ok {
+		return nil, fmt.Errorf("tail subscription not found: %s", subscriptionID)
+	}
+	return sub, nil
+}
+
+// normalizeTailOptions applies defaults and compiles the filter
+func normalizeTailOptions(opts *TailOptions) (*regexp.Regexp, int, error) {
+	if opts.Path == "" {
+		return nil, 0, errors.New("path must not be empty")
+	}
+
+	lines := opts.Lines
+	if lines <= 0 {
+		lines = defaultTailLines
+	}
+	if lines > maxTailLines {
+		lines = maxTailLines
+	}
+
+	if opts.Filter == "" {
+		return nil, lines, nil
+	}
+	filter, err := regexp.Compile(opts.Filter)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid filter: %v", err)
+	}
+	return filter, lines, nil
+}
+
+// run reads lines from the remote tail until it ends, batching notifications
+func (s *tailSubscription) run(r io.Reader) {
+	lines, readErr := streamLines(r)
+
+	ticker := time.NewTicker(tailFlushInterval)
+	defer ticker.Stop()
+
+	var pending []TailLine
+	flush := func() {
+		if len(pending) > 0 && s.notify != nil {
+			s.notify(s.id, pending)
+		}
+		pending = nil
+	}
+
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				flush()
+				s.close(<-readErr)
+				return
+			}
+			if s.filter != nil && !s.filter.MatchString(line) {
+				continue
+			}
+			pending = append(pending, s.append(line))
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// streamLines sends the lines read from r without line endings. The line channel is
+// closed when r ends, after the read error, if any, has been sent.
+func streamLines(r io.Reader) (<-chan string, <-chan error) {
+	lines := make(chan string)
+	readErr := make(chan error, 1)
+	go func() {
+		reader := bufio.NewReader(r)
+		for {
+			line, err := reader.ReadString('\n')
+			if line != "" {
+				lines <- strings.TrimRight(line, "\r\n")
+			}
+			if err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				readErr <- err
+				close(lines)
+				return
+			}
+		}
+	}()
+	return lines, readErr
+}
+
+// append buffers a line and returns it with its cursor
+func (s *tailSubscription) append(text string) TailLine {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cursor++
+	line := TailLine{Cursor: s.cursor, Text: text}
+	s.lines = append(s.lines, line)
+	if len(s.lines) > tailBufferLines {
+		s.lines = s.lines[len(s.lines)-tailBufferLines:]
+	}
+	return line
+}
+
+// close marks the subscription as ended
+func (s *tailSubscription) close(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	s.err = err
+}
+
+// lastCursor returns the cursor of the most recent line
+func (s *tailSubscription) lastCursor() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.cursor
+}
+
+// read returns the buffered lines after cursor, at most max if max is positive
+func (s *tailSubscription) read(cursor int64, max int) *TailRead {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	read := &TailRead{
+		SubscriptionID: s.id,
+		Lines:          []TailLine{},
+		Cursor:         cursor,
+		Closed:         s.closed,
+	}
+	if s.err != nil {
+		read.Error = s.err.Error()
+	}
+
+	for _, line := range s.lines {
+		if line.Cursor <= cursor {
+			continue
+		}
+		if max > 0 && len(read.Lines) == max {
+			break
+		}
+		if len(read.Lines) == 0 && line.Cursor > cursor+1 {
+			read.Dropped = line.Cursor - cursor - 1
+		}
+		read.Lines = append(read.Lines, line)
+		read.Cursor = line.Cursor
+	}
+	if len(s.lines) == 0 && s.cursor > cursor {
+		read.Dropped = s.cursor - cursor
+		read.Cursor = s.cursor
+	}
+
+	return read
+}
+
+// newSubscriptionID returns a random identifier with a readable prefix
+func newSubscriptionID(prefix string) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate subscription ID: %v", err)
+	}
+	return prefix + "-" + hex.EncodeToString(b), nil
+}
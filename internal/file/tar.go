@@ -0,0 +1,540 @@
+package file
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"ssh-mcp/internal/session"
+)
+
+// Directory transfer modes
+const (
+	ModeSCP = "scp" // One file at a time over the SCP protocol
+	ModeTar = "tar" // A single tar stream piped through the remote tar
+)
+
+// Compression formats for tar mode transfers
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionNone = "none"
+)
+
+// normalizeTransferMode validates a transfer mode and compression, applying defaults
+func normalizeTransferMode(mode, compression string) (string, string, error) {
+	switch mode {
+	case "":
+		mode = ModeSCP
+	case ModeSCP, ModeTar:
+	default:
+		return "", "", fmt.Errorf("invalid transfer mode %q, expected scp or tar", mode)
+	}
+
+	switch compression {
+	case "":
+		compression = CompressionGzip
+	case CompressionGzip, CompressionZstd, CompressionNone:
+	default:
+		return "", "", fmt.Errorf("invalid compression %q, expected gzip, zstd or none", compression)
+	}
+
+	return mode, compression, nil
+}
+
+// remoteTarCompression checks which of tar, gzip and zstd the remote host provides and
+// returns the compression to use. A missing compressor degrades to the next best one;
+// ok is false when there is no remote tar at all.
+func remoteTarCompression(sess *session.Session, compression string) (string, bool) {
+	output, err := remoteOutput(sess, "for c in tar gzip zstd; do command -v $c >/dev/null 2>&1 && echo $c; done")
+	if err != nil {
+		log.Printf("[DEBUG] tar: failed to probe remote tools: %v", err)
+		return "", false
+	}
+
+	return pickTarCompression(strings.Fields(output), compression)
+}
+
+// pickTarCompression chooses a compression from the tools available on the remote host
+func pickTarCompression(tools []string, compression string) (string, bool) {
+	available := make(map[string]bool, len(tools))
+	for _, tool := range tools {
+		available[tool] = true
+	}
+
+	if !available["tar"] {
+		return "", false
+	}
+	if compression == CompressionZstd && !available["zstd"] {
+		compression = CompressionGzip
+	}
+	if compression == CompressionGzip && !available["gzip"] {
+		compression = CompressionNone
+	}
+
+	return compression, true
+}
+
+// remoteCompressCommand returns the shell pipeline stage that compresses stdout on the remote
+func remoteCompressCommand(compression string) string {
+	switch compression {
+	case CompressionGzip:
+		return " | gzip -c"
+	case CompressionZstd:
+		return " | zstd -q -c"
+	default:
+		return ""
+	}
+}
+
+// remoteDecompressCommand returns the command feeding the remote tar, decompressing stdin
+func remoteDecompressCommand(compression string) string {
+	switch compression {
+	case CompressionGzip:
+		return "gzip -dc | "
+	case CompressionZstd:
+		return "zstd -q -dc | "
+	default:
+		return ""
+	}
+}
+
+// compressWriter wraps w with the local compressor for the given format
+func compressWriter(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	default:
+		return nopWriteCloser{w}, nil
+	}
+}
+
+// decompressReader wraps r with the local decompressor for the given format
+func decompressReader(r io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return io.NopCloser(r), nil
+	}
+}
+
+// nopWriteCloser adds a no-op Close to an io.Writer
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// tarUploadDir streams the contents of localDir into remoteRoot through the remote tar
+func (o *Operations) tarUploadDir(ctx context.Context, sess *session.Session, localDir, remoteRoot string, u *dirUpload) error {
+	// -o keeps the remote user as owner, -m stamps files with the current time
+	flags := "-xomf"
+	if u.opts.Preserve {
+		flags = "-xopf"
+	}
+	cmd := fmt.Sprintf("mkdir -p %s && cd %s && %star %s -",
+		shellQuote(remoteRoot), shellQuote(remoteRoot), remoteDecompressCommand(u.opts.Compression), flags)
+
+	log.Printf("[DEBUG] tar: starting directory upload to %s (%s)", remoteRoot, u.opts.Compression)
+
+	return o.streamSession(ctx, sess, cmd, func(stdin io.Writer, _ io.Reader) error {
+		cw, err := compressWriter(stdin, u.opts.Compression)
+		if err != nil {
+			return fmt.Errorf("failed to start compression: %v", err)
+		}
+
+		tw := tar.NewWriter(cw)
+		if err := writeTarTree(tw, localDir, remoteRoot, u); err != nil {
+			return err
+		}
+		if err := tw.Close(); err != nil {
+			return fmt.Errorf("failed to finish archive: %v", err)
+		}
+		if err := cw.Close(); err != nil {
+			return fmt.Errorf("failed to finish compression: %v", err)
+		}
+		return nil
+	})
+}
+
+// writeTarTree writes the entries below localDir to tw, applying the symlink policy.
+// remoteRoot is only used to record the remote path of the file being sent.
+func writeTarTree(tw *tar.Writer, localDir, remoteRoot string, u *dirUpload) error {
+	rootInfo, err := os.Stat(localDir)
+	if err != nil {
+		return err
+	}
+
+	// The root entry carries the directory's own mode and times
+	if u.opts.Preserve {
+		if err := tw.WriteHeader(tarHeader("./", tar.TypeDir, rootInfo, u.dirMode(rootInfo), u.opts.Preserve)); err != nil {
+			return fmt.Errorf("failed to write archive header: %v", err)
+		}
+	}
+
+	if err := u.enter(localDir); err != nil {
+		return err
+	}
+	defer u.leave(localDir)
+
+	return writeTarDir(tw, localDir, "", remoteRoot, u)
+}
+
+// writeTarDir writes the entries of one local directory, recursing into subdirectories
+func writeTarDir(tw *tar.Writer, localPath, name, remoteRoot string, u *dirUpload) error {
+	entries, err := os.ReadDir(localPath)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		entryPath := filepath.Join(localPath, entry.Name())
+		entryName := path.Join(name, entry.Name())
+
+		info, err := os.Lstat(entryPath)
+		if err != nil {
+			return err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			switch u.opts.Symlinks {
+			case SymlinkSkip:
+				log.Printf("[DEBUG] tar: skipping symlink %s", entryPath)
+				continue
+			case SymlinkCopy:
+				target, err := os.Readlink(entryPath)
+				if err != nil {
+					return err
+				}
+				hdr := tarHeader(entryName, tar.TypeSymlink, info, 0777, u.opts.Preserve)
+				hdr.Linkname = target
+				if err := tw.WriteHeader(hdr); err != nil {
+					return fmt.Errorf("failed to write archive header: %v", err)
+				}
+				continue
+			}
+
+			if info, err = os.Stat(entryPath); err != nil {
+				log.Printf("[DEBUG] tar: skipping dangling symlink %s: %v", entryPath, err)
+				continue
+			}
+			if err := u.checkFollow(entryPath); err != nil {
+				return err
+			}
+		}
+
+		switch {
+		case info.IsDir():
+			if err := tw.WriteHeader(tarHeader(entryName+"/", tar.TypeDir, info, u.dirMode(info), u.opts.Preserve)); err != nil {
+				return fmt.Errorf("failed to write archive header: %v", err)
+			}
+
+			if err := u.enter(entryPath); err != nil {
+				return err
+			}
+			err = writeTarDir(tw, entryPath, entryName, remoteRoot, u)
+			u.leave(entryPath)
+			if err != nil {
+				return err
+			}
+
+		case info.Mode().IsRegular():
+			u.p.current = path.Join(remoteRoot, entryName)
+			if err := writeTarFile(tw, entryPath, entryName, info, u); err != nil {
+				return err
+			}
+			u.p.current = ""
+
+		default:
+			log.Printf("[DEBUG] tar: skipping special file %s", entryPath)
+		}
+	}
+
+	return nil
+}
+
+// writeTarFile writes a header and the content of a regular file
+func writeTarFile(tw *tar.Writer, localPath, name string, info os.FileInfo, u *dirUpload) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hdr := tarHeader(name, tar.TypeReg, info, u.fileMode(info), u.opts.Preserve)
+	hdr.Size = info.Size()
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write archive header: %v", err)
+	}
+
+	// The file may have changed size since it was stat'ed, tar needs exactly hdr.Size bytes
+	n, err := io.Copy(tw, u.p.Reader(io.LimitReader(f, hdr.Size)))
+	if err != nil {
+		return fmt.Errorf("failed to send %s: %v", localPath, err)
+	}
+	if n != hdr.Size {
+		return fmt.Errorf("failed to send %s: file shrank from %d to %d bytes", localPath, hdr.Size, n)
+	}
+
+	return nil
+}
+
+// tarHeader builds an archive header without owner information, so that the remote
+// side never tries to apply local user and group IDs
+func tarHeader(name string, typeflag byte, info os.FileInfo, mode uint32, preserve bool) *tar.Header {
+	hdr := &tar.Header{
+		Typeflag: typeflag,
+		Name:     name,
+		Mode:     int64(mode),
+		ModTime:  info.ModTime().Truncate(time.Second),
+	}
+	if preserve {
+		hdr.AccessTime = fileAtime(info).Truncate(time.Second)
+		hdr.Format = tar.FormatPAX
+	}
+	return hdr
+}
+
+// tarDownloadDir streams the contents of remotePath into localPath through the remote tar
+func (o *Operations) tarDownloadDir(ctx context.Context, sess *session.Session, remotePath, localPath string, opts DirTransferOptions, p *progress) error {
+	// -h makes the remote tar archive what symlinks point to
+	flags := "-cf"
+	if opts.Symlinks == SymlinkFollow {
+		flags = "-chf"
+	}
+	cmd := fmt.Sprintf("cd %s && tar %s - .%s", shellQuote(remotePath), flags, remoteCompressCommand(opts.Compression))
+
+	log.Printf("[DEBUG] tar: starting directory download from %s (%s)", remotePath, opts.Compression)
+
+	return o.streamSession(ctx, sess, cmd, func(_ io.Writer, stdout io.Reader) error {
+		dr, err := decompressReader(stdout, opts.Compression)
+		if err != nil {
+			return fmt.Errorf("failed to start decompression: %v", err)
+		}
+		defer dr.Close()
+
+		return extractTar(tar.NewReader(dr), localPath, opts, p)
+	})
+}
+
+// extractTar writes the entries of an archive below dest. Entries that would end up
+// outside of dest, directly or through a symlink, are rejected.
+func extractTar(tr *tar.Reader, dest string, opts DirTransferOptions, p *progress) error {
+	// Directory attributes are applied last, as writing their entries changes the times
+	var dirs []*tar.Header
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %v", err)
+		}
+
+		target, err := localEntryPath(dest, hdr.Name)
+		if err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			// A link left by an earlier entry must not be followed
+			if err := checkLocalDir(target); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return fmt.Errorf("failed to create directory: %v", err)
+			}
+			hdr.Name = target
+			dirs = append(dirs, hdr)
+
+		case tar.TypeReg:
+			if err := extractTarFile(tr, hdr, target, opts, p); err != nil {
+				return err
+			}
+
+		case tar.TypeSymlink:
+			if opts.Symlinks != SymlinkCopy {
+				log.Printf("[DEBUG] tar: skipping symlink %s", hdr.Name)
+				continue
+			}
+			if err := removeExisting(target); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return fmt.Errorf("failed to create symlink: %v", err)
+			}
+
+		default:
+			log.Printf("[DEBUG] tar: skipping special file %s", hdr.Name)
+		}
+	}
+
+	if opts.Preserve {
+		for i := len(dirs) - 1; i >= 0; i-- {
+			// Later entries may have replaced the directory
+			if err := checkLocalDir(dirs[i].Name); err != nil {
+				return err
+			}
+			if err := applyTarAttributes(dirs[i].Name, dirs[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// extractTarFile writes the content of a regular file entry
+func extractTarFile(tr *tar.Reader, hdr *tar.Header, target string, opts DirTransferOptions, p *progress) error {
+	// Never write through a link left at the destination
+	if err := removeExisting(target); err != nil {
+		return err
+	}
+
+	p.current = target
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create local file: %v", err)
+	}
+
+	_, err = io.Copy(p.Writer(f), tr)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", target, err)
+	}
+	p.current = ""
+
+	if opts.Preserve {
+		return applyTarAttributes(target, hdr)
+	}
+	return nil
+}
+
+// applyTarAttributes sets the mode and times recorded in an archive header
+func applyTarAttributes(target string, hdr *tar.Header) error {
+	if err := os.Chmod(target, os.FileMode(hdr.Mode).Perm()); err != nil {
+		return fmt.Errorf("failed to set mode: %v", err)
+	}
+
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+	if err := os.Chtimes(target, atime, hdr.ModTime); err != nil {
+		return fmt.Errorf("failed to set times: %v", err)
+	}
+	return nil
+}
+
+// checkLocalDir refuses anything at target other than a real directory
+func checkLocalDir(target string) error {
+	info, err := os.Lstat(target)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("refusing to use non-directory %s as a directory", target)
+	}
+	return nil
+}
+
+// removeExisting removes a non-directory at target so that it can be replaced
+func removeExisting(target string) error {
+	info, err := os.Lstat(target)
+	if err != nil {
+		return nil
+	}
+	if info.IsDir() {
+		return fmt.Errorf("cannot replace directory %s", target)
+	}
+	if err := os.Remove(target); err != nil {
+		return fmt.Errorf("failed to replace %s: %v", target, err)
+	}
+	return nil
+}
+
+// streamSession runs a command whose stdin and stdout carry a data stream, such as tar.
+// Cancelling ctx closes the SSH session, which unblocks any pending I/O.
+func (o *Operations) streamSession(ctx context.Context, sess *session.Session, command string, f func(stdin io.Writer, stdout io.Reader) error) error {
+	sshSession, err := sess.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to create SSH session: %v", err)
+	}
+	defer sshSession.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		sshSession.Close()
+	})
+	defer stop()
+
+	stdin, err := sshSession.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("failed to get stdin pipe: %v", err)
+	}
+	stdout, err := sshSession.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to get stdout pipe: %v", err)
+	}
+	stderr := new(bytes.Buffer)
+	sshSession.Stderr = stderr
+
+	if err := sshSession.Start(command); err != nil {
+		return fmt.Errorf("failed to start remote command: %v", err)
+	}
+
+	err = f(stdin, stdout)
+	stdin.Close()
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return fmt.Errorf("transfer cancelled: %w", ctxErr)
+	}
+
+	// Drain whatever follows the end of the stream so that the command can exit
+	if err == nil {
+		_, err = io.Copy(io.Discard, stdout)
+	}
+
+	waitErr := sshSession.Wait()
+	if msg := strings.TrimSpace(stderr.String()); msg != "" && (err != nil || waitErr != nil) {
+		if err != nil {
+			return fmt.Errorf("%v, stderr: %s", err, msg)
+		}
+		return fmt.Errorf("remote command failed: %v, stderr: %s", waitErr, msg)
+	}
+	if err != nil {
+		return err
+	}
+	if waitErr != nil {
+		return fmt.Errorf("remote command failed: %v", waitErr)
+	}
+
+	return nil
+}
@@ -0,0 +1,313 @@
+package file
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/sftp"
+	"github.com/pmezard/go-difflib/difflib"
+
+	"ssh-mcp/internal/security"
+	"ssh-mcp/internal/session"
+)
+
+// maxTemplateDiffSize is the largest remote file a template is diffed against
+const maxTemplateDiffSize = 1 << 20
+
+// TemplateOptions describes a template to render and where to write the result
+type TemplateOptions struct {
+	Template     string                 // Inline template text
+	TemplateFile string                 // Local template file, used if Template is empty
+	Vars         map[string]interface{} // Data the template is executed with
+	Path         string                 // Remote file to write
+	Mode         string                 // Octal permission bits, e.g. 0644 (empty keeps those of an existing file)
+	Owner        string                 // Owner as user, user:group or :group, applied with chown (empty leaves it alone)
+	Diff         bool                   // Include a unified diff against the current remote content
+	DryRun       bool                   // Only render and diff, do not write
+	Backup       bool                   // Save the file being overwritten in the session's change journal
+}
+
+// TemplateResult describes a rendered template
+type TemplateResult struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	SHA256  string `json:"sha256"`
+	Changed bool   `json:"changed"`        // The rendered content differs from the remote file
+	Written bool   `json:"written"`        // The remote file was written
+	Diff    string `json:"diff,omitempty"` // Unified diff from the remote content to the rendered content
+}
+
+// ownerPattern matches the owner specifications accepted by chown
+var ownerPattern = regexp.MustCompile(`^([A-Za-z0-9._][A-Za-z0-9._-]*)?(:[A-Za-z0-9._][A-Za-z0-9._-]*)?$`)
+
+// UploadTemplate renders a text/template and writes the result to a remote file. Missing
+// variables are an error rather than rendering as <no value>; index returns nil for them,
+// so {{ default "x" (index . "key") }} covers optional ones. The file is replaced through
+// a partial file, like Upload, and its content left untouched if the rendering is unchanged.
+func (o *Operations) UploadTemplate(sessionID string, opts TemplateOptions) (*TemplateResult, error) {
+	sess, release, err := o.sessionManager.AcquireSession(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var mode *os.FileMode
+	if opts.Mode != "" {
+		bits, err := strconv.ParseUint(opts.Mode, 8, 32)
+		if err != nil || bits > 0777 {
+			return nil, fmt.Errorf("invalid mode %q, expected octal permission bits such as 0644", opts.Mode)
+		}
+		m := os.FileMode(bits).Perm()
+		mode = &m
+	}
+	if opts.Owner != "" && (opts.Owner == ":" || !ownerPattern.MatchString(opts.Owner)) {
+		return nil, fmt.Errorf("invalid owner %q, expected user, user:group or :group", opts.Owner)
+	}
+
+	text := opts.Template
+	name := "template"
+	if text == "" {
+		if opts.TemplateFile == "" {
+			return nil, errors.New("either a template or a template file is required")
+		}
+		localPath, err := o.localPath(sessionID, opts.TemplateFile)
+		if err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(localPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read template file: %v", err)
+		}
+		text, name = string(data), filepath.Base(localPath)
+	}
+
+	content, err := renderTemplate(name, text, opts.Vars)
+	if err != nil {
+		return nil, err
+	}
+
+	access := security.AccessWrite
+	if opts.DryRun {
+		access = security.AccessRead
+	}
+	if opts.Path, err = o.remotePath(sess, opts.Path, access); err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(content)
+	result := &TemplateResult{
+		Path:   opts.Path,
+		Size:   int64(len(content)),
+		SHA256: hex.EncodeToString(sum[:]),
+	}
+
+	err = o.sftpSession(sess, func(client *sftp.Client) error {
+		current, exists, err := readRemoteForDiff(client, opts.Path)
+		if err != nil {
+			return err
+		}
+		result.Changed = !exists || !bytes.Equal(current, content)
+		if opts.Diff && result.Changed {
+			if result.Diff, err = unifiedDiff(opts.Path, current, content); err != nil {
+				return err
+			}
+		}
+		if opts.DryRun || (!result.Changed && mode == nil && opts.Owner == "") {
+			return nil
+		}
+
+		change, err := o.snapshot(sess, sessionID, "upload_template", opts.Path, opts.Backup)
+		if err != nil {
+			return err
+		}
+		err = writeTemplate(client, sess, opts.Path, content, result.Changed, mode, opts.Owner)
+		o.finishChange(sessionID, change, err)
+		if err != nil {
+			return err
+		}
+		result.Written = result.Changed
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// renderTemplate executes a template with a set of helper functions
+func renderTemplate(name, text string, vars map[string]interface{}) ([]byte, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, vars); err != nil {
+		return nil, fmt.Errorf("failed to render template: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// templateFuncs are helpers available in templates, named after their sprig counterparts
+var templateFuncs = template.FuncMap{
+	"default": func(def interface{}, value interface{}) interface{} {
+		if isEmptyValue(value) {
+			return def
+		}
+		return value
+	},
+	"required": func(msg string, value interface{}) (interface{}, error) {
+		if isEmptyValue(value) {
+			return nil, errors.New(msg)
+		}
+		return value, nil
+	},
+	"quote":      func(s interface{}) string { return strconv.Quote(fmt.Sprint(s)) },
+	"squote":     func(s interface{}) string { return "'" + fmt.Sprint(s) + "'" },
+	"upper":      strings.ToUpper,
+	"lower":      strings.ToLower,
+	"trim":       strings.TrimSpace,
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+	"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+	"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+	"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+	"split":      func(sep, s string) []string { return strings.Split(s, sep) },
+	"join": func(sep string, values interface{}) (string, error) {
+		switch v := values.(type) {
+		case []string:
+			return strings.Join(v, sep), nil
+		case []interface{}:
+			parts := make([]string, len(v))
+			for i, part := range v {
+				parts[i] = fmt.Sprint(part)
+			}
+			return strings.Join(parts, sep), nil
+		}
+		return "", fmt.Errorf("join: cannot join %T", values)
+	},
+	"indent": func(spaces int, s string) string {
+		pad := strings.Repeat(" ", spaces)
+		return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+	},
+	"nindent": func(spaces int, s string) string {
+		pad := strings.Repeat(" ", spaces)
+		return "\n" + pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+	},
+	"toJson": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"b64enc": func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+	"b64dec": func(s string) (string, error) {
+		b, err := base64.StdEncoding.DecodeString(s)
+		return string(b), err
+	},
+}
+
+// isEmptyValue reports whether a template value is nil or the zero value of its type
+func isEmptyValue(value interface{}) bool {
+	return value == nil || reflect.ValueOf(value).IsZero()
+}
+
+// readRemoteForDiff reads the current content of a remote file, reporting whether it exists.
+// Files larger than maxTemplateDiffSize are an error, as they are not meant to be templated.
+func readRemoteForDiff(client *sftp.Client, remotePath string) ([]byte, bool, error) {
+	f, err := client.Open(remotePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open remote file: %v", err)
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, maxTemplateDiffSize+1))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read remote file: %v", err)
+	}
+	if len(data) > maxTemplateDiffSize {
+		return nil, false, fmt.Errorf("remote file %s is larger than %d bytes", remotePath, maxTemplateDiffSize)
+	}
+	return data, true, nil
+}
+
+// unifiedDiff returns a unified diff between the old and new content of a file
+func unifiedDiff(name string, old, new []byte) (string, error) {
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(old)),
+		B:        difflib.SplitLines(string(new)),
+		FromFile: name,
+		ToFile:   name + " (rendered)",
+		Context:  3,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to diff: %v", err)
+	}
+	return diff, nil
+}
+
+// writeTemplate writes rendered content through a partial file and applies mode and owner.
+// If the content is unchanged only the mode and owner are applied to the existing file.
+func writeTemplate(client *sftp.Client, sess *session.Session, remotePath string, content []byte, changed bool, mode *os.FileMode, owner string) error {
+	target := remotePath
+	cleanup := func() {}
+	if changed {
+		target = remotePartialPath(remotePath)
+		cleanup = func() { client.Remove(target) }
+
+		f, err := client.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		if err != nil {
+			return fmt.Errorf("failed to open remote file: %v", err)
+		}
+		_, err = f.Write(content)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			cleanup()
+			return fmt.Errorf("failed to write remote file: %v", err)
+		}
+
+		// Keep the permissions of a file that is being replaced unless a mode is given
+		if mode == nil {
+			if fi, err := client.Stat(remotePath); err == nil {
+				perm := fi.Mode().Perm()
+				mode = &perm
+			}
+		}
+	}
+
+	if mode != nil {
+		if err := client.Chmod(target, *mode); err != nil {
+			cleanup()
+			return fmt.Errorf("failed to set permissions: %v", err)
+		}
+	}
+	if owner != "" {
+		if _, err := remoteOutput(sess, fmt.Sprintf("chown -- %s %s", shellQuote(owner), shellQuote(target))); err != nil {
+			cleanup()
+			return fmt.Errorf("failed to set owner: %v", err)
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+	return renameRemote(client, target, remotePath)
+}
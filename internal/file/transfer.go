@@ -0,0 +1,323 @@
+package file
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/sftp"
+
+	"ssh-mcp/internal/session"
+)
+
+// partialSuffix is appended to the destination name while a transfer is in progress.
+// Keeping the name stable lets an interrupted transfer be resumed later.
+const partialSuffix = ".ssh-mcp-part"
+
+// TransferOptions controls single file uploads and downloads
+type TransferOptions struct {
+	Resume   bool         // Continue from a partial file left by an interrupted transfer
+	Verify   bool         // Compare SHA-256 checksums of both sides after the transfer
+	Backup   bool         // Save the remote file being overwritten in the session's change journal
+	Progress ProgressFunc // Receives progress updates, may be nil
+}
+
+// DirTransferOptions controls directory uploads and downloads
+type DirTransferOptions struct {
+	Preserve    bool         // Carry over permission bits and modification/access times (scp -p)
+	Symlinks    string       // Symlink policy: follow (default), copy or skip
+	Mode        string       // Transfer mode: scp (default) or tar
+	Compression string       // Compression of the tar stream: gzip (default), zstd or none
+	Backup      bool         // Save the remote directory being overwritten in the session's change journal
+	Progress    ProgressFunc // Receives progress updates, may be nil
+}
+
+// TransferResult describes a completed single file transfer
+type TransferResult struct {
+	Size        int64  `json:"size"`             // Final size of the file
+	Transferred int64  `json:"transferred"`      // Bytes sent during this transfer
+	ResumedFrom int64  `json:"resumedFrom"`      // Offset the transfer was resumed from
+	SHA256      string `json:"sha256,omitempty"` // Checksum of the content, if it was verified or computed in transit
+}
+
+// remotePartialPath returns the temporary remote path used while uploading to remotePath
+func remotePartialPath(remotePath string) string {
+	dir, name := path.Split(remotePath)
+	return dir + "." + name + partialSuffix
+}
+
+// localPartialPath returns the temporary local path used while downloading to localPath
+func localPartialPath(localPath string) string {
+	return localPath + partialSuffix
+}
+
+// resumeOffset decides where a transfer continues from, given the size of an existing
+// partial file and the size of the source. A partial file larger than the source cannot
+// belong to it, so the transfer starts over.
+func resumeOffset(resume bool, partialSize, sourceSize int64) int64 {
+	if !resume || partialSize < 0 || partialSize > sourceSize {
+		return 0
+	}
+	return partialSize
+}
+
+// sftpUpload uploads a local file through a partial remote file which is renamed into place
+func sftpUpload(ctx context.Context, client *sftp.Client, sess *session.Session, localPath, remotePath string, opts TransferOptions) (*TransferResult, error) {
+	localFile, err := os.Open(localPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open local file: %v", err)
+	}
+	defer localFile.Close()
+
+	fileInfo, err := localFile.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file info: %v", err)
+	}
+	size := fileInfo.Size()
+
+	partialPath := remotePartialPath(remotePath)
+
+	// Work out how much of the file the remote side already has
+	partialSize := int64(-1)
+	if fi, err := client.Stat(partialPath); err == nil {
+		partialSize = fi.Size()
+	}
+	offset := resumeOffset(opts.Resume, partialSize, size)
+
+	flags := os.O_WRONLY | os.O_CREATE
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	remoteFile, err := client.OpenFile(partialPath, flags)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open remote file: %v", err)
+	}
+
+	if _, err := localFile.Seek(offset, io.SeekStart); err != nil {
+		remoteFile.Close()
+		return nil, fmt.Errorf("failed to seek local file: %v", err)
+	}
+	if _, err := remoteFile.Seek(offset, io.SeekStart); err != nil {
+		remoteFile.Close()
+		return nil, fmt.Errorf("failed to seek remote file: %v", err)
+	}
+
+	p := newProgress(ctx, opts.Progress, offset, size)
+	written, err := remoteFile.ReadFrom(p.Reader(io.LimitReader(localFile, size-offset)))
+	if closeErr := remoteFile.Close(); err == nil {
+		err = closeErr
+	}
+	if ctxErr := p.ctx.Err(); ctxErr != nil {
+		// A cancelled upload is not meant to be resumed, so clean up after it
+		client.Remove(partialPath)
+		return nil, fmt.Errorf("upload cancelled after %d bytes: %w", offset+written, ctxErr)
+	}
+	if err != nil {
+		// The partial file is kept so that the transfer can be resumed
+		return nil, fmt.Errorf("failed to send file content after %d bytes: %v", offset+written, err)
+	}
+
+	result := &TransferResult{
+		Size:        size,
+		Transferred: written,
+		ResumedFrom: offset,
+	}
+
+	if opts.Verify {
+		sum, err := verifyChecksums(sess, localPath, partialPath)
+		if err != nil {
+			client.Remove(partialPath)
+			return nil, err
+		}
+		result.SHA256 = sum
+	}
+
+	// Keep the permissions of a file that is being replaced
+	if fi, err := client.Stat(remotePath); err == nil {
+		if err := client.Chmod(partialPath, fi.Mode().Perm()); err != nil {
+			return nil, fmt.Errorf("failed to copy permissions: %v", err)
+		}
+	}
+
+	if err := renameRemote(client, partialPath, remotePath); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// sftpDownload downloads a remote file through a partial local file which is renamed into place
+func sftpDownload(ctx context.Context, client *sftp.Client, sess *session.Session, remotePath, localPath string, opts TransferOptions) (*TransferResult, error) {
+	remoteFile, err := client.Open(remotePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open remote file: %v", err)
+	}
+	defer remoteFile.Close()
+
+	remoteInfo, err := remoteFile.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get remote file info: %v", err)
+	}
+	if !remoteInfo.Mode().IsRegular() {
+		return nil, fmt.Errorf("remote path %s is not a regular file", remotePath)
+	}
+	size := remoteInfo.Size()
+
+	partialPath := localPartialPath(localPath)
+
+	partialSize := int64(-1)
+	if fi, err := os.Stat(partialPath); err == nil {
+		partialSize = fi.Size()
+	}
+	offset := resumeOffset(opts.Resume, partialSize, size)
+
+	localFile, err := os.OpenFile(partialPath, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create local file: %v", err)
+	}
+
+	// Drop anything past the resume point, which also empties the file when starting over
+	if err := localFile.Truncate(offset); err != nil {
+		localFile.Close()
+		return nil, fmt.Errorf("failed to truncate local file: %v", err)
+	}
+	if _, err := localFile.Seek(offset, io.SeekStart); err != nil {
+		localFile.Close()
+		return nil, fmt.Errorf("failed to seek local file: %v", err)
+	}
+	if _, err := remoteFile.Seek(offset, io.SeekStart); err != nil {
+		localFile.Close()
+		return nil, fmt.Errorf("failed to seek remote file: %v", err)
+	}
+
+	p := newProgress(ctx, opts.Progress, offset, size)
+	written, err := io.Copy(p.Writer(localFile), io.LimitReader(remoteFile, size-offset))
+	if err == nil && offset+written != size {
+		err = fmt.Errorf("remote file ended after %d of %d bytes", offset+written, size)
+	}
+	if err == nil {
+		err = localFile.Sync()
+	}
+	if closeErr := localFile.Close(); err == nil {
+		err = closeErr
+	}
+	if ctxErr := p.ctx.Err(); ctxErr != nil {
+		// A cancelled download is not meant to be resumed, so clean up after it
+		os.Remove(partialPath)
+		return nil, fmt.Errorf("download cancelled after %d bytes: %w", offset+written, ctxErr)
+	}
+	if err != nil {
+		// The partial file is kept so that the transfer can be resumed
+		return nil, fmt.Errorf("failed to copy file content after %d bytes: %v", offset+written, err)
+	}
+
+	result := &TransferResult{
+		Size:        size,
+		Transferred: written,
+		ResumedFrom: offset,
+	}
+
+	if opts.Verify {
+		sum, err := verifyChecksums(sess, partialPath, remotePath)
+		if err != nil {
+			os.Remove(partialPath)
+			return nil, err
+		}
+		result.SHA256 = sum
+	}
+
+	if err := os.Rename(partialPath, localPath); err != nil {
+		return nil, fmt.Errorf("failed to move file into place: %v", err)
+	}
+
+	return result, nil
+}
+
+// renameRemote atomically replaces newPath with oldPath, falling back to remove and
+// rename on servers without the posix-rename extension
+func renameRemote(client *sftp.Client, oldPath, newPath string) error {
+	if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+		if err := client.PosixRename(oldPath, newPath); err != nil {
+			return fmt.Errorf("failed to move file into place: %v", err)
+		}
+		return nil
+	}
+
+	if err := client.Remove(newPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to replace existing file: %v", err)
+	}
+	if err := client.Rename(oldPath, newPath); err != nil {
+		return fmt.Errorf("failed to move file into place: %v", err)
+	}
+	return nil
+}
+
+// verifyChecksums compares the SHA-256 of a local file with the output of sha256sum on the remote
+func verifyChecksums(sess *session.Session, localPath, remotePath string) (string, error) {
+	localSum, err := localSHA256(localPath)
+	if err != nil {
+		return "", err
+	}
+
+	remoteSum, err := remoteSHA256(sess, remotePath)
+	if err != nil {
+		return "", err
+	}
+
+	if localSum != remoteSum {
+		return "", fmt.Errorf("checksum mismatch: local %s, remote %s", localSum, remoteSum)
+	}
+
+	return localSum, nil
+}
+
+// localSHA256 computes the hex encoded SHA-256 of a local file
+func localSHA256(localPath string) (string, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file for checksum: %v", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to compute local checksum: %v", err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// remoteSHA256 runs sha256sum on the remote host and returns the hex encoded checksum
+func remoteSHA256(sess *session.Session, remotePath string) (string, error) {
+	output, err := remoteOutput(sess, "sha256sum -- "+shellQuote(remotePath))
+	if err != nil {
+		return "", fmt.Errorf("failed to compute remote checksum: %v", err)
+	}
+
+	return parseChecksumOutput(output)
+}
+
+// parseChecksumOutput extracts the checksum from sha256sum output
+func parseChecksumOutput(output string) (string, error) {
+	fields := strings.Fields(output)
+	if len(fields) == 0 {
+		return "", errors.New("empty checksum output")
+	}
+
+	// sha256sum prefixes the line with a backslash when the file name needs escaping
+	sum := strings.ToLower(strings.TrimPrefix(fields[0], "\\"))
+	if len(sum) != sha256.Size*2 {
+		return "", fmt.Errorf("unexpected checksum output: %q", output)
+	}
+	if _, err := hex.DecodeString(sum); err != nil {
+		return "", fmt.Errorf("unexpected checksum output: %q", output)
+	}
+
+	return sum, nil
+}
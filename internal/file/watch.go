@@ -0,0 +1,465 @@
+package file
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+
+	"ssh-mcp/internal/security"
+)
+
+// Limits for watching remote paths
+const (
+	defaultWatchInterval = 2 * time.Second
+	minWatchInterval     = time.Second
+	maxWatchEntries      = 20000 // Entries a polling watch may track
+	watchBufferEvents    = 1000  // Events a watch keeps for polling
+)
+
+// Watch engines
+const (
+	WatchEngineInotify = "inotifywait"
+	WatchEnginePoll    = "poll"
+)
+
+// Watch event types
+const (
+	WatchCreate = "create"
+	WatchModify = "modify"
+	WatchDelete = "delete"
+)
+
+// WatchOptions describes a remote path to watch
+type WatchOptions struct {
+	Path     string        // Remote file or directory tree to watch
+	Interval time.Duration // Time between two snapshots when polling (0 means the default)
+	Poll     bool          // Poll with stat snapshots even if inotifywait is available
+}
+
+// WatchEvent is a change below a watched path
+type WatchEvent struct {
+	Cursor int64  `json:"cursor"`
+	Type   string `json:"type"` // create, modify or delete
+	Path   string `json:"path"`
+	Dir    bool   `json:"dir,omitempty"`
+}
+
+// WatchRead holds the events of a watch after a cursor
+type WatchRead struct {
+	SubscriptionID string       `json:"subscriptionId"`
+	Engine         string       `json:"engine"`
+	Events         []WatchEvent `json:"events"`
+	Cursor         int64        `json:"cursor"`            // Cursor to pass to the next read
+	Dropped        int64        `json:"dropped,omitempty"` // Events that left the buffer before they were read
+	Closed         bool         `json:"closed"`            // The watch has ended and no more events will arrive
+	Error          string       `json:"error,omitempty"`   // Why the watch ended, if it failed
+}
+
+// watchSubscription watches a remote path with inotifywait or by polling
+type watchSubscription struct {
+	id     string
+	owner  string // MCP client session that owns the SSH session
+	engine string
+	notify func(string, []WatchEvent)
+	stop   func()
+
+	mu     sync.Mutex
+	events []WatchEvent // The most recent events, oldest first
+	cursor int64        // Cursor of the most recent event
+	closed bool
+	err    error
+}
+
+// watchEntry is the state of a path in a polling snapshot
+type watchEntry struct {
+	dir     bool
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+// Watch starts watching a remote file or directory tree for created, modified and
+// deleted entries. It uses inotifywait when the remote host has it and otherwise
+// compares stat snapshots taken over SFTP. Events are buffered for ReadWatch and,
+// if notify is not nil, passed to it in batches. The watch ends when it is stopped
+// or the SSH session closes.
+func (o *Operations) Watch(sessionID string, opts WatchOptions, notify func(subscriptionID string, events []WatchEvent)) (*WatchRead, error) {
+	sess, release, err := o.sessionManager.AcquireSession(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if opts.Path == "" {
+		return nil, errors.New("path must not be empty")
+	}
+	if opts.Path, err = o.remoteTree(sess, opts.Path, security.AccessRead); err != nil {
+		return nil, err
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = defaultWatchInterval
+	}
+	if opts.Interval < minWatchInterval {
+		opts.Interval = minWatchInterval
+	}
+
+	id, err := newSubscriptionID("watch")
+	if err != nil {
+		return nil, err
+	}
+	sub := &watchSubscription{id: id, owner: sess.Owner, notify: notify}
+
+	useInotify := false
+	if !opts.Poll {
+		_, err := remoteOutput(sess, "command -v inotifywait")
+		useInotify = err == nil
+	}
+
+	if useInotify {
+		sub.engine = WatchEngineInotify
+
+		sshSession, err := sess.NewSession()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create SSH session: %v", err)
+		}
+		stdout, err := sshSession.StdoutPipe()
+		if err != nil {
+			sshSession.Close()
+			return nil, fmt.Errorf("failed to get stdout pipe: %v", err)
+		}
+		cmd := "inotifywait -m -r -q -e create -e modify -e delete -e move -e delete_self -e move_self --format '%e %w%f' -- " + shellQuote(opts.Path)
+		if err := sshSession.Start(cmd); err != nil {
+			sshSession.Close()
+			return nil, fmt.Errorf("failed to start inotifywait: %v", err)
+		}
+		sub.stop = func() { sshSession.Close() }
+
+		// The watch outlives the hold on the session, so removing the session stops it
+		unwatch := context.AfterFunc(sess.Context(), sub.stop)
+
+		go func() {
+			sub.run(stdout)
+			if err := sshSession.Wait(); err != nil {
+				log.Printf("[DEBUG] watch: %s on %s ended: %v", opts.Path, sessionID, err)
+			}
+			sshSession.Close()
+			unwatch()
+		}()
+	} else {
+		sub.engine = WatchEnginePoll
+
+		releaseChannel, err := sess.AcquireChannel()
+		if err != nil {
+			return nil, fmt.Errorf("failed to start SFTP subsystem: %v", err)
+		}
+		client, err := sftp.NewClient(sess.Client)
+		if err != nil {
+			releaseChannel()
+			return nil, fmt.Errorf("failed to start SFTP subsystem: %v", err)
+		}
+		// The first snapshot is the baseline, so that only later changes are reported
+		snapshot, err := watchSnapshot(client, opts.Path)
+		if err != nil {
+			client.Close()
+			releaseChannel()
+			return nil, err
+		}
+
+		done := make(chan struct{})
+		var once sync.Once
+		sub.stop = func() {
+			once.Do(func() {
+				close(done)
+				client.Close()
+				releaseChannel()
+			})
+		}
+
+		// The watch outlives the hold on the session, so removing the session stops it.
+		// Stopping also frees the channel slot when polling fails.
+		unwatch := context.AfterFunc(sess.Context(), sub.stop)
+
+		go func() {
+			sub.poll(client, opts.Path, snapshot, opts.Interval, done)
+			unwatch()
+			sub.stop()
+		}()
+	}
+
+	o.mu.Lock()
+	o.watches[id] = sub
+	o.mu.Unlock()
+
+	return &WatchRead{SubscriptionID: id, Engine: sub.engine, Events: []WatchEvent{}}, nil
+}
+
+// ReadWatch returns the buffered events of a watch after cursor, at most max
+func (o *Operations) ReadWatch(subscriptionID string, cursor int64, max int) (*WatchRead, error) {
+	o.mu.Lock()
+	sub, ok := o.watches[subscriptionID]
+	o.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("watch subscription not found: %s", subscriptionID)
+	}
+
+	read := sub.read(cursor, max)
+
+	// A closed watch is forgotten once the caller has seen all of its events
+	if read.Closed && read.Cursor == sub.lastCursor() {
+		o.mu.Lock()
+		delete(o.watches, subscriptionID)
+		o.mu.Unlock()
+	}
+
+	return read, nil
+}
+
+// StopWatch ends a watch
+func (o *Operations) StopWatch(subscriptionID string) error {
+	o.mu.Lock()
+	sub, ok := o.watches[subscriptionID]
+	delete(o.watches, subscriptionID)
+	o.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("watch subscription not found: %s", subscriptionID)
+	}
+
+	sub.stop()
+	return nil
+}
+
+// run reads inotifywait output until it ends. Events are collected for tailFlushInterval
+// and repeated events for the same path are merged before they are published.
+func (s *watchSubscription) run(r io.Reader) {
+	lines, readErr := streamLines(r)
+
+	ticker := time.NewTicker(tailFlushInterval)
+	defer ticker.Stop()
+
+	var pending []WatchEvent
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				s.publish(pending)
+				s.close(<-readErr)
+				return
+			}
+			if event, ok := parseInotifyLine(line); ok {
+				pending = append(pending, event)
+			}
+		case <-ticker.C:
+			s.publish(pending)
+			pending = nil
+		}
+	}
+}
+
+// poll compares snapshots of a path every interval until done is closed
+func (s *watchSubscription) poll(client *sftp.Client, root string, snapshot map[string]watchEntry, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			s.close(nil)
+			return
+		case <-ticker.C:
+			next, err := watchSnapshot(client, root)
+			if err != nil {
+				select {
+				case <-done:
+					// Closing the client made the snapshot fail
+					err = nil
+				default:
+				}
+				s.close(err)
+				client.Close()
+				return
+			}
+			s.publish(diffSnapshots(snapshot, next))
+			snapshot = next
+		}
+	}
+}
+
+// publish merges repeated events, buffers them and notifies the subscriber
+func (s *watchSubscription) publish(events []WatchEvent) {
+	events = mergeWatchEvents(events)
+	if len(events) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	for i := range events {
+		s.cursor++
+		events[i].Cursor = s.cursor
+	}
+	s.events = append(s.events, events...)
+	if len(s.events) > watchBufferEvents {
+		s.events = s.events[len(s.events)-watchBufferEvents:]
+	}
+	s.mu.Unlock()
+
+	if s.notify != nil {
+		s.notify(s.id, events)
+	}
+}
+
+// close marks the watch as ended
+func (s *watchSubscription) close(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	s.err = err
+}
+
+// lastCursor returns the cursor of the most recent event
+func (s *watchSubscription) lastCursor() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.cursor
+}
+
+// read returns the buffered events after cursor, at most max if max is positive
+func (s *watchSubscription) read(cursor int64, max int) *WatchRead {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	read := &WatchRead{
+		SubscriptionID: s.id,
+		Engine:         s.engine,
+		Events:         []WatchEvent{},
+		Cursor:         cursor,
+		Closed:         s.closed,
+	}
+	if s.err != nil {
+		read.Error = s.err.Error()
+	}
+
+	for _, event := range s.events {
+		if event.Cursor <= cursor {
+			continue
+		}
+		if max > 0 && len(read.Events) == max {
+			break
+		}
+		if len(read.Events) == 0 && event.Cursor > cursor+1 {
+			read.Dropped = event.Cursor - cursor - 1
+		}
+		read.Events = append(read.Events, event)
+		read.Cursor = event.Cursor
+	}
+
+	return read
+}
+
+// parseInotifyLine parses a line of inotifywait --format '%e %w%f' output
+func parseInotifyLine(line string) (WatchEvent, bool) {
+	flags, p, ok := strings.Cut(line, " ")
+	if !ok || p == "" {
+		return WatchEvent{}, false
+	}
+
+	event := WatchEvent{Path: strings.TrimSuffix(p, "/")}
+	for _, flag := range strings.Split(flags, ",") {
+		switch flag {
+		case "CREATE", "MOVED_TO":
+			event.Type = WatchCreate
+		case "DELETE", "MOVED_FROM", "DELETE_SELF", "MOVE_SELF":
+			event.Type = WatchDelete
+		case "MODIFY":
+			event.Type = WatchModify
+		case "ISDIR":
+			event.Dir = true
+		}
+	}
+	if event.Type == "" {
+		return WatchEvent{}, false
+	}
+	return event, true
+}
+
+// mergeWatchEvents drops events that repeat the previous event for the same path,
+// such as the many modify events of a file being written
+func mergeWatchEvents(events []WatchEvent) []WatchEvent {
+	var merged []WatchEvent
+	last := make(map[string]string)
+	for _, event := range events {
+		if last[event.Path] == event.Type {
+			continue
+		}
+		last[event.Path] = event.Type
+		merged = append(merged, event)
+	}
+	return merged
+}
+
+// watchSnapshot records the state of every entry below root. A missing root gives an
+// empty snapshot, so that its creation is reported.
+func watchSnapshot(client *sftp.Client, root string) (map[string]watchEntry, error) {
+	snapshot := make(map[string]watchEntry)
+
+	walker := client.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			if walker.Path() == root && os.IsNotExist(err) {
+				return snapshot, nil
+			}
+			// Entries may disappear or be unreadable while walking
+			continue
+		}
+		if len(snapshot) == maxWatchEntries {
+			return nil, fmt.Errorf("too many entries below %s to watch by polling (limit %d)", root, maxWatchEntries)
+		}
+
+		fi := walker.Stat()
+		snapshot[walker.Path()] = watchEntry{
+			dir:     fi.IsDir(),
+			size:    fi.Size(),
+			mode:    fi.Mode(),
+			modTime: fi.ModTime(),
+		}
+	}
+
+	return snapshot, nil
+}
+
+// diffSnapshots returns the events that turn one snapshot into the next, ordered by path.
+// Directories are only reported when they are created or deleted, as their modification
+// time changes with every entry added or removed.
+func diffSnapshots(prev, next map[string]watchEntry) []WatchEvent {
+	var deleted, changed []WatchEvent
+	for p, entry := range prev {
+		if now, ok := next[p]; !ok || now.dir != entry.dir {
+			deleted = append(deleted, WatchEvent{Type: WatchDelete, Path: p, Dir: entry.dir})
+		}
+	}
+	for p, entry := range next {
+		old, ok := prev[p]
+		switch {
+		case !ok || old.dir != entry.dir:
+			changed = append(changed, WatchEvent{Type: WatchCreate, Path: p, Dir: entry.dir})
+		case !entry.dir && (old.size != entry.size || old.mode != entry.mode || !old.modTime.Equal(entry.modTime)):
+			changed = append(changed, WatchEvent{Type: WatchModify, Path: p})
+		}
+	}
+
+	// Entries are deleted before their parents, and created after them
+	sort.Slice(deleted, func(i, j int) bool { return deleted[i].Path > deleted[j].Path })
+	sort.Slice(changed, func(i, j int) bool { return changed[i].Path < changed[j].Path })
+	return append(deleted, changed...)
+}
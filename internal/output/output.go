@@ -0,0 +1,91 @@
+package output
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// ANSI handling modes
+const (
+	ANSIStrip  = "strip"  // Remove escape sequences (default)
+	ANSIKeep   = "keep"   // Leave escape sequences as they are
+	ANSIEscape = "escape" // Make escape sequences visible by writing ESC as \e
+)
+
+// Options controls how raw command or file output is turned into text
+type Options struct {
+	Encoding string // Character encoding of the output, e.g. latin1, windows-1252 or utf-16le (empty means UTF-8)
+	ANSI     string // ANSI escape sequences: strip (default), keep or escape
+}
+
+// Result is output ready to be returned to a client
+type Result struct {
+	Text     string // The output as UTF-8 text, if it is not binary
+	Binary   bool   // The output is not text and is left in Data
+	Data     []byte // The raw output, if it is binary
+	MIMEType string // Detected content type
+}
+
+// ansiSequence matches CSI, OSC and other escape sequences
+var ansiSequence = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b[()][0-9A-Za-z]|\x1b[@-Z\\-_]`)
+
+// Process decodes output in the declared encoding and decides whether it is text. Output
+// containing NUL bytes or invalid UTF-8 after decoding is reported as binary, so that it
+// reaches the client unchanged instead of being mangled into text.
+func Process(data []byte, opts Options) (*Result, error) {
+	ansi, err := normalizeANSI(opts.ANSI)
+	if err != nil {
+		return nil, err
+	}
+
+	text := data
+	if opts.Encoding != "" {
+		enc, err := htmlindex.Get(opts.Encoding)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported encoding %q: %v", opts.Encoding, err)
+		}
+		if text, err = enc.NewDecoder().Bytes(data); err != nil {
+			return nil, fmt.Errorf("failed to decode output as %s: %v", opts.Encoding, err)
+		}
+	}
+
+	if IsBinary(text) {
+		return &Result{
+			Binary:   true,
+			Data:     data,
+			MIMEType: http.DetectContentType(data),
+		}, nil
+	}
+
+	s := string(text)
+	switch ansi {
+	case ANSIStrip:
+		s = ansiSequence.ReplaceAllString(s, "")
+	case ANSIEscape:
+		s = strings.ReplaceAll(s, "\x1b", `\e`)
+	}
+
+	return &Result{Text: s, MIMEType: "text/plain; charset=utf-8"}, nil
+}
+
+// IsBinary reports whether data is not UTF-8 text
+func IsBinary(data []byte) bool {
+	return bytes.IndexByte(data, 0) >= 0 || !utf8.Valid(data)
+}
+
+// normalizeANSI validates an ANSI handling mode, defaulting to strip
+func normalizeANSI(mode string) (string, error) {
+	switch mode {
+	case "":
+		return ANSIStrip, nil
+	case ANSIStrip, ANSIKeep, ANSIEscape:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid ANSI mode %q, expected strip, keep or escape", mode)
+}
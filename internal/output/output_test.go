@@ -0,0 +1,54 @@
+package output
+
+import (
+	"testing"
+)
+
+// TestProcess tests the decoding, ANSI stripping and binary detection of command output
+func TestProcess(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		opts     Options
+		expected string
+		binary   bool
+	}{
+		{"plain text", []byte("hello\nworld\n"), Options{}, "hello\nworld\n", false},
+		{"colors stripped", []byte("\x1b[0;1;32m●\x1b[0m nginx.service - \x1b]8;;file://host/x\x07link\x1b]8;;\x07\n"), Options{}, "● nginx.service - link\n", false},
+		{"colors kept", []byte("\x1b[31mred\x1b[0m"), Options{ANSI: ANSIKeep}, "\x1b[31mred\x1b[0m", false},
+		{"colors escaped", []byte("\x1b[31mred\x1b[0m"), Options{ANSI: ANSIEscape}, `\e[31mred\e[0m`, false},
+		{"latin1 declared", []byte("caf\xe9"), Options{Encoding: "latin1"}, "café", false},
+		{"windows-1252 declared", []byte("\x93quoted\x94"), Options{Encoding: "windows-1252"}, "“quoted”", false},
+		{"utf-16le declared", []byte("h\x00i\x00"), Options{Encoding: "utf-16le"}, "hi", false},
+		{"latin1 undeclared", []byte("caf\xe9"), Options{}, "", true},
+		{"NUL bytes", []byte("\x7fELF\x02\x01\x01\x00\x00"), Options{}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := Process(tt.data, tt.opts)
+			if err != nil {
+				t.Fatalf("Process failed: %v", err)
+			}
+			if result.Binary != tt.binary {
+				t.Fatalf("Expected binary %v, got %v", tt.binary, result.Binary)
+			}
+			if tt.binary {
+				if string(result.Data) != string(tt.data) || result.MIMEType == "" {
+					t.Errorf("Expected the raw data with a MIME type, got %q, %q", result.Data, result.MIMEType)
+				}
+				return
+			}
+			if result.Text != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, result.Text)
+			}
+		})
+	}
+
+	if _, err := Process([]byte("x"), Options{Encoding: "no-such-encoding"}); err == nil {
+		t.Error("Expected an error for an unknown encoding")
+	}
+	if _, err := Process([]byte("x"), Options{ANSI: "colour"}); err == nil {
+		t.Error("Expected an error for an unknown ANSI mode")
+	}
+}
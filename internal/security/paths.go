@@ -0,0 +1,203 @@
+package security
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// CheckLocalPath verifies that a local path lies inside one of the allowed local roots and
+// returns it with symlinks resolved. Links are resolved in every existing part of the path,
+// so neither the path itself nor one of its parents can lead outside of the roots. A trailing
+// separator is kept, as it changes the meaning of directory uploads.
+// If no local roots are configured, the path is returned unchanged.
+func (m *Manager) CheckLocalPath(sessionID, localPath string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.config.AllowedLocalRoots) == 0 {
+		return localPath, nil
+	}
+
+	resolved, err := resolveLocalPath(localPath)
+	if err != nil {
+		m.logOperation("local_path_denied", sessionID, localPath)
+		return "", fmt.Errorf("failed to resolve local path %s: %v", localPath, err)
+	}
+
+	for _, root := range m.config.AllowedLocalRoots {
+		resolvedRoot, err := resolveLocalPath(root)
+		if err != nil {
+			continue
+		}
+		if withinRoot(resolvedRoot, resolved) {
+			if strings.HasSuffix(localPath, "/") || strings.HasSuffix(localPath, string(filepath.Separator)) {
+				resolved += string(filepath.Separator)
+			}
+			return resolved, nil
+		}
+	}
+
+	m.logOperation("local_path_denied", sessionID, localPath)
+	return "", fmt.Errorf("local path %s is outside the allowed local roots", localPath)
+}
+
+// resolveLocalPath makes a path absolute and resolves symlinks in its longest existing
+// prefix. The parts that do not exist yet cannot be links and are appended as they are.
+func resolveLocalPath(localPath string) (string, error) {
+	abs, err := filepath.Abs(localPath)
+	if err != nil {
+		return "", err
+	}
+
+	existing, rest := abs, ""
+	for {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return "", err
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+}
+
+// withinRoot reports whether target is root or lies below it. Both paths must be clean and absolute.
+func withinRoot(root, target string) bool {
+	rel, err := filepath.Rel(root, target)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// PathAccess is the kind of access an operation needs to a remote path
+type PathAccess string
+
+// Remote path access kinds
+const (
+	AccessRead   PathAccess = "read"
+	AccessWrite  PathAccess = "write"
+	AccessDelete PathAccess = "delete"
+)
+
+// RemotePathRule allows or denies access to a remote path and everything below it
+type RemotePathRule struct {
+	Host   string       `json:"host"`   // Host pattern the rule applies to, as in AllowedHosts (if empty, all hosts)
+	Path   string       `json:"path"`   // Absolute remote path covered by the rule, including everything below it
+	Access []PathAccess `json:"access"` // Kinds of access the rule covers (if empty, all kinds)
+	Deny   bool         `json:"deny"`   // Whether the rule denies rather than allows access
+}
+
+// appliesTo reports whether the rule covers a kind of access on a host
+func (r RemotePathRule) appliesTo(host string, access PathAccess) bool {
+	if r.Host != "" && !matchHost(host, r.Host) {
+		return false
+	}
+	return len(r.Access) == 0 || containsAccess(r.Access, access)
+}
+
+// cleanPath returns the rule's path in the normalized form paths are matched in
+func (r RemotePathRule) cleanPath() string {
+	return path.Clean("/" + r.Path)
+}
+
+// HasRemotePathRules reports whether any remote path rules are configured, so that
+// callers can skip normalizing paths when there is nothing to check them against
+func (m *Manager) HasRemotePathRules() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.config.RemotePathRules) > 0
+}
+
+// CheckRemotePath verifies that an access to a remote path on a host is permitted.
+// The path must be absolute and is cleaned before matching, so .. elements cannot step
+// out of a rule. Deny rules are checked first. If any allow rule applies to the host and
+// kind of access, the path must lie below one of them; otherwise the access is permitted.
+func (m *Manager) CheckRemotePath(sessionID, host, remotePath string, access PathAccess) error {
+	return m.checkRemotePath(sessionID, host, remotePath, access, false)
+}
+
+// CheckRemoteTree is like CheckRemotePath for operations on a whole directory tree.
+// It additionally fails if a deny rule covers anything below the root of the tree.
+func (m *Manager) CheckRemoteTree(sessionID, host, remotePath string, access PathAccess) error {
+	return m.checkRemotePath(sessionID, host, remotePath, access, true)
+}
+
+// checkRemotePath implements CheckRemotePath and CheckRemoteTree
+func (m *Manager) checkRemotePath(sessionID, host, remotePath string, access PathAccess, tree bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.config.RemotePathRules) == 0 {
+		return nil
+	}
+
+	// Remove port from host if present
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	details := fmt.Sprintf("%s %s", access, remotePath)
+	if !path.IsAbs(remotePath) {
+		m.logOperation("remote_path_denied", sessionID, details)
+		return fmt.Errorf("remote path %s must be absolute", remotePath)
+	}
+	remotePath = path.Clean(remotePath)
+
+	for _, rule := range m.config.RemotePathRules {
+		if !rule.Deny || !rule.appliesTo(host, access) {
+			continue
+		}
+		rulePath := rule.cleanPath()
+		if withinRemoteRoot(rulePath, remotePath) || (tree && withinRemoteRoot(remotePath, rulePath)) {
+			m.logOperation("remote_path_denied", sessionID, details)
+			return fmt.Errorf("%s access to remote path %s is denied", access, remotePath)
+		}
+	}
+
+	restricted := false
+	for _, rule := range m.config.RemotePathRules {
+		if rule.Deny || !rule.appliesTo(host, access) {
+			continue
+		}
+		if withinRemoteRoot(rule.cleanPath(), remotePath) {
+			return nil
+		}
+		restricted = true
+	}
+
+	if restricted {
+		m.logOperation("remote_path_not_allowed", sessionID, details)
+		return fmt.Errorf("%s access to remote path %s is not allowed", access, remotePath)
+	}
+
+	return nil
+}
+
+// containsAccess reports whether a list of access kinds includes access
+func containsAccess(list []PathAccess, access PathAccess) bool {
+	for _, a := range list {
+		if a == access {
+			return true
+		}
+	}
+	return false
+}
+
+// withinRemoteRoot reports whether a clean absolute remote path is root or lies below it
+func withinRemoteRoot(root, remotePath string) bool {
+	return root == "/" || remotePath == root || strings.HasPrefix(remotePath, root+"/")
+}
@@ -12,12 +12,14 @@ import (
 
 // Config holds security configuration settings
 type Config struct {
-	AllowedHosts    []string      // List of allowed hosts (if empty, all hosts are allowed)
-	DeniedHosts     []string      // List of denied hosts
-	AllowedCommands []string      // List of allowed command prefixes (if empty, all commands are allowed)
-	DeniedCommands  []string      // List of denied command prefixes
-	RateLimit       time.Duration // Minimum time between operations (rate limiting)
-	LoggingEnabled  bool          // Whether to log operations
+	AllowedHosts      []string         // List of allowed hosts (if empty, all hosts are allowed)
+	DeniedHosts       []string         // List of denied hosts
+	AllowedCommands   []string         // List of allowed command prefixes (if empty, all commands are allowed)
+	DeniedCommands    []string         // List of denied command prefixes
+	AllowedLocalRoots []string         // Local directories file transfers are confined to (if empty, local paths are not restricted)
+	RemotePathRules   []RemotePathRule // Remote path permissions per host (if empty, remote paths are not restricted)
+	RateLimit         time.Duration    // Minimum time between operations (rate limiting)
+	LoggingEnabled    bool             // Whether to log operations
 }
 
 // Manager handles security features for SSH operations
@@ -152,6 +154,11 @@ func (m *Manager) StartCleanupRoutine(interval, maxAge time.Duration) {
 	}()
 }
 
+// MatchHost reports whether a host matches a pattern as used in the host allow and deny lists
+func MatchHost(host, pattern string) bool {
+	return matchHost(host, pattern)
+}
+
 // matchHost checks if a host matches a pattern (supports wildcards)
 func matchHost(host, pattern string) bool {
 	// Simple exact match
@@ -1,6 +1,8 @@
 package security
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -272,3 +274,108 @@ func TestMatchHost(t *testing.T) {
 		t.Error("Invalid IP should not match CIDR")
 	}
 }
+
+func TestCheckLocalPath(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	os.Mkdir(filepath.Join(root, "data"), 0755)
+	os.Symlink(outside, filepath.Join(root, "escape"))
+	os.Symlink(filepath.Join(root, "data"), filepath.Join(outside, "inside"))
+
+	// Without roots every path is allowed and returned unchanged
+	manager := NewManager(Config{})
+	if p, err := manager.CheckLocalPath("session", "/etc/passwd"); err != nil || p != "/etc/passwd" {
+		t.Errorf("Expected unrestricted path, got %q, %v", p, err)
+	}
+
+	manager = NewManager(Config{AllowedLocalRoots: []string{root}})
+	resolvedRoot, _ := filepath.EvalSymlinks(root)
+
+	allowed := map[string]string{
+		filepath.Join(root, "data", "file.txt"):       filepath.Join(resolvedRoot, "data", "file.txt"),
+		filepath.Join(root, "new", "dir", "file.txt"): filepath.Join(resolvedRoot, "new", "dir", "file.txt"),
+		filepath.Join(outside, "inside", "file.txt"):  filepath.Join(resolvedRoot, "data", "file.txt"),
+		root:                              resolvedRoot,
+		filepath.Join(root, "data") + "/": filepath.Join(resolvedRoot, "data") + "/",
+		filepath.Join(root, "data", "..", "other.txt"): filepath.Join(resolvedRoot, "other.txt"),
+	}
+	for input, expected := range allowed {
+		p, err := manager.CheckLocalPath("session", input)
+		if err != nil {
+			t.Errorf("Expected %s to be allowed, got %v", input, err)
+		} else if p != expected {
+			t.Errorf("Expected %s to resolve to %s, got %s", input, expected, p)
+		}
+	}
+
+	denied := []string{
+		"/etc/passwd",
+		filepath.Join(root, "..", "secret"),
+		filepath.Join(root, "escape", "file.txt"),
+		filepath.Join(root, "escape", "missing", "file.txt"),
+		root + "-sibling",
+	}
+	for _, input := range denied {
+		if _, err := manager.CheckLocalPath("session", input); err == nil {
+			t.Errorf("Expected %s to be denied", input)
+		}
+	}
+}
+
+func TestCheckRemotePath(t *testing.T) {
+	// Without rules every path is allowed
+	manager := NewManager(Config{})
+	if err := manager.CheckRemotePath("session", "db-1", "/etc/shadow", AccessRead); err != nil {
+		t.Errorf("Expected unrestricted access, got %v", err)
+	}
+
+	manager = NewManager(Config{
+		RemotePathRules: []RemotePathRule{
+			{Host: "*.example.com", Path: "/srv/app", Access: []PathAccess{AccessWrite, AccessDelete}},
+			{Path: "/etc/shadow", Deny: true},
+			{Host: "db-1", Path: "/var/lib/db/", Access: []PathAccess{AccessRead}, Deny: true},
+		},
+	})
+
+	tests := []struct {
+		host    string
+		path    string
+		access  PathAccess
+		allowed bool
+	}{
+		{"web.example.com", "/srv/app/config.yml", AccessWrite, true},
+		{"web.example.com:22", "/srv/app", AccessDelete, true},
+		{"web.example.com", "/srv/application", AccessWrite, false},
+		{"web.example.com", "/srv/app/../../etc/passwd", AccessWrite, false},
+		{"web.example.com", "/etc/passwd", AccessRead, true},
+		{"web.example.com", "/etc/shadow", AccessRead, false},
+		{"web.example.com", "/etc//./shadow", AccessRead, false},
+		{"other", "/tmp/file", AccessWrite, true},
+		{"other", "/etc/shadow", AccessWrite, false},
+		{"db-1", "/var/lib/db/data", AccessRead, false},
+		{"db-1", "/var/lib/db/data", AccessWrite, true},
+		{"db-2", "/var/lib/db/data", AccessRead, true},
+		{"other", "relative/path", AccessRead, false},
+	}
+
+	for _, tt := range tests {
+		err := manager.CheckRemotePath("session", tt.host, tt.path, tt.access)
+		if tt.allowed && err != nil {
+			t.Errorf("Expected %s access to %s on %s to be allowed, got %v", tt.access, tt.path, tt.host, err)
+		}
+		if !tt.allowed && err == nil {
+			t.Errorf("Expected %s access to %s on %s to be denied", tt.access, tt.path, tt.host)
+		}
+	}
+
+	// Trees containing a denied path are denied as a whole
+	if err := manager.CheckRemoteTree("session", "other", "/etc", AccessRead); err == nil {
+		t.Error("Expected tree containing /etc/shadow to be denied")
+	}
+	if err := manager.CheckRemotePath("session", "other", "/etc", AccessRead); err != nil {
+		t.Errorf("Expected /etc itself to be allowed, got %v", err)
+	}
+	if err := manager.CheckRemoteTree("session", "other", "/srv", AccessRead); err != nil {
+		t.Errorf("Expected tree without denied paths to be allowed, got %v", err)
+	}
+}
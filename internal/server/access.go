@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+
+	"github.com/mark3labs/mcp-go/server"
+
+	"ssh-mcp/internal/file"
+	"ssh-mcp/internal/session"
+)
+
+// sessionArgs are the tool arguments that name an SSH session
+var sessionArgs = []string{"sessionId", "sourceSessionId", "destinationSessionId"}
+
+// clientSessionID returns the ID of the MCP client session a call came from, or an empty
+// string if it did not come from one
+func clientSessionID(ctx context.Context) string {
+	if clientSession := server.ClientSessionFromContext(ctx); clientSession != nil {
+		return clientSession.SessionID()
+	}
+	return ""
+}
+
+// resolveSessions replaces session labels in the arguments that name an SSH session with
+// the session IDs, so every tool accepts a label wherever it takes a session ID. Labels are
+// looked up among the calling client's sessions, or all sessions if all is set.
+func resolveSessions(ctx context.Context, sessionManager *session.Manager, args map[string]interface{}, all bool) error {
+	owner := clientSessionID(ctx)
+	for _, name := range sessionArgs {
+		if ref := getStringOrEmpty(args[name]); ref != "" {
+			id, err := sessionManager.ResolveSession(ref, owner, all)
+			if err != nil {
+				return err
+			}
+			args[name] = id
+		}
+	}
+	return nil
+}
+
+// checkAccess verifies that the SSH sessions, forwards and subscriptions a tool call names
+// belong to the MCP client making the call, so that clients sharing the HTTP transport
+// cannot use each other's sessions
+func checkAccess(ctx context.Context, sessionManager *session.Manager, fileOps *file.Operations, args map[string]interface{}) error {
+	owner := clientSessionID(ctx)
+	for _, name := range sessionArgs {
+		if id := getStringOrEmpty(args[name]); id != "" {
+			if err := sessionManager.CheckOwner(id, owner); err != nil {
+				return err
+			}
+		}
+	}
+	if id := getStringOrEmpty(args["forwardId"]); id != "" {
+		if err := sessionManager.CheckForwardOwner(id, owner); err != nil {
+			return err
+		}
+	}
+	if id := getStringOrEmpty(args["subscriptionId"]); id != "" {
+		if err := fileOps.CheckSubscriptionOwner(id, owner); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"net/url"
+	"strings"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+
+	"ssh-mcp/internal/file"
+)
+
+// newTailNotifier returns a function that forwards new lines of a followed file to the
+// calling client as MCP log message notifications. The notifications outlive the tool
+// call, so they are addressed to the client session rather than the request.
+// It returns nil if the call did not come from an MCP client session.
+func newTailNotifier(ctx context.Context, path string) func(string, []file.TailLine) {
+	mcpServer := server.ServerFromContext(ctx)
+	clientSession := server.ClientSessionFromContext(ctx)
+	if mcpServer == nil || clientSession == nil {
+		return nil
+	}
+	clientSessionID := clientSession.SessionID()
+
+	return func(subscriptionID string, lines []file.TailLine) {
+		params := map[string]any{
+			"level":  "info",
+			"logger": "ssh_tail",
+			"data": map[string]any{
+				"subscriptionId": subscriptionID,
+				"path":           path,
+				"lines":          lines,
+				"cursor":         lines[len(lines)-1].Cursor,
+			},
+		}
+
+		// Notifications are best effort, the lines can still be read by cursor
+		mcpServer.SendNotificationToSpecificClient(clientSessionID, "notifications/message", params)
+	}
+}
+
+// newWatchNotifier returns a function that reports changes below a watched path to the
+// calling client as MCP resource updated notifications, one per changed path. The URIs
+// match the remote file resource template, so the client can read the changed files.
+// mcp-go does not handle resources/subscribe, so the watch itself is the subscription.
+// It returns nil if the call did not come from an MCP client session.
+func newWatchNotifier(ctx context.Context, sessionID string) func(string, []file.WatchEvent) {
+	mcpServer := server.ServerFromContext(ctx)
+	clientSession := server.ClientSessionFromContext(ctx)
+	if mcpServer == nil || clientSession == nil {
+		return nil
+	}
+	clientSessionID := clientSession.SessionID()
+
+	return func(subscriptionID string, events []file.WatchEvent) {
+		for _, event := range events {
+			params := map[string]any{
+				"uri":            remoteResourceURI(sessionID, event.Path),
+				"subscriptionId": subscriptionID,
+				"type":           event.Type,
+				"path":           event.Path,
+				"dir":            event.Dir,
+				"cursor":         event.Cursor,
+			}
+
+			// Notifications are best effort, the events can still be read by cursor
+			mcpServer.SendNotificationToSpecificClient(clientSessionID, mcp.MethodNotificationResourceUpdated, params)
+		}
+	}
+}
+
+// remoteResourceURI identifies a path on the host of an SSH session, as ssh://<session>/<path>
+func remoteResourceURI(sessionID, p string) string {
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return "ssh://" + url.QueryEscape(sessionID) + (&url.URL{Path: p}).EscapedPath()
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+
+	"ssh-mcp/internal/file"
+)
+
+// progressInterval is the minimum time between two progress notifications
+const progressInterval = 500 * time.Millisecond
+
+// progressTokenKey is the context key for the progress token of a tool call
+type progressTokenKey struct{}
+
+// withProgressToken stores the progress token of a tool call in the context, if the client sent one
+func withProgressToken(ctx context.Context, request mcp.CallToolRequest) context.Context {
+	if request.Params.Meta == nil || request.Params.Meta.ProgressToken == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, progressTokenKey{}, request.Params.Meta.ProgressToken)
+}
+
+// newProgressNotifier returns a ProgressFunc that reports transfer progress to the calling
+// client as MCP progress notifications. It returns nil if the client did not ask for progress.
+func newProgressNotifier(ctx context.Context, operation string) file.ProgressFunc {
+	token := ctx.Value(progressTokenKey{})
+	mcpServer := server.ServerFromContext(ctx)
+	if token == nil || mcpServer == nil {
+		return nil
+	}
+
+	var (
+		mu       sync.Mutex
+		started  bool
+		start    time.Time
+		offset   int64
+		lastSent time.Time
+	)
+
+	return func(transferred, total int64) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		// A resumed transfer starts at the bytes already present, which must not count
+		// towards the rate
+		now := time.Now()
+		if !started {
+			started, start, offset = true, now, transferred
+		}
+
+		// Throttle updates, but always report completion
+		if now.Sub(lastSent) < progressInterval && transferred != total {
+			return
+		}
+		lastSent = now
+
+		rate := float64(0)
+		if elapsed := now.Sub(start).Seconds(); elapsed > 0 {
+			rate = float64(transferred-offset) / elapsed
+		}
+
+		message := fmt.Sprintf("%s: %s", operation, formatBytes(transferred))
+		if total > 0 {
+			message += " of " + formatBytes(total)
+		}
+		message += fmt.Sprintf(" at %s/s", formatBytes(int64(rate)))
+
+		params := map[string]any{
+			"progressToken": token,
+			"progress":      transferred,
+			"message":       message,
+		}
+		if total > 0 {
+			params["total"] = total
+		}
+
+		if err := mcpServer.SendNotificationToClient(ctx, "notifications/progress", params); err != nil {
+			// Progress is best effort, a failed notification must not abort the transfer
+			return
+		}
+	}
+}
+
+// formatBytes formats a byte count using binary units
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"unicode/utf8"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+
+	"ssh-mcp/internal/file"
+	"ssh-mcp/internal/session"
+)
+
+// remoteResourceTemplate matches the URIs built by remoteResourceURI. The reserved
+// expansion lets the path contain slashes.
+const remoteResourceTemplate = "ssh://{sessionId}/{+path}"
+
+// newRemoteResourceHandler returns a handler that reads the remote files named by
+// ssh://<session>/<path> URIs, such as those in watch notifications. Sessions are
+// checked like the session arguments of tools.
+func newRemoteResourceHandler(sessionManager *session.Manager, fileOps *file.Operations, admin bool) server.ResourceTemplateHandlerFunc {
+	return func(ctx context.Context, request mcp.ReadResourceRequest) ([]mcp.ResourceContents, error) {
+		sessionID, remotePath, err := parseRemoteResourceURI(request.Params.URI)
+		if err != nil {
+			return nil, err
+		}
+
+		args := map[string]interface{}{"sessionId": sessionID}
+		if err := resolveSessions(ctx, sessionManager, args, admin); err != nil {
+			return nil, err
+		}
+		if !admin {
+			if err := checkAccess(ctx, sessionManager, fileOps, args); err != nil {
+				return nil, err
+			}
+		}
+
+		content, err := fileOps.ReadFile(getStringOrEmpty(args["sessionId"]), remotePath)
+		if err != nil {
+			return nil, err
+		}
+
+		if utf8.Valid(content.Data) {
+			return []mcp.ResourceContents{
+				mcp.TextResourceContents{
+					URI:      request.Params.URI,
+					MIMEType: "text/plain",
+					Text:     string(content.Data),
+				},
+			}, nil
+		}
+		return []mcp.ResourceContents{
+			mcp.BlobResourceContents{
+				URI:      request.Params.URI,
+				MIMEType: "application/octet-stream",
+				Blob:     base64.StdEncoding.EncodeToString(content.Data),
+			},
+		}, nil
+	}
+}
+
+// parseRemoteResourceURI returns the session and path of a URI built by remoteResourceURI
+func parseRemoteResourceURI(uri string) (string, string, error) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "ssh" || u.Host == "" || u.RawQuery != "" {
+		return "", "", fmt.Errorf("invalid resource URI %q", uri)
+	}
+	sessionID, err := url.QueryUnescape(u.Host)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid resource URI %q", uri)
+	}
+	if u.Path == "" {
+		return sessionID, "/", nil
+	}
+	return sessionID, u.Path, nil
+}
@@ -9,8 +9,10 @@ import (
 	"github.com/mark3labs/mcp-go/mcp"
 	"github.com/mark3labs/mcp-go/server"
 
+	"ssh-mcp/internal/file"
 	"ssh-mcp/internal/security"
 	"ssh-mcp/internal/session"
+	"ssh-mcp/internal/ssh"
 )
 
 // Config holds configuration for the MCP server
@@ -20,6 +22,26 @@ type Config struct {
 	CleanupInterval time.Duration
 	RateLimit       time.Duration
 	LoggingEnabled  bool
+
+	// AllowedLocalRoots confines the local side of file transfers to these directories.
+	// If empty, local paths are not restricted.
+	AllowedLocalRoots []string
+
+	// RemotePathRules grant or deny read, write and delete access to remote paths per host.
+	// If empty, remote paths are not restricted.
+	RemotePathRules []security.RemotePathRule
+
+	// MaxChannels caps the concurrent session channels per SSH connection, which is shared
+	// by sessions connecting with the same credentials. It should match the servers' MaxSessions.
+	MaxChannels int
+
+	// Admin lets every MCP client list and use all SSH sessions. By default a client only
+	// sees and uses the sessions it created.
+	Admin bool
+
+	// ProxyRules set the proxy or proxy command SSH servers are reached through per host.
+	// If empty, the ALL_PROXY and HTTPS_PROXY environment variables apply.
+	ProxyRules []ssh.ProxyRule
 }
 
 // DefaultConfig returns a default configuration
@@ -28,6 +50,7 @@ func DefaultConfig() Config {
 		Port:            8081,
 		SessionExpiry:   30 * time.Minute,
 		CleanupInterval: 5 * time.Minute,
+		MaxChannels:     session.DefaultMaxChannels,
 		//RateLimit:       time.Second * 1,
 		LoggingEnabled: true,
 	}
@@ -37,10 +60,13 @@ func DefaultConfig() Config {
 func SetupServer(config Config) (*server.MCPServer, *session.Manager, error) {
 	// Initialize components
 	sessionManager := session.NewManager(config.SessionExpiry)
+	sessionManager.SetMaxChannels(config.MaxChannels)
 	sessionManager.StartCleanupRoutine(config.CleanupInterval)
 
 	securityManager := security.NewManager(security.Config{
-		LoggingEnabled: config.LoggingEnabled,
+		LoggingEnabled:    config.LoggingEnabled,
+		AllowedLocalRoots: config.AllowedLocalRoots,
+		RemotePathRules:   config.RemotePathRules,
 		//RateLimit:      config.RateLimit,
 	})
 	securityManager.StartCleanupRoutine(config.CleanupInterval, config.SessionExpiry)
@@ -65,12 +91,14 @@ func SetupServer(config Config) (*server.MCPServer, *session.Manager, error) {
 		"ssh-mcp",
 		"0.1.0",
 		server.WithToolCapabilities(true),
+		server.WithResourceCapabilities(false, false),
 		server.WithLogging(),
 		server.WithHooks(hooks),
 	)
 
 	// Get all tools
-	tools := GetTools(sessionManager, securityManager)
+	fileOps := file.NewOperations(sessionManager, securityManager)
+	tools := GetTools(sessionManager, securityManager, fileOps, config)
 
 	// Register all tools
 	for _, tool := range tools {
@@ -81,15 +109,51 @@ func SetupServer(config Config) (*server.MCPServer, *session.Manager, error) {
 
 		mcpServer.AddTool(mcpTool, func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
 			// Convert the handler to the new format
-			handler, ok := tool.Handler.(func(args map[string]interface{}) (*mcp.CallToolResult, error))
+			handler, ok := tool.Handler.(func(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error))
 			if !ok {
 				return nil, fmt.Errorf("invalid handler for tool %s", tool.Name)
 			}
 
-			return handler(request.GetArguments())
+			// Sessions belong to the client that created them
+			args := request.GetArguments()
+			if err := resolveSessions(ctx, sessionManager, args, config.Admin); err != nil {
+				return &mcp.CallToolResult{
+					Content: []mcp.Content{
+						mcp.TextContent{
+							Type: "text",
+							Text: "Access error: " + err.Error(),
+						},
+					},
+				}, err
+			}
+			if !config.Admin {
+				if err := checkAccess(ctx, sessionManager, fileOps, args); err != nil {
+					return &mcp.CallToolResult{
+						Content: []mcp.Content{
+							mcp.TextContent{
+								Type: "text",
+								Text: "Access error: " + err.Error(),
+							},
+						},
+					}, err
+				}
+			}
+
+			// The context carries cancellation of the request and its progress token
+			return handler(withProgressToken(ctx, request), args)
 		})
 	}
 
+	// Remote files, as named by watch notifications, can be read as resources
+	mcpServer.AddResourceTemplate(
+		mcp.NewResourceTemplate(
+			remoteResourceTemplate,
+			"Remote file",
+			mcp.WithTemplateDescription("The content of a file on the host of an SSH session, up to 1 MiB"),
+		),
+		newRemoteResourceHandler(sessionManager, fileOps, config.Admin),
+	)
+
 	return mcpServer, sessionManager, nil
 }
 
@@ -1,11 +1,19 @@
 package server
 
 import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/mark3labs/mcp-go/mcp"
 
 	"ssh-mcp/internal/file"
+	"ssh-mcp/internal/output"
 	"ssh-mcp/internal/security"
 	"ssh-mcp/internal/session"
 	"ssh-mcp/internal/ssh"
@@ -45,6 +53,127 @@ func getIntOrDefault(value interface{}, defaultValue int) int {
 	return defaultValue
 }
 
+// getBoolOrDefault safely converts an interface value to bool
+// Returns defaultValue if the value is nil or cannot be converted to bool
+func getBoolOrDefault(value interface{}, defaultValue bool) bool {
+	if value == nil {
+		return defaultValue
+	}
+
+	switch v := value.(type) {
+	case bool:
+		return v
+	case string:
+		// Try to parse string to bool, but return default on failure
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	}
+
+	return defaultValue
+}
+
+// getStringSlice safely converts an interface value to a slice of strings
+// Non-string elements are skipped; returns nil if the value is not a list
+func getStringSlice(value interface{}) []string {
+	switch v := value.(type) {
+	case []string:
+		return v
+	case []interface{}:
+		result := make([]string, 0, len(v))
+		for _, item := range v {
+			if str, ok := item.(string); ok {
+				result = append(result, str)
+			}
+		}
+		return result
+	}
+
+	return nil
+}
+
+// describeTransfer formats the optional details of a completed file transfer
+func describeTransfer(result *file.TransferResult) string {
+	details := fmt.Sprintf(" (%d bytes", result.Size)
+	if result.ResumedFrom > 0 {
+		details += fmt.Sprintf(", resumed at %d", result.ResumedFrom)
+	}
+	if result.SHA256 != "" {
+		details += ", sha256 " + result.SHA256
+	}
+	return details + ")"
+}
+
+// outputContent turns raw command or file output into tool result content. Text is decoded
+// and cleaned of ANSI sequences as requested and also returned on its own; binary output is
+// returned base64 encoded, either as text or as an embedded resource identified by uri.
+func outputContent(data []byte, opts output.Options, binary, uri string) ([]mcp.Content, *string, error) {
+	if binary == "" {
+		binary = "base64"
+	}
+	if binary != "base64" && binary != "resource" {
+		return nil, nil, fmt.Errorf("invalid binary mode %q, expected base64 or resource", binary)
+	}
+
+	result, err := output.Process(data, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !result.Binary {
+		return []mcp.Content{mcp.TextContent{Type: "text", Text: result.Text}}, &result.Text, nil
+	}
+
+	blob := base64.StdEncoding.EncodeToString(result.Data)
+	if binary == "resource" {
+		return []mcp.Content{mcp.NewEmbeddedResource(mcp.BlobResourceContents{
+			URI:      uri,
+			MIMEType: result.MIMEType,
+			Blob:     blob,
+		})}, nil, nil
+	}
+
+	text := fmt.Sprintf("Binary output (%d bytes, %s), base64 encoded. If this is text in a legacy encoding, pass it as encoding.\n%s",
+		len(result.Data), result.MIMEType, blob)
+	return []mcp.Content{mcp.TextContent{Type: "text", Text: text}}, nil, nil
+}
+
+// checkRemoteSocket verifies that a remote Unix socket may be connected to under the remote
+// path rules. Connecting needs write permission on the socket, so it is checked as a write.
+func checkRemoteSocket(sessionManager *session.Manager, securityManager *security.Manager, sessionID, socketPath string) error {
+	if socketPath == "" {
+		return nil
+	}
+	sess, err := sessionManager.GetSession(sessionID)
+	if err != nil {
+		return err
+	}
+	return securityManager.CheckRemotePath(sessionID, sess.Host, socketPath, security.AccessWrite)
+}
+
+// describeForward summarises a forward on one line
+func describeForward(info session.ForwardInfo) string {
+	text := fmt.Sprintf("%s: %s %s", info.ID, info.Kind, info.Listen)
+	if info.Target != "" {
+		text += " -> " + info.Target
+	}
+	return text + " (session " + info.SessionID + ")"
+}
+
+// describeChange summarises a change journal entry on one line
+func describeChange(change file.Change) string {
+	text := fmt.Sprintf("#%d %s %s %s", change.ID, change.Time.Format(time.RFC3339), change.Operation, change.Path)
+	if !change.Existed {
+		text += " (created)"
+	}
+	if change.Error != "" {
+		text += " (failed: " + change.Error + ")"
+	}
+	if change.RolledBack {
+		text += " (rolled back)"
+	}
+	return text
+}
+
 // Tool represents a tool that can be registered with the MCP server
 type Tool struct {
 	Name    string
@@ -53,9 +182,9 @@ type Tool struct {
 }
 
 // GetTools returns all available tools for the SSH MCP server
-func GetTools(sessionManager *session.Manager, securityManager *security.Manager) []Tool {
+func GetTools(sessionManager *session.Manager, securityManager *security.Manager, fileOps *file.Operations, config Config) []Tool {
 	sshClient := ssh.NewClient(sessionManager)
-	fileOps := file.NewOperations(sessionManager)
+	sshClient.SetProxyRules(config.ProxyRules)
 
 	return []Tool{
 		{
@@ -82,8 +211,22 @@ func GetTools(sessionManager *session.Manager, securityManager *security.Manager
 					mcp.DefaultString(""),
 					mcp.Description("Path to the private key file for authentication. If using password, this can be left empty."),
 				),
+				mcp.WithString("proxy",
+					mcp.Description("socks5://, http:// or https:// proxy URL to connect through, or none for a direct connection. By default the server's proxy rules apply, then ALL_PROXY or HTTPS_PROXY"),
+				),
+				mcp.WithBoolean("reuse",
+					mcp.DefaultBool(true),
+					mcp.Description("Share an existing connection made with the same credentials instead of opening a new one. The connection is closed when its last session is disconnected"),
+				),
+				mcp.WithString("label",
+					mcp.Description("Name to refer to the session by. Any tool's sessionId accepts it in place of the session ID"),
+				),
+				mcp.WithArray("tags",
+					mcp.WithStringItems(),
+					mcp.Description("Tags to filter ssh_list_sessions by, e.g. prod or db"),
+				),
 			},
-			Handler: func(args map[string]interface{}) (*mcp.CallToolResult, error) {
+			Handler: func(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
 				// Convert map to SSHConnectArgs
 				connectArgs := ssh.SSHConnectArgs{
 					Host:     getStringOrEmpty(args["host"]),
@@ -91,6 +234,10 @@ func GetTools(sessionManager *session.Manager, securityManager *security.Manager
 					Username: getStringOrEmpty(args["username"]),
 					Password: getStringOrEmpty(args["password"]),
 					KeyPath:  getStringOrEmpty(args["keyPath"]),
+					Proxy:    getStringOrEmpty(args["proxy"]),
+					Reuse:    getBoolOrDefault(args["reuse"], true),
+					Label:    getStringOrEmpty(args["label"]),
+					Tags:     getStringSlice(args["tags"]),
 				}
 
 				// Check security
@@ -105,7 +252,7 @@ func GetTools(sessionManager *session.Manager, securityManager *security.Manager
 					}, err
 				}
 
-				sessionID, err := sshClient.Connect(connectArgs)
+				sessionID, err := sshClient.Connect(connectArgs, clientSessionID(ctx))
 				if err != nil {
 					return &mcp.CallToolResult{
 						Content: []mcp.Content{
@@ -117,11 +264,16 @@ func GetTools(sessionManager *session.Manager, securityManager *security.Manager
 					}, err
 				}
 
+				text := "Connected. Session ID: " + sessionID
+				if connectArgs.Label != "" {
+					text += " (label: " + connectArgs.Label + ")"
+				}
+
 				return &mcp.CallToolResult{
 					Content: []mcp.Content{
 						mcp.TextContent{
 							Type: "text",
-							Text: "Connected. Session ID: " + sessionID,
+							Text: text,
 						},
 					},
 				}, nil
@@ -143,12 +295,28 @@ func GetTools(sessionManager *session.Manager, securityManager *security.Manager
 					mcp.DefaultNumber(30),
 					mcp.Description("Command execution timeout in seconds"),
 				),
+				mcp.WithString("encoding",
+					mcp.Description("Character encoding of the output if it is not UTF-8, e.g. latin1, windows-1252, shift_jis or utf-16le"),
+				),
+				mcp.WithString("ansi",
+					mcp.DefaultString("strip"),
+					mcp.Enum("strip", "keep", "escape"),
+					mcp.Description("ANSI escape sequences such as colours: strip them, keep them, or make them visible as \\e"),
+				),
+				mcp.WithString("binary",
+					mcp.DefaultString("base64"),
+					mcp.Enum("base64", "resource"),
+					mcp.Description("How to return output that is not UTF-8 text: base64 encoded text, or an embedded resource"),
+				),
 			},
-			Handler: func(args map[string]interface{}) (*mcp.CallToolResult, error) {
+			Handler: func(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
 				// Convert map to SSHCommandArgs
 				commandArgs := ssh.SSHCommandArgs{
 					SessionID: getStringOrEmpty(args["sessionId"]),
 					Command:   getStringOrEmpty(args["command"]),
+					Encoding:  getStringOrEmpty(args["encoding"]),
+					ANSI:      getStringOrEmpty(args["ansi"]),
+					Binary:    getStringOrEmpty(args["binary"]),
 				}
 
 				// Check security
@@ -163,7 +331,7 @@ func GetTools(sessionManager *session.Manager, securityManager *security.Manager
 					}, err
 				}
 
-				output, err := sshClient.ExecuteCommand(commandArgs)
+				commandOutput, err := sshClient.ExecuteCommand(commandArgs)
 				if err != nil {
 					return &mcp.CallToolResult{
 						Content: []mcp.Content{
@@ -175,13 +343,23 @@ func GetTools(sessionManager *session.Manager, securityManager *security.Manager
 					}, err
 				}
 
-				return &mcp.CallToolResult{
-					Content: []mcp.Content{
-						mcp.TextContent{
-							Type: "text",
-							Text: output,
+				content, _, err := outputContent([]byte(commandOutput), output.Options{
+					Encoding: commandArgs.Encoding,
+					ANSI:     commandArgs.ANSI,
+				}, commandArgs.Binary, remoteResourceURI(commandArgs.SessionID, "")+"?command="+url.QueryEscape(commandArgs.Command))
+				if err != nil {
+					return &mcp.CallToolResult{
+						Content: []mcp.Content{
+							mcp.TextContent{
+								Type: "text",
+								Text: "Output error: " + err.Error(),
+							},
 						},
-					},
+					}, err
+				}
+
+				return &mcp.CallToolResult{
+					Content: content,
 				}, nil
 			},
 		},
@@ -194,7 +372,7 @@ func GetTools(sessionManager *session.Manager, securityManager *security.Manager
 					mcp.Description("The SSH session identifier"),
 				),
 			},
-			Handler: func(args map[string]interface{}) (*mcp.CallToolResult, error) {
+			Handler: func(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
 				// Convert map to SSHDisconnectArgs
 				disconnectArgs := ssh.SSHDisconnectArgs{
 					SessionID: getStringOrEmpty(args["sessionId"]),
@@ -226,9 +404,36 @@ func GetTools(sessionManager *session.Manager, securityManager *security.Manager
 			Name: "ssh_list_sessions",
 			Opts: []mcp.ToolOption{
 				mcp.WithDescription("List active SSH sessions"),
+				mcp.WithString("host",
+					mcp.Description("Only list sessions to hosts matching this name or pattern, e.g. *.example.com or 10.0.0.0/8"),
+				),
+				mcp.WithString("tag",
+					mcp.Description("Only list sessions with this tag"),
+				),
+				mcp.WithNumber("minIdle",
+					mcp.Description("Only list sessions idle for at least this many seconds"),
+				),
+				mcp.WithNumber("maxIdle",
+					mcp.Description("Only list sessions idle for at most this many seconds"),
+				),
 			},
-			Handler: func(args map[string]interface{}) (*mcp.CallToolResult, error) {
-				sessions := sshClient.ListSessions()
+			Handler: func(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
+				listArgs := ssh.SSHListSessionsArgs{
+					Host:    getStringOrEmpty(args["host"]),
+					Tag:     getStringOrEmpty(args["tag"]),
+					MinIdle: getIntOrDefault(args["minIdle"], 0),
+					MaxIdle: getIntOrDefault(args["maxIdle"], 0),
+				}
+
+				// Clients only see their own sessions unless the server runs in admin mode
+				owner := clientSessionID(ctx)
+				sessions := make([]session.SessionInfo, 0)
+				for _, sess := range sshClient.ListSessions(listArgs) {
+					if config.Admin || sess.Owner == owner {
+						sessions = append(sessions, sess)
+					}
+				}
+				structured := map[string]interface{}{"sessions": sessions}
 
 				if len(sessions) == 0 {
 					return &mcp.CallToolResult{
@@ -238,16 +443,34 @@ func GetTools(sessionManager *session.Manager, securityManager *security.Manager
 								Text: "No active SSH sessions",
 							},
 						},
+						StructuredContent: structured,
 					}, nil
 				}
 
 				result := "Active SSH Sessions:\n"
 				for _, sess := range sessions {
-					result += "- ID: " + sess["id"] + "\n"
-					result += "  Host: " + sess["host"] + "\n"
-					result += "  Username: " + sess["username"] + "\n"
-					result += "  Created: " + sess["createdAt"] + "\n"
-					result += "  Last Activity: " + sess["lastActivity"] + "\n\n"
+					result += "- ID: " + sess.ID + "\n"
+					if sess.Label != "" {
+						result += "  Label: " + sess.Label + "\n"
+					}
+					if len(sess.Tags) > 0 {
+						result += "  Tags: " + strings.Join(sess.Tags, ", ") + "\n"
+					}
+					result += "  Host: " + sess.Host + "\n"
+					result += "  Username: " + sess.Username + "\n"
+					result += "  Created: " + sess.CreatedAt.Format(time.RFC3339) + "\n"
+					result += "  Last Activity: " + sess.LastActivity.Format(time.RFC3339) + "\n"
+					result += fmt.Sprintf("  Idle: %ds\n", sess.IdleSeconds)
+					if config.Admin && sess.Owner != "" {
+						result += "  Owner: " + sess.Owner + "\n"
+					}
+					if sess.SharedSessions > 1 {
+						result += fmt.Sprintf("  Connection: shared by %d sessions\n", sess.SharedSessions)
+					}
+					for _, forward := range sshClient.ListForwards(sess.ID) {
+						result += "  Forward: " + describeForward(forward.Info()) + "\n"
+					}
+					result += "\n"
 				}
 
 				return &mcp.CallToolResult{
@@ -257,6 +480,7 @@ func GetTools(sessionManager *session.Manager, securityManager *security.Manager
 							Text: result,
 						},
 					},
+					StructuredContent: structured,
 				}, nil
 			},
 		},
@@ -276,17 +500,37 @@ func GetTools(sessionManager *session.Manager, securityManager *security.Manager
 					mcp.Required(),
 					mcp.Description("Destination file path"),
 				),
+				mcp.WithBoolean("resume",
+					mcp.DefaultBool(false),
+					mcp.Description("Resume from the partial file left by an interrupted transfer instead of starting over"),
+				),
+				mcp.WithBoolean("verify",
+					mcp.DefaultBool(false),
+					mcp.Description("Verify the transferred file against the remote sha256sum"),
+				),
+				mcp.WithBoolean("backup",
+					mcp.DefaultBool(false),
+					mcp.Description("Save the file being overwritten in the session's change journal, so that ssh_rollback can restore it"),
+				),
 			},
-			Handler: func(args map[string]interface{}) (*mcp.CallToolResult, error) {
+			Handler: func(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
 				// Convert map to SSHFileTransferArgs
 				transferArgs := ssh.SSHFileTransferArgs{
 					SessionID:   getStringOrEmpty(args["sessionId"]),
 					Source:      getStringOrEmpty(args["source"]),
 					Destination: getStringOrEmpty(args["destination"]),
 					Direction:   "upload",
+					Resume:      getBoolOrDefault(args["resume"], false),
+					Verify:      getBoolOrDefault(args["verify"], false),
+					Backup:      getBoolOrDefault(args["backup"], false),
 				}
 
-				err := fileOps.Upload(transferArgs.SessionID, transferArgs.Source, transferArgs.Destination)
+				transfer, err := fileOps.Upload(ctx, transferArgs.SessionID, transferArgs.Source, transferArgs.Destination, file.TransferOptions{
+					Resume:   transferArgs.Resume,
+					Verify:   transferArgs.Verify,
+					Backup:   transferArgs.Backup,
+					Progress: newProgressNotifier(ctx, "upload"),
+				})
 				if err != nil {
 					return &mcp.CallToolResult{
 						Content: []mcp.Content{
@@ -302,9 +546,10 @@ func GetTools(sessionManager *session.Manager, securityManager *security.Manager
 					Content: []mcp.Content{
 						mcp.TextContent{
 							Type: "text",
-							Text: "File uploaded successfully",
+							Text: "File uploaded successfully" + describeTransfer(transfer),
 						},
 					},
+					StructuredContent: transfer,
 				}, nil
 			},
 		},
@@ -324,17 +569,31 @@ func GetTools(sessionManager *session.Manager, securityManager *security.Manager
 					mcp.Required(),
 					mcp.Description("Destination file path"),
 				),
+				mcp.WithBoolean("resume",
+					mcp.DefaultBool(false),
+					mcp.Description("Resume from the partial file left by an interrupted transfer instead of starting over"),
+				),
+				mcp.WithBoolean("verify",
+					mcp.DefaultBool(false),
+					mcp.Description("Verify the transferred file against the remote sha256sum"),
+				),
 			},
-			Handler: func(args map[string]interface{}) (*mcp.CallToolResult, error) {
+			Handler: func(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
 				// Convert map to SSHFileTransferArgs
 				transferArgs := ssh.SSHFileTransferArgs{
 					SessionID:   getStringOrEmpty(args["sessionId"]),
 					Source:      getStringOrEmpty(args["source"]),
 					Destination: getStringOrEmpty(args["destination"]),
 					Direction:   "download",
+					Resume:      getBoolOrDefault(args["resume"], false),
+					Verify:      getBoolOrDefault(args["verify"], false),
 				}
 
-				err := fileOps.Download(transferArgs.SessionID, transferArgs.Source, transferArgs.Destination)
+				transfer, err := fileOps.Download(ctx, transferArgs.SessionID, transferArgs.Source, transferArgs.Destination, file.TransferOptions{
+					Resume:   transferArgs.Resume,
+					Verify:   transferArgs.Verify,
+					Progress: newProgressNotifier(ctx, "download"),
+				})
 				if err != nil {
 					return &mcp.CallToolResult{
 						Content: []mcp.Content{
@@ -350,9 +609,77 @@ func GetTools(sessionManager *session.Manager, securityManager *security.Manager
 					Content: []mcp.Content{
 						mcp.TextContent{
 							Type: "text",
-							Text: "File downloaded successfully",
+							Text: "File downloaded successfully" + describeTransfer(transfer),
+						},
+					},
+					StructuredContent: transfer,
+				}, nil
+			},
+		},
+		{
+			Name: "ssh_copy_between_sessions",
+			Opts: []mcp.ToolOption{
+				mcp.WithDescription("Copy a file from one SSH server to another, streaming it through memory without touching the local disk"),
+				mcp.WithString("sourceSessionId",
+					mcp.Required(),
+					mcp.Description("The SSH session to copy from"),
+				),
+				mcp.WithString("sourcePath",
+					mcp.Required(),
+					mcp.Description("File path on the source server"),
+				),
+				mcp.WithString("destinationSessionId",
+					mcp.Required(),
+					mcp.Description("The SSH session to copy to"),
+				),
+				mcp.WithString("destinationPath",
+					mcp.Required(),
+					mcp.Description("File path on the destination server"),
+				),
+				mcp.WithBoolean("verify",
+					mcp.DefaultBool(false),
+					mcp.Description("Verify the streamed SHA-256 against sha256sum on both servers"),
+				),
+				mcp.WithBoolean("backup",
+					mcp.DefaultBool(false),
+					mcp.Description("Save the destination file being overwritten in the destination session's change journal, so that ssh_rollback can restore it"),
+				),
+			},
+			Handler: func(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
+				// Convert map to SSHCopyBetweenSessionsArgs
+				copyArgs := ssh.SSHCopyBetweenSessionsArgs{
+					SourceSessionID:      getStringOrEmpty(args["sourceSessionId"]),
+					SourcePath:           getStringOrEmpty(args["sourcePath"]),
+					DestinationSessionID: getStringOrEmpty(args["destinationSessionId"]),
+					DestinationPath:      getStringOrEmpty(args["destinationPath"]),
+					Verify:               getBoolOrDefault(args["verify"], false),
+					Backup:               getBoolOrDefault(args["backup"], false),
+				}
+
+				transfer, err := fileOps.CopyBetweenSessions(ctx, copyArgs.SourceSessionID, copyArgs.SourcePath, copyArgs.DestinationSessionID, copyArgs.DestinationPath, file.TransferOptions{
+					Verify:   copyArgs.Verify,
+					Backup:   copyArgs.Backup,
+					Progress: newProgressNotifier(ctx, "copy"),
+				})
+				if err != nil {
+					return &mcp.CallToolResult{
+						Content: []mcp.Content{
+							mcp.TextContent{
+								Type: "text",
+								Text: "Copy error: " + err.Error(),
+							},
+						},
+					}, err
+				}
+
+				return &mcp.CallToolResult{
+					Content: []mcp.Content{
+						mcp.TextContent{
+							Type: "text",
+							Text: "File copied successfully" + describeTransfer(transfer),
 						},
 					},
+					StructuredContent: transfer,
 				}, nil
 			},
 		},
@@ -368,15 +695,53 @@ func GetTools(sessionManager *session.Manager, securityManager *security.Manager
 					mcp.Required(),
 					mcp.Description("Directory path to list"),
 				),
+				mcp.WithNumber("depth",
+					mcp.DefaultNumber(1),
+					mcp.Description("How many directory levels to descend, at most 10"),
+				),
+				mcp.WithString("pattern",
+					mcp.DefaultString(""),
+					mcp.Description("Glob pattern matched against entry names, e.g. *.log"),
+				),
+				mcp.WithString("sortBy",
+					mcp.DefaultString("name"),
+					mcp.Enum("name", "size", "mtime"),
+					mcp.Description("Sort key"),
+				),
+				mcp.WithBoolean("reverse",
+					mcp.DefaultBool(false),
+					mcp.Description("Reverse the sort order"),
+				),
+				mcp.WithNumber("offset",
+					mcp.DefaultNumber(0),
+					mcp.Description("Number of entries to skip"),
+				),
+				mcp.WithNumber("limit",
+					mcp.DefaultNumber(0),
+					mcp.Description("Maximum number of entries to return (0 for no limit)"),
+				),
 			},
-			Handler: func(args map[string]interface{}) (*mcp.CallToolResult, error) {
+			Handler: func(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
 				// Convert map to SSHListDirectoryArgs
 				listArgs := ssh.SSHListDirectoryArgs{
 					SessionID: getStringOrEmpty(args["sessionId"]),
 					Path:      getStringOrEmpty(args["path"]),
+					Depth:     getIntOrDefault(args["depth"], 1),
+					Pattern:   getStringOrEmpty(args["pattern"]),
+					SortBy:    getStringOrEmpty(args["sortBy"]),
+					Reverse:   getBoolOrDefault(args["reverse"], false),
+					Offset:    getIntOrDefault(args["offset"], 0),
+					Limit:     getIntOrDefault(args["limit"], 0),
 				}
 
-				files, err := fileOps.ListDirectory(listArgs.SessionID, listArgs.Path)
+				listing, err := fileOps.ListDirectory(listArgs.SessionID, listArgs.Path, file.ListOptions{
+					Depth:   listArgs.Depth,
+					Pattern: listArgs.Pattern,
+					SortBy:  listArgs.SortBy,
+					Reverse: listArgs.Reverse,
+					Offset:  listArgs.Offset,
+					Limit:   listArgs.Limit,
+				})
 				if err != nil {
 					return &mcp.CallToolResult{
 						Content: []mcp.Content{
@@ -388,7 +753,7 @@ func GetTools(sessionManager *session.Manager, securityManager *security.Manager
 					}, err
 				}
 
-				if len(files) == 0 {
+				if listing.Total == 0 && len(listing.Skipped) == 0 {
 					return &mcp.CallToolResult{
 						Content: []mcp.Content{
 							mcp.TextContent{
@@ -396,18 +761,29 @@ func GetTools(sessionManager *session.Manager, securityManager *security.Manager
 								Text: "Directory is empty",
 							},
 						},
+						StructuredContent: listing,
 					}, nil
 				}
 
-				result := "Directory contents of " + listArgs.Path + ":\n"
-				for _, file := range files {
-					isDir := file["isDirectory"] == "true"
-					dirMarker := ""
-					if isDir {
-						dirMarker = "/"
+				result := fmt.Sprintf("Directory contents of %s (%d of %d entries):\n", listing.Path, len(listing.Entries), listing.Total)
+				for _, entry := range listing.Entries {
+					name := entry.Name
+					if entry.Type == "directory" {
+						name += "/"
+					}
+					if entry.SymlinkTarget != "" {
+						name += " -> " + entry.SymlinkTarget
+					}
+
+					owner := entry.Owner
+					if owner == "" {
+						owner = strconv.FormatUint(uint64(entry.UID), 10)
 					}
 
-					result += file["permissions"] + " " + file["size"] + " " + file["date"] + " " + file["name"] + dirMarker + "\n"
+					result += fmt.Sprintf("%s %s %d %s %s\n", entry.Permissions, owner, entry.Size, entry.ModTime, name)
+				}
+				for _, skipped := range listing.Skipped {
+					result += "Skipped " + skipped + "\n"
 				}
 
 				return &mcp.CallToolResult{
@@ -417,6 +793,7 @@ func GetTools(sessionManager *session.Manager, securityManager *security.Manager
 							Text: result,
 						},
 					},
+					StructuredContent: listing,
 				}, nil
 			},
 		},
@@ -436,16 +813,51 @@ func GetTools(sessionManager *session.Manager, securityManager *security.Manager
 					mcp.Required(),
 					mcp.Description("Destination directory path on remote server"),
 				),
+				mcp.WithBoolean("preserve",
+					mcp.DefaultBool(false),
+					mcp.Description("Preserve permission bits and modification/access times, like scp -p"),
+				),
+				mcp.WithString("symlinks",
+					mcp.DefaultString("follow"),
+					mcp.Enum("follow", "copy", "skip"),
+					mcp.Description("How to handle symlinks: follow them, copy them as links, or skip them"),
+				),
+				mcp.WithString("mode",
+					mcp.DefaultString("scp"),
+					mcp.Enum("scp", "tar"),
+					mcp.Description("Transfer mode: scp sends one file at a time, tar streams the whole tree over a single channel and falls back to scp when the remote host has no tar"),
+				),
+				mcp.WithString("compression",
+					mcp.DefaultString("gzip"),
+					mcp.Enum("gzip", "zstd", "none"),
+					mcp.Description("Compression of the tar stream in tar mode"),
+				),
+				mcp.WithBoolean("backup",
+					mcp.DefaultBool(false),
+					mcp.Description("Save the remote directory being overwritten in the session's change journal, so that ssh_rollback can restore it"),
+				),
 			},
-			Handler: func(args map[string]interface{}) (*mcp.CallToolResult, error) {
+			Handler: func(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
 				// Convert map to SSHDirectoryUploadArgs
 				uploadArgs := ssh.SSHDirectoryUploadArgs{
 					SessionID:   getStringOrEmpty(args["sessionId"]),
 					Source:      getStringOrEmpty(args["source"]),
 					Destination: getStringOrEmpty(args["destination"]),
+					Preserve:    getBoolOrDefault(args["preserve"], false),
+					Symlinks:    getStringOrEmpty(args["symlinks"]),
+					Mode:        getStringOrEmpty(args["mode"]),
+					Compression: getStringOrEmpty(args["compression"]),
+					Backup:      getBoolOrDefault(args["backup"], false),
 				}
 
-				err := fileOps.UploadDir(uploadArgs.SessionID, uploadArgs.Source, uploadArgs.Destination)
+				err := fileOps.UploadDir(ctx, uploadArgs.SessionID, uploadArgs.Source, uploadArgs.Destination, file.DirTransferOptions{
+					Preserve:    uploadArgs.Preserve,
+					Symlinks:    uploadArgs.Symlinks,
+					Mode:        uploadArgs.Mode,
+					Compression: uploadArgs.Compression,
+					Backup:      uploadArgs.Backup,
+					Progress:    newProgressNotifier(ctx, "directory upload"),
+				})
 				if err != nil {
 					return &mcp.CallToolResult{
 						Content: []mcp.Content{
@@ -483,16 +895,45 @@ func GetTools(sessionManager *session.Manager, securityManager *security.Manager
 					mcp.Required(),
 					mcp.Description("Destination directory path on local machine"),
 				),
+				mcp.WithBoolean("preserve",
+					mcp.DefaultBool(false),
+					mcp.Description("Preserve permission bits and modification/access times, like scp -p"),
+				),
+				mcp.WithString("symlinks",
+					mcp.DefaultString("follow"),
+					mcp.Enum("follow", "copy", "skip"),
+					mcp.Description("How to handle symlinks: follow them, copy them as links, or skip them"),
+				),
+				mcp.WithString("mode",
+					mcp.DefaultString("scp"),
+					mcp.Enum("scp", "tar"),
+					mcp.Description("Transfer mode: scp sends one file at a time, tar streams the whole tree over a single channel and falls back to scp when the remote host has no tar"),
+				),
+				mcp.WithString("compression",
+					mcp.DefaultString("gzip"),
+					mcp.Enum("gzip", "zstd", "none"),
+					mcp.Description("Compression of the tar stream in tar mode"),
+				),
 			},
-			Handler: func(args map[string]interface{}) (*mcp.CallToolResult, error) {
+			Handler: func(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
 				// Convert map to SSHDirectoryDownloadArgs
 				downloadArgs := ssh.SSHDirectoryDownloadArgs{
 					SessionID:   getStringOrEmpty(args["sessionId"]),
 					Source:      getStringOrEmpty(args["source"]),
 					Destination: getStringOrEmpty(args["destination"]),
+					Preserve:    getBoolOrDefault(args["preserve"], false),
+					Symlinks:    getStringOrEmpty(args["symlinks"]),
+					Mode:        getStringOrEmpty(args["mode"]),
+					Compression: getStringOrEmpty(args["compression"]),
 				}
 
-				err := fileOps.DownloadDir(downloadArgs.SessionID, downloadArgs.Source, downloadArgs.Destination)
+				err := fileOps.DownloadDir(ctx, downloadArgs.SessionID, downloadArgs.Source, downloadArgs.Destination, file.DirTransferOptions{
+					Preserve:    downloadArgs.Preserve,
+					Symlinks:    downloadArgs.Symlinks,
+					Mode:        downloadArgs.Mode,
+					Compression: downloadArgs.Compression,
+					Progress:    newProgressNotifier(ctx, "directory download"),
+				})
 				if err != nil {
 					return &mcp.CallToolResult{
 						Content: []mcp.Content{
@@ -514,5 +955,1192 @@ func GetTools(sessionManager *session.Manager, securityManager *security.Manager
 				}, nil
 			},
 		},
+		{
+			Name: "ssh_sync_directory",
+			Opts: []mcp.ToolOption{
+				mcp.WithDescription("Synchronise a directory between the local machine and the SSH server, transferring only changed files"),
+				mcp.WithString("sessionId",
+					mcp.Required(),
+					mcp.Description("The SSH session identifier"),
+				),
+				mcp.WithString("localPath",
+					mcp.Required(),
+					mcp.Description("Directory path on local machine"),
+				),
+				mcp.WithString("remotePath",
+					mcp.Required(),
+					mcp.Description("Directory path on remote server"),
+				),
+				mcp.WithString("direction",
+					mcp.Required(),
+					mcp.Enum("upload", "download"),
+					mcp.Description("upload copies local changes to the server, download copies remote changes to the local machine"),
+				),
+				mcp.WithBoolean("delete",
+					mcp.DefaultBool(false),
+					mcp.Description("Delete destination files that do not exist in the source and replace paths that are a file on one side and a directory on the other"),
+				),
+				mcp.WithArray("exclude",
+					mcp.WithStringItems(),
+					mcp.Description(".gitignore-style patterns of paths to skip, e.g. node_modules/ or *.log"),
+				),
+				mcp.WithBoolean("dryRun",
+					mcp.DefaultBool(false),
+					mcp.Description("Only report what would change"),
+				),
+				mcp.WithString("compare",
+					mcp.DefaultString("mtime"),
+					mcp.Enum("mtime", "checksum"),
+					mcp.Description("Detect changed files by size and modification time, or by SHA-256 checksum"),
+				),
+				mcp.WithBoolean("backup",
+					mcp.DefaultBool(false),
+					mcp.Description("When uploading, save the remote directory in the session's change journal first, so that ssh_rollback can restore it"),
+				),
+			},
+			Handler: func(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
+				// Convert map to SSHSyncDirectoryArgs
+				syncArgs := ssh.SSHSyncDirectoryArgs{
+					SessionID:  getStringOrEmpty(args["sessionId"]),
+					LocalPath:  getStringOrEmpty(args["localPath"]),
+					RemotePath: getStringOrEmpty(args["remotePath"]),
+					Direction:  getStringOrEmpty(args["direction"]),
+					Delete:     getBoolOrDefault(args["delete"], false),
+					Exclude:    getStringSlice(args["exclude"]),
+					DryRun:     getBoolOrDefault(args["dryRun"], false),
+					Compare:    getStringOrEmpty(args["compare"]),
+					Backup:     getBoolOrDefault(args["backup"], false),
+				}
+
+				syncResult, err := fileOps.Sync(ctx, syncArgs.SessionID, file.SyncOptions{
+					LocalDir:  syncArgs.LocalPath,
+					RemoteDir: syncArgs.RemotePath,
+					Direction: syncArgs.Direction,
+					Delete:    syncArgs.Delete,
+					Exclude:   syncArgs.Exclude,
+					DryRun:    syncArgs.DryRun,
+					Compare:   syncArgs.Compare,
+					Backup:    syncArgs.Backup,
+					Progress:  newProgressNotifier(ctx, "sync"),
+				})
+				if err != nil {
+					return &mcp.CallToolResult{
+						Content: []mcp.Content{
+							mcp.TextContent{
+								Type: "text",
+								Text: "Sync error: " + err.Error(),
+							},
+						},
+					}, err
+				}
+
+				result := "Directory synchronised"
+				if syncResult.DryRun {
+					result = "Dry run, no changes made"
+				}
+				result += fmt.Sprintf(": %d added, %d updated, %d deleted, %d unchanged, %s transferred\n",
+					len(syncResult.Added), len(syncResult.Updated), len(syncResult.Deleted), syncResult.Unchanged, formatBytes(syncResult.Transferred))
+				for _, name := range syncResult.Added {
+					result += "+ " + name + "\n"
+				}
+				for _, name := range syncResult.Updated {
+					result += "~ " + name + "\n"
+				}
+				for _, name := range syncResult.Deleted {
+					result += "- " + name + "\n"
+				}
+				for _, name := range syncResult.Conflicts {
+					result += "! " + name + " (type differs, set delete to replace)\n"
+				}
+
+				return &mcp.CallToolResult{
+					Content: []mcp.Content{
+						mcp.TextContent{
+							Type: "text",
+							Text: result,
+						},
+					},
+					StructuredContent: syncResult,
+				}, nil
+			},
+		},
+		{
+			Name: "ssh_search",
+			Opts: []mcp.ToolOption{
+				mcp.WithDescription("Search file contents on the SSH server with rg, falling back to grep, and return structured matches"),
+				mcp.WithString("sessionId",
+					mcp.Required(),
+					mcp.Description("The SSH session identifier"),
+				),
+				mcp.WithString("path",
+					mcp.Required(),
+					mcp.Description("Directory or file to search"),
+				),
+				mcp.WithString("pattern",
+					mcp.Required(),
+					mcp.Description("Regular expression to search for (rg syntax, or extended regular expressions when grep is used)"),
+				),
+				mcp.WithArray("include",
+					mcp.WithStringItems(),
+					mcp.Description("Only search files matching these globs, e.g. *.go"),
+				),
+				mcp.WithArray("exclude",
+					mcp.WithStringItems(),
+					mcp.Description("Skip files and directories matching these globs, e.g. node_modules"),
+				),
+				mcp.WithNumber("maxResults",
+					mcp.DefaultNumber(100),
+					mcp.Description("Maximum number of matches to return, at most 1000"),
+				),
+				mcp.WithNumber("contextLines",
+					mcp.DefaultNumber(2),
+					mcp.Description("Lines of context before and after each match, at most 10"),
+				),
+			},
+			Handler: func(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
+				// Convert map to SSHSearchArgs
+				searchArgs := ssh.SSHSearchArgs{
+					SessionID:    getStringOrEmpty(args["sessionId"]),
+					Path:         getStringOrEmpty(args["path"]),
+					Pattern:      getStringOrEmpty(args["pattern"]),
+					Include:      getStringSlice(args["include"]),
+					Exclude:      getStringSlice(args["exclude"]),
+					MaxResults:   getIntOrDefault(args["maxResults"], 100),
+					ContextLines: getIntOrDefault(args["contextLines"], 2),
+				}
+
+				searchResult, err := fileOps.Search(ctx, searchArgs.SessionID, file.SearchOptions{
+					Root:       searchArgs.Path,
+					Pattern:    searchArgs.Pattern,
+					Include:    searchArgs.Include,
+					Exclude:    searchArgs.Exclude,
+					MaxResults: searchArgs.MaxResults,
+					Context:    searchArgs.ContextLines,
+				})
+				if err != nil {
+					return &mcp.CallToolResult{
+						Content: []mcp.Content{
+							mcp.TextContent{
+								Type: "text",
+								Text: "Search error: " + err.Error(),
+							},
+						},
+					}, err
+				}
+
+				result := fmt.Sprintf("%d matches for %q in %s (%s)", len(searchResult.Matches), searchResult.Pattern, searchResult.Root, searchResult.Engine)
+				if searchResult.Truncated {
+					result += ", more matches were not returned"
+				}
+				result += "\n"
+				for _, m := range searchResult.Matches {
+					result += fmt.Sprintf("%s:%d: %s\n", m.File, m.Line, m.Text)
+				}
+
+				return &mcp.CallToolResult{
+					Content: []mcp.Content{
+						mcp.TextContent{
+							Type: "text",
+							Text: result,
+						},
+					},
+					StructuredContent: searchResult,
+				}, nil
+			},
+		},
+		{
+			Name: "ssh_tail",
+			Opts: []mcp.ToolOption{
+				mcp.WithDescription("Read the last lines of a file on the SSH server, or follow it like tail -F and receive new lines as log notifications or by polling ssh_tail_read"),
+				mcp.WithString("sessionId",
+					mcp.Required(),
+					mcp.Description("The SSH session identifier"),
+				),
+				mcp.WithString("path",
+					mcp.Required(),
+					mcp.Description("Remote file to read"),
+				),
+				mcp.WithNumber("lines",
+					mcp.DefaultNumber(50),
+					mcp.Description("Number of lines from the end of the file, at most 5000"),
+				),
+				mcp.WithString("filter",
+					mcp.Description("Regular expression lines must match; applied to the last lines, and to every new line when following"),
+				),
+				mcp.WithBoolean("follow",
+					mcp.DefaultBool(false),
+					mcp.Description("Keep following the file, surviving log rotation, until ssh_tail_stop is called or the session closes"),
+				),
+				mcp.WithString("encoding",
+					mcp.Description("Character encoding of the file if it is not UTF-8, e.g. latin1, windows-1252, shift_jis or utf-16le"),
+				),
+				mcp.WithString("ansi",
+					mcp.DefaultString("strip"),
+					mcp.Enum("strip", "keep", "escape"),
+					mcp.Description("ANSI escape sequences such as colours: strip them, keep them, or make them visible as \\e"),
+				),
+				mcp.WithString("binary",
+					mcp.DefaultString("base64"),
+					mcp.Enum("base64", "resource"),
+					mcp.Description("How to return content read without follow that is not UTF-8 text: base64 encoded text, or an embedded resource"),
+				),
+			},
+			Handler: func(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
+				// Convert map to SSHTailArgs
+				tailArgs := ssh.SSHTailArgs{
+					SessionID: getStringOrEmpty(args["sessionId"]),
+					Path:      getStringOrEmpty(args["path"]),
+					Lines:     getIntOrDefault(args["lines"], 50),
+					Filter:    getStringOrEmpty(args["filter"]),
+					Follow:    getBoolOrDefault(args["follow"], false),
+					Encoding:  getStringOrEmpty(args["encoding"]),
+					ANSI:      getStringOrEmpty(args["ansi"]),
+					Binary:    getStringOrEmpty(args["binary"]),
+				}
+
+				opts := file.TailOptions{
+					Path:   tailArgs.Path,
+					Lines:  tailArgs.Lines,
+					Filter: tailArgs.Filter,
+				}
+
+				if tailArgs.Follow {
+					read, err := fileOps.Follow(tailArgs.SessionID, opts, newTailNotifier(ctx, tailArgs.Path))
+					if err != nil {
+						return &mcp.CallToolResult{
+							Content: []mcp.Content{
+								mcp.TextContent{
+									Type: "text",
+									Text: "Tail error: " + err.Error(),
+								},
+							},
+						}, err
+					}
+
+					return &mcp.CallToolResult{
+						Content: []mcp.Content{
+							mcp.TextContent{
+								Type: "text",
+								Text: fmt.Sprintf("Following %s with subscription %s. New lines are sent as log notifications and can be polled with ssh_tail_read from cursor %d.", tailArgs.Path, read.SubscriptionID, read.Cursor),
+							},
+						},
+						StructuredContent: read,
+					}, nil
+				}
+
+				tail, err := fileOps.Tail(tailArgs.SessionID, opts)
+				if err != nil {
+					return &mcp.CallToolResult{
+						Content: []mcp.Content{
+							mcp.TextContent{
+								Type: "text",
+								Text: "Tail error: " + err.Error(),
+							},
+						},
+					}, err
+				}
+
+				content, text, err := outputContent([]byte(strings.Join(tail.Lines, "\n")), output.Options{
+					Encoding: tailArgs.Encoding,
+					ANSI:     tailArgs.ANSI,
+				}, tailArgs.Binary, remoteResourceURI(tailArgs.SessionID, tail.Path))
+				if err != nil {
+					return &mcp.CallToolResult{
+						Content: []mcp.Content{
+							mcp.TextContent{
+								Type: "text",
+								Text: "Tail error: " + err.Error(),
+							},
+						},
+					}, err
+				}
+
+				// Binary content has no meaningful lines to return as structured content
+				callResult := &mcp.CallToolResult{Content: content}
+				if text != nil {
+					if *text != "" {
+						tail.Lines = strings.Split(*text, "\n")
+					}
+					callResult.StructuredContent = tail
+				}
+				return callResult, nil
+			},
+		},
+		{
+			Name: "ssh_tail_read",
+			Opts: []mcp.ToolOption{
+				mcp.WithDescription("Read the lines a tail subscription received after a cursor"),
+				mcp.WithString("subscriptionId",
+					mcp.Required(),
+					mcp.Description("The tail subscription identifier"),
+				),
+				mcp.WithNumber("cursor",
+					mcp.DefaultNumber(0),
+					mcp.Description("Cursor returned by the previous read, 0 to start from the oldest buffered line"),
+				),
+				mcp.WithNumber("maxLines",
+					mcp.DefaultNumber(500),
+					mcp.Description("Maximum number of lines to return"),
+				),
+			},
+			Handler: func(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
+				// Convert map to SSHTailReadArgs
+				readArgs := ssh.SSHTailReadArgs{
+					SubscriptionID: getStringOrEmpty(args["subscriptionId"]),
+					Cursor:         int64(getIntOrDefault(args["cursor"], 0)),
+					MaxLines:       getIntOrDefault(args["maxLines"], 500),
+				}
+
+				read, err := fileOps.ReadTail(readArgs.SubscriptionID, readArgs.Cursor, readArgs.MaxLines)
+				if err != nil {
+					return &mcp.CallToolResult{
+						Content: []mcp.Content{
+							mcp.TextContent{
+								Type: "text",
+								Text: "Tail error: " + err.Error(),
+							},
+						},
+					}, err
+				}
+
+				result := ""
+				if read.Dropped > 0 {
+					result += fmt.Sprintf("(%d lines dropped)\n", read.Dropped)
+				}
+				for _, line := range read.Lines {
+					result += line.Text + "\n"
+				}
+				result += fmt.Sprintf("Next cursor: %d", read.Cursor)
+				if read.Closed {
+					result += ", subscription has ended"
+					if read.Error != "" {
+						result += ": " + read.Error
+					}
+				}
+
+				return &mcp.CallToolResult{
+					Content: []mcp.Content{
+						mcp.TextContent{
+							Type: "text",
+							Text: result,
+						},
+					},
+					StructuredContent: read,
+				}, nil
+			},
+		},
+		{
+			Name: "ssh_tail_stop",
+			Opts: []mcp.ToolOption{
+				mcp.WithDescription("Stop following a file"),
+				mcp.WithString("subscriptionId",
+					mcp.Required(),
+					mcp.Description("The tail subscription identifier"),
+				),
+			},
+			Handler: func(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
+				// Convert map to SSHTailStopArgs
+				stopArgs := ssh.SSHTailStopArgs{
+					SubscriptionID: getStringOrEmpty(args["subscriptionId"]),
+				}
+
+				if err := fileOps.StopTail(stopArgs.SubscriptionID); err != nil {
+					return &mcp.CallToolResult{
+						Content: []mcp.Content{
+							mcp.TextContent{
+								Type: "text",
+								Text: "Tail error: " + err.Error(),
+							},
+						},
+					}, err
+				}
+
+				return &mcp.CallToolResult{
+					Content: []mcp.Content{
+						mcp.TextContent{
+							Type: "text",
+							Text: "Stopped tail subscription " + stopArgs.SubscriptionID,
+						},
+					},
+				}, nil
+			},
+		},
+		{
+			Name: "ssh_watch_path",
+			Opts: []mcp.ToolOption{
+				mcp.WithDescription("Watch a file or directory tree on the SSH server for created, modified and deleted entries. Uses inotifywait when available and polls stat snapshots otherwise. Changes are sent as resource updated notifications with ssh://<sessionId>/<path> URIs and can be polled with ssh_watch_read"),
+				mcp.WithString("sessionId",
+					mcp.Required(),
+					mcp.Description("The SSH session identifier"),
+				),
+				mcp.WithString("path",
+					mcp.Required(),
+					mcp.Description("Remote file or directory tree to watch"),
+				),
+				mcp.WithNumber("interval",
+					mcp.DefaultNumber(2),
+					mcp.Description("Seconds between two snapshots when polling, at least 1"),
+				),
+				mcp.WithBoolean("poll",
+					mcp.DefaultBool(false),
+					mcp.Description("Poll with stat snapshots even if inotifywait is available"),
+				),
+			},
+			Handler: func(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
+				// Convert map to SSHWatchPathArgs
+				watchArgs := ssh.SSHWatchPathArgs{
+					SessionID: getStringOrEmpty(args["sessionId"]),
+					Path:      getStringOrEmpty(args["path"]),
+					Interval:  getIntOrDefault(args["interval"], 2),
+					Poll:      getBoolOrDefault(args["poll"], false),
+				}
+
+				opts := file.WatchOptions{
+					Path:     watchArgs.Path,
+					Interval: time.Duration(watchArgs.Interval) * time.Second,
+					Poll:     watchArgs.Poll,
+				}
+
+				read, err := fileOps.Watch(watchArgs.SessionID, opts, newWatchNotifier(ctx, watchArgs.SessionID))
+				if err != nil {
+					return &mcp.CallToolResult{
+						Content: []mcp.Content{
+							mcp.TextContent{
+								Type: "text",
+								Text: "Watch error: " + err.Error(),
+							},
+						},
+					}, err
+				}
+
+				return &mcp.CallToolResult{
+					Content: []mcp.Content{
+						mcp.TextContent{
+							Type: "text",
+							Text: fmt.Sprintf("Watching %s with subscription %s (%s). Changes are sent as resource updated notifications and can be polled with ssh_watch_read.", watchArgs.Path, read.SubscriptionID, read.Engine),
+						},
+					},
+					StructuredContent: read,
+				}, nil
+			},
+		},
+		{
+			Name: "ssh_watch_read",
+			Opts: []mcp.ToolOption{
+				mcp.WithDescription("Read the changes a watch observed after a cursor"),
+				mcp.WithString("subscriptionId",
+					mcp.Required(),
+					mcp.Description("The watch subscription identifier"),
+				),
+				mcp.WithNumber("cursor",
+					mcp.DefaultNumber(0),
+					mcp.Description("Cursor returned by the previous read, 0 to start from the oldest buffered event"),
+				),
+				mcp.WithNumber("maxEvents",
+					mcp.DefaultNumber(500),
+					mcp.Description("Maximum number of events to return"),
+				),
+			},
+			Handler: func(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
+				// Convert map to SSHWatchReadArgs
+				readArgs := ssh.SSHWatchReadArgs{
+					SubscriptionID: getStringOrEmpty(args["subscriptionId"]),
+					Cursor:         int64(getIntOrDefault(args["cursor"], 0)),
+					MaxEvents:      getIntOrDefault(args["maxEvents"], 500),
+				}
+
+				read, err := fileOps.ReadWatch(readArgs.SubscriptionID, readArgs.Cursor, readArgs.MaxEvents)
+				if err != nil {
+					return &mcp.CallToolResult{
+						Content: []mcp.Content{
+							mcp.TextContent{
+								Type: "text",
+								Text: "Watch error: " + err.Error(),
+							},
+						},
+					}, err
+				}
+
+				result := ""
+				if read.Dropped > 0 {
+					result += fmt.Sprintf("(%d events dropped)\n", read.Dropped)
+				}
+				for _, event := range read.Events {
+					result += fmt.Sprintf("%s %s\n", event.Type, event.Path)
+				}
+				result += fmt.Sprintf("Next cursor: %d", read.Cursor)
+				if read.Closed {
+					result += ", watch has ended"
+					if read.Error != "" {
+						result += ": " + read.Error
+					}
+				}
+
+				return &mcp.CallToolResult{
+					Content: []mcp.Content{
+						mcp.TextContent{
+							Type: "text",
+							Text: result,
+						},
+					},
+					StructuredContent: read,
+				}, nil
+			},
+		},
+		{
+			Name: "ssh_watch_stop",
+			Opts: []mcp.ToolOption{
+				mcp.WithDescription("Stop watching a path"),
+				mcp.WithString("subscriptionId",
+					mcp.Required(),
+					mcp.Description("The watch subscription identifier"),
+				),
+			},
+			Handler: func(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
+				// Convert map to SSHWatchStopArgs
+				stopArgs := ssh.SSHWatchStopArgs{
+					SubscriptionID: getStringOrEmpty(args["subscriptionId"]),
+				}
+
+				if err := fileOps.StopWatch(stopArgs.SubscriptionID); err != nil {
+					return &mcp.CallToolResult{
+						Content: []mcp.Content{
+							mcp.TextContent{
+								Type: "text",
+								Text: "Watch error: " + err.Error(),
+							},
+						},
+					}, err
+				}
+
+				return &mcp.CallToolResult{
+					Content: []mcp.Content{
+						mcp.TextContent{
+							Type: "text",
+							Text: "Stopped watch subscription " + stopArgs.SubscriptionID,
+						},
+					},
+				}, nil
+			},
+		},
+		{
+			Name: "ssh_list_changes",
+			Opts: []mcp.ToolOption{
+				mcp.WithDescription("List the changes made with backup enabled in an SSH session. The returned checkpoint can later be passed to ssh_rollback to undo everything after it"),
+				mcp.WithString("sessionId",
+					mcp.Required(),
+					mcp.Description("The SSH session identifier"),
+				),
+			},
+			Handler: func(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
+				// Convert map to SSHListChangesArgs
+				listArgs := ssh.SSHListChangesArgs{
+					SessionID: getStringOrEmpty(args["sessionId"]),
+				}
+
+				changes, err := fileOps.ListChanges(listArgs.SessionID)
+				if err != nil {
+					return &mcp.CallToolResult{
+						Content: []mcp.Content{
+							mcp.TextContent{
+								Type: "text",
+								Text: "List changes error: " + err.Error(),
+							},
+						},
+					}, err
+				}
+
+				result := fmt.Sprintf("%d changes, checkpoint %d\n", len(changes.Changes), changes.Checkpoint)
+				for _, change := range changes.Changes {
+					result += describeChange(change) + "\n"
+				}
+
+				return &mcp.CallToolResult{
+					Content: []mcp.Content{
+						mcp.TextContent{
+							Type: "text",
+							Text: result,
+						},
+					},
+					StructuredContent: changes,
+				}, nil
+			},
+		},
+		{
+			Name: "ssh_rollback",
+			Opts: []mcp.ToolOption{
+				mcp.WithDescription("Restore the previous version of paths changed with backup enabled: either one change, or every change after a checkpoint, newest first"),
+				mcp.WithString("sessionId",
+					mcp.Required(),
+					mcp.Description("The SSH session identifier"),
+				),
+				mcp.WithNumber("changeId",
+					mcp.Description("The change to roll back"),
+				),
+				mcp.WithNumber("since",
+					mcp.Description("Roll back every change after this checkpoint, as returned by ssh_list_changes; 0 rolls back all changes"),
+				),
+			},
+			Handler: func(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
+				// Convert map to SSHRollbackArgs; a missing checkpoint is told apart from 0
+				rollbackArgs := ssh.SSHRollbackArgs{
+					SessionID: getStringOrEmpty(args["sessionId"]),
+					ChangeID:  getIntOrDefault(args["changeId"], 0),
+					Since:     getIntOrDefault(args["since"], -1),
+				}
+
+				rollback, err := fileOps.Rollback(rollbackArgs.SessionID, rollbackArgs.ChangeID, rollbackArgs.Since)
+				if err != nil {
+					text := "Rollback error: " + err.Error()
+					if rollback != nil && len(rollback.RolledBack) > 0 {
+						text += fmt.Sprintf(" (%d changes were rolled back before the failure)", len(rollback.RolledBack))
+					}
+					return &mcp.CallToolResult{
+						Content: []mcp.Content{
+							mcp.TextContent{
+								Type: "text",
+								Text: text,
+							},
+						},
+					}, err
+				}
+
+				result := fmt.Sprintf("Rolled back %d changes\n", len(rollback.RolledBack))
+				for _, change := range rollback.RolledBack {
+					result += describeChange(change) + "\n"
+				}
+
+				return &mcp.CallToolResult{
+					Content: []mcp.Content{
+						mcp.TextContent{
+							Type: "text",
+							Text: result,
+						},
+					},
+					StructuredContent: rollback,
+				}, nil
+			},
+		},
+		{
+			Name: "ssh_upload_template",
+			Opts: []mcp.ToolOption{
+				mcp.WithDescription("Render a Go text/template with variables and write the result to a file on the SSH server, optionally showing a diff against the current content first. Besides the built-in functions, templates can use default, required, quote, squote, upper, lower, trim, trimPrefix, trimSuffix, hasPrefix, hasSuffix, contains, replace, split, join, indent, nindent, toJson, b64enc and b64dec. Missing variables are an error; use index for optional ones, e.g. {{ default \"80\" (index . \"port\") }}"),
+				mcp.WithString("sessionId",
+					mcp.Required(),
+					mcp.Description("The SSH session identifier"),
+				),
+				mcp.WithString("template",
+					mcp.Description("Inline template text"),
+				),
+				mcp.WithString("templateFile",
+					mcp.Description("Local template file, used if no inline template is given"),
+				),
+				mcp.WithObject("vars",
+					mcp.Description("Variables the template is rendered with, available as .name"),
+				),
+				mcp.WithString("path",
+					mcp.Required(),
+					mcp.Description("Remote file to write"),
+				),
+				mcp.WithString("mode",
+					mcp.Description("Octal permission bits such as 0644; by default those of an existing file are kept"),
+				),
+				mcp.WithString("owner",
+					mcp.Description("Owner as user, user:group or :group, applied with chown"),
+				),
+				mcp.WithBoolean("diff",
+					mcp.DefaultBool(false),
+					mcp.Description("Include a unified diff against the current remote content"),
+				),
+				mcp.WithBoolean("dryRun",
+					mcp.DefaultBool(false),
+					mcp.Description("Only render and diff, without writing"),
+				),
+				mcp.WithBoolean("backup",
+					mcp.DefaultBool(false),
+					mcp.Description("Save the file being overwritten in the session's change journal, so that ssh_rollback can restore it"),
+				),
+			},
+			Handler: func(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
+				// Convert map to SSHUploadTemplateArgs
+				templateArgs := ssh.SSHUploadTemplateArgs{
+					SessionID:    getStringOrEmpty(args["sessionId"]),
+					Template:     getStringOrEmpty(args["template"]),
+					TemplateFile: getStringOrEmpty(args["templateFile"]),
+					Path:         getStringOrEmpty(args["path"]),
+					Mode:         getStringOrEmpty(args["mode"]),
+					Owner:        getStringOrEmpty(args["owner"]),
+					Diff:         getBoolOrDefault(args["diff"], false),
+					DryRun:       getBoolOrDefault(args["dryRun"], false),
+					Backup:       getBoolOrDefault(args["backup"], false),
+				}
+				if vars, ok := args["vars"].(map[string]interface{}); ok {
+					templateArgs.Vars = vars
+				}
+
+				rendered, err := fileOps.UploadTemplate(templateArgs.SessionID, file.TemplateOptions{
+					Template:     templateArgs.Template,
+					TemplateFile: templateArgs.TemplateFile,
+					Vars:         templateArgs.Vars,
+					Path:         templateArgs.Path,
+					Mode:         templateArgs.Mode,
+					Owner:        templateArgs.Owner,
+					Diff:         templateArgs.Diff,
+					DryRun:       templateArgs.DryRun,
+					Backup:       templateArgs.Backup,
+				})
+				if err != nil {
+					return &mcp.CallToolResult{
+						Content: []mcp.Content{
+							mcp.TextContent{
+								Type: "text",
+								Text: "Template error: " + err.Error(),
+							},
+						},
+					}, err
+				}
+
+				var result string
+				switch {
+				case templateArgs.DryRun && rendered.Changed:
+					result = fmt.Sprintf("Dry run, %s would change (%d bytes)", rendered.Path, rendered.Size)
+				case templateArgs.DryRun:
+					result = fmt.Sprintf("Dry run, %s is up to date", rendered.Path)
+				case rendered.Written:
+					result = fmt.Sprintf("Template rendered to %s (%d bytes, sha256 %s)", rendered.Path, rendered.Size, rendered.SHA256)
+				default:
+					result = fmt.Sprintf("%s is up to date", rendered.Path)
+				}
+				if rendered.Diff != "" {
+					result += "\n" + rendered.Diff
+				}
+
+				return &mcp.CallToolResult{
+					Content: []mcp.Content{
+						mcp.TextContent{
+							Type: "text",
+							Text: result,
+						},
+					},
+					StructuredContent: rendered,
+				}, nil
+			},
+		},
+		{
+			Name: "ssh_forward_local",
+			Opts: []mcp.ToolOption{
+				mcp.WithDescription("Forward a local port through an SSH session to a host and port reachable from the remote server, like ssh -L. The remote host is subject to the host allow and deny lists. Either end may be a Unix socket, e.g. to use a remote Docker socket locally. The forward lasts until ssh_close_forward is called or the session ends"),
+				mcp.WithString("sessionId",
+					mcp.Required(),
+					mcp.Description("The SSH session identifier"),
+				),
+				mcp.WithString("localHost",
+					mcp.DefaultString("127.0.0.1"),
+					mcp.Description("Local address to listen on"),
+				),
+				mcp.WithNumber("localPort",
+					mcp.DefaultNumber(0),
+					mcp.Description("Local port to listen on; 0 picks a free port"),
+				),
+				mcp.WithString("localSocket",
+					mcp.Description("Local Unix socket to listen on instead of a port"),
+				),
+				mcp.WithString("remoteHost",
+					mcp.Description("Host to connect to from the remote server, e.g. localhost or an internal database host"),
+				),
+				mcp.WithNumber("remotePort",
+					mcp.Description("Port to connect to from the remote server"),
+				),
+				mcp.WithString("remoteSocket",
+					mcp.Description("Remote Unix socket to connect to instead of a host and port, e.g. /var/run/docker.sock"),
+				),
+			},
+			Handler: func(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
+				// Convert map to SSHForwardLocalArgs
+				forwardArgs := ssh.SSHForwardLocalArgs{
+					SessionID:    getStringOrEmpty(args["sessionId"]),
+					LocalHost:    getStringOrEmpty(args["localHost"]),
+					LocalPort:    getIntOrDefault(args["localPort"], 0),
+					LocalSocket:  getStringOrEmpty(args["localSocket"]),
+					RemoteHost:   getStringOrEmpty(args["remoteHost"]),
+					RemotePort:   getIntOrDefault(args["remotePort"], 0),
+					RemoteSocket: getStringOrEmpty(args["remoteSocket"]),
+				}
+
+				// Check security
+				err := checkRemoteSocket(sessionManager, securityManager, forwardArgs.SessionID, forwardArgs.RemoteSocket)
+				if err == nil && forwardArgs.RemoteHost != "" {
+					err = securityManager.CheckHost(forwardArgs.RemoteHost)
+				}
+				if err == nil && forwardArgs.LocalSocket != "" {
+					// Local sockets are confined to the local roots, like the files of transfers
+					forwardArgs.LocalSocket, err = securityManager.CheckLocalPath(forwardArgs.SessionID, forwardArgs.LocalSocket)
+				}
+				if err != nil {
+					return &mcp.CallToolResult{
+						Content: []mcp.Content{
+							mcp.TextContent{
+								Type: "text",
+								Text: "Security error: " + err.Error(),
+							},
+						},
+					}, err
+				}
+
+				forward, err := sshClient.ForwardLocal(forwardArgs)
+				if err != nil {
+					return &mcp.CallToolResult{
+						Content: []mcp.Content{
+							mcp.TextContent{
+								Type: "text",
+								Text: "Forward error: " + err.Error(),
+							},
+						},
+					}, err
+				}
+
+				return &mcp.CallToolResult{
+					Content: []mcp.Content{
+						mcp.TextContent{
+							Type: "text",
+							Text: fmt.Sprintf("Forwarding %s to %s through session %s (forward %s)", forward.Listen, forward.Target, forward.SessionID, forward.ID),
+						},
+					},
+					StructuredContent: forward.Info(),
+				}, nil
+			},
+		},
+		{
+			Name: "ssh_forward_remote",
+			Opts: []mcp.ToolOption{
+				mcp.WithDescription("Forward a port on the remote server through an SSH session to a local host and port, like ssh -R. Useful to expose a local server to the remote host. The local host is subject to the host allow and deny lists. The forward lasts until ssh_close_forward is called or the session ends"),
+				mcp.WithString("sessionId",
+					mcp.Required(),
+					mcp.Description("The SSH session identifier"),
+				),
+				mcp.WithString("remoteHost",
+					mcp.DefaultString("127.0.0.1"),
+					mcp.Description("Address to listen on on the remote server; binding other addresses depends on the server's GatewayPorts setting"),
+				),
+				mcp.WithNumber("remotePort",
+					mcp.DefaultNumber(0),
+					mcp.Description("Port to listen on on the remote server; 0 lets the server pick one"),
+				),
+				mcp.WithString("localHost",
+					mcp.DefaultString("127.0.0.1"),
+					mcp.Description("Local host to connect to"),
+				),
+				mcp.WithNumber("localPort",
+					mcp.Required(),
+					mcp.Description("Local port to connect to"),
+				),
+			},
+			Handler: func(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
+				// Convert map to SSHForwardRemoteArgs
+				forwardArgs := ssh.SSHForwardRemoteArgs{
+					SessionID:  getStringOrEmpty(args["sessionId"]),
+					RemoteHost: getStringOrEmpty(args["remoteHost"]),
+					RemotePort: getIntOrDefault(args["remotePort"], 0),
+					LocalHost:  getStringOrEmpty(args["localHost"]),
+					LocalPort:  getIntOrDefault(args["localPort"], 0),
+				}
+
+				forward, err := sshClient.ForwardRemote(forwardArgs, securityManager.CheckHost)
+				if err != nil {
+					return &mcp.CallToolResult{
+						Content: []mcp.Content{
+							mcp.TextContent{
+								Type: "text",
+								Text: "Forward error: " + err.Error(),
+							},
+						},
+					}, err
+				}
+
+				return &mcp.CallToolResult{
+					Content: []mcp.Content{
+						mcp.TextContent{
+							Type: "text",
+							Text: fmt.Sprintf("Forwarding remote %s to %s through session %s (forward %s)", forward.Listen, forward.Target, forward.SessionID, forward.ID),
+						},
+					},
+					StructuredContent: forward.Info(),
+				}, nil
+			},
+		},
+		{
+			Name: "ssh_forward_dynamic",
+			Opts: []mcp.ToolOption{
+				mcp.WithDescription("Start a local SOCKS5 proxy that connects to each destination from the remote server, like ssh -D. Destinations are subject to the host allow and deny lists. The proxy lasts until ssh_close_forward is called or the session ends"),
+				mcp.WithString("sessionId",
+					mcp.Required(),
+					mcp.Description("The SSH session identifier"),
+				),
+				mcp.WithString("localHost",
+					mcp.DefaultString("127.0.0.1"),
+					mcp.Description("Local address to listen on"),
+				),
+				mcp.WithNumber("localPort",
+					mcp.DefaultNumber(0),
+					mcp.Description("Local port to listen on; 0 picks a free port"),
+				),
+			},
+			Handler: func(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
+				// Convert map to SSHForwardDynamicArgs
+				forwardArgs := ssh.SSHForwardDynamicArgs{
+					SessionID: getStringOrEmpty(args["sessionId"]),
+					LocalHost: getStringOrEmpty(args["localHost"]),
+					LocalPort: getIntOrDefault(args["localPort"], 0),
+				}
+
+				forward, err := sshClient.ForwardDynamic(forwardArgs, securityManager.CheckHost)
+				if err != nil {
+					return &mcp.CallToolResult{
+						Content: []mcp.Content{
+							mcp.TextContent{
+								Type: "text",
+								Text: "Forward error: " + err.Error(),
+							},
+						},
+					}, err
+				}
+
+				return &mcp.CallToolResult{
+					Content: []mcp.Content{
+						mcp.TextContent{
+							Type: "text",
+							Text: fmt.Sprintf("SOCKS5 proxy listening on %s through session %s (forward %s)", forward.Listen, forward.SessionID, forward.ID),
+						},
+					},
+					StructuredContent: forward.Info(),
+				}, nil
+			},
+		},
+		{
+			Name: "ssh_http_request",
+			Opts: []mcp.ToolOption{
+				mcp.WithDescription("Make an HTTP request to a service reachable from the remote server, with the connection tunneled through the SSH session. Nothing needs to be installed on the remote server. Hosts are subject to the host allow and deny lists"),
+				mcp.WithString("sessionId",
+					mcp.Required(),
+					mcp.Description("The SSH session identifier"),
+				),
+				mcp.WithString("method",
+					mcp.DefaultString("GET"),
+					mcp.Description("HTTP method"),
+				),
+				mcp.WithString("url",
+					mcp.Required(),
+					mcp.Description("http or https URL as seen from the remote server, e.g. http://localhost:8080/health"),
+				),
+				mcp.WithObject("headers",
+					mcp.Description("Request headers as name-value pairs"),
+				),
+				mcp.WithString("body",
+					mcp.Description("Request body"),
+				),
+				mcp.WithNumber("timeout",
+					mcp.DefaultNumber(30),
+					mcp.Description("Request timeout in seconds"),
+				),
+				mcp.WithNumber("maxBytes",
+					mcp.DefaultNumber(1048576),
+					mcp.Description("Largest response body to return; longer bodies are truncated"),
+				),
+				mcp.WithBoolean("followRedirects",
+					mcp.DefaultBool(true),
+					mcp.Description("Follow redirects"),
+				),
+				mcp.WithBoolean("insecure",
+					mcp.DefaultBool(false),
+					mcp.Description("Skip TLS certificate verification, e.g. for self-signed internal services"),
+				),
+				mcp.WithString("socketPath",
+					mcp.Description("Remote Unix socket to send the request to, e.g. /var/run/docker.sock with the URL http://docker/v1.43/containers/json; the URL host then only sets the Host header"),
+				),
+				mcp.WithString("binary",
+					mcp.DefaultString("base64"),
+					mcp.Description("How to return a binary body: base64 text or an embedded resource"),
+					mcp.Enum("base64", "resource"),
+				),
+			},
+			Handler: func(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
+				// Convert map to SSHHTTPRequestArgs
+				requestArgs := ssh.SSHHTTPRequestArgs{
+					SessionID:       getStringOrEmpty(args["sessionId"]),
+					Method:          getStringOrEmpty(args["method"]),
+					URL:             getStringOrEmpty(args["url"]),
+					Body:            getStringOrEmpty(args["body"]),
+					Timeout:         getIntOrDefault(args["timeout"], 30),
+					MaxBytes:        getIntOrDefault(args["maxBytes"], 1048576),
+					FollowRedirects: getBoolOrDefault(args["followRedirects"], true),
+					Insecure:        getBoolOrDefault(args["insecure"], false),
+					SocketPath:      getStringOrEmpty(args["socketPath"]),
+				}
+				if headers, ok := args["headers"].(map[string]interface{}); ok {
+					requestArgs.Headers = make(map[string]string, len(headers))
+					for name, value := range headers {
+						requestArgs.Headers[name] = fmt.Sprint(value)
+					}
+				}
+
+				// Check security
+				if err := checkRemoteSocket(sessionManager, securityManager, requestArgs.SessionID, requestArgs.SocketPath); err != nil {
+					return &mcp.CallToolResult{
+						Content: []mcp.Content{
+							mcp.TextContent{
+								Type: "text",
+								Text: "Security error: " + err.Error(),
+							},
+						},
+					}, err
+				}
+
+				resp, err := sshClient.HTTPRequest(ctx, requestArgs, securityManager.CheckHost)
+				if err != nil {
+					return &mcp.CallToolResult{
+						Content: []mcp.Content{
+							mcp.TextContent{
+								Type: "text",
+								Text: "HTTP request error: " + err.Error(),
+							},
+						},
+					}, err
+				}
+
+				head := resp.Proto + " " + resp.Status + "\n"
+				names := make([]string, 0, len(resp.Headers))
+				for name := range resp.Headers {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				for _, name := range names {
+					for _, value := range resp.Headers[name] {
+						head += name + ": " + value + "\n"
+					}
+				}
+				if resp.Truncated {
+					head += fmt.Sprintf("(body truncated to %d bytes)\n", len(resp.Body))
+				}
+
+				body, text, err := outputContent(resp.Body, output.Options{ANSI: output.ANSIKeep}, getStringOrEmpty(args["binary"]), resp.URL)
+				if err != nil {
+					return &mcp.CallToolResult{
+						Content: []mcp.Content{
+							mcp.TextContent{
+								Type: "text",
+								Text: "Output error: " + err.Error(),
+							},
+						},
+					}, err
+				}
+
+				structured := map[string]interface{}{
+					"url":        resp.URL,
+					"status":     resp.Status,
+					"statusCode": resp.StatusCode,
+					"proto":      resp.Proto,
+					"headers":    resp.Headers,
+					"truncated":  resp.Truncated,
+				}
+				if text != nil {
+					structured["body"] = *text
+				}
+
+				return &mcp.CallToolResult{
+					Content:           append([]mcp.Content{mcp.TextContent{Type: "text", Text: head}}, body...),
+					StructuredContent: structured,
+				}, nil
+			},
+		},
+		{
+			Name: "ssh_list_forwards",
+			Opts: []mcp.ToolOption{
+				mcp.WithDescription("List active port forwards with their traffic"),
+				mcp.WithString("sessionId",
+					mcp.Description("Only list the forwards of this SSH session"),
+				),
+			},
+			Handler: func(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
+				// Convert map to SSHListForwardsArgs
+				listArgs := ssh.SSHListForwardsArgs{
+					SessionID: getStringOrEmpty(args["sessionId"]),
+				}
+
+				owner := clientSessionID(ctx)
+				forwards := sshClient.ListForwards(listArgs.SessionID)
+				infos := make([]session.ForwardInfo, 0, len(forwards))
+				for _, forward := range forwards {
+					if config.Admin || sessionManager.CheckOwner(forward.SessionID, owner) == nil {
+						infos = append(infos, forward.Info())
+					}
+				}
+
+				if len(infos) == 0 {
+					return &mcp.CallToolResult{
+						Content: []mcp.Content{
+							mcp.TextContent{
+								Type: "text",
+								Text: "No active forwards",
+							},
+						},
+						StructuredContent: map[string]interface{}{"forwards": infos},
+					}, nil
+				}
+
+				result := "Active forwards:\n"
+				for _, info := range infos {
+					result += "- " + describeForward(info) + "\n"
+					for _, t := range info.Traffic {
+						result += fmt.Sprintf("  %s: %d connections, %s sent, %s received\n", t.Destination, t.Connections, formatBytes(t.BytesSent), formatBytes(t.BytesReceived))
+					}
+				}
+
+				return &mcp.CallToolResult{
+					Content: []mcp.Content{
+						mcp.TextContent{
+							Type: "text",
+							Text: result,
+						},
+					},
+					StructuredContent: map[string]interface{}{"forwards": infos},
+				}, nil
+			},
+		},
+		{
+			Name: "ssh_close_forward",
+			Opts: []mcp.ToolOption{
+				mcp.WithDescription("Stop a port forward and close its open connections"),
+				mcp.WithString("forwardId",
+					mcp.Required(),
+					mcp.Description("The forward identifier"),
+				),
+			},
+			Handler: func(ctx context.Context, args map[string]interface{}) (*mcp.CallToolResult, error) {
+				// Convert map to SSHCloseForwardArgs
+				closeArgs := ssh.SSHCloseForwardArgs{
+					ForwardID: getStringOrEmpty(args["forwardId"]),
+				}
+
+				if err := sshClient.CloseForward(closeArgs.ForwardID); err != nil {
+					return &mcp.CallToolResult{
+						Content: []mcp.Content{
+							mcp.TextContent{
+								Type: "text",
+								Text: "Forward error: " + err.Error(),
+							},
+						},
+					}, err
+				}
+
+				return &mcp.CallToolResult{
+					Content: []mcp.Content{
+						mcp.TextContent{
+							Type: "text",
+							Text: "Closed forward " + closeArgs.ForwardID,
+						},
+					},
+				}, nil
+			},
+		},
 	}
 }
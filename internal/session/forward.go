@@ -0,0 +1,177 @@
+package session
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Forward kinds
+const (
+	ForwardLocal   = "local"   // Local listener, connections dialed from the remote host (ssh -L)
+	ForwardRemote  = "remote"  // Listener on the remote host, connections dialed locally (ssh -R)
+	ForwardDynamic = "dynamic" // Local SOCKS5 proxy, each destination dialed from the remote host (ssh -D)
+)
+
+// Forward is a port forward running over a session. It lives until it is removed or
+// its session is removed or expires.
+type Forward struct {
+	ID        string
+	SessionID string
+	Kind      string
+	Listen    string // Address connections are accepted on
+	Target    string // Address connections are forwarded to
+	CreatedAt time.Time
+
+	closer  func() error
+	mu      sync.Mutex
+	traffic map[string]*Traffic // By destination
+}
+
+// Traffic counts the connections and bytes forwarded to a destination
+type Traffic struct {
+	Destination   string `json:"destination"`
+	Connections   int64  `json:"connections"`
+	BytesSent     int64  `json:"bytesSent"`     // From the connecting client to the destination
+	BytesReceived int64  `json:"bytesReceived"` // From the destination back to the client
+}
+
+// ForwardInfo describes a forward and its traffic
+type ForwardInfo struct {
+	ID        string    `json:"id"`
+	SessionID string    `json:"sessionId"`
+	Kind      string    `json:"kind"`
+	Listen    string    `json:"listen"`
+	Target    string    `json:"target,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	Traffic   []Traffic `json:"traffic"`
+}
+
+// NewForward creates a forward that calls closer when it is removed
+func NewForward(id, sessionID, kind, listen, target string, closer func() error) *Forward {
+	return &Forward{
+		ID:        id,
+		SessionID: sessionID,
+		Kind:      kind,
+		Listen:    listen,
+		Target:    target,
+		CreatedAt: time.Now(),
+		closer:    closer,
+		traffic:   make(map[string]*Traffic),
+	}
+}
+
+// AddConnection counts a new connection to a destination
+func (f *Forward) AddConnection(destination string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.destination(destination).Connections++
+}
+
+// AddBytes counts bytes forwarded to and from a destination
+func (f *Forward) AddBytes(destination string, sent, received int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t := f.destination(destination)
+	t.BytesSent += sent
+	t.BytesReceived += received
+}
+
+// Traffic returns the traffic of the forward per destination, ordered by destination
+func (f *Forward) Traffic() []Traffic {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	traffic := make([]Traffic, 0, len(f.traffic))
+	for _, t := range f.traffic {
+		traffic = append(traffic, *t)
+	}
+	sort.Slice(traffic, func(i, j int) bool { return traffic[i].Destination < traffic[j].Destination })
+	return traffic
+}
+
+// Info returns a description of the forward and its traffic so far
+func (f *Forward) Info() ForwardInfo {
+	return ForwardInfo{
+		ID:        f.ID,
+		SessionID: f.SessionID,
+		Kind:      f.Kind,
+		Listen:    f.Listen,
+		Target:    f.Target,
+		CreatedAt: f.CreatedAt,
+		Traffic:   f.Traffic(),
+	}
+}
+
+// destination returns the traffic counters of a destination; f.mu must be held
+func (f *Forward) destination(destination string) *Traffic {
+	t, ok := f.traffic[destination]
+	if !ok {
+		t = &Traffic{Destination: destination}
+		f.traffic[destination] = t
+	}
+	return t
+}
+
+// close stops the forward
+func (f *Forward) close() error {
+	if f.closer == nil {
+		return nil
+	}
+	return f.closer()
+}
+
+// AddForward registers a forward with its session
+func (m *Manager) AddForward(f *Forward) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.sessions[f.SessionID]; !exists {
+		return errors.New("session not found")
+	}
+
+	m.forwards[f.ID] = f
+	return nil
+}
+
+// RemoveForward stops a forward and removes it from the manager
+func (m *Manager) RemoveForward(id string) error {
+	m.mu.Lock()
+	f, exists := m.forwards[id]
+	delete(m.forwards, id)
+	m.mu.Unlock()
+
+	if !exists {
+		return errors.New("forward not found")
+	}
+	return f.close()
+}
+
+// ListForwards returns the forwards of a session, or of all sessions if sessionID is empty,
+// oldest first
+func (m *Manager) ListForwards(sessionID string) []*Forward {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	forwards := make([]*Forward, 0)
+	for _, f := range m.forwards {
+		if sessionID == "" || f.SessionID == sessionID {
+			forwards = append(forwards, f)
+		}
+	}
+	sort.Slice(forwards, func(i, j int) bool { return forwards[i].CreatedAt.Before(forwards[j].CreatedAt) })
+	return forwards
+}
+
+// closeForwards stops the forwards of a session; m.mu must be held
+func (m *Manager) closeForwards(sessionID string) {
+	for id, f := range m.forwards {
+		if f.SessionID == sessionID {
+			f.close()
+			delete(m.forwards, id)
+		}
+	}
+}
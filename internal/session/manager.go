@@ -1,7 +1,10 @@
 package session
 
 import (
+	"context"
 	"errors"
+	"log"
+	"sort"
 	"sync"
 	"time"
 
@@ -16,11 +19,28 @@ type Session struct {
 	LastActivity time.Time
 	Host         string
 	Username     string
+	Owner        string // MCP client session that created the session; empty if none
+	Label        string   // Optional name the session can be referred to by instead of its ID
+	Tags         []string // Optional tags to find the session by
+	
+	conn   *Connection        // Connection the session runs on, possibly shared with other sessions
+	inUse  int                // Operations holding the session; guarded by the manager
+	idle   chan struct{}      // Closed when the last operation releases a removed session
+	ctx    context.Context    // Cancelled when the session is removed
+	cancel context.CancelFunc
 }
 
+// removeWait is how long removing a session waits for its in-flight operations to finish
+// before closing the connection under them
+const removeWait = 10 * time.Second
+
 // Manager handles SSH session tracking and lifecycle
 type Manager struct {
 	sessions      map[string]*Session
+	forwards      map[string]*Forward    // Port forwards by ID
+	connections   map[string]*Connection // Shared connections by credentials
+	maxChannels   int                    // Cap on concurrent session channels per connection
+	removeHooks   []func(*Session)       // Called for every removed or expired session
 	mu            sync.RWMutex
 	sessionExpiry time.Duration
 }
@@ -33,30 +53,24 @@ func NewManager(sessionExpiry time.Duration) *Manager {
 	
 	return &Manager{
 		sessions:      make(map[string]*Session),
+		forwards:      make(map[string]*Forward),
+		connections:   make(map[string]*Connection),
+		maxChannels:   DefaultMaxChannels,
 		sessionExpiry: sessionExpiry,
 	}
 }
 
-// AddSession adds a new SSH session to the manager
+// AddSession adds a new SSH session to the manager, on a connection of its own
 func (m *Manager) AddSession(id string, client *ssh.Client, host, username string) *Session {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	
-	now := time.Now()
-	session := &Session{
-		ID:           id,
-		Client:       client,
-		CreatedAt:    now,
-		LastActivity: now,
-		Host:         host,
-		Username:     username,
-	}
-	
-	m.sessions[id] = session
-	return session
+	return m.addSession(id, newConnection("", client, m.maxChannels), host, username, "")
 }
 
-// GetSession retrieves a session by ID and updates its last activity time
+// GetSession retrieves a session by ID and updates its last activity time. Operations that
+// use the connection should use AcquireSession instead, so that the session is not closed
+// under them.
 func (m *Manager) GetSession(id string) (*Session, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -70,25 +84,116 @@ func (m *Manager) GetSession(id string) (*Session, error) {
 	return session, nil
 }
 
-// RemoveSession removes a session from the manager
-func (m *Manager) RemoveSession(id string) error {
+// AcquireSession retrieves a session for an operation. The session does not expire while
+// it is held, and removing it waits for the operation to call release. Its last activity
+// time is updated both when it is acquired and when it is released.
+func (m *Manager) AcquireSession(id string) (*Session, func(), error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	
 	session, exists := m.sessions[id]
 	if !exists {
-		return errors.New("session not found")
+		return nil, nil, errors.New("session not found")
 	}
 	
-	// Close the SSH client connection
-	if session.Client != nil {
-		session.Client.Close()
+	session.inUse++
+	session.LastActivity = time.Now()
+	
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			
+			session.inUse--
+			session.LastActivity = time.Now()
+			if session.inUse == 0 && session.idle != nil {
+				close(session.idle)
+				session.idle = nil
+			}
+		})
+	}
+	return session, release, nil
+}
+
+// Context returns a context that is cancelled when the session is removed, so that long
+// operations can stop early
+func (s *Session) Context() context.Context {
+	return s.ctx
+}
+
+// WithContext returns a context that is cancelled when ctx is done or the session is
+// removed, whichever comes first
+func (s *Session) WithContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(s.ctx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// RemoveSession removes a session from the manager. Operations in progress are cancelled
+// through the session's context and given removeWait to finish before the connection is
+// released.
+func (m *Manager) RemoveSession(id string) error {
+	m.mu.Lock()
+	session, exists := m.sessions[id]
+	if !exists {
+		m.mu.Unlock()
+		return errors.New("session not found")
 	}
 	
+	// New operations can no longer acquire the session and its forwards stop right away
 	delete(m.sessions, id)
+	m.closeForwards(id)
+	session.cancel()
+	
+	var idle chan struct{}
+	if session.inUse > 0 {
+		session.idle = make(chan struct{})
+		idle = session.idle
+	}
+	m.mu.Unlock()
+	
+	if idle != nil {
+		select {
+		case <-idle:
+		case <-time.After(removeWait):
+			log.Printf("[DEBUG] session %s: closing with operations still in progress", id)
+		}
+	}
+	m.runRemoveHooks(session)
+	
+	// Release the SSH connection, closing it if no other session uses it
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	
+	m.releaseConnection(session)
 	return nil
 }
 
+// OnRemove registers a function that is called when a session is removed or expires. It
+// runs before the session's connection is released, so it can still clean up on the
+// remote host.
+func (m *Manager) OnRemove(hook func(*Session)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	
+	m.removeHooks = append(m.removeHooks, hook)
+}
+
+// runRemoveHooks calls the removal hooks for a session; m.mu must not be held
+func (m *Manager) runRemoveHooks(session *Session) {
+	m.mu.RLock()
+	hooks := append([]func(*Session){}, m.removeHooks...)
+	m.mu.RUnlock()
+	
+	for _, hook := range hooks {
+		hook(session)
+	}
+}
+
 // ListSessions returns a list of all active sessions
 func (m *Manager) ListSessions() []*Session {
 	m.mu.RLock()
@@ -102,27 +207,85 @@ func (m *Manager) ListSessions() []*Session {
 	return sessions
 }
 
+// SessionInfo describes a session
+type SessionInfo struct {
+	ID             string    `json:"id"`
+	Label          string    `json:"label,omitempty"`
+	Tags           []string  `json:"tags"`
+	Host           string    `json:"host"`
+	Username       string    `json:"username"`
+	Owner          string    `json:"owner,omitempty"`
+	CreatedAt      time.Time `json:"createdAt"`
+	LastActivity   time.Time `json:"lastActivity"`
+	IdleSeconds    int64     `json:"idleSeconds"`
+	InUse          bool      `json:"inUse"`          // An operation is running on the session
+	Forwards       int       `json:"forwards"`       // Active port forwards
+	SharedSessions int       `json:"sharedSessions"` // Sessions sharing the connection, including this one
+}
+
+// SessionInfos describes all active sessions, oldest first
+func (m *Manager) SessionInfos() []SessionInfo {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	
+	forwards := make(map[string]int)
+	for _, f := range m.forwards {
+		forwards[f.SessionID]++
+	}
+	
+	now := time.Now()
+	infos := make([]SessionInfo, 0, len(m.sessions))
+	for _, session := range m.sessions {
+		infos = append(infos, SessionInfo{
+			ID:             session.ID,
+			Label:          session.Label,
+			Tags:           append([]string{}, session.Tags...),
+			Host:           session.Host,
+			Username:       session.Username,
+			Owner:          session.Owner,
+			CreatedAt:      session.CreatedAt,
+			LastActivity:   session.LastActivity,
+			IdleSeconds:    int64(now.Sub(session.LastActivity).Seconds()),
+			InUse:          session.inUse > 0,
+			Forwards:       forwards[session.ID],
+			SharedSessions: session.conn.refs,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].CreatedAt.Before(infos[j].CreatedAt) })
+	
+	return infos
+}
+
 // CleanupExpiredSessions removes sessions that have been inactive for longer than the expiry duration
 func (m *Manager) CleanupExpiredSessions() int {
 	m.mu.Lock()
-	defer m.mu.Unlock()
 	
 	now := time.Now()
-	expiredCount := 0
+	var expired []*Session
 	
 	for id, session := range m.sessions {
-		if now.Sub(session.LastActivity) > m.sessionExpiry {
-			// Close the SSH client connection
-			if session.Client != nil {
-				session.Client.Close()
-			}
+		// Sessions in use by an operation never expire
+		if session.inUse == 0 && now.Sub(session.LastActivity) > m.sessionExpiry {
+			// Stop the forwards right away, the connection is released after the removal hooks
+			m.closeForwards(id)
+			session.cancel()
 			
 			delete(m.sessions, id)
-			expiredCount++
+			expired = append(expired, session)
 		}
 	}
+	m.mu.Unlock()
+	
+	for _, session := range expired {
+		m.runRemoveHooks(session)
+		
+		// Release the SSH connection, closing it if no other session uses it
+		m.mu.Lock()
+		m.releaseConnection(session)
+		m.mu.Unlock()
+	}
 	
-	return expiredCount
+	return len(expired)
 }
 
 // StartCleanupRoutine starts a background goroutine that periodically cleans up expired sessions
@@ -1,6 +1,7 @@
 package session
 
 import (
+	"context"
 	"testing"
 	"time"
 )
@@ -187,3 +188,363 @@ func TestStartCleanupRoutine(t *testing.T) {
 	// Allow some time for the goroutine to run
 	time.Sleep(10 * time.Millisecond)
 }
+
+func TestForwardLifetime(t *testing.T) {
+	manager := NewManager(100 * time.Millisecond)
+
+	closed := make(map[string]bool)
+	newForward := func(id, sessionID string) *Forward {
+		return NewForward(id, sessionID, ForwardLocal, "127.0.0.1:0", "db:5432", func() error {
+			closed[id] = true
+			return nil
+		})
+	}
+
+	if err := manager.AddForward(newForward("fwd-orphan", "missing")); err == nil {
+		t.Error("Expected an error for a forward without a session")
+	}
+
+	manager.AddSession("session1", nil, "host1", "user1")
+	manager.AddSession("session2", nil, "host2", "user2")
+	for _, f := range []*Forward{newForward("fwd-1", "session1"), newForward("fwd-2", "session1"), newForward("fwd-3", "session2")} {
+		if err := manager.AddForward(f); err != nil {
+			t.Fatalf("Failed to add forward: %v", err)
+		}
+	}
+
+	if forwards := manager.ListForwards("session1"); len(forwards) != 2 {
+		t.Errorf("Expected 2 forwards for session1, got %d", len(forwards))
+	}
+	if forwards := manager.ListForwards(""); len(forwards) != 3 {
+		t.Errorf("Expected 3 forwards in total, got %d", len(forwards))
+	}
+
+	// Forwards can be closed on their own
+	if err := manager.RemoveForward("fwd-2"); err != nil || !closed["fwd-2"] {
+		t.Errorf("Expected fwd-2 to be closed, got %v", err)
+	}
+	if err := manager.RemoveForward("fwd-2"); err == nil {
+		t.Error("Expected an error for a forward that was already removed")
+	}
+
+	// Removing a session closes its forwards
+	manager.RemoveSession("session1")
+	if !closed["fwd-1"] || closed["fwd-3"] {
+		t.Errorf("Expected only the forwards of session1 to be closed, got %v", closed)
+	}
+
+	// So does expiry
+	manager.sessions["session2"].LastActivity = time.Now().Add(-200 * time.Millisecond)
+	manager.CleanupExpiredSessions()
+	if !closed["fwd-3"] || len(manager.ListForwards("")) != 0 {
+		t.Errorf("Expected the forwards of the expired session to be closed, got %v", closed)
+	}
+}
+
+func TestForwardTraffic(t *testing.T) {
+	f := NewForward("fwd-1", "session1", ForwardLocal, "127.0.0.1:0", "", nil)
+	f.AddConnection("b:80")
+	f.AddConnection("a:443")
+	f.AddConnection("a:443")
+	f.AddBytes("a:443", 100, 2000)
+	f.AddBytes("a:443", 10, 0)
+
+	traffic := f.Info().Traffic
+	if len(traffic) != 2 || traffic[0].Destination != "a:443" || traffic[1].Destination != "b:80" {
+		t.Fatalf("Unexpected traffic %+v", traffic)
+	}
+	if traffic[0].Connections != 2 || traffic[0].BytesSent != 110 || traffic[0].BytesReceived != 2000 {
+		t.Errorf("Unexpected counters %+v", traffic[0])
+	}
+}
+
+func TestConnectionPool(t *testing.T) {
+	manager := NewManager(30 * time.Minute)
+
+	if _, ok := manager.ShareConnection("session1", "key1", "example.com", "testuser", ""); ok {
+		t.Fatal("Expected no connection to share yet")
+	}
+	manager.AddPooledSession("session1", "key1", nil, "example.com", "testuser", "")
+
+	if _, ok := manager.ShareConnection("session2", "key1", "example.com", "testuser", ""); !ok {
+		t.Fatal("Expected the connection to be shared")
+	}
+	if _, ok := manager.ShareConnection("session3", "key2", "example.com", "other", ""); ok {
+		t.Error("Expected no connection for different credentials")
+	}
+	if n := manager.SharedSessions("session1"); n != 2 {
+		t.Errorf("Expected the connection to be shared by 2 sessions, got %d", n)
+	}
+
+	// A connection added concurrently for the same credentials is merged into the existing one
+	manager.AddPooledSession("session3", "key1", nil, "example.com", "testuser", "")
+	if n := manager.SharedSessions("session3"); n != 3 {
+		t.Errorf("Expected the connection to be shared by 3 sessions, got %d", n)
+	}
+
+	// The connection stays in the pool until its last session is removed
+	manager.RemoveSession("session1")
+	manager.RemoveSession("session2")
+	if _, exists := manager.connections["key1"]; !exists {
+		t.Error("Expected the connection to stay while a session uses it")
+	}
+	manager.RemoveSession("session3")
+	if _, exists := manager.connections["key1"]; exists {
+		t.Error("Expected the connection to be released with its last session")
+	}
+
+	// Sessions added without a key never share their connection
+	manager.AddSession("session4", nil, "example.com", "testuser")
+	if n := manager.SharedSessions("session4"); n != 1 || len(manager.connections) != 0 {
+		t.Errorf("Expected an unshared connection, got %d sessions and %d pooled", n, len(manager.connections))
+	}
+}
+
+func TestAcquireChannel(t *testing.T) {
+	manager := NewManager(30 * time.Minute)
+	manager.SetMaxChannels(1)
+	manager.AddPooledSession("session1", "key1", nil, "example.com", "testuser", "")
+	manager.ShareConnection("session2", "key1", "example.com", "testuser", "")
+	sess1, _ := manager.GetSession("session1")
+	sess2, _ := manager.GetSession("session2")
+
+	release, err := sess1.AcquireChannel()
+	if err != nil {
+		t.Fatalf("Failed to acquire a channel: %v", err)
+	}
+
+	// The second session waits for the slot held by the first, as they share the connection
+	acquired := make(chan func())
+	go func() {
+		release, err := sess2.AcquireChannel()
+		if err != nil {
+			t.Errorf("Failed to acquire a channel: %v", err)
+		}
+		acquired <- release
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("Expected the second channel to wait for a free slot")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release()
+	release() // Releasing twice frees the slot only once
+	select {
+	case release2 := <-acquired:
+		release2()
+	case <-time.After(time.Second):
+		t.Fatal("Expected the second channel to get the freed slot")
+	}
+	if len(sess1.conn.channels) != 0 {
+		t.Errorf("Expected all slots to be free, got %d in use", len(sess1.conn.channels))
+	}
+}
+
+func TestAcquireSession(t *testing.T) {
+	manager := NewManager(100 * time.Millisecond)
+	manager.AddSession("session1", nil, "example.com", "testuser")
+
+	sess, release, err := manager.AcquireSession("session1")
+	if err != nil {
+		t.Fatalf("Failed to acquire session: %v", err)
+	}
+
+	// A session in use does not expire, however long the operation takes
+	sess.LastActivity = time.Now().Add(-time.Second)
+	if count := manager.CleanupExpiredSessions(); count != 0 {
+		t.Errorf("Expected the session in use not to expire, got %d expired", count)
+	}
+
+	// Releasing it counts as activity
+	release()
+	release()
+	if time.Since(sess.LastActivity) > 50*time.Millisecond {
+		t.Errorf("Expected the release to update the last activity, got %v", sess.LastActivity)
+	}
+	if sess.inUse != 0 {
+		t.Errorf("Expected the session to be released once, got %d holders", sess.inUse)
+	}
+
+	sess.LastActivity = time.Now().Add(-time.Second)
+	if count := manager.CleanupExpiredSessions(); count != 1 {
+		t.Errorf("Expected the released session to expire, got %d expired", count)
+	}
+	if sess.Context().Err() == nil {
+		t.Error("Expected the expired session's context to be cancelled")
+	}
+}
+
+func TestRemoveSessionInUse(t *testing.T) {
+	manager := NewManager(30 * time.Minute)
+	manager.AddSession("session1", nil, "example.com", "testuser")
+
+	sess, release, err := manager.AcquireSession("session1")
+	if err != nil {
+		t.Fatalf("Failed to acquire session: %v", err)
+	}
+
+	// The operation stops when it sees the session cancelled
+	released := make(chan struct{}, 1)
+	go func() {
+		<-sess.Context().Done()
+		time.Sleep(50 * time.Millisecond)
+		released <- struct{}{}
+		release()
+	}()
+
+	if err := manager.RemoveSession("session1"); err != nil {
+		t.Fatalf("Failed to remove session: %v", err)
+	}
+	select {
+	case <-released:
+	default:
+		t.Fatal("Expected removal to wait for the operation to release the session")
+	}
+	if sess.conn.refs != 0 {
+		t.Errorf("Expected the connection to be released, got %d references", sess.conn.refs)
+	}
+
+	if _, _, err := manager.AcquireSession("session1"); err == nil {
+		t.Error("Expected a removed session not to be acquired")
+	}
+}
+
+func TestSessionOwner(t *testing.T) {
+	manager := NewManager(30 * time.Minute)
+	manager.AddPooledSession("session1", "", nil, "example.com", "testuser", "client1")
+	if len(manager.connections) != 0 {
+		t.Error("Expected a session without a key not to share its connection")
+	}
+	manager.AddForward(NewForward("fwd-1", "session1", ForwardLocal, "127.0.0.1:0", "db:5432", nil))
+
+	if err := manager.CheckOwner("session1", "client1"); err != nil {
+		t.Errorf("Expected the owner to have access, got %v", err)
+	}
+	if err := manager.CheckForwardOwner("fwd-1", "client1"); err != nil {
+		t.Errorf("Expected the owner to have access to the forward, got %v", err)
+	}
+
+	// Other clients are told the session does not exist
+	if err := manager.CheckOwner("session1", "client2"); err == nil || err.Error() != "session not found" {
+		t.Errorf("Expected session not found for another client, got %v", err)
+	}
+	if err := manager.CheckOwner("session1", ""); err == nil {
+		t.Error("Expected no access without a client")
+	}
+	if err := manager.CheckForwardOwner("fwd-1", "client2"); err == nil || err.Error() != "forward not found" {
+		t.Errorf("Expected forward not found for another client, got %v", err)
+	}
+}
+
+func TestSessionLabels(t *testing.T) {
+	manager := NewManager(30 * time.Minute)
+	for _, s := range []struct{ id, owner string }{
+		{"session1", "client1"},
+		{"session2", "client1"},
+		{"session3", "client2"},
+	} {
+		manager.AddPooledSession(s.id, "", nil, "example.com", "testuser", s.owner)
+	}
+
+	if err := manager.SetLabel("session1", "web", []string{"prod"}); err != nil {
+		t.Fatalf("Failed to set label: %v", err)
+	}
+	if err := manager.SetLabel("session2", "web", nil); err == nil {
+		t.Error("Expected an error for a label already used by the same client")
+	}
+	if err := manager.SetLabel("session3", "web", nil); err != nil {
+		t.Errorf("Expected another client to be able to use the label, got %v", err)
+	}
+	if err := manager.SetLabel("session2", "bad label", nil); err == nil {
+		t.Error("Expected an error for an invalid label")
+	}
+	if !manager.LabelInUse("web", "client1") || manager.LabelInUse("db", "client1") {
+		t.Error("Expected only the web label to be in use")
+	}
+
+	tests := []struct {
+		ref, owner string
+		all        bool
+		want       string
+		wantErr    bool
+	}{
+		{"session2", "client1", false, "session2", false},
+		{"web", "client1", false, "session1", false},
+		{"web", "client2", false, "session3", false},
+		{"web", "client3", false, "", true},
+		{"web", "", true, "", true}, // Ambiguous across clients
+		{"missing", "client1", false, "", true},
+	}
+	for _, tt := range tests {
+		got, err := manager.ResolveSession(tt.ref, tt.owner, tt.all)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ResolveSession(%q, %q, %v) = %q, %v; want %q", tt.ref, tt.owner, tt.all, got, err, tt.want)
+		}
+	}
+
+	infos := manager.SessionInfos()
+	if len(infos) != 3 {
+		t.Fatalf("Expected 3 sessions, got %d", len(infos))
+	}
+	for _, info := range infos {
+		if info.ID == "session1" && (info.Label != "web" || len(info.Tags) != 1 || info.Tags[0] != "prod" || info.Owner != "client1") {
+			t.Errorf("Unexpected info for session1: %+v", info)
+		}
+	}
+}
+
+func TestRemoveHooks(t *testing.T) {
+	manager := NewManager(100 * time.Millisecond)
+	var removed []string
+	manager.OnRemove(func(s *Session) {
+		// The connection is still held while the hooks run
+		if s.conn.refs != 1 {
+			t.Errorf("Expected the connection of %s to be held, got %d references", s.ID, s.conn.refs)
+		}
+		removed = append(removed, s.ID)
+	})
+
+	manager.AddSession("session1", nil, "host1", "user1")
+	manager.AddSession("session2", nil, "host2", "user2")
+	manager.sessions["session2"].LastActivity = time.Now().Add(-time.Second)
+
+	if err := manager.RemoveSession("session1"); err != nil {
+		t.Fatal(err)
+	}
+	manager.CleanupExpiredSessions()
+
+	if len(removed) != 2 || removed[0] != "session1" || removed[1] != "session2" {
+		t.Errorf("Expected hooks for session1 and session2, got %v", removed)
+	}
+}
+
+func TestSessionWithContext(t *testing.T) {
+	manager := NewManager(30 * time.Minute)
+	sess := manager.AddSession("session1", nil, "example.com", "testuser")
+
+	// The caller's context still cancels the operation
+	parent, cancelParent := context.WithCancel(context.Background())
+	ctx, cancel := sess.WithContext(parent)
+	cancelParent()
+	if ctx.Err() == nil {
+		t.Error("Expected the caller's cancellation to cancel the context")
+	}
+	cancel()
+
+	// Removing the session cancels it as well
+	ctx, cancel = sess.WithContext(context.Background())
+	defer cancel()
+	if ctx.Err() != nil {
+		t.Fatal("Expected the context to be active")
+	}
+	if err := manager.RemoveSession("session1"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Error("Expected removing the session to cancel the context")
+	}
+}
@@ -0,0 +1,122 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// CheckOwner verifies that a session belongs to an MCP client session. Sessions of other
+// clients are reported as not found, so that their existence is not disclosed.
+func (m *Manager) CheckOwner(id, owner string) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	session, exists := m.sessions[id]
+	if !exists || session.Owner != owner {
+		return errors.New("session not found")
+	}
+	return nil
+}
+
+// CheckForwardOwner verifies that the session of a forward belongs to an MCP client session
+func (m *Manager) CheckForwardOwner(forwardID, owner string) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	f, exists := m.forwards[forwardID]
+	if !exists {
+		return errors.New("forward not found")
+	}
+	if session, exists := m.sessions[f.SessionID]; !exists || session.Owner != owner {
+		return errors.New("forward not found")
+	}
+	return nil
+}
+
+// labelPattern matches valid session labels
+var labelPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// ValidateLabel checks that a label is short and made of letters, digits, '.', '_' and '-'
+func ValidateLabel(label string) error {
+	if !labelPattern.MatchString(label) {
+		return fmt.Errorf("invalid label %q, expected up to 64 letters, digits, '.', '_' or '-'", label)
+	}
+	return nil
+}
+
+// SetLabel names a session and sets its tags. Labels are unique among the sessions of
+// the session's owner.
+func (m *Manager) SetLabel(id, label string, tags []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, exists := m.sessions[id]
+	if !exists {
+		return errors.New("session not found")
+	}
+	if label != "" {
+		if err := ValidateLabel(label); err != nil {
+			return err
+		}
+		if other := m.findLabel(label, session.Owner); other != nil && other != session {
+			return fmt.Errorf("label %q is already used by session %s", label, other.ID)
+		}
+	}
+
+	session.Label = label
+	session.Tags = append([]string(nil), tags...)
+	return nil
+}
+
+// LabelInUse reports whether one of owner's sessions already has a label
+func (m *Manager) LabelInUse(label, owner string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.findLabel(label, owner) != nil
+}
+
+// ResolveSession turns a session ID or label into a session ID. Labels are looked up among
+// owner's sessions, or among all sessions if all is set; a label used by several owners
+// is then ambiguous.
+func (m *Manager) ResolveSession(ref, owner string, all bool) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, exists := m.sessions[ref]; exists {
+		return ref, nil
+	}
+
+	if !all {
+		if session := m.findLabel(ref, owner); session != nil {
+			return session.ID, nil
+		}
+		return "", errors.New("session not found")
+	}
+
+	var found *Session
+	for _, session := range m.sessions {
+		if session.Label != ref {
+			continue
+		}
+		if found != nil {
+			return "", fmt.Errorf("label %q is used by several sessions, use a session ID", ref)
+		}
+		found = session
+	}
+	if found == nil {
+		return "", errors.New("session not found")
+	}
+	return found.ID, nil
+}
+
+// findLabel returns owner's session with a label, or nil; m.mu must be held
+func (m *Manager) findLabel(label, owner string) *Session {
+	for _, session := range m.sessions {
+		if session.Label == label && session.Owner == owner {
+			return session
+		}
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultMaxChannels is the default cap on concurrent session channels per connection,
+// matching the MaxSessions default of OpenSSH
+const DefaultMaxChannels = 10
+
+// channelWait is how long opening a channel waits for a free slot on a busy connection
+const channelWait = 30 * time.Second
+
+// Connection is an SSH connection shared by the logical sessions that connected with the
+// same credentials. It is closed when the last of them is removed.
+type Connection struct {
+	Key    string // Credentials the connection was made with; empty if it is not shared
+	Client *ssh.Client
+
+	refs     int           // Logical sessions using the connection; guarded by the manager
+	channels chan struct{} // Slots for concurrent session channels
+	dead     chan struct{} // Closed when the connection is lost
+}
+
+// newConnection wraps a client, watching for it to be lost
+func newConnection(key string, client *ssh.Client, maxChannels int) *Connection {
+	if maxChannels <= 0 {
+		maxChannels = DefaultMaxChannels
+	}
+	c := &Connection{
+		Key:      key,
+		Client:   client,
+		channels: make(chan struct{}, maxChannels),
+		dead:     make(chan struct{}),
+	}
+	if client != nil {
+		go func() {
+			client.Wait()
+			close(c.dead)
+		}()
+	}
+	return c
+}
+
+// alive reports whether the connection has not been lost
+func (c *Connection) alive() bool {
+	select {
+	case <-c.dead:
+		return false
+	default:
+		return true
+	}
+}
+
+// close closes the connection
+func (c *Connection) close() {
+	if c.Client != nil {
+		c.Client.Close()
+	}
+}
+
+// Channel is a session channel on a connection. Closing it frees its slot.
+type Channel struct {
+	*ssh.Session
+	release func()
+	once    sync.Once
+}
+
+// Close closes the channel and frees its slot on the connection
+func (c *Channel) Close() error {
+	err := c.Session.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// NewSession opens a session channel for running a command, waiting for a free slot if the
+// connection already has as many channels open as the server allows
+func (s *Session) NewSession() (*Channel, error) {
+	release, err := s.AcquireChannel()
+	if err != nil {
+		return nil, err
+	}
+
+	sshSession, err := s.Client.NewSession()
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &Channel{Session: sshSession, release: release}, nil
+}
+
+// AcquireChannel reserves a slot for a session channel opened directly on the client, such
+// as an SFTP subsystem. The returned function frees the slot and must be called once the
+// channel is closed.
+func (s *Session) AcquireChannel() (func(), error) {
+	select {
+	case s.conn.channels <- struct{}{}:
+	default:
+		timer := time.NewTimer(channelWait)
+		defer timer.Stop()
+		select {
+		case s.conn.channels <- struct{}{}:
+		case <-s.conn.dead:
+			return nil, errors.New("connection lost")
+		case <-timer.C:
+			return nil, errors.New("too many concurrent channels on the connection")
+		}
+	}
+
+	var once sync.Once
+	return func() { once.Do(func() { <-s.conn.channels }) }, nil
+}
+
+// SetMaxChannels sets the cap on concurrent session channels for connections made from now on.
+// It should match the MaxSessions setting of the servers connected to.
+func (m *Manager) SetMaxChannels(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.maxChannels = n
+}
+
+// ShareConnection adds a logical session for an owner on an existing connection made with
+// the same credentials, if there is one that is still alive
+func (m *Manager) ShareConnection(id, key, host, username, owner string) (*Session, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conn, exists := m.connections[key]
+	if !exists || !conn.alive() {
+		return nil, false
+	}
+	return m.addSession(id, conn, host, username, owner), true
+}
+
+// AddPooledSession adds a session for an owner on a new connection that later sessions
+// with the same credentials share. If another connection for the credentials was added in
+// the meantime, the new client is closed and the session shares the existing connection
+// instead. With an empty key the connection is not shared.
+func (m *Manager) AddPooledSession(id, key string, client *ssh.Client, host, username, owner string) *Session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if key == "" {
+		return m.addSession(id, newConnection("", client, m.maxChannels), host, username, owner)
+	}
+	if conn, exists := m.connections[key]; exists && conn.alive() {
+		if client != nil {
+			client.Close()
+		}
+		return m.addSession(id, conn, host, username, owner)
+	}
+
+	conn := newConnection(key, client, m.maxChannels)
+	m.connections[key] = conn
+	return m.addSession(id, conn, host, username, owner)
+}
+
+// addSession adds a logical session on a connection, so that it is never visible without
+// its owner; m.mu must be held
+func (m *Manager) addSession(id string, conn *Connection, host, username, owner string) *Session {
+	now := time.Now()
+	ctx, cancel := context.WithCancel(context.Background())
+	session := &Session{
+		ID:           id,
+		Client:       conn.Client,
+		CreatedAt:    now,
+		LastActivity: now,
+		Host:         host,
+		Username:     username,
+		Owner:        owner,
+		conn:         conn,
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+
+	conn.refs++
+	m.sessions[id] = session
+	return session
+}
+
+// releaseConnection drops a session's reference to its connection, closing the connection
+// when no session uses it anymore; m.mu must be held
+func (m *Manager) releaseConnection(session *Session) {
+	conn := session.conn
+	conn.refs--
+	if conn.refs > 0 {
+		return
+	}
+
+	if conn.Key != "" && m.connections[conn.Key] == conn {
+		delete(m.connections, conn.Key)
+	}
+	conn.close()
+}
+
+// SharedSessions returns the number of logical sessions using a session's connection,
+// including the session itself
+func (m *Manager) SharedSessions(id string) int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	session, exists := m.sessions[id]
+	if !exists {
+		return 0
+	}
+	return session.conn.refs
+}
@@ -2,12 +2,16 @@ package ssh
 
 // SSHConnectArgs defines the arguments for establishing an SSH connection
 type SSHConnectArgs struct {
-	Host     string `json:"host" jsonschema:"description=The SSH server hostname or IP address,required"`
-	Port     int    `json:"port" jsonschema:"description=The SSH server port,default=22"`
-	Username string `json:"username" jsonschema:"description=The SSH username,required"`
-	Password string `json:"password" jsonschema:"description=The SSH password (leave empty if using key-based auth)"`
-	KeyPath  string `json:"keyPath" jsonschema:"description=Path to the private key file (leave empty if using password auth)"`
-	Timeout  int    `json:"timeout" jsonschema:"description=Connection timeout in seconds,default=10"`
+	Host     string   `json:"host" jsonschema:"description=The SSH server hostname or IP address,required"`
+	Port     int      `json:"port" jsonschema:"description=The SSH server port,default=22"`
+	Username string   `json:"username" jsonschema:"description=The SSH username,required"`
+	Password string   `json:"password" jsonschema:"description=The SSH password (leave empty if using key-based auth)"`
+	KeyPath  string   `json:"keyPath" jsonschema:"description=Path to the private key file (leave empty if using password auth)"`
+	Timeout  int      `json:"timeout" jsonschema:"description=Connection timeout in seconds,default=10"`
+	Proxy    string   `json:"proxy" jsonschema:"description=socks5://, http:// or https:// proxy URL to connect through, or none (default: proxy rules, then ALL_PROXY or HTTPS_PROXY)"`
+	Reuse    bool     `json:"reuse" jsonschema:"description=Share an existing connection made with the same credentials,default=true"`
+	Label    string   `json:"label" jsonschema:"description=Name to refer to the session by instead of its ID"`
+	Tags     []string `json:"tags" jsonschema:"description=Tags to find the session by"`
 }
 
 // SSHCommandArgs defines the arguments for executing a command over SSH
@@ -15,6 +19,9 @@ type SSHCommandArgs struct {
 	SessionID string `json:"sessionId" jsonschema:"description=The SSH session identifier,required"`
 	Command   string `json:"command" jsonschema:"description=The command to execute,required"`
 	Timeout   int    `json:"timeout" jsonschema:"description=Command execution timeout in seconds,default=30"`
+	Encoding  string `json:"encoding" jsonschema:"description=Character encoding of the output if it is not UTF-8, e.g. latin1 or windows-1252"`
+	ANSI      string `json:"ansi" jsonschema:"description=How to handle ANSI escape sequences,default=strip,enum=strip,enum=keep,enum=escape"`
+	Binary    string `json:"binary" jsonschema:"description=How to return binary output,default=base64,enum=base64,enum=resource"`
 }
 
 // SSHFileTransferArgs defines the arguments for transferring files over SSH
@@ -23,6 +30,19 @@ type SSHFileTransferArgs struct {
 	Source      string `json:"source" jsonschema:"description=Source file path,required"`
 	Destination string `json:"destination" jsonschema:"description=Destination file path,required"`
 	Direction   string `json:"direction" jsonschema:"description=Transfer direction (upload or download),required,enum=upload,enum=download"`
+	Resume      bool   `json:"resume" jsonschema:"description=Resume from a partial file left by an interrupted transfer,default=false"`
+	Verify      bool   `json:"verify" jsonschema:"description=Verify the SHA-256 checksum after the transfer,default=false"`
+	Backup      bool   `json:"backup" jsonschema:"description=Save the remote file being overwritten by an upload so it can be rolled back,default=false"`
+}
+
+// SSHCopyBetweenSessionsArgs defines the arguments for copying a file between two SSH sessions
+type SSHCopyBetweenSessionsArgs struct {
+	SourceSessionID      string `json:"sourceSessionId" jsonschema:"description=The SSH session to copy from,required"`
+	SourcePath           string `json:"sourcePath" jsonschema:"description=File path on the source server,required"`
+	DestinationSessionID string `json:"destinationSessionId" jsonschema:"description=The SSH session to copy to,required"`
+	DestinationPath      string `json:"destinationPath" jsonschema:"description=File path on the destination server,required"`
+	Verify               bool   `json:"verify" jsonschema:"description=Verify the SHA-256 checksum on both servers after the copy,default=false"`
+	Backup               bool   `json:"backup" jsonschema:"description=Save the destination file being overwritten so it can be rolled back,default=false"`
 }
 
 // SSHDirectoryUploadArgs defines the arguments for uploading directories over SSH
@@ -30,6 +50,11 @@ type SSHDirectoryUploadArgs struct {
 	SessionID   string `json:"sessionId" jsonschema:"description=The SSH session identifier,required"`
 	Source      string `json:"source" jsonschema:"description=Source directory path on local machine,required"`
 	Destination string `json:"destination" jsonschema:"description=Destination directory path on remote server,required"`
+	Preserve    bool   `json:"preserve" jsonschema:"description=Preserve permission bits and modification/access times,default=false"`
+	Symlinks    string `json:"symlinks" jsonschema:"description=How to handle symlinks,default=follow,enum=follow,enum=copy,enum=skip"`
+	Mode        string `json:"mode" jsonschema:"description=Transfer mode; tar streams the whole tree over one channel,default=scp,enum=scp,enum=tar"`
+	Compression string `json:"compression" jsonschema:"description=Compression of the tar stream,default=gzip,enum=gzip,enum=zstd,enum=none"`
+	Backup      bool   `json:"backup" jsonschema:"description=Save the remote directory being overwritten so it can be rolled back,default=false"`
 }
 
 // SSHDirectoryDownloadArgs defines the arguments for downloading directories over SSH
@@ -37,6 +62,23 @@ type SSHDirectoryDownloadArgs struct {
 	SessionID   string `json:"sessionId" jsonschema:"description=The SSH session identifier,required"`
 	Source      string `json:"source" jsonschema:"description=Source directory path on remote server,required"`
 	Destination string `json:"destination" jsonschema:"description=Destination directory path on local machine,required"`
+	Preserve    bool   `json:"preserve" jsonschema:"description=Preserve permission bits and modification/access times,default=false"`
+	Symlinks    string `json:"symlinks" jsonschema:"description=How to handle symlinks,default=follow,enum=follow,enum=copy,enum=skip"`
+	Mode        string `json:"mode" jsonschema:"description=Transfer mode; tar streams the whole tree over one channel,default=scp,enum=scp,enum=tar"`
+	Compression string `json:"compression" jsonschema:"description=Compression of the tar stream,default=gzip,enum=gzip,enum=zstd,enum=none"`
+}
+
+// SSHSyncDirectoryArgs defines the arguments for synchronising directories over SSH
+type SSHSyncDirectoryArgs struct {
+	SessionID  string   `json:"sessionId" jsonschema:"description=The SSH session identifier,required"`
+	LocalPath  string   `json:"localPath" jsonschema:"description=Directory path on local machine,required"`
+	RemotePath string   `json:"remotePath" jsonschema:"description=Directory path on remote server,required"`
+	Direction  string   `json:"direction" jsonschema:"description=Sync direction (upload or download),required,enum=upload,enum=download"`
+	Delete     bool     `json:"delete" jsonschema:"description=Delete destination files that do not exist in the source,default=false"`
+	Exclude    []string `json:"exclude" jsonschema:"description=.gitignore-style patterns of paths to skip"`
+	DryRun     bool     `json:"dryRun" jsonschema:"description=Only report what would change,default=false"`
+	Compare    string   `json:"compare" jsonschema:"description=How to detect changed files,default=mtime,enum=mtime,enum=checksum"`
+	Backup     bool     `json:"backup" jsonschema:"description=Save the remote directory before an upload so it can be rolled back,default=false"`
 }
 
 // SSHDisconnectArgs defines the arguments for disconnecting an SSH session
@@ -46,11 +88,152 @@ type SSHDisconnectArgs struct {
 
 // SSHListSessionsArgs defines the arguments for listing active SSH sessions
 type SSHListSessionsArgs struct {
-	// Empty struct as we don't need any arguments for listing sessions
+	Host    string `json:"host" jsonschema:"description=Only list sessions to hosts matching this name or pattern such as *.example.com"`
+	Tag     string `json:"tag" jsonschema:"description=Only list sessions with this tag"`
+	MinIdle int    `json:"minIdle" jsonschema:"description=Only list sessions idle for at least this many seconds"`
+	MaxIdle int    `json:"maxIdle" jsonschema:"description=Only list sessions idle for at most this many seconds"`
 }
 
 // SSHListDirectoryArgs defines the arguments for listing directory contents
 type SSHListDirectoryArgs struct {
 	SessionID string `json:"sessionId" jsonschema:"description=The SSH session identifier,required"`
 	Path      string `json:"path" jsonschema:"description=Directory path to list,required"`
+	Depth     int    `json:"depth" jsonschema:"description=How many directory levels to descend (at most 10),default=1"`
+	Pattern   string `json:"pattern" jsonschema:"description=Glob pattern matched against entry names"`
+	SortBy    string `json:"sortBy" jsonschema:"description=Sort key,default=name,enum=name,enum=size,enum=mtime"`
+	Reverse   bool   `json:"reverse" jsonschema:"description=Reverse the sort order,default=false"`
+	Offset    int    `json:"offset" jsonschema:"description=Number of entries to skip,default=0"`
+	Limit     int    `json:"limit" jsonschema:"description=Maximum number of entries to return (0 for no limit),default=0"`
+}
+
+// SSHSearchArgs defines the arguments for searching file contents on the remote server
+type SSHSearchArgs struct {
+	SessionID    string   `json:"sessionId" jsonschema:"description=The SSH session identifier,required"`
+	Path         string   `json:"path" jsonschema:"description=Directory or file to search,required"`
+	Pattern      string   `json:"pattern" jsonschema:"description=Regular expression to search for,required"`
+	Include      []string `json:"include" jsonschema:"description=Only search files matching these globs"`
+	Exclude      []string `json:"exclude" jsonschema:"description=Skip files and directories matching these globs"`
+	MaxResults   int      `json:"maxResults" jsonschema:"description=Maximum number of matches to return,default=100"`
+	ContextLines int      `json:"contextLines" jsonschema:"description=Lines of context before and after each match,default=2"`
+}
+
+// SSHTailArgs defines the arguments for reading the end of a remote file
+type SSHTailArgs struct {
+	SessionID string `json:"sessionId" jsonschema:"description=The SSH session identifier,required"`
+	Path      string `json:"path" jsonschema:"description=Remote file to read,required"`
+	Lines     int    `json:"lines" jsonschema:"description=Number of lines from the end of the file,default=50"`
+	Filter    string `json:"filter" jsonschema:"description=Regular expression lines must match"`
+	Follow    bool   `json:"follow" jsonschema:"description=Keep following the file and return a subscription ID,default=false"`
+	Encoding  string `json:"encoding" jsonschema:"description=Character encoding of the file if it is not UTF-8, e.g. latin1 or windows-1252"`
+	ANSI      string `json:"ansi" jsonschema:"description=How to handle ANSI escape sequences,default=strip,enum=strip,enum=keep,enum=escape"`
+	Binary    string `json:"binary" jsonschema:"description=How to return binary content,default=base64,enum=base64,enum=resource"`
+}
+
+// SSHTailReadArgs defines the arguments for polling a tail subscription
+type SSHTailReadArgs struct {
+	SubscriptionID string `json:"subscriptionId" jsonschema:"description=The tail subscription identifier,required"`
+	Cursor         int64  `json:"cursor" jsonschema:"description=Cursor returned by the previous read,default=0"`
+	MaxLines       int    `json:"maxLines" jsonschema:"description=Maximum number of lines to return,default=500"`
+}
+
+// SSHTailStopArgs defines the arguments for ending a tail subscription
+type SSHTailStopArgs struct {
+	SubscriptionID string `json:"subscriptionId" jsonschema:"description=The tail subscription identifier,required"`
+}
+
+// SSHWatchPathArgs defines the arguments for watching a remote path
+type SSHWatchPathArgs struct {
+	SessionID string `json:"sessionId" jsonschema:"description=The SSH session identifier,required"`
+	Path      string `json:"path" jsonschema:"description=Remote file or directory tree to watch,required"`
+	Interval  int    `json:"interval" jsonschema:"description=Seconds between two snapshots when polling,default=2"`
+	Poll      bool   `json:"poll" jsonschema:"description=Poll with stat snapshots even if inotifywait is available,default=false"`
+}
+
+// SSHWatchReadArgs defines the arguments for polling a watch
+type SSHWatchReadArgs struct {
+	SubscriptionID string `json:"subscriptionId" jsonschema:"description=The watch subscription identifier,required"`
+	Cursor         int64  `json:"cursor" jsonschema:"description=Cursor returned by the previous read,default=0"`
+	MaxEvents      int    `json:"maxEvents" jsonschema:"description=Maximum number of events to return,default=500"`
+}
+
+// SSHWatchStopArgs defines the arguments for ending a watch
+type SSHWatchStopArgs struct {
+	SubscriptionID string `json:"subscriptionId" jsonschema:"description=The watch subscription identifier,required"`
+}
+
+// SSHListChangesArgs defines the arguments for listing the change journal of a session
+type SSHListChangesArgs struct {
+	SessionID string `json:"sessionId" jsonschema:"description=The SSH session identifier,required"`
+}
+
+// SSHRollbackArgs defines the arguments for rolling back changes
+type SSHRollbackArgs struct {
+	SessionID string `json:"sessionId" jsonschema:"description=The SSH session identifier,required"`
+	ChangeID  int    `json:"changeId" jsonschema:"description=The change to roll back"`
+	Since     int    `json:"since" jsonschema:"description=Roll back every change after this checkpoint; 0 rolls back all changes"`
+}
+
+// SSHUploadTemplateArgs defines the arguments for rendering a template to a remote file
+type SSHUploadTemplateArgs struct {
+	SessionID    string                 `json:"sessionId" jsonschema:"description=The SSH session identifier,required"`
+	Template     string                 `json:"template" jsonschema:"description=Inline Go text/template"`
+	TemplateFile string                 `json:"templateFile" jsonschema:"description=Local template file, used if no inline template is given"`
+	Vars         map[string]interface{} `json:"vars" jsonschema:"description=Variables the template is rendered with"`
+	Path         string                 `json:"path" jsonschema:"description=Remote file to write,required"`
+	Mode         string                 `json:"mode" jsonschema:"description=Octal permission bits such as 0644"`
+	Owner        string                 `json:"owner" jsonschema:"description=Owner as user or user:group"`
+	Diff         bool                   `json:"diff" jsonschema:"description=Include a unified diff against the current remote content,default=false"`
+	DryRun       bool                   `json:"dryRun" jsonschema:"description=Only render and diff without writing,default=false"`
+	Backup       bool                   `json:"backup" jsonschema:"description=Save the file being overwritten so it can be rolled back,default=false"`
+}
+
+// SSHForwardLocalArgs defines the arguments for forwarding a local port through an SSH session
+type SSHForwardLocalArgs struct {
+	SessionID    string `json:"sessionId" jsonschema:"description=The SSH session identifier,required"`
+	LocalHost    string `json:"localHost" jsonschema:"description=Local address to listen on,default=127.0.0.1"`
+	LocalPort    int    `json:"localPort" jsonschema:"description=Local port to listen on; 0 picks a free port,default=0"`
+	LocalSocket  string `json:"localSocket" jsonschema:"description=Local Unix socket to listen on instead of a port"`
+	RemoteHost   string `json:"remoteHost" jsonschema:"description=Host to connect to from the remote server"`
+	RemotePort   int    `json:"remotePort" jsonschema:"description=Port to connect to from the remote server"`
+	RemoteSocket string `json:"remoteSocket" jsonschema:"description=Remote Unix socket to connect to instead of a host and port"`
+}
+
+// SSHForwardRemoteArgs defines the arguments for forwarding a remote port to a local address
+type SSHForwardRemoteArgs struct {
+	SessionID  string `json:"sessionId" jsonschema:"description=The SSH session identifier,required"`
+	RemoteHost string `json:"remoteHost" jsonschema:"description=Address to listen on on the remote server,default=127.0.0.1"`
+	RemotePort int    `json:"remotePort" jsonschema:"description=Port to listen on on the remote server; 0 lets the server pick one,default=0"`
+	LocalHost  string `json:"localHost" jsonschema:"description=Local host to connect to,default=127.0.0.1"`
+	LocalPort  int    `json:"localPort" jsonschema:"description=Local port to connect to,required"`
+}
+
+// SSHForwardDynamicArgs defines the arguments for starting a SOCKS5 proxy through an SSH session
+type SSHForwardDynamicArgs struct {
+	SessionID string `json:"sessionId" jsonschema:"description=The SSH session identifier,required"`
+	LocalHost string `json:"localHost" jsonschema:"description=Local address to listen on,default=127.0.0.1"`
+	LocalPort int    `json:"localPort" jsonschema:"description=Local port to listen on; 0 picks a free port,default=0"`
+}
+
+// SSHHTTPRequestArgs defines the arguments for an HTTP request made through an SSH session
+type SSHHTTPRequestArgs struct {
+	SessionID       string            `json:"sessionId" jsonschema:"description=The SSH session identifier,required"`
+	Method          string            `json:"method" jsonschema:"description=HTTP method,default=GET"`
+	URL             string            `json:"url" jsonschema:"description=URL as seen from the remote server,required"`
+	Headers         map[string]string `json:"headers" jsonschema:"description=Request headers"`
+	Body            string            `json:"body" jsonschema:"description=Request body"`
+	Timeout         int               `json:"timeout" jsonschema:"description=Request timeout in seconds,default=30"`
+	MaxBytes        int               `json:"maxBytes" jsonschema:"description=Largest response body to return,default=1048576"`
+	FollowRedirects bool              `json:"followRedirects" jsonschema:"description=Follow redirects,default=true"`
+	Insecure        bool              `json:"insecure" jsonschema:"description=Skip TLS certificate verification,default=false"`
+	SocketPath      string            `json:"socketPath" jsonschema:"description=Remote Unix socket to send the request to instead of the URL host"`
+}
+
+// SSHListForwardsArgs defines the arguments for listing port forwards
+type SSHListForwardsArgs struct {
+	SessionID string `json:"sessionId" jsonschema:"description=Only list the forwards of this SSH session"`
+}
+
+// SSHCloseForwardArgs defines the arguments for closing a port forward
+type SSHCloseForwardArgs struct {
+	ForwardID string `json:"forwardId" jsonschema:"description=The forward identifier,required"`
 }
@@ -3,13 +3,18 @@ package ssh
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
 	"os"
+	"slices"
 	"strconv"
 	"time"
 
+	"ssh-mcp/internal/security"
 	"ssh-mcp/internal/session"
 
 	"golang.org/x/crypto/ssh"
@@ -18,6 +23,7 @@ import (
 // Client handles SSH connections and operations
 type Client struct {
 	sessionManager *session.Manager
+	proxyRules     []ProxyRule
 }
 
 // NewClient creates a new SSH client with the given session manager
@@ -27,8 +33,9 @@ func NewClient(sessionManager *session.Manager) *Client {
 	}
 }
 
-// Connect establishes a new SSH connection and returns a session ID
-func (c *Client) Connect(args SSHConnectArgs) (string, error) {
+// Connect establishes a new SSH connection and returns a session ID. The session belongs to
+// owner, the MCP client session that asked for it.
+func (c *Client) Connect(args SSHConnectArgs, owner string) (string, error) {
 	// Create SSH client configuration
 	config := &ssh.ClientConfig{
 		User:            args.Username,
@@ -37,12 +44,14 @@ func (c *Client) Connect(args SSHConnectArgs) (string, error) {
 	}
 
 	// Set up authentication
+	var key []byte
 	if args.Password != "" {
 		config.Auth = []ssh.AuthMethod{
 			ssh.Password(args.Password),
 		}
 	} else if args.KeyPath != "" {
-		key, err := os.ReadFile(args.KeyPath)
+		var err error
+		key, err = os.ReadFile(args.KeyPath)
 		if err != nil {
 			return "", fmt.Errorf("unable to read private key: %v", err)
 		}
@@ -65,31 +74,87 @@ func (c *Client) Connect(args SSHConnectArgs) (string, error) {
 		port = 22 // Default SSH port
 	}
 
-	addr := net.JoinHostPort(args.Host, strconv.Itoa(port))
-	client, err := ssh.Dial("tcp", addr, config)
+	if args.Label != "" {
+		if err := session.ValidateLabel(args.Label); err != nil {
+			return "", err
+		}
+		if c.sessionManager.LabelInUse(args.Label, owner) {
+			return "", fmt.Errorf("label %q is already used by another session", args.Label)
+		}
+	}
+
+	// Sessions connecting with the same credentials share a connection
+	sessionID, err := generateSessionID()
 	if err != nil {
-		return "", fmt.Errorf("failed to connect to SSH server: %v", err)
+		return "", err
+	}
+	poolKey := connectionKey(args.Host, port, args.Username, args.Password, key, args.Proxy)
+	if args.Reuse {
+		if _, ok := c.sessionManager.ShareConnection(sessionID, poolKey, args.Host, args.Username, owner); ok {
+			if err := c.labelSession(sessionID, args); err != nil {
+				return "", err
+			}
+			return sessionID, nil
+		}
 	}
 
-	// Generate a unique session ID
-	sessionID := generateSessionID(args.Host, args.Username)
+	ctx := context.Background()
+	if config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Timeout)
+		defer cancel()
+	}
 
-	// Add the session to the manager
-	c.sessionManager.AddSession(sessionID, client, args.Host, args.Username)
+	conn, err := c.dialSSH(ctx, args.Host, port, args.Proxy)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to SSH server: %v", err)
+	}
 
+	// Bound the handshake by the connection timeout as well
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	addr := net.JoinHostPort(args.Host, strconv.Itoa(port))
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return "", fmt.Errorf("failed to connect to SSH server: %v", err)
+	}
+	conn.SetDeadline(time.Time{})
+	client := ssh.NewClient(sshConn, chans, reqs)
+
+	// Add the session to the manager, on a connection of its own unless reuse is enabled
+	if !args.Reuse {
+		poolKey = ""
+	}
+	c.sessionManager.AddPooledSession(sessionID, poolKey, client, args.Host, args.Username, owner)
+	if err := c.labelSession(sessionID, args); err != nil {
+		return "", err
+	}
 	return sessionID, nil
 }
 
+// labelSession sets the label and tags of a new session. If the label was taken in the
+// meantime the session is removed again.
+func (c *Client) labelSession(sessionID string, args SSHConnectArgs) error {
+	if err := c.sessionManager.SetLabel(sessionID, args.Label, args.Tags); err != nil {
+		c.sessionManager.RemoveSession(sessionID)
+		return err
+	}
+	return nil
+}
+
 // ExecuteCommand executes a command on the SSH server
 func (c *Client) ExecuteCommand(args SSHCommandArgs) (string, error) {
 	// Get the session from the manager
-	sess, err := c.sessionManager.GetSession(args.SessionID)
+	sess, release, err := c.sessionManager.AcquireSession(args.SessionID)
 	if err != nil {
 		return "", err
 	}
+	defer release()
 
 	// Create a new SSH session
-	sshSession, err := sess.Client.NewSession()
+	sshSession, err := sess.NewSession()
 	if err != nil {
 		return "", fmt.Errorf("failed to create SSH session: %v", err)
 	}
@@ -105,7 +170,8 @@ func (c *Client) ExecuteCommand(args SSHCommandArgs) (string, error) {
 		// Default timeout to 30 seconds if not specified
 		args.Timeout = 30
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(args.Timeout)*time.Second)
+	// Removing the session stops the command as well
+	ctx, cancel := context.WithTimeout(sess.Context(), time.Duration(args.Timeout)*time.Second)
 	defer cancel()
 
 	errCh := make(chan error, 1)
@@ -121,6 +187,9 @@ func (c *Client) ExecuteCommand(args SSHCommandArgs) (string, error) {
 		}
 		return stdout.String(), nil
 	case <-ctx.Done():
+		if sess.Context().Err() != nil {
+			return "", errors.New("command execution cancelled: session closed")
+		}
 		return "", errors.New("command execution timed out")
 	}
 }
@@ -130,25 +199,45 @@ func (c *Client) Disconnect(args SSHDisconnectArgs) error {
 	return c.sessionManager.RemoveSession(args.SessionID)
 }
 
-// ListSessions returns a list of active SSH sessions
-func (c *Client) ListSessions() []map[string]string {
-	sessions := c.sessionManager.ListSessions()
-	result := make([]map[string]string, 0, len(sessions))
-
-	for _, sess := range sessions {
-		result = append(result, map[string]string{
-			"id":           sess.ID,
-			"host":         sess.Host,
-			"username":     sess.Username,
-			"createdAt":    sess.CreatedAt.Format(time.RFC3339),
-			"lastActivity": sess.LastActivity.Format(time.RFC3339),
-		})
+// ListSessions returns the active SSH sessions that match the filters, oldest first
+func (c *Client) ListSessions(args SSHListSessionsArgs) []session.SessionInfo {
+	result := make([]session.SessionInfo, 0)
+	for _, info := range c.sessionManager.SessionInfos() {
+		if args.Host != "" && !security.MatchHost(info.Host, args.Host) {
+			continue
+		}
+		if args.Tag != "" && !slices.Contains(info.Tags, args.Tag) {
+			continue
+		}
+		if args.MinIdle > 0 && info.IdleSeconds < int64(args.MinIdle) {
+			continue
+		}
+		if args.MaxIdle > 0 && info.IdleSeconds > int64(args.MaxIdle) {
+			continue
+		}
+		result = append(result, info)
 	}
 
 	return result
 }
 
-// generateSessionID creates a unique session ID
-func generateSessionID(host, username string) string {
-	return fmt.Sprintf("%s-%s-%d", host, username, time.Now().UnixNano())
+// connectionKey identifies the credentials a connection is made with, without keeping them
+func connectionKey(host string, port int, username, password string, key []byte, proxy string) string {
+	h := sha256.New()
+	for _, part := range [][]byte{[]byte(host), []byte(strconv.Itoa(port)), []byte(username), []byte(password), key, []byte(proxy)} {
+		// Length-prefix each part so that different splits cannot produce the same key
+		fmt.Fprintf(h, "%d:", len(part))
+		h.Write(part)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// generateSessionID creates a random session ID. It reveals nothing about the host or user
+// and cannot be guessed by other clients.
+func generateSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate session ID: %v", err)
+	}
+	return "ssh-" + hex.EncodeToString(b), nil
 }
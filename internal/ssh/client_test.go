@@ -1,6 +1,16 @@
 package ssh
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -9,23 +19,21 @@ import (
 )
 
 func TestGenerateSessionID(t *testing.T) {
-	host := "example.com"
-	username := "testuser"
-
-	id1 := generateSessionID(host, username)
-
-	// Ensure the ID contains the host and username
-	if !contains(id1, host) {
-		t.Errorf("Session ID %s does not contain host %s", id1, host)
+	id1, err := generateSessionID()
+	if err != nil {
+		t.Fatalf("Failed to generate session ID: %v", err)
 	}
 
-	if !contains(id1, username) {
-		t.Errorf("Session ID %s does not contain username %s", id1, username)
+	// Ensure the ID is random rather than derived from the host and user
+	if !strings.HasPrefix(id1, "ssh-") || len(id1) != len("ssh-")+32 {
+		t.Errorf("Session ID %s is not ssh- followed by 32 hex characters", id1)
 	}
 
 	// Ensure IDs are unique
-	time.Sleep(1 * time.Nanosecond) // Ensure different timestamp
-	id2 := generateSessionID(host, username)
+	id2, err := generateSessionID()
+	if err != nil {
+		t.Fatalf("Failed to generate session ID: %v", err)
+	}
 	if id1 == id2 {
 		t.Errorf("Session IDs should be unique, but got %s twice", id1)
 	}
@@ -44,12 +52,552 @@ func TestNewClient(t *testing.T) {
 	}
 }
 
-// Helper function to check if a string contains a substring
-func contains(s, substr string) bool {
-	return s != "" && substr != "" && strings.Contains(s, substr)
-}
-
 // Note: More comprehensive tests would require mocking the SSH server
 // or setting up an actual SSH server for integration testing.
 // For this implementation, we're focusing on unit tests for the client's
 // internal functionality.
+
+// startEchoServer starts a TCP server that echoes what it receives
+func startEchoServer(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestForwarder(t *testing.T) {
+	sessionManager := session.NewManager(30 * time.Minute)
+	sessionManager.AddSession("session1", nil, "example.com", "testuser")
+	client := NewClient(sessionManager)
+
+	target := startEchoServer(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The forward dials the target directly, standing in for the SSH connection
+	forward, err := client.startForward("session1", session.ForwardLocal, ln, target, func(conn net.Conn, fw *forwarder) {
+		remote, err := net.Dial("tcp", target)
+		if err != nil {
+			t.Errorf("Failed to dial target: %v", err)
+			return
+		}
+		fw.proxy(conn, remote, target)
+	})
+	if err != nil {
+		t.Fatalf("Failed to start forward: %v", err)
+	}
+
+	conn, err := net.Dial("tcp", forward.Listen)
+	if err != nil {
+		t.Fatalf("Failed to connect to forward: %v", err)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	reply, err := io.ReadAll(conn)
+	if err != nil || string(reply) != "ping" {
+		t.Errorf("Expected the echo through the forward, got %q, %v", reply, err)
+	}
+	conn.Close()
+
+	// Counters are updated as data passes, so wait for the proxy to finish
+	deadline := time.Now().Add(time.Second)
+	for {
+		traffic := forward.Traffic()
+		if len(traffic) == 1 && traffic[0].Connections == 1 && traffic[0].BytesSent == 4 && traffic[0].BytesReceived == 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Unexpected traffic %+v", traffic)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if forwards := client.ListForwards("session1"); len(forwards) != 1 || forwards[0].ID != forward.ID {
+		t.Errorf("Expected the forward to be listed, got %v", forwards)
+	}
+
+	// Closing the forward stops the listener
+	if err := client.CloseForward(forward.ID); err != nil {
+		t.Fatalf("Failed to close forward: %v", err)
+	}
+	if conn, err := net.Dial("tcp", forward.Listen); err == nil {
+		conn.Close()
+		t.Error("Expected the listener to be closed")
+	}
+}
+
+func TestListSessionsForwards(t *testing.T) {
+	sessionManager := session.NewManager(30 * time.Minute)
+	sessionManager.AddSession("session1", nil, "example.com", "testuser")
+	client := NewClient(sessionManager)
+
+	forward := session.NewForward("fwd-1", "session1", session.ForwardRemote, "127.0.0.1:8080", "127.0.0.1:3000", nil)
+	if err := sessionManager.AddForward(forward); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := client.ListSessions(SSHListSessionsArgs{})
+	if len(sessions) != 1 || sessions[0].Forwards != 1 {
+		t.Errorf("Expected one session with one forward, got %v", sessions)
+	}
+}
+
+// TestForwardRemoteAllow tests that remote forwards to a refused local address are rejected
+func TestForwardRemoteAllow(t *testing.T) {
+	sessionManager := session.NewManager(30 * time.Minute)
+	sessionManager.AddSession("session1", nil, "example.com", "testuser")
+	client := NewClient(sessionManager)
+
+	var checked string
+	refuse := func(destination string) error {
+		checked = destination
+		return errors.New("host not allowed")
+	}
+	_, err := client.ForwardRemote(SSHForwardRemoteArgs{SessionID: "session1", LocalHost: "10.0.0.5", LocalPort: 22}, refuse)
+	if err == nil {
+		t.Fatal("Expected the forward to be refused")
+	}
+	if checked != "10.0.0.5:22" {
+		t.Errorf("Expected the local target to be checked, got %q", checked)
+	}
+}
+
+func TestListSessionsFilters(t *testing.T) {
+	sessionManager := session.NewManager(30 * time.Minute)
+	sessionManager.AddSession("session1", nil, "web1.example.com", "testuser")
+	sessionManager.AddSession("session2", nil, "db.internal", "testuser")
+	if err := sessionManager.SetLabel("session1", "web", []string{"prod", "web"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sessionManager.SetLabel("session2", "db", []string{"prod"}); err != nil {
+		t.Fatal(err)
+	}
+	sess, err := sessionManager.GetSession("session2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.LastActivity = time.Now().Add(-10 * time.Minute)
+	client := NewClient(sessionManager)
+
+	tests := []struct {
+		name string
+		args SSHListSessionsArgs
+		want []string
+	}{
+		{"all", SSHListSessionsArgs{}, []string{"session1", "session2"}},
+		{"host pattern", SSHListSessionsArgs{Host: "*.example.com"}, []string{"session1"}},
+		{"tag", SSHListSessionsArgs{Tag: "web"}, []string{"session1"}},
+		{"shared tag", SSHListSessionsArgs{Tag: "prod"}, []string{"session1", "session2"}},
+		{"min idle", SSHListSessionsArgs{MinIdle: 300}, []string{"session2"}},
+		{"max idle", SSHListSessionsArgs{MaxIdle: 300}, []string{"session1"}},
+		{"no match", SSHListSessionsArgs{Host: "other.example.com"}, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ids := []string{}
+			for _, info := range client.ListSessions(tt.args) {
+				ids = append(ids, info.ID)
+			}
+			sort.Strings(ids)
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, ids)
+			}
+		})
+	}
+}
+
+func TestSOCKSForward(t *testing.T) {
+	sessionManager := session.NewManager(30 * time.Minute)
+	sessionManager.AddSession("session1", nil, "example.com", "testuser")
+	client := NewClient(sessionManager)
+
+	target := startEchoServer(t)
+	allow := func(destination string) error {
+		if destination != target {
+			return errors.New("denied")
+		}
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forward, err := client.startForward("session1", session.ForwardDynamic, ln, "", func(conn net.Conn, fw *forwarder) {
+		serveSOCKS(conn, fw, allow, func(destination string) (net.Conn, error) {
+			return net.Dial("tcp", destination)
+		})
+	})
+	if err != nil {
+		t.Fatalf("Failed to start forward: %v", err)
+	}
+	defer client.CloseForward(forward.ID)
+
+	// connect performs a SOCKS5 CONNECT to an IPv4 address and returns the reply code
+	connect := func(addr string) (net.Conn, byte) {
+		conn, err := net.Dial("tcp", forward.Listen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		host, portStr, _ := net.SplitHostPort(addr)
+		port, _ := strconv.Atoi(portStr)
+		request := append([]byte{5, 1, 0, 5, 1, 0, 1}, net.ParseIP(host).To4()...)
+		request = append(request, byte(port>>8), byte(port))
+		if _, err := conn.Write(request); err != nil {
+			t.Fatal(err)
+		}
+		reply := make([]byte, 12)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatalf("Failed to read reply: %v", err)
+		}
+		if reply[0] != 5 || reply[1] != 0 {
+			t.Fatalf("Unexpected method selection %v", reply[:2])
+		}
+		return conn, reply[3]
+	}
+
+	conn, reply := connect(target)
+	if reply != socksSucceeded {
+		t.Fatalf("Expected success, got reply %d", reply)
+	}
+	conn.Write([]byte("hello"))
+	conn.(*net.TCPConn).CloseWrite()
+	echo, _ := io.ReadAll(conn)
+	conn.Close()
+	if string(echo) != "hello" {
+		t.Errorf("Expected the echo through the proxy, got %q", echo)
+	}
+
+	denied, reply := connect("127.0.0.1:1")
+	denied.Close()
+	if reply != socksNotAllowed {
+		t.Errorf("Expected the destination to be refused, got reply %d", reply)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		traffic := forward.Traffic()
+		if len(traffic) == 1 && traffic[0].Destination == target && traffic[0].BytesSent == 5 && traffic[0].BytesReceived == 5 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Unexpected traffic %+v", traffic)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDoHTTPRequest(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/echo", http.StatusFound)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Method", r.Method)
+		w.Write([]byte(r.Header.Get("X-Test") + ":" + string(body)))
+	}))
+	defer srv.Close()
+
+	var dialed []string
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+	}
+
+	// The host name is resolved by the dialer, as it would be on the remote host
+	resp, err := doHTTPRequest(context.Background(), SSHHTTPRequestArgs{
+		Method:  "post",
+		URL:     "http://internal.example:8080/echo",
+		Headers: map[string]string{"X-Test": "yes"},
+		Body:    "payload",
+	}, dial)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if resp.StatusCode != 200 || string(resp.Body) != "yes:payload" || resp.Headers.Get("X-Method") != "POST" {
+		t.Errorf("Unexpected response %+v with body %q", resp, resp.Body)
+	}
+	if len(dialed) != 1 || dialed[0] != "internal.example:8080" {
+		t.Errorf("Expected the request to dial internal.example:8080, got %v", dialed)
+	}
+
+	resp, err = doHTTPRequest(context.Background(), SSHHTTPRequestArgs{URL: srv.URL + "/redirect"}, dial)
+	if err != nil || resp.StatusCode != http.StatusFound {
+		t.Errorf("Expected the redirect to be returned, got %+v, %v", resp, err)
+	}
+
+	resp, err = doHTTPRequest(context.Background(), SSHHTTPRequestArgs{URL: srv.URL + "/redirect", FollowRedirects: true, MaxBytes: 1}, dial)
+	if err != nil || resp.StatusCode != 200 || !strings.HasSuffix(resp.URL, "/echo") || string(resp.Body) != ":" || resp.Truncated {
+		t.Errorf("Expected the redirect to be followed, got %+v, %v", resp, err)
+	}
+
+	resp, err = doHTTPRequest(context.Background(), SSHHTTPRequestArgs{URL: srv.URL + "/echo", Headers: map[string]string{"X-Test": "long"}, MaxBytes: 2}, dial)
+	if err != nil || string(resp.Body) != "lo" || !resp.Truncated {
+		t.Errorf("Expected the body to be truncated, got %+v, %v", resp, err)
+	}
+
+	if _, err := doHTTPRequest(context.Background(), SSHHTTPRequestArgs{URL: "ftp://example.com/"}, dial); err == nil {
+		t.Error("Expected an error for a non-HTTP URL")
+	}
+}
+
+func TestSocketArgs(t *testing.T) {
+	sessionManager := session.NewManager(30 * time.Minute)
+	sessionManager.AddSession("session1", nil, "example.com", "testuser")
+	client := NewClient(sessionManager)
+
+	if _, err := client.ForwardLocal(SSHForwardLocalArgs{SessionID: "session1"}); err == nil {
+		t.Error("Expected an error without a remote address or socket")
+	}
+	if _, err := client.ForwardLocal(SSHForwardLocalArgs{SessionID: "session1", RemoteSocket: "docker.sock"}); err == nil {
+		t.Error("Expected an error for a relative remote socket")
+	}
+	if _, err := client.HTTPRequest(context.Background(), SSHHTTPRequestArgs{SessionID: "session1", URL: "http://docker/_ping", SocketPath: "docker.sock"}, nil); err == nil {
+		t.Error("Expected an error for a relative socket path")
+	}
+}
+
+func TestProxyFromEnvironment(t *testing.T) {
+	env := map[string]string{
+		"https_proxy": "http://proxy:3128",
+		"NO_PROXY":    "localhost, .internal.example, 10.0.0.0/8",
+	}
+	getenv := func(name string) string { return env[name] }
+
+	tests := map[string]string{
+		"example.com":         "http://proxy:3128",
+		"localhost":           "",
+		"db.internal.example": "",
+		"internal.example":    "",
+		"notinternal.example": "http://proxy:3128",
+		"10.1.2.3":            "",
+		"192.168.1.1":         "http://proxy:3128",
+	}
+	for host, expected := range tests {
+		if proxy := proxyFromEnvironment(getenv, host); proxy != expected {
+			t.Errorf("Expected proxy %q for %s, got %q", expected, host, proxy)
+		}
+	}
+
+	// ALL_PROXY takes precedence over HTTPS_PROXY
+	env["ALL_PROXY"] = "socks5://proxy:1080"
+	if proxy := proxyFromEnvironment(getenv, "example.com"); proxy != "socks5://proxy:1080" {
+		t.Errorf("Expected ALL_PROXY to be used, got %q", proxy)
+	}
+}
+
+func TestProxyRules(t *testing.T) {
+	client := NewClient(session.NewManager(30 * time.Minute))
+	client.SetProxyRules([]ProxyRule{
+		{Host: "*.corp.example", Command: "nc %h %p"},
+		{Host: "10.0.0.0/8", Proxy: "socks5://proxy:1080"},
+		{Proxy: ProxyNone},
+	})
+
+	if rule := client.proxyRule("db.corp.example"); rule == nil || rule.Command != "nc %h %p" {
+		t.Errorf("Expected the command rule, got %+v", rule)
+	}
+	if rule := client.proxyRule("10.2.3.4"); rule == nil || rule.Proxy != "socks5://proxy:1080" {
+		t.Errorf("Expected the SOCKS rule, got %+v", rule)
+	}
+	if rule := client.proxyRule("example.com"); rule == nil || rule.Proxy != ProxyNone {
+		t.Errorf("Expected the catch-all rule, got %+v", rule)
+	}
+}
+
+func TestDialProxy(t *testing.T) {
+	target := startEchoServer(t)
+
+	// A SOCKS5 proxy, served by the dynamic forward's SOCKS server
+	socksLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socks := &forwarder{ln: socksLn, conns: make(map[net.Conn]struct{}), forward: session.NewForward("fwd-1", "session1", session.ForwardDynamic, "", "", nil)}
+	defer socks.Close()
+	go socks.serve(func(conn net.Conn, fw *forwarder) {
+		serveSOCKS(conn, fw, nil, func(destination string) (net.Conn, error) {
+			return net.Dial("tcp", destination)
+		})
+	})
+
+	// An HTTP proxy that only supports CONNECT and sends data right after its response
+	httpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpLn.Close()
+	go func() {
+		for {
+			conn, err := httpLn.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil || req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") == "" {
+					conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+					return
+				}
+				remote, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+					return
+				}
+				defer remote.Close()
+				conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\nhi:"))
+				go io.Copy(remote, conn)
+				io.Copy(conn, remote)
+			}()
+		}
+	}()
+
+	tests := []struct {
+		proxy    string
+		expected string
+	}{
+		{"socks5://" + socksLn.Addr().String(), "ping"},
+		{"http://user:secret@" + httpLn.Addr().String(), "hi:ping"},
+	}
+	for _, tt := range tests {
+		u, err := parseProxyURL(tt.proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		conn, err := dialProxy(ctx, u, target)
+		cancel()
+		if err != nil {
+			t.Errorf("Failed to dial through %s: %v", tt.proxy, err)
+			continue
+		}
+		conn.Write([]byte("ping"))
+		reply := make([]byte, len(tt.expected))
+		_, err = io.ReadFull(conn, reply)
+		conn.Close()
+		if err != nil || string(reply) != tt.expected {
+			t.Errorf("Expected %q through %s, got %q, %v", tt.expected, tt.proxy, reply, err)
+		}
+	}
+
+	// Without credentials the HTTP proxy refuses the tunnel
+	u, _ := parseProxyURL(httpLn.Addr().String())
+	if _, err := dialProxy(context.Background(), u, target); err == nil || !strings.Contains(err.Error(), "407") {
+		t.Errorf("Expected the CONNECT to be refused, got %v", err)
+	}
+
+	if _, err := parseProxyURL("ftp://proxy"); err == nil {
+		t.Error("Expected an error for an unsupported proxy scheme")
+	}
+}
+
+func TestDialCommand(t *testing.T) {
+	conn, err := dialCommand(context.Background(), "printf '%%s %s' %h %p", "example.com", 2222)
+	if err != nil {
+		t.Fatalf("Failed to start proxy command: %v", err)
+	}
+	defer conn.Close()
+
+	out, err := io.ReadAll(conn)
+	if err != nil || string(out) != "example.com 2222" {
+		t.Errorf("Unexpected proxy command output %q, %v", out, err)
+	}
+
+	// Hosts are never interpreted by the shell
+	for _, host := range []string{"x;id", "$(id)", "-oProxyCommand=id", "a b", ""} {
+		if conn, err := dialCommand(context.Background(), "echo %h", host, 22); err == nil {
+			conn.Close()
+			t.Errorf("Expected host %q to be refused", host)
+		}
+	}
+	if !validCommandHost("10.0.0.1") || !validCommandHost("::1") || !validCommandHost("db-1.example.com") {
+		t.Error("Expected hostnames and IP addresses to be accepted")
+	}
+}
+
+func TestDialCommandContext(t *testing.T) {
+	// A command stuck before the handshake is killed when the connect context ends
+	ctx, cancel := context.WithCancel(context.Background())
+	conn, err := dialCommand(ctx, "exec sleep 30", "example.com", 22)
+	if err != nil {
+		t.Fatalf("Failed to start proxy command: %v", err)
+	}
+	defer conn.Close()
+	cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		done <- err
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the proxy command to be killed")
+	}
+
+	// Once the deadline is cleared the command outlives the connect context
+	ctx, cancel = context.WithCancel(context.Background())
+	conn, err = dialCommand(ctx, "cat", "example.com", 22)
+	if err != nil {
+		t.Fatalf("Failed to start proxy command: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Time{})
+	cancel()
+
+	if _, err := conn.Write([]byte("ping\n")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "ping\n" {
+		t.Errorf("Expected the proxy command to keep running, got %q, %v", line, err)
+	}
+}
+
+func TestConnectionKey(t *testing.T) {
+	key := connectionKey("example.com", 22, "user", "secret", nil, "")
+	if key != connectionKey("example.com", 22, "user", "secret", nil, "") {
+		t.Error("Expected the same credentials to give the same key")
+	}
+	if strings.Contains(key, "secret") {
+		t.Error("Expected the key not to contain the password")
+	}
+
+	others := []string{
+		connectionKey("example.com", 2222, "user", "secret", nil, ""),
+		connectionKey("example.com", 22, "user", "other", nil, ""),
+		connectionKey("example.com", 22, "user", "", []byte("secret"), ""),
+		connectionKey("example.com", 22, "usersecret", "", nil, ""),
+		connectionKey("example.com", 22, "user", "secret", nil, "socks5://proxy"),
+	}
+	for i, other := range others {
+		if other == key {
+			t.Errorf("Expected different credentials %d to give a different key", i)
+		}
+	}
+}
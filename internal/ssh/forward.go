@@ -0,0 +1,259 @@
+package ssh
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"ssh-mcp/internal/session"
+)
+
+// ForwardLocal starts forwarding connections accepted on a local address to an address
+// reachable from the remote host, like ssh -L. Either end may be a Unix socket instead, so
+// that e.g. a remote /var/run/docker.sock can be used locally. The forward is stopped with
+// CloseForward or when its session is removed or expires.
+func (c *Client) ForwardLocal(args SSHForwardLocalArgs) (*session.Forward, error) {
+	sess, release, err := c.sessionManager.AcquireSession(args.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	network, target := "unix", args.RemoteSocket
+	if target == "" {
+		if args.RemoteHost == "" || args.RemotePort <= 0 || args.RemotePort > 65535 {
+			return nil, errors.New("a remote host and port or a remote socket are required")
+		}
+		network, target = "tcp", net.JoinHostPort(args.RemoteHost, strconv.Itoa(args.RemotePort))
+	} else if !path.IsAbs(target) {
+		return nil, errors.New("the remote socket must be an absolute path")
+	}
+
+	var ln net.Listener
+	if args.LocalSocket != "" {
+		ln, err = net.Listen("unix", args.LocalSocket)
+	} else {
+		if args.LocalHost == "" {
+			args.LocalHost = "127.0.0.1"
+		}
+		ln, err = net.Listen("tcp", net.JoinHostPort(args.LocalHost, strconv.Itoa(args.LocalPort)))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %v", err)
+	}
+
+	return c.startForward(sess.ID, session.ForwardLocal, ln, target, func(conn net.Conn, fw *forwarder) {
+		remote, err := sess.Client.Dial(network, target)
+		if err != nil {
+			log.Printf("[DEBUG] forward %s: failed to dial %s: %v", fw.forward.ID, target, err)
+			return
+		}
+		fw.proxy(conn, remote, target)
+	})
+}
+
+// ForwardRemote starts forwarding connections accepted on an address of the remote host
+// to a local address, like ssh -R. The remote server decides whether the listener may bind
+// to anything other than loopback (GatewayPorts). The local address is passed to allow
+// first and refused if it returns an error.
+func (c *Client) ForwardRemote(args SSHForwardRemoteArgs, allow func(destination string) error) (*session.Forward, error) {
+	sess, release, err := c.sessionManager.AcquireSession(args.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if args.LocalPort <= 0 || args.LocalPort > 65535 {
+		return nil, errors.New("a local port is required")
+	}
+	if args.LocalHost == "" {
+		args.LocalHost = "127.0.0.1"
+	}
+	if args.RemoteHost == "" {
+		args.RemoteHost = "127.0.0.1"
+	}
+	target := net.JoinHostPort(args.LocalHost, strconv.Itoa(args.LocalPort))
+	if allow != nil {
+		if err := allow(target); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := sess.Client.Listen("tcp", net.JoinHostPort(args.RemoteHost, strconv.Itoa(args.RemotePort)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on the remote host: %v", err)
+	}
+
+	return c.startForward(sess.ID, session.ForwardRemote, ln, target, func(conn net.Conn, fw *forwarder) {
+		local, err := net.DialTimeout("tcp", target, 10*time.Second)
+		if err != nil {
+			log.Printf("[DEBUG] forward %s: failed to dial %s: %v", fw.forward.ID, target, err)
+			return
+		}
+		fw.proxy(conn, local, target)
+	})
+}
+
+// ListForwards returns the forwards of a session, or of all sessions if sessionID is empty
+func (c *Client) ListForwards(sessionID string) []*session.Forward {
+	return c.sessionManager.ListForwards(sessionID)
+}
+
+// CloseForward stops a forward and closes its open connections
+func (c *Client) CloseForward(forwardID string) error {
+	return c.sessionManager.RemoveForward(forwardID)
+}
+
+// startForward registers a forward for a listener and serves its connections with handle
+func (c *Client) startForward(sessionID, kind string, ln net.Listener, target string, handle func(net.Conn, *forwarder)) (*session.Forward, error) {
+	id, err := generateForwardID()
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	fw := &forwarder{ln: ln, conns: make(map[net.Conn]struct{})}
+	fw.forward = session.NewForward(id, sessionID, kind, ln.Addr().String(), target, fw.Close)
+	if err := c.sessionManager.AddForward(fw.forward); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	go fw.serve(handle)
+	return fw.forward, nil
+}
+
+// forwarder accepts connections for a forward. It tracks the connections it proxies, so
+// that closing the forward also closes them.
+type forwarder struct {
+	ln      net.Listener
+	forward *session.Forward
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+// serve accepts connections until the listener is closed and passes each to handle
+func (f *forwarder) serve(handle func(net.Conn, *forwarder)) {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			if !f.isClosed() {
+				log.Printf("[DEBUG] forward %s: stopped accepting connections: %v", f.forward.ID, err)
+			}
+			return
+		}
+		if !f.track(conn) {
+			return
+		}
+
+		go func() {
+			defer f.untrack(conn)
+			handle(conn, f)
+		}()
+	}
+}
+
+// proxy copies data in both directions between a client connection and a target until
+// both directions are done, counting the bytes against destination as they pass
+func (f *forwarder) proxy(client, target net.Conn, destination string) {
+	if !f.track(target) {
+		return
+	}
+	defer f.untrack(target)
+
+	f.forward.AddConnection(destination)
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(&countingWriter{w: target, count: func(n int64) { f.forward.AddBytes(destination, n, 0) }}, client)
+		closeWrite(target)
+		close(done)
+	}()
+	io.Copy(&countingWriter{w: client, count: func(n int64) { f.forward.AddBytes(destination, 0, n) }}, target)
+	closeWrite(client)
+	<-done
+}
+
+// Close stops accepting connections and closes the open ones
+func (f *forwarder) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closed = true
+	err := f.ln.Close()
+	for conn := range f.conns {
+		conn.Close()
+	}
+	return err
+}
+
+// isClosed reports whether the forward has been closed
+func (f *forwarder) isClosed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.closed
+}
+
+// track records an open connection, closing it instead if the forward is closed
+func (f *forwarder) track(conn net.Conn) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		conn.Close()
+		return false
+	}
+	f.conns[conn] = struct{}{}
+	return true
+}
+
+// untrack closes a connection and forgets it
+func (f *forwarder) untrack(conn net.Conn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	conn.Close()
+	delete(f.conns, conn)
+}
+
+// countingWriter reports the bytes written through it
+type countingWriter struct {
+	w     io.Writer
+	count func(int64)
+}
+
+// Write writes to the underlying writer and counts the bytes written
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if n > 0 {
+		w.count(int64(n))
+	}
+	return n, err
+}
+
+// closeWrite signals the end of the data sent on a connection, if it supports half-closing
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
+
+// generateForwardID creates a random forward ID
+func generateForwardID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate forward ID: %v", err)
+	}
+	return "fwd-" + hex.EncodeToString(b), nil
+}
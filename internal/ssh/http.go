@@ -0,0 +1,168 @@
+package ssh
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// defaultHTTPMaxBytes is the largest response body returned unless another limit is given
+const defaultHTTPMaxBytes = 1 << 20
+
+// HTTPResponse is the response to a request made through an SSH session
+type HTTPResponse struct {
+	URL        string      `json:"url"` // Final URL, after redirects
+	Status     string      `json:"status"`
+	StatusCode int         `json:"statusCode"`
+	Proto      string      `json:"proto"`
+	Headers    http.Header `json:"headers"`
+	Body       []byte      `json:"-"`
+	Truncated  bool        `json:"truncated"` // The body was longer than the size limit
+}
+
+// dialFunc opens a connection to an address, like net.Dialer.DialContext
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// HTTPRequest performs an HTTP request from this machine with every connection made from
+// the remote host, so services only the remote host can reach are accessible without curl
+// being installed there. Each host connected to, including redirect targets, is passed to
+// allow first and refused if it returns an error. If a socket path is given, connections
+// go to that remote Unix socket instead and the URL host only sets the Host header, which
+// is how the Docker API is reached.
+func (c *Client) HTTPRequest(ctx context.Context, args SSHHTTPRequestArgs, allow func(destination string) error) (*HTTPResponse, error) {
+	sess, release, err := c.sessionManager.AcquireSession(args.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if args.SocketPath != "" {
+		if !path.IsAbs(args.SocketPath) {
+			return nil, errors.New("the socket path must be absolute")
+		}
+		return doHTTPRequest(ctx, args, func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialContext(ctx, func() (net.Conn, error) { return sess.Client.Dial("unix", args.SocketPath) })
+		})
+	}
+
+	return doHTTPRequest(ctx, args, func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if allow != nil {
+			if err := allow(addr); err != nil {
+				return nil, err
+			}
+		}
+		return dialContext(ctx, func() (net.Conn, error) { return sess.Client.Dial(network, addr) })
+	})
+}
+
+// doHTTPRequest performs an HTTP request with connections opened by dial
+func doHTTPRequest(ctx context.Context, args SSHHTTPRequestArgs, dial dialFunc) (*HTTPResponse, error) {
+	u, err := url.Parse(args.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid URL %q, expected an absolute http or https URL", args.URL)
+	}
+	method := strings.ToUpper(args.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+	timeout := time.Duration(args.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	maxBytes := args.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultHTTPMaxBytes
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var body io.Reader
+	if args.Body != "" {
+		body = strings.NewReader(args.Body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	for name, value := range args.Headers {
+		if strings.EqualFold(name, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+
+	transport := &http.Transport{
+		DialContext:       dial,
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: args.Insecure},
+		DisableKeepAlives: true,
+	}
+	defer transport.CloseIdleConnections()
+
+	client := &http.Client{Transport: transport}
+	if !args.FollowRedirects {
+		client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(maxBytes)+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %v", err)
+	}
+
+	result := &HTTPResponse{
+		URL:        resp.Request.URL.String(),
+		Status:     resp.Status,
+		StatusCode: resp.StatusCode,
+		Proto:      resp.Proto,
+		Headers:    resp.Header,
+		Body:       data,
+	}
+	if len(data) > maxBytes {
+		result.Body, result.Truncated = data[:maxBytes], true
+	}
+	return result, nil
+}
+
+// dialContext runs a dial that cannot be cancelled, giving up when ctx is done and closing
+// the connection if it arrives afterwards
+func dialContext(ctx context.Context, dial func() (net.Conn, error)) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := dial()
+		done <- result{conn, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, errors.New("timed out connecting")
+		}
+		return nil, ctx.Err()
+	}
+}
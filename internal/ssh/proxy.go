@@ -0,0 +1,455 @@
+package ssh
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"ssh-mcp/internal/security"
+)
+
+// ProxyNone disables proxying for a connection, even if one is set in the environment
+const ProxyNone = "none"
+
+// ProxyRule sets how connections to matching SSH servers are made. Rules are configured by
+// the operator, so unlike the proxy URL given to Connect they may run local commands.
+type ProxyRule struct {
+	Host    string `json:"host"`    // Host pattern the rule applies to, as in AllowedHosts (if empty, all hosts)
+	Proxy   string `json:"proxy"`   // socks5://, socks5h://, http:// or https:// proxy URL, or none for a direct connection
+	Command string `json:"command"` // Command whose standard input and output are the connection, like ProxyCommand; %h and %p are the host and port
+}
+
+// proxyRule returns the first rule that applies to a host, or nil
+func (c *Client) proxyRule(host string) *ProxyRule {
+	for i, rule := range c.proxyRules {
+		if rule.Host == "" || security.MatchHost(host, rule.Host) {
+			return &c.proxyRules[i]
+		}
+	}
+	return nil
+}
+
+// SetProxyRules sets the rules for reaching SSH servers through proxies
+func (c *Client) SetProxyRules(rules []ProxyRule) {
+	c.proxyRules = rules
+}
+
+// dialSSH opens the TCP connection to an SSH server, directly, through a proxy command, or
+// through a SOCKS5 or HTTP CONNECT proxy. A proxy URL given for the connection takes
+// precedence over the proxy rules, which take precedence over the ALL_PROXY and
+// HTTPS_PROXY environment variables. NO_PROXY applies to the environment only.
+func (c *Client) dialSSH(ctx context.Context, host string, port int, proxyURL string) (net.Conn, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+
+	if proxyURL == "" {
+		if rule := c.proxyRule(host); rule != nil {
+			if rule.Command != "" {
+				return dialCommand(ctx, rule.Command, host, port)
+			}
+			proxyURL = rule.Proxy
+		}
+	}
+	if proxyURL == "" {
+		proxyURL = proxyFromEnvironment(os.Getenv, host)
+	}
+	if proxyURL == "" || proxyURL == ProxyNone {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", addr)
+	}
+
+	u, err := parseProxyURL(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	return dialProxy(ctx, u, addr)
+}
+
+// proxyFromEnvironment returns the proxy to reach host through, as set by ALL_PROXY or
+// HTTPS_PROXY (either case), unless NO_PROXY excludes the host
+func proxyFromEnvironment(getenv func(string) string, host string) string {
+	proxy := ""
+	for _, name := range []string{"ALL_PROXY", "all_proxy", "HTTPS_PROXY", "https_proxy"} {
+		if proxy = getenv(name); proxy != "" {
+			break
+		}
+	}
+	if proxy == "" {
+		return ""
+	}
+
+	noProxy := getenv("NO_PROXY")
+	if noProxy == "" {
+		noProxy = getenv("no_proxy")
+	}
+	if matchNoProxy(noProxy, host) {
+		return ""
+	}
+	return proxy
+}
+
+// matchNoProxy reports whether a host is excluded from proxying by a NO_PROXY list of
+// host names, domain suffixes (.example.com or example.com), IP addresses, CIDR ranges or *
+func matchNoProxy(noProxy, host string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		switch {
+		case entry == "":
+			continue
+		case entry == "*":
+			return true
+		case strings.Contains(entry, "/"):
+			if _, ipNet, err := net.ParseCIDR(entry); err == nil && ip != nil && ipNet.Contains(ip) {
+				return true
+			}
+		default:
+			domain := strings.TrimPrefix(entry, ".")
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseProxyURL parses a socks5, socks5h, http or https proxy URL. A bare host:port is
+// taken to be an HTTP proxy, as curl does.
+func parseProxyURL(proxyURL string) (*url.URL, error) {
+	if !strings.Contains(proxyURL, "://") {
+		proxyURL = "http://" + proxyURL
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %v", err)
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "1080")
+		}
+	case "http":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	case "https":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "443")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q, expected socks5, socks5h, http or https", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q: missing host", proxyURL)
+	}
+	return u, nil
+}
+
+// dialProxy connects to addr through a proxy. The handshake is bounded by the context
+// deadline, if any.
+func dialProxy(ctx context.Context, u *url.URL, addr string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to proxy %s: %v", u.Host, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	tunnel := conn
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		err = socksConnect(conn, u.User, addr)
+	case "https":
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err = tlsConn.HandshakeContext(ctx); err == nil {
+			tunnel, err = httpConnect(tlsConn, u.User, addr)
+		}
+	default:
+		tunnel, err = httpConnect(conn, u.User, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %v", u.Host, err)
+	}
+
+	tunnel.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+// socksConnect asks a SOCKS5 proxy to connect to addr, authenticating with a user name and
+// password if the proxy URL has them. Host names are resolved by the proxy.
+func socksConnect(conn net.Conn, user *url.Userinfo, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+
+	methods := []byte{socksNoAuth}
+	if user != nil {
+		methods = []byte{socksNoAuth, socksUserPass}
+	}
+	if _, err := conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...)); err != nil {
+		return fmt.Errorf("failed to write greeting: %v", err)
+	}
+	selected := make([]byte, 2)
+	if _, err := io.ReadFull(conn, selected); err != nil {
+		return fmt.Errorf("failed to read method: %v", err)
+	}
+	if selected[0] != socksVersion {
+		return fmt.Errorf("unexpected SOCKS version %d", selected[0])
+	}
+
+	switch selected[1] {
+	case socksNoAuth:
+	case socksUserPass:
+		if user == nil {
+			return errors.New("proxy requires a user name and password")
+		}
+		password, _ := user.Password()
+		if len(user.Username()) > 255 || len(password) > 255 {
+			return errors.New("proxy user name or password too long")
+		}
+		auth := []byte{0x01, byte(len(user.Username()))}
+		auth = append(auth, user.Username()...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := conn.Write(auth); err != nil {
+			return fmt.Errorf("failed to write credentials: %v", err)
+		}
+		status := make([]byte, 2)
+		if _, err := io.ReadFull(conn, status); err != nil {
+			return fmt.Errorf("failed to read authentication status: %v", err)
+		}
+		if status[1] != 0x00 {
+			return errors.New("proxy rejected the user name and password")
+		}
+	default:
+		return errors.New("proxy accepts none of the offered authentication methods")
+	}
+
+	request := []byte{socksVersion, socksCmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		request = append(append(request, socksAddrIPv4), ip.To4()...)
+	} else if ip != nil {
+		request = append(append(request, socksAddrIPv6), ip.To16()...)
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("host name %q too long", host)
+		}
+		request = append(append(request, socksAddrDomain, byte(len(host))), host...)
+	}
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+	if _, err := conn.Write(request); err != nil {
+		return fmt.Errorf("failed to write request: %v", err)
+	}
+
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("failed to read reply: %v", err)
+	}
+	if reply[1] != socksSucceeded {
+		return fmt.Errorf("connection to %s refused with SOCKS reply %d", addr, reply[1])
+	}
+
+	// Skip the bound address and port
+	var skip int
+	switch reply[3] {
+	case socksAddrIPv4:
+		skip = net.IPv4len + 2
+	case socksAddrIPv6:
+		skip = net.IPv6len + 2
+	case socksAddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return fmt.Errorf("failed to read reply: %v", err)
+		}
+		skip = int(length[0]) + 2
+	default:
+		return fmt.Errorf("unsupported address type %d in reply", reply[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, skip)); err != nil {
+		return fmt.Errorf("failed to read reply: %v", err)
+	}
+	return nil
+}
+
+// httpConnect asks an HTTP proxy to open a tunnel to addr with the CONNECT method
+func httpConnect(conn net.Conn, user *url.Userinfo, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user != nil {
+		password, _ := user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("failed to write CONNECT request: %v", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CONNECT response: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CONNECT to %s failed: %s", addr, resp.Status)
+	}
+
+	// The SSH server may already have sent its version line
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection with data already read into a buffer
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read reads the buffered data before reading from the connection
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// hostnamePattern matches DNS names and the bracketless forms of IP addresses that may be
+// put into a proxy command
+var hostnamePattern = regexp.MustCompile(`^[A-Za-z0-9_]([A-Za-z0-9_.-]*[A-Za-z0-9_])?$`)
+
+// validCommandHost reports whether a host is a plain hostname or IP address. Anything else,
+// such as shell syntax or a leading - that would be taken as an option, is refused.
+func validCommandHost(host string) bool {
+	return net.ParseIP(host) != nil || hostnamePattern.MatchString(host)
+}
+
+// shellQuote quotes a string for use as a single shell word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// dialCommand runs a proxy command, like OpenSSH's ProxyCommand, and uses its standard
+// input and output as the connection. %h and %p are replaced by the quoted host and the
+// port, and %% by a literal %. The command is killed if ctx ends before the connection's
+// deadline is cleared, which the SSH handshake does once it succeeds.
+func dialCommand(ctx context.Context, command, host string, port int) (net.Conn, error) {
+	if !validCommandHost(host) {
+		return nil, fmt.Errorf("invalid host %q for a proxy command", host)
+	}
+	expanded := strings.NewReplacer("%%", "%", "%h", shellQuote(host), "%p", strconv.Itoa(port)).Replace(command)
+
+	cmdCtx, cancel := context.WithCancel(context.Background())
+	cmd := exec.CommandContext(cmdCtx, "sh", "-c", expanded)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to start proxy command: %v", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to start proxy command: %v", err)
+	}
+	// Children of the shell may keep the pipes open, so close them too when killing it
+	cmd.Cancel = func() error {
+		stdin.Close()
+		stdout.Close()
+		return cmd.Process.Kill()
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to start proxy command: %v", err)
+	}
+
+	return &commandConn{
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: stdout,
+		cancel: cancel,
+		detach: context.AfterFunc(ctx, cancel),
+	}, nil
+}
+
+// commandConn is a connection over the standard input and output of a proxy command
+type commandConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	cancel context.CancelFunc // Kills the command
+	detach func() bool        // Stops the connect context from killing the command
+}
+
+// Read reads from the command's standard output
+func (c *commandConn) Read(p []byte) (int, error) { return c.stdout.Read(p) }
+
+// Write writes to the command's standard input
+func (c *commandConn) Write(p []byte) (int, error) { return c.stdin.Write(p) }
+
+// Close closes the pipes and stops the command
+func (c *commandConn) Close() error {
+	c.stdin.Close()
+	c.stdout.Close()
+	c.cancel()
+	c.cmd.Wait()
+	return nil
+}
+
+// LocalAddr returns a placeholder address, as the command has none
+func (c *commandConn) LocalAddr() net.Addr { return commandAddr{} }
+
+// RemoteAddr returns a placeholder address, as the command has none
+func (c *commandConn) RemoteAddr() net.Addr { return commandAddr{} }
+
+// SetDeadline is not supported on pipes. Clearing it marks the connection as established,
+// after which the connect context no longer kills the command.
+func (c *commandConn) SetDeadline(t time.Time) error {
+	if t.IsZero() {
+		c.detach()
+	}
+	return nil
+}
+
+// SetReadDeadline is not supported on pipes and does nothing
+func (c *commandConn) SetReadDeadline(time.Time) error { return nil }
+
+// SetWriteDeadline is not supported on pipes and does nothing
+func (c *commandConn) SetWriteDeadline(time.Time) error { return nil }
+
+// commandAddr is the address of a proxy command connection
+type commandAddr struct{}
+
+// Network returns the network name of a proxy command connection
+func (commandAddr) Network() string { return "proxycommand" }
+
+// String returns the address of a proxy command connection
+func (commandAddr) String() string { return "proxycommand" }
@@ -0,0 +1,177 @@
+package ssh
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"ssh-mcp/internal/session"
+)
+
+// SOCKS5 protocol values (RFC 1928)
+const (
+	socksVersion        = 0x05
+	socksNoAuth         = 0x00
+	socksUserPass       = 0x02
+	socksNoAcceptable   = 0xff
+	socksCmdConnect     = 0x01
+	socksAddrIPv4       = 0x01
+	socksAddrDomain     = 0x03
+	socksAddrIPv6       = 0x04
+	socksSucceeded      = 0x00
+	socksNotAllowed     = 0x02
+	socksHostUnreach    = 0x04
+	socksCmdUnsupported = 0x07
+	socksAddrUnsupport  = 0x08
+)
+
+// socksHandshakeTimeout bounds how long a client may take to send its request
+const socksHandshakeTimeout = 30 * time.Second
+
+// ForwardDynamic starts a SOCKS5 proxy on a local address that connects to each requested
+// destination from the remote host, like ssh -D. Every destination is passed to allow first
+// and refused if it returns an error.
+func (c *Client) ForwardDynamic(args SSHForwardDynamicArgs, allow func(destination string) error) (*session.Forward, error) {
+	sess, release, err := c.sessionManager.AcquireSession(args.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if args.LocalHost == "" {
+		args.LocalHost = "127.0.0.1"
+	}
+
+	ln, err := net.Listen("tcp", net.JoinHostPort(args.LocalHost, strconv.Itoa(args.LocalPort)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %v", err)
+	}
+
+	return c.startForward(sess.ID, session.ForwardDynamic, ln, "", func(conn net.Conn, fw *forwarder) {
+		serveSOCKS(conn, fw, allow, func(destination string) (net.Conn, error) {
+			return sess.Client.Dial("tcp", destination)
+		})
+	})
+}
+
+// serveSOCKS handles one SOCKS5 client connection. Only CONNECT without authentication is
+// supported, which is what browsers and package managers use.
+func serveSOCKS(conn net.Conn, fw *forwarder, allow func(string) error, dial func(string) (net.Conn, error)) {
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+
+	destination, reply, err := readSOCKSRequest(conn)
+	if err == nil && allow != nil {
+		if err = allow(destination); err != nil {
+			reply = socksNotAllowed
+		}
+	}
+	if err != nil {
+		log.Printf("[DEBUG] forward %s: refused SOCKS request: %v", fw.forward.ID, err)
+		if reply != 0 {
+			writeSOCKSReply(conn, reply)
+		}
+		return
+	}
+
+	target, err := dial(destination)
+	if err != nil {
+		log.Printf("[DEBUG] forward %s: failed to dial %s: %v", fw.forward.ID, destination, err)
+		writeSOCKSReply(conn, socksHostUnreach)
+		return
+	}
+	if err := writeSOCKSReply(conn, socksSucceeded); err != nil {
+		target.Close()
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+	fw.proxy(conn, target, destination)
+}
+
+// readSOCKSRequest negotiates the authentication method and reads a CONNECT request,
+// returning the requested destination as host:port. On failure it also returns the reply
+// code to send, or 0 if the client should just be disconnected.
+func readSOCKSRequest(conn net.Conn) (string, byte, error) {
+	// Greeting: version, number of methods, methods
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", 0, fmt.Errorf("failed to read greeting: %v", err)
+	}
+	if header[0] != socksVersion {
+		return "", 0, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", 0, fmt.Errorf("failed to read methods: %v", err)
+	}
+
+	noAuth := false
+	for _, method := range methods {
+		if method == socksNoAuth {
+			noAuth = true
+		}
+	}
+	if !noAuth {
+		conn.Write([]byte{socksVersion, socksNoAcceptable})
+		return "", 0, errors.New("client requires authentication")
+	}
+	if _, err := conn.Write([]byte{socksVersion, socksNoAuth}); err != nil {
+		return "", 0, fmt.Errorf("failed to write method: %v", err)
+	}
+
+	// Request: version, command, reserved, address type, address, port
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", 0, fmt.Errorf("failed to read request: %v", err)
+	}
+	if request[0] != socksVersion {
+		return "", 0, fmt.Errorf("unsupported SOCKS version %d", request[0])
+	}
+	if request[1] != socksCmdConnect {
+		return "", socksCmdUnsupported, fmt.Errorf("unsupported command %d", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make([]byte, net.IPv4len)
+		if request[3] == socksAddrIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", 0, fmt.Errorf("failed to read address: %v", err)
+		}
+		host = net.IP(ip).String()
+	case socksAddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", 0, fmt.Errorf("failed to read address: %v", err)
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", 0, fmt.Errorf("failed to read address: %v", err)
+		}
+		host = string(name)
+	default:
+		return "", socksAddrUnsupport, fmt.Errorf("unsupported address type %d", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", 0, fmt.Errorf("failed to read port: %v", err)
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), 0, nil
+}
+
+// writeSOCKSReply sends a reply to a CONNECT request. The bound address is not meaningful
+// for a connection made from the remote host, so it is left unspecified.
+func writeSOCKSReply(conn net.Conn, reply byte) error {
+	_, err := conn.Write([]byte{socksVersion, reply, 0x00, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"log"
+	"os"
+	"strings"
 
 	"ssh-mcp/internal/server"
 )
@@ -12,10 +15,46 @@ func main() {
 	var transport string
 	flag.StringVar(&transport, "t", "http", "Transport type (stdio or http)")
 	flag.StringVar(&transport, "transport", "http", "Transport type (stdio or http)")
+	var localRoots string
+	flag.StringVar(&localRoots, "local-roots", "", "Comma-separated local directories file transfers are confined to (default: unrestricted)")
+	var remotePathRules string
+	flag.StringVar(&remotePathRules, "remote-path-rules", "", "JSON file with remote path rules (default: unrestricted)")
+	var proxyRules string
+	flag.StringVar(&proxyRules, "proxy-rules", "", "JSON file with per-host proxy rules (default: ALL_PROXY or HTTPS_PROXY)")
+	var maxChannels int
+	flag.IntVar(&maxChannels, "max-channels", 10, "Maximum concurrent channels per SSH connection, matching the servers' MaxSessions")
+	var admin bool
+	flag.BoolVar(&admin, "admin", false, "Let every MCP client list and use all SSH sessions (default: only their own)")
 	flag.Parse()
 
 	// Get default server configuration
 	config := server.DefaultConfig()
+	config.MaxChannels = maxChannels
+	config.Admin = admin
+	for _, root := range strings.Split(localRoots, ",") {
+		if root = strings.TrimSpace(root); root != "" {
+			config.AllowedLocalRoots = append(config.AllowedLocalRoots, root)
+		}
+	}
+	if remotePathRules != "" {
+		data, err := os.ReadFile(remotePathRules)
+		if err != nil {
+			log.Fatalf("Failed to read remote path rules: %v", err)
+		}
+		if err := json.Unmarshal(data, &config.RemotePathRules); err != nil {
+			log.Fatalf("Failed to parse remote path rules: %v", err)
+		}
+	}
+
+	if proxyRules != "" {
+		data, err := os.ReadFile(proxyRules)
+		if err != nil {
+			log.Fatalf("Failed to read proxy rules: %v", err)
+		}
+		if err := json.Unmarshal(data, &config.ProxyRules); err != nil {
+			log.Fatalf("Failed to parse proxy rules: %v", err)
+		}
+	}
 
 	// Create and configure the server
 	mcpServer, _, err := server.SetupServer(config)